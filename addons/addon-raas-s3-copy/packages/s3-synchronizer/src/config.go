@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// The version of the configuration document format understood by this program
+const currentConfigVersion = 1
+
+// The prefix for all environment variables read by the program, e.g., S3_SYNCHRONIZER_REGION
+const configEnvPrefix = "S3_SYNCHRONIZER_"
+
+// The name of the environment variable containing path of the configuration document
+const configFileEnvVar = configEnvPrefix + "CONFIG"
+
+// synchronizerConfig holds all settings of the program.
+//
+// The settings are resolved from the following sources in order, each later source overriding
+// values set by the earlier ones:
+//  1. Built-in defaults
+//  2. The configuration document specified by "-config" (or "S3_SYNCHRONIZER_CONFIG" environment variable).
+//     The document can be in YAML or JSON format. Passing "-" reads the document from stdin.
+//  3. Environment variables prefixed with "S3_SYNCHRONIZER_", e.g., S3_SYNCHRONIZER_DOWNLOAD_INTERVAL
+//  4. Program arguments that are explicitly specified, e.g., -downloadInterval=30
+type synchronizerConfig struct {
+	Version                     int       `json:"version"`
+	Mounts                      []s3Mount `json:"mounts,omitempty"`
+	Region                      string    `json:"region,omitempty"`
+	Profile                     string    `json:"profile,omitempty"`
+	Destination                 string    `json:"destination,omitempty"`
+	Concurrency                 int       `json:"concurrency,omitempty"`
+	ObjectConcurrency           int       `json:"objectConcurrency,omitempty"`
+	MaxConcurrentTransfers      int       `json:"maxConcurrentTransfers,omitempty"`
+	MaxConcurrentMounts         int       `json:"maxConcurrentMounts,omitempty"`
+	RecurringDownloads          bool      `json:"recurringDownloads,omitempty"`
+	StopRecurringDownloadsAfter int       `json:"stopRecurringDownloadsAfter,omitempty"`
+	DownloadInterval            int       `json:"downloadInterval,omitempty"`
+	MountsReloadInterval        int       `json:"mountsReloadInterval,omitempty"`
+	DeleteRemovedMountData      bool      `json:"deleteRemovedMountData,omitempty"`
+	UploadQuietPeriod           string    `json:"uploadQuietPeriod,omitempty"`
+	UploadMaxDelay              string    `json:"uploadMaxDelay,omitempty"`
+	StateDir                    string    `json:"stateDir,omitempty"`
+	StateInMounts               bool      `json:"stateInMounts,omitempty"`
+	Adopt                       bool      `json:"adopt,omitempty"`
+	ReconcileMaxDeletions       int       `json:"reconcileMaxDeletions,omitempty"`
+	ConfirmReconcileDeletions   bool      `json:"confirmReconcileDeletions,omitempty"`
+	LogLevel                    string    `json:"logLevel,omitempty"`
+	LogFormat                   string    `json:"logFormat,omitempty"`
+	LogFile                     string    `json:"logFile,omitempty"`
+	LogFileMaxSize              int       `json:"logFileMaxSize,omitempty"`
+	LogFileMaxBackups           int       `json:"logFileMaxBackups,omitempty"`
+	// Same as logLevel "debug", kept for compatibility
+	Debug bool `json:"debug,omitempty"`
+
+	// Path of the configuration document the settings were read from, if any
+	configFilePath string
+}
+
+// Returns configuration containing the default values for all settings
+func newDefaultConfig() *synchronizerConfig {
+	return &synchronizerConfig{
+		Version:                     currentConfigVersion,
+		Mounts:                      []s3Mount{},
+		Region:                      "us-east-1",
+		Profile:                     "",
+		Destination:                 "./",
+		Concurrency:                 20,
+		ObjectConcurrency:           10,
+		MaxConcurrentTransfers:      50,
+		MaxConcurrentMounts:         5,
+		RecurringDownloads:          false,
+		StopRecurringDownloadsAfter: -1,
+		DownloadInterval:            60,
+		MountsReloadInterval:        30,
+		DeleteRemovedMountData:      false,
+		UploadQuietPeriod:           "2s",
+		UploadMaxDelay:              "1m",
+		StateDir:                    "",
+		StateInMounts:               false,
+		Adopt:                       false,
+		ReconcileMaxDeletions:       100,
+		ConfirmReconcileDeletions:   false,
+		LogLevel:                    "info",
+		LogFormat:                   logFormatText,
+		LogFile:                     "",
+		LogFileMaxSize:              100,
+		LogFileMaxBackups:           5,
+		Debug:                       false,
+	}
+}
+
+// A source of configuration settings.
+// Each source only overrides the settings it explicitly specifies and leaves the other settings intact.
+type configSource interface {
+	apply(config *synchronizerConfig) error
+}
+
+// Returns configuration by applying the given sources (in the given order) on top of the default configuration
+func loadConfig(sources ...configSource) (*synchronizerConfig, error) {
+	config := newDefaultConfig()
+	for _, source := range sources {
+		if err := source.apply(config); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func validateConfig(config *synchronizerConfig) error {
+	if config.Version != currentConfigVersion {
+		return fmt.Errorf("unsupported config version %v specified; the supported version is %v", config.Version, currentConfigVersion)
+	}
+	if config.DownloadInterval <= 0 {
+		return fmt.Errorf("incorrect downloadInterval %v specified; the downloadInterval must be a positive integer", config.DownloadInterval)
+	}
+	if config.MountsReloadInterval < 0 {
+		return fmt.Errorf("incorrect mountsReloadInterval %v specified; the mountsReloadInterval must be zero (to disable) or a positive integer", config.MountsReloadInterval)
+	}
+	if config.Concurrency <= 0 {
+		return fmt.Errorf("incorrect concurrency %v specified; the concurrency must be a positive integer", config.Concurrency)
+	}
+	if config.ObjectConcurrency <= 0 {
+		return fmt.Errorf("incorrect objectConcurrency %v specified; the objectConcurrency must be a positive integer", config.ObjectConcurrency)
+	}
+	if config.MaxConcurrentTransfers <= 0 {
+		return fmt.Errorf("incorrect maxConcurrentTransfers %v specified; the maxConcurrentTransfers must be a positive integer", config.MaxConcurrentTransfers)
+	}
+	if config.MaxConcurrentMounts <= 0 {
+		return fmt.Errorf("incorrect maxConcurrentMounts %v specified; the maxConcurrentMounts must be a positive integer", config.MaxConcurrentMounts)
+	}
+	if d, err := time.ParseDuration(config.UploadQuietPeriod); err != nil || d < 0 {
+		return fmt.Errorf("incorrect uploadQuietPeriod %q specified; the uploadQuietPeriod must be zero (to disable) or a positive duration, e.g., \"2s\"", config.UploadQuietPeriod)
+	}
+	if d, err := time.ParseDuration(config.UploadMaxDelay); err != nil || d < 0 {
+		return fmt.Errorf("incorrect uploadMaxDelay %q specified; the uploadMaxDelay must be zero (for no maximum) or a positive duration, e.g., \"1m\"", config.UploadMaxDelay)
+	}
+	if config.ReconcileMaxDeletions < 0 {
+		return fmt.Errorf("incorrect reconcileMaxDeletions %v specified; the reconcileMaxDeletions must be zero or a positive integer", config.ReconcileMaxDeletions)
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return fmt.Errorf("incorrect logLevel %q specified; the logLevel must be one of %v", config.LogLevel, strings.Join(logLevelNames, ", "))
+	}
+	if config.LogFormat != logFormatText && config.LogFormat != logFormatJson {
+		return fmt.Errorf("incorrect logFormat %q specified; the logFormat must be %q or %q", config.LogFormat, logFormatText, logFormatJson)
+	}
+	if config.LogFileMaxSize < 0 {
+		return fmt.Errorf("incorrect logFileMaxSize %v specified; the logFileMaxSize must be zero (to disable the rotation) or a positive integer", config.LogFileMaxSize)
+	}
+	if config.LogFileMaxBackups < 0 {
+		return fmt.Errorf("incorrect logFileMaxBackups %v specified; the logFileMaxBackups must be zero or a positive integer", config.LogFileMaxBackups)
+	}
+	return nil
+}
+
+// Returns the level of the lines to log, the config must be valid. The debug setting raises the level to debug.
+func (config *synchronizerConfig) logLevel() logLevel {
+	level, _ := parseLogLevel(config.LogLevel)
+	if config.Debug && level < levelDebug {
+		level = levelDebug
+	}
+	return level
+}
+
+// Returns the maximum number of objects deleted when reconciling the files of a mount deleted while the synchronizer
+// was not running, negative for no maximum
+func (config *synchronizerConfig) reconcileMaxDeletions() int {
+	if config.ConfirmReconcileDeletions {
+		return -1
+	}
+	return config.ReconcileMaxDeletions
+}
+
+// Returns the time a changed file must be quiet for before it is uploaded, the config must be valid
+func (config *synchronizerConfig) uploadQuietPeriod() time.Duration {
+	d, _ := time.ParseDuration(config.UploadQuietPeriod)
+	return d
+}
+
+// Returns the maximum time the upload of a changed file is delayed for, the config must be valid
+func (config *synchronizerConfig) uploadMaxDelay() time.Duration {
+	d, _ := time.ParseDuration(config.UploadMaxDelay)
+	return d
+}
+
+// ------------------------------- Configuration document -------------------------------/
+
+// Config source reading a versioned configuration document in YAML or JSON format
+type documentConfigSource struct {
+	name string
+	read func() ([]byte, error)
+}
+
+// Returns config source reading the configuration document at the given file path.
+// If the filePath is "-" the document is read from stdin.
+func newFileConfigSource(filePath string) configSource {
+	if filePath == "-" {
+		return newReaderConfigSource("stdin", os.Stdin)
+	}
+	return &documentConfigSource{
+		name: filePath,
+		read: func() ([]byte, error) {
+			return ioutil.ReadFile(filePath)
+		},
+	}
+}
+
+// Returns config source reading the configuration document from the given reader.
+// The reader is consumed only once, applying the source again re-uses the document read the first time.
+func newReaderConfigSource(name string, r io.Reader) configSource {
+	var once sync.Once
+	var content []byte
+	var err error
+	return &documentConfigSource{
+		name: name,
+		read: func() ([]byte, error) {
+			once.Do(func() {
+				content, err = ioutil.ReadAll(r)
+			})
+			return content, err
+		},
+	}
+}
+
+func (source *documentConfigSource) apply(config *synchronizerConfig) error {
+	content, err := source.read()
+	if err != nil {
+		return fmt.Errorf("error reading config from %v: %v", source.name, err)
+	}
+	if err := parseConfigDocument(content, config); err != nil {
+		return fmt.Errorf("error parsing config from %v: %v", source.name, err)
+	}
+	return nil
+}
+
+// Parses the given YAML or JSON document into the given config.
+// Only the settings present in the document are overwritten.
+func parseConfigDocument(content []byte, config *synchronizerConfig) error {
+	// JSON is a subset of YAML so converting the document to JSON works for both formats
+	jsonContent, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return err
+	}
+
+	// The version is required in the document so make sure we don't fallback to the default one
+	var versioned struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(jsonContent, &versioned); err != nil {
+		return err
+	}
+	if versioned.Version == nil {
+		return fmt.Errorf("the config document does not specify a version; add \"version: %v\"", currentConfigVersion)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonContent))
+	// Fail on typos in the setting names instead of silently ignoring them
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return err
+	}
+	setMountDefaults(config.Mounts)
+	return nil
+}
+
+// ------------------------------- Environment variables -------------------------------/
+
+// Config source reading settings from environment variables
+type envConfigSource struct {
+	lookupEnv func(key string) (string, bool)
+}
+
+// Returns config source reading settings from the process environment
+func newEnvConfigSource() configSource {
+	return &envConfigSource{lookupEnv: os.LookupEnv}
+}
+
+func (source *envConfigSource) apply(config *synchronizerConfig) error {
+	lookup := func(name string) (string, bool) {
+		return source.lookupEnv(configEnvPrefix + name)
+	}
+
+	if v, ok := lookup("DEFAULT_S3_MOUNTS"); ok {
+		if err := applyDefaultS3Mounts(v, config); err != nil {
+			return fmt.Errorf("error parsing %vDEFAULT_S3_MOUNTS: %v", configEnvPrefix, err)
+		}
+	}
+	if v, ok := lookup("REGION"); ok {
+		config.Region = v
+	}
+	if v, ok := lookup("PROFILE"); ok {
+		config.Profile = v
+	}
+	if v, ok := lookup("DESTINATION"); ok {
+		config.Destination = v
+	}
+	if v, ok := lookup("UPLOAD_QUIET_PERIOD"); ok {
+		config.UploadQuietPeriod = strings.TrimSpace(v)
+	}
+	if v, ok := lookup("UPLOAD_MAX_DELAY"); ok {
+		config.UploadMaxDelay = strings.TrimSpace(v)
+	}
+	if v, ok := lookup("STATE_DIR"); ok {
+		config.StateDir = v
+	}
+	if v, ok := lookup("LOG_LEVEL"); ok {
+		config.LogLevel = strings.TrimSpace(v)
+	}
+	if v, ok := lookup("LOG_FORMAT"); ok {
+		config.LogFormat = strings.TrimSpace(v)
+	}
+	if v, ok := lookup("LOG_FILE"); ok {
+		config.LogFile = v
+	}
+
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"CONCURRENCY", &config.Concurrency},
+		{"OBJECT_CONCURRENCY", &config.ObjectConcurrency},
+		{"MAX_CONCURRENT_TRANSFERS", &config.MaxConcurrentTransfers},
+		{"MAX_CONCURRENT_MOUNTS", &config.MaxConcurrentMounts},
+		{"STOP_RECURRING_DOWNLOADS_AFTER", &config.StopRecurringDownloadsAfter},
+		{"DOWNLOAD_INTERVAL", &config.DownloadInterval},
+		{"MOUNTS_RELOAD_INTERVAL", &config.MountsReloadInterval},
+		{"RECONCILE_MAX_DELETIONS", &config.ReconcileMaxDeletions},
+		{"LOG_FILE_MAX_SIZE", &config.LogFileMaxSize},
+		{"LOG_FILE_MAX_BACKUPS", &config.LogFileMaxBackups},
+	}
+	for _, setting := range ints {
+		if v, ok := lookup(setting.name); ok {
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("incorrect value %q specified for %v%v; expecting an integer", v, configEnvPrefix, setting.name)
+			}
+			*setting.value = i
+		}
+	}
+
+	bools := []struct {
+		name  string
+		value *bool
+	}{
+		{"RECURRING_DOWNLOADS", &config.RecurringDownloads},
+		{"DELETE_REMOVED_MOUNT_DATA", &config.DeleteRemovedMountData},
+		{"STATE_IN_MOUNTS", &config.StateInMounts},
+		{"ADOPT", &config.Adopt},
+		{"CONFIRM_RECONCILE_DELETIONS", &config.ConfirmReconcileDeletions},
+		{"DEBUG", &config.Debug},
+	}
+	for _, setting := range bools {
+		if v, ok := lookup(setting.name); ok {
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("incorrect value %q specified for %v%v; expecting true or false", v, configEnvPrefix, setting.name)
+			}
+			*setting.value = b
+		}
+	}
+	return nil
+}
+
+// ------------------------------- Program arguments -------------------------------/
+
+// Config source reading settings from the program arguments.
+// Only the arguments explicitly passed to the program override the other sources.
+type flagConfigSource struct {
+	flags *flag.FlagSet
+
+	configFile                  *string
+	defaultS3Mounts             *string
+	region                      *string
+	profile                     *string
+	destination                 *string
+	concurrency                 *int
+	objectConcurrency           *int
+	maxConcurrentTransfers      *int
+	maxConcurrentMounts         *int
+	recurringDownloads          *bool
+	stopRecurringDownloadsAfter *int
+	downloadInterval            *int
+	mountsReloadInterval        *int
+	deleteRemovedMountData      *bool
+	uploadQuietPeriod           *string
+	uploadMaxDelay              *string
+	stateDir                    *string
+	stateInMounts               *bool
+	adopt                       *bool
+	reconcileMaxDeletions       *int
+	confirmReconcileDeletions   *bool
+	logLevel                    *string
+	logFormat                   *string
+	logFile                     *string
+	logFileMaxSize              *int
+	logFileMaxBackups           *int
+	debug                       *bool
+}
+
+// Returns config source with all the program arguments defined on the given flag set
+func newFlagConfigSource(flags *flag.FlagSet) *flagConfigSource {
+	defaults := newDefaultConfig()
+	return &flagConfigSource{
+		flags:                       flags,
+		configFile:                  flags.String("config", "", `Path to a YAML or JSON configuration document containing the mounts and any of the other settings. Use "-" to read the document from stdin. The settings in the document are overridden by "S3_SYNCHRONIZER_*" environment variables and the explicitly specified program arguments.`),
+		defaultS3Mounts:             flags.String("defaultS3Mounts", "", `A JSON string containing information about the default S3 mounts E.g., [{"id":"some-id","bucket":"some-s3-bucket-name","prefix":"some/s3/prefix/path","writeable":false,"kmsKeyId":"some-kms-key-arn"}]`),
+		region:                      flags.String("region", defaults.Region, "The aws region to use for the session"),
+		profile:                     flags.String("profile", defaults.Profile, "AWS Credentials profile. Default is no profile. The code will look for credentials in the following order: ENV variables, default credentials profile, EC2 instance metadata"),
+		destination:                 flags.String("destination", defaults.Destination, "The directory to download to"),
+		concurrency:                 flags.Int("concurrency", defaults.Concurrency, "The maximum number of concurrent parts to download for a single large object"),
+		objectConcurrency:           flags.Int("objectConcurrency", defaults.ObjectConcurrency, "The number of objects to download concurrently for each mount"),
+		maxConcurrentMounts:         flags.Int("maxConcurrentMounts", defaults.MaxConcurrentMounts, "The maximum number of mounts downloading changes from S3 at the same time. The other mounts wait for their turn in the order they became ready"),
+		maxConcurrentTransfers:      flags.Int("maxConcurrentTransfers", defaults.MaxConcurrentTransfers, "The maximum number of concurrent download requests (objects and their parts) across all mounts"),
+		recurringDownloads:          flags.Bool("recurringDownloads", defaults.RecurringDownloads, "Whether to periodically download changes from S3"),
+		stopRecurringDownloadsAfter: flags.Int("stopRecurringDownloadsAfter", defaults.StopRecurringDownloadsAfter, "Stop recurring downloads after certain number of seconds. ZERO or Negative value means continue indefinitely."),
+		downloadInterval:            flags.Int("downloadInterval", defaults.DownloadInterval, "The interval at which to re-download changes from S3 in seconds. This is only applicable when recurringDownloads is true"),
+		mountsReloadInterval:        flags.Int("mountsReloadInterval", defaults.MountsReloadInterval, "The interval in seconds at which to check the configuration document for added or removed mounts. ZERO means the document is not checked, the mounts can still be reloaded by sending SIGHUP to the process. This is only applicable when recurringDownloads is true"),
+		deleteRemovedMountData:      flags.Bool("deleteRemovedMountData", defaults.DeleteRemovedMountData, "Whether to delete the local directory of a mount when the mount is removed while the program is running"),
+		uploadQuietPeriod:           flags.String("uploadQuietPeriod", defaults.UploadQuietPeriod, `The time a changed file of a writeable mount must go without changes before it is uploaded, e.g., "2s". ZERO uploads the file on every change`),
+		uploadMaxDelay:              flags.String("uploadMaxDelay", defaults.UploadMaxDelay, `The maximum time the upload of a file that keeps changing is delayed for, e.g., "1m". ZERO means no maximum`),
+		stateDir:                    flags.String("stateDir", defaults.StateDir, "The directory to keep the synchronizer state and status files in. Default is the user's home directory"),
+		stateInMounts:               flags.Bool("stateInMounts", defaults.StateInMounts, `Whether to keep the synchronizer state of each mount in the ".s3sync" directory of the mount instead of the state directory, so the local data of a mount carries its own state (e.g., when its volume is moved to another instance)`),
+		adopt:                       flags.Bool("adopt", defaults.Adopt, "Whether to adopt the files already in the local directory of each mount (e.g., restored from a snapshot) when the mount starts. The files with the same size and content as their objects in S3 are not downloaded again"),
+		reconcileMaxDeletions:       flags.Int("reconcileMaxDeletions", defaults.ReconcileMaxDeletions, "The maximum number of objects deleted from S3 for the files of a writeable mount deleted while the program was not running. When more files were deleted, none of the objects are deleted (and the files are downloaded again) unless confirmReconcileDeletions is set"),
+		confirmReconcileDeletions:   flags.Bool("confirmReconcileDeletions", defaults.ConfirmReconcileDeletions, "Whether to delete the objects of all the files of writeable mounts deleted while the program was not running, even when there are more than reconcileMaxDeletions"),
+		logLevel:                    flags.String("logLevel", defaults.LogLevel, "The level of the lines to log: error, warn, info, debug or trace"),
+		logFormat:                   flags.String("logFormat", defaults.LogFormat, `The format of the lines to log: "text" or "json" (one JSON object per line)`),
+		logFile:                     flags.String("logFile", defaults.LogFile, "The file to write the log to instead of stderr. The file is rotated once it reaches logFileMaxSize"),
+		logFileMaxSize:              flags.Int("logFileMaxSize", defaults.LogFileMaxSize, "The size in megabytes at which the log file is rotated. ZERO means the log file is not rotated"),
+		logFileMaxBackups:           flags.Int("logFileMaxBackups", defaults.LogFileMaxBackups, "The number of rotated log files to keep"),
+		debug:                       flags.Bool("debug", defaults.Debug, `Whether to print debug information. Same as -logLevel=debug`),
+	}
+}
+
+func (source *flagConfigSource) apply(config *synchronizerConfig) error {
+	var err error
+	source.flags.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch f.Name {
+		case "defaultS3Mounts":
+			if e := applyDefaultS3Mounts(*source.defaultS3Mounts, config); e != nil {
+				err = fmt.Errorf("error parsing -defaultS3Mounts: %v", e)
+			}
+		case "region":
+			config.Region = *source.region
+		case "profile":
+			config.Profile = *source.profile
+		case "destination":
+			config.Destination = *source.destination
+		case "concurrency":
+			config.Concurrency = *source.concurrency
+		case "objectConcurrency":
+			config.ObjectConcurrency = *source.objectConcurrency
+		case "maxConcurrentTransfers":
+			config.MaxConcurrentTransfers = *source.maxConcurrentTransfers
+		case "maxConcurrentMounts":
+			config.MaxConcurrentMounts = *source.maxConcurrentMounts
+		case "recurringDownloads":
+			config.RecurringDownloads = *source.recurringDownloads
+		case "stopRecurringDownloadsAfter":
+			config.StopRecurringDownloadsAfter = *source.stopRecurringDownloadsAfter
+		case "downloadInterval":
+			config.DownloadInterval = *source.downloadInterval
+		case "mountsReloadInterval":
+			config.MountsReloadInterval = *source.mountsReloadInterval
+		case "deleteRemovedMountData":
+			config.DeleteRemovedMountData = *source.deleteRemovedMountData
+		case "uploadQuietPeriod":
+			config.UploadQuietPeriod = *source.uploadQuietPeriod
+		case "uploadMaxDelay":
+			config.UploadMaxDelay = *source.uploadMaxDelay
+		case "stateDir":
+			config.StateDir = *source.stateDir
+		case "stateInMounts":
+			config.StateInMounts = *source.stateInMounts
+		case "adopt":
+			config.Adopt = *source.adopt
+		case "reconcileMaxDeletions":
+			config.ReconcileMaxDeletions = *source.reconcileMaxDeletions
+		case "confirmReconcileDeletions":
+			config.ConfirmReconcileDeletions = *source.confirmReconcileDeletions
+		case "logLevel":
+			config.LogLevel = *source.logLevel
+		case "logFormat":
+			config.LogFormat = *source.logFormat
+		case "logFile":
+			config.LogFile = *source.logFile
+		case "logFileMaxSize":
+			config.LogFileMaxSize = *source.logFileMaxSize
+		case "logFileMaxBackups":
+			config.LogFileMaxBackups = *source.logFileMaxBackups
+		case "debug":
+			config.Debug = *source.debug
+		}
+	})
+	return err
+}
+
+// Returns path of the configuration document passed as "-config" argument or via environment variable.
+// The argument takes precedence over the environment variable.
+func (source *flagConfigSource) configFilePath() string {
+	if *source.configFile != "" {
+		return *source.configFile
+	}
+	return os.Getenv(configFileEnvVar)
+}
+
+// ------------------------------- Default S3 mounts -------------------------------/
+
+func applyDefaultS3Mounts(defaultS3Mounts string, config *synchronizerConfig) error {
+	if strings.TrimSpace(defaultS3Mounts) == "" {
+		return nil
+	}
+	mounts, err := getDefaultMounts(defaultS3Mounts)
+	if err != nil {
+		return err
+	}
+	config.Mounts = *mounts
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// The level of a log line, each level includes the lines of the levels before it
+type logLevel int32
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	// Every request and decision on every file, very verbose
+	levelTrace
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (level logLevel) String() string {
+	if level < levelError || int(level) >= len(logLevelNames) {
+		return strconv.Itoa(int(level))
+	}
+	return logLevelNames[level]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q; the log level must be one of %v", s, strings.Join(logLevelNames, ", "))
+}
+
+// The formats of the log lines
+const (
+	// Human readable lines, e.g., 2020-01-02T15:04:05.000Z INFO  Downloaded file mount=some-id bucket=some-bucket key=a.txt
+	logFormatText = "text"
+	// One JSON object per line, e.g., {"time":"2020-01-02T15:04:05.000Z","level":"info","msg":"Downloaded file","mount":"some-id"}
+	logFormatJson = "json"
+)
+
+// The names of the fields of the log lines
+const (
+	logFieldMount     = "mount"
+	logFieldBucket    = "bucket"
+	logFieldKey       = "key"
+	logFieldPath      = "path"
+	logFieldOp        = "op"
+	logFieldBytes     = "bytes"
+	logFieldDuration  = "duration"
+	logFieldError     = "error"
+	logFieldErrorCode = "errorCode"
+)
+
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Where the lines of the loggers derived from the same logger are written to, and at which level and format
+type logOutput struct {
+	level int32
+
+	lock sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+type logField struct {
+	name  string
+	value interface{}
+}
+
+// Logger writing lines with a level and a set of fields. The loggers derived with the with* functions add their
+// fields to the fields of the logger they are derived from, and write to the same output.
+type structuredLogger struct {
+	output *logOutput
+	fields []logField
+}
+
+// The logger of the program, the loggers of the mounts and operations are derived from it. Writes the lines at the
+// info level in text format to stderr until configureLogging is called.
+var logger = newStructuredLogger(os.Stderr, levelInfo, logFormatText)
+
+func newStructuredLogger(w io.Writer, level logLevel, format string) *structuredLogger {
+	return &structuredLogger{output: &logOutput{level: int32(level), w: w, json: format == logFormatJson}}
+}
+
+// Sets the level, format and output of the given logger and all the loggers derived from it
+func (l *structuredLogger) configure(w io.Writer, level logLevel, format string) {
+	l.output.lock.Lock()
+	defer l.output.lock.Unlock()
+	l.output.w = w
+	l.output.json = format == logFormatJson
+	l.setLevel(level)
+}
+
+func (l *structuredLogger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.output.level, int32(level))
+}
+
+// Returns flag indicating if the lines of the given level are written, e.g., to skip the work of preparing lines
+// that are not written
+func (l *structuredLogger) enabled(level logLevel) bool {
+	return level <= logLevel(atomic.LoadInt32(&l.output.level))
+}
+
+func (l *structuredLogger) with(name string, value interface{}) *structuredLogger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	for i, field := range fields {
+		if field.name == name {
+			fields[i].value = value
+			return &structuredLogger{output: l.output, fields: fields}
+		}
+	}
+	return &structuredLogger{output: l.output, fields: append(fields, logField{name, value})}
+}
+
+func (l *structuredLogger) withMount(id string, bucket string) *structuredLogger {
+	return l.with(logFieldMount, id).with(logFieldBucket, bucket)
+}
+
+func (l *structuredLogger) withKey(key string) *structuredLogger {
+	return l.with(logFieldKey, key)
+}
+
+func (l *structuredLogger) withPath(path string) *structuredLogger {
+	return l.with(logFieldPath, path)
+}
+
+// The operation, e.g., download, upload, delete
+func (l *structuredLogger) withOp(op string) *structuredLogger {
+	return l.with(logFieldOp, op)
+}
+
+func (l *structuredLogger) withBytes(n int64) *structuredLogger {
+	return l.with(logFieldBytes, n)
+}
+
+func (l *structuredLogger) withDuration(d time.Duration) *structuredLogger {
+	return l.with(logFieldDuration, d)
+}
+
+// Adds the message of the given error and the code of the error for AWS errors (e.g., AccessDenied)
+func (l *structuredLogger) withError(err error) *structuredLogger {
+	if err == nil {
+		return l
+	}
+	withErr := l.with(logFieldError, err.Error())
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		withErr = withErr.with(logFieldErrorCode, awsErr.Code())
+	}
+	return withErr
+}
+
+func (l *structuredLogger) errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+func (l *structuredLogger) warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+
+func (l *structuredLogger) infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+func (l *structuredLogger) debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+func (l *structuredLogger) tracef(format string, args ...interface{}) {
+	l.logf(levelTrace, format, args...)
+}
+
+// Writes the line at the error level and exits the program
+func (l *structuredLogger) fatalf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *structuredLogger) logf(level logLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	now := time.Now()
+
+	l.output.lock.Lock()
+	defer l.output.lock.Unlock()
+	var line []byte
+	if l.output.json {
+		line = l.jsonLine(now, level, msg)
+	} else {
+		line = l.textLine(now, level, msg)
+	}
+	l.output.w.Write(line)
+}
+
+func (l *structuredLogger) textLine(now time.Time, level logLevel, msg string) []byte {
+	var b bytes.Buffer
+	b.WriteString(now.Format(logTimeFormat))
+	fmt.Fprintf(&b, " %-5s %s", strings.ToUpper(level.String()), msg)
+	for _, field := range l.fields {
+		value := fmt.Sprint(field.value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", field.name, value)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func (l *structuredLogger) jsonLine(now time.Time, level logLevel, msg string) []byte {
+	var b bytes.Buffer
+	writeJsonField := func(name string, value interface{}) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(strconv.AppendQuote(nil, name))
+		b.WriteByte(':')
+		b.Write(data)
+	}
+	writeJsonField("time", now.Format(logTimeFormat))
+	writeJsonField("level", level.String())
+	writeJsonField("msg", msg)
+	for _, field := range l.fields {
+		if d, ok := field.value.(time.Duration); ok {
+			// Durations in seconds so they can be aggregated
+			writeJsonField(field.name, d.Seconds())
+		} else {
+			writeJsonField(field.name, field.value)
+		}
+	}
+	return append(append([]byte{'{'}, b.Bytes()...), '}', '\n')
+}
+
+// Writer passing the lines written with the log package (e.g., by the AWS SDK) to the given logger
+type stdLogWriter struct {
+	logger *structuredLogger
+	level  logLevel
+}
+
+func (w *stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.logf(w.level, "%s", p)
+	return len(p), nil
+}
+
+// ------------------------------- Log file rotation -------------------------------/
+
+// Writer appending to a log file, the file is rotated once it reaches maxSize bytes: the file is renamed to
+// <path>.1, the previous <path>.1 to <path>.2 and so on, and only maxBackups rotated files are kept. The file is
+// closed before it is renamed so the rotation works on Windows too.
+type rotatingFileWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Returns new writer appending to the log file at the given path, a maxSize of zero means the file is not rotated
+func newRotatingFileWriter(path string, maxSize int64, maxBackups int) (*rotatingFileWriter, error) {
+	w := &rotatingFileWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingFileWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = fi.Size()
+	return nil
+}
+
+func (w *rotatingFileWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			// Keep writing to the current file rather than losing the lines
+			fmt.Fprintf(os.Stderr, "Unable to rotate the log file %v: %v\n", w.path, err)
+		}
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Must be called with the lock held
+func (w *rotatingFileWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	backupPath := func(i int) string {
+		return w.path + "." + strconv.Itoa(i)
+	}
+	var err error
+	if w.maxBackups > 0 {
+		os.Remove(backupPath(w.maxBackups))
+		for i := w.maxBackups - 1; i >= 1; i-- {
+			os.Rename(backupPath(i), backupPath(i+1))
+		}
+		err = os.Rename(w.path, backupPath(1))
+	} else {
+		err = os.Truncate(w.path, 0)
+	}
+	if openErr := w.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (w *rotatingFileWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
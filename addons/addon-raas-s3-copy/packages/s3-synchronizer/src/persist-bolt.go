@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The queued changes are written at the latest this long after they were queued, or as soon as this many are queued
+var boltFlushInterval = 100 * time.Millisecond
+var boltMaxBatchSize = 1000
+
+// The database is compacted when it is opened if it is larger than this and at least half of it is free pages
+var boltCompactMinSize int64 = 16 * 1024 * 1024
+
+// Size of the records copied per transaction when the database is compacted, to keep the transactions small
+const boltCompactTxMaxSize = 64 * 1024 * 1024
+
+// The table and key of the value saved with Save
+const boltValueTable = "value"
+const boltValueKey = "value"
+
+// RecordPersistence backed by a bolt database, i.e., a single file B+tree key/value store with ACID transactions. Each
+// table is a bolt bucket and each record is saved as JSON under its own key. The changes are queued and written in
+// batches, one transaction per batch. A transaction is either written completely or not at all so a crash never leaves
+// the database corrupt, it loses the changes queued since the last batch only.
+type boltPersistence struct {
+	filePath string
+	db       *bolt.DB
+
+	lock sync.Mutex
+	// Map of table vs map of key vs the data to save for the queued changes, nil to delete the record
+	pending        map[string]map[string][]byte
+	pendingN       int
+	flushScheduled bool
+}
+
+// Returns new RecordPersistence implementation that saves the records in a bolt database at the given filePath location
+// The given filePath is evaluated to be relative to the given baseDirPath
+// If baseDirPath is empty then it creates the given filePath relative to the user's home directory
+func NewBoltPersistence(filePath string, baseDirPath string) (RecordPersistence, error) {
+	persistence := &boltPersistence{filePath: persistenceFilePath(filePath, baseDirPath), pending: make(map[string]map[string][]byte)}
+	if err := persistence.open(); err != nil {
+		return nil, err
+	}
+	if err := persistence.compactIfNeeded(); err != nil {
+		logger.withPath(persistence.filePath).withError(err).warnf("Unable to compact")
+	}
+	return persistence, nil
+}
+
+func (persistence *boltPersistence) open() error {
+	// Fail instead of waiting forever if another process has the database open
+	db, err := bolt.Open(persistence.filePath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	persistence.db = db
+	return nil
+}
+
+func (persistence *boltPersistence) Put(table string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	persistence.queue(table, key, data)
+	return nil
+}
+
+func (persistence *boltPersistence) Delete(table string, key string) error {
+	persistence.queue(table, key, nil)
+	return nil
+}
+
+func (persistence *boltPersistence) queue(table string, key string, data []byte) {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+
+	records, ok := persistence.pending[table]
+	if !ok {
+		records = make(map[string][]byte)
+		persistence.pending[table] = records
+	}
+	if _, queued := records[key]; !queued {
+		persistence.pendingN++
+	}
+	records[key] = data
+	if persistence.pendingN >= boltMaxBatchSize {
+		persistence.flushLocked()
+	} else {
+		persistence.scheduleFlushLocked()
+	}
+}
+
+func (persistence *boltPersistence) scheduleFlushLocked() {
+	if !persistence.flushScheduled {
+		persistence.flushScheduled = true
+		time.AfterFunc(boltFlushInterval, func() {
+			persistence.Flush()
+		})
+	}
+}
+
+// Writes the queued changes
+func (persistence *boltPersistence) Flush() error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	return persistence.flushLocked()
+}
+
+// Must be called with the lock held
+func (persistence *boltPersistence) flushLocked() error {
+	persistence.flushScheduled = false
+	if persistence.pendingN == 0 {
+		return nil
+	}
+	if persistence.db == nil {
+		return errors.New("the database is closed")
+	}
+	err := persistence.db.Update(func(tx *bolt.Tx) error {
+		for table, records := range persistence.pending {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(table))
+			if err != nil {
+				return err
+			}
+			for key, data := range records {
+				if data == nil {
+					err = bucket.Delete([]byte(key))
+				} else {
+					err = bucket.Put([]byte(key), data)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Keep the changes queued, they are written with the next batch
+		logger.withPath(persistence.filePath).withError(err).errorf("Unable to save changes")
+		persistence.scheduleFlushLocked()
+		return err
+	}
+	persistence.pending = make(map[string]map[string][]byte)
+	persistence.pendingN = 0
+	return nil
+}
+
+// Calls fn with each record of the given table once the queued changes are written. The data is only valid until fn
+// returns.
+func (persistence *boltPersistence) ForEach(table string, fn func(key string, data []byte) error) error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	if err := persistence.flushLocked(); err != nil {
+		return err
+	}
+	return persistence.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, data []byte) error {
+			return fn(string(key), data)
+		})
+	})
+}
+
+// Saves a representation of v as the value of the database, written right away
+func (persistence *boltPersistence) Save(v interface{}) error {
+	if err := persistence.Put(boltValueTable, boltValueKey, v); err != nil {
+		return err
+	}
+	return persistence.Flush()
+}
+
+// Loads the value of the database saved with Save into v.
+// Use os.IsNotExist() to see if the returned error is due to no value being saved.
+func (persistence *boltPersistence) Load(v interface{}) error {
+	found := false
+	err := persistence.ForEach(boltValueTable, func(key string, data []byte) error {
+		if key != boltValueKey {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	if err == nil && !found {
+		return &os.PathError{Op: "load", Path: persistence.filePath, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// Removes all the records, including the queued changes
+func (persistence *boltPersistence) Clean() error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	persistence.pending = make(map[string]map[string][]byte)
+	persistence.pendingN = 0
+	if persistence.db == nil {
+		return errors.New("the database is closed")
+	}
+	return persistence.db.Update(func(tx *bolt.Tx) error {
+		var tables [][]byte
+		err := tx.ForEach(func(table []byte, _ *bolt.Bucket) error {
+			tables = append(tables, append([]byte{}, table...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if err := tx.DeleteBucket(table); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Writes the queued changes and closes the database
+func (persistence *boltPersistence) Close() error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	if persistence.db == nil {
+		return nil
+	}
+	flushErr := persistence.flushLocked()
+	err := persistence.db.Close()
+	persistence.db = nil
+	if flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// Compacts the database if most of the file is free pages. Bolt reuses the pages freed by deleted records but never
+// shrinks the file, e.g., after the records of a large mount were removed.
+func (persistence *boltPersistence) compactIfNeeded() error {
+	fi, err := os.Stat(persistence.filePath)
+	if err != nil || fi.Size() < boltCompactMinSize {
+		return err
+	}
+	// The free page statistics are updated when a write transaction ends
+	tx, err := persistence.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	tx.Rollback()
+	if int64(persistence.db.Stats().FreeAlloc) < fi.Size()/2 {
+		return nil
+	}
+	return persistence.Compact()
+}
+
+// Rewrites the records to a new database file without free pages and replaces the database file with it. The
+// compacted file is moved over the database file while both are open so that the database stays locked throughout.
+// Where an open file can not be replaced (i.e., on Windows) the database is left as is.
+func (persistence *boltPersistence) Compact() error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	if err := persistence.flushLocked(); err != nil {
+		return err
+	}
+
+	compactedPath := persistence.filePath + ".compact"
+	os.Remove(compactedPath)
+	compacted, err := bolt.Open(compactedPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(compacted, persistence.db, boltCompactTxMaxSize)
+	if err == nil {
+		err = os.Rename(compactedPath, persistence.filePath)
+	}
+	if err != nil {
+		compacted.Close()
+		os.Remove(compactedPath)
+		return err
+	}
+	syncDir(filepath.Dir(persistence.filePath))
+
+	// The compacted database holds the lock of the file now
+	if err := persistence.db.Close(); err != nil {
+		logger.withPath(persistence.filePath).withError(err).warnf("Unable to close the database replaced by the compacted one")
+	}
+	persistence.db = compacted
+	return nil
+}
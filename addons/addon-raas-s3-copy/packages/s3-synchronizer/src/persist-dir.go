@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The table and key of the value saved with Save
+const dirValueTable = "value"
+const dirValueKey = "value"
+
+// RecordPersistence that saves each record in its own file, in a directory per table. Each change is written right
+// away: the record is written to a temp file, synced to disk and renamed over the previous record, so a crash leaves
+// either the previous or the new record and never a partially written one. Suited to tables whose records change one
+// at a time (e.g., the changes of an outbox), not to saving many records at once.
+type dirBasedPersistence struct {
+	dirPath string
+	lock    sync.Mutex
+}
+
+// Returns new RecordPersistence implementation that saves the records in files under the directory at the given path
+func NewDirBasedPersistence(dirPath string) RecordPersistence {
+	return &dirBasedPersistence{dirPath: dirPath}
+}
+
+// Returns the path of the file of the given record. The file names are the keys in hex so that any key makes a valid
+// file name and the files sort in the order of their keys.
+func (persistence *dirBasedPersistence) recordFilePath(table string, key string) string {
+	return filepath.Join(persistence.dirPath, table, hex.EncodeToString([]byte(key)))
+}
+
+func (persistence *dirBasedPersistence) Put(table string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+
+	filePath := persistence.recordFilePath(table, key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	tempFilePath := filePath + ".tmp"
+	if err := writeFileSynced(tempFilePath, data); err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+	if err := os.Rename(tempFilePath, filePath); err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+	syncDir(filepath.Dir(filePath))
+	return nil
+}
+
+func (persistence *dirBasedPersistence) Delete(table string, key string) error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	if err := os.Remove(persistence.recordFilePath(table, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Calls fn with the key and the saved data of each record of the given table, in the order of their keys
+func (persistence *dirBasedPersistence) ForEach(table string, fn func(key string, data []byte) error) error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+
+	tableDirPath := filepath.Join(persistence.dirPath, table)
+	files, err := ioutil.ReadDir(tableDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".tmp") {
+			// The temp file of a record whose write was interrupted
+			continue
+		}
+		key, err := hex.DecodeString(file.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(tableDirPath, file.Name()))
+		if err != nil {
+			return err
+		}
+		if err := fn(string(key), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The changes are written right away, there is nothing to flush
+func (persistence *dirBasedPersistence) Flush() error {
+	return nil
+}
+
+func (persistence *dirBasedPersistence) Close() error {
+	return nil
+}
+
+// Saves a representation of v as the value of the directory
+func (persistence *dirBasedPersistence) Save(v interface{}) error {
+	return persistence.Put(dirValueTable, dirValueKey, v)
+}
+
+// Loads the value of the directory saved with Save into v.
+// Use os.IsNotExist() to see if the returned error is due to no value being saved.
+func (persistence *dirBasedPersistence) Load(v interface{}) error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	data, err := ioutil.ReadFile(persistence.recordFilePath(dirValueTable, dirValueKey))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Removes all the records
+func (persistence *dirBasedPersistence) Clean() error {
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	return os.RemoveAll(persistence.dirPath)
+}
@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+import "os"
+
+// There is no file lock on the other platforms, the files are only locked against the other persistences of the
+// process
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/mitchellh/go-homedir"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -40,9 +44,97 @@ type Persistence interface {
 	Load(v interface{}) error
 	Clean() error
 }
+
+// Persistence that saves each record under its own key in a table, so that a change of a record is saved without
+// rewriting the other records. The changes may be queued and written in batches, Flush writes the queued changes.
+type RecordPersistence interface {
+	Persistence
+	// Saves the given record under the given key of the given table, replacing the record saved before
+	Put(table string, key string, v interface{}) error
+	// Removes the record of the given key of the given table
+	Delete(table string, key string) error
+	// Calls fn with the key and the saved data of each record of the given table, including the queued changes
+	ForEach(table string, fn func(key string, data []byte) error) error
+	Flush() error
+	Close() error
+}
+
+// The version of the format of the files saved by fileBasedPersistence. Files of a newer version are not loaded.
+const persistenceFileFormat = 1
+
+// Returned (as the Err of an *os.PathError) when the file is locked by another process
+var errPersistenceLocked = errors.New("in use by another synchronizer process")
+
+// A file saved by fileBasedPersistence: the saved value with the version of the file format and the checksum of the
+// value to detect corrupted files. Files saved by older versions are the bare value.
+type persistedFile struct {
+	Format   *int            `json:"format"`
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// The file could not be loaded because it is corrupt (e.g., it was modified by hand or damaged on disk). The file is
+// moved aside to MovedTo so that it is not overwritten by the next save.
+type CorruptFileError struct {
+	Path    string
+	MovedTo string
+	Err     error
+}
+
+func (e *CorruptFileError) Error() string {
+	return fmt.Sprintf("%v is corrupt (moved to %v): %v", e.Path, e.MovedTo, e.Err)
+}
+
+func (e *CorruptFileError) Unwrap() error {
+	return e.Err
+}
+
+// Lock of a persistence file, shared by all the persistences of the same file in the process. The lock file is locked
+// with the first save or load and stays locked until the process exits, so another process can not use the same file.
+type persistenceFileLock struct {
+	sync.Mutex
+	lockFile *os.File
+}
+
+var persistenceFileLocks = make(map[string]*persistenceFileLock)
+var persistenceFileLocksLock sync.Mutex
+
+// Returns the lock of the file at the given path
+func getPersistenceFileLock(filePath string) *persistenceFileLock {
+	persistenceFileLocksLock.Lock()
+	defer persistenceFileLocksLock.Unlock()
+	fileLock, ok := persistenceFileLocks[filePath]
+	if !ok {
+		fileLock = &persistenceFileLock{}
+		persistenceFileLocks[filePath] = fileLock
+	}
+	return fileLock
+}
+
+// Locks the file against the other processes if not done yet. Must be called with the lock held.
+func (fileLock *persistenceFileLock) lockAgainstOtherProcesses(filePath string) error {
+	if fileLock.lockFile != nil {
+		return nil
+	}
+	lockFilePath := filePath + ".lock"
+	f, err := os.OpenFile(lockFilePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if err == errPersistenceLocked {
+			return &os.PathError{Op: "lock", Path: filePath, Err: err}
+		}
+		return err
+	}
+	fileLock.lockFile = f
+	return nil
+}
+
 type fileBasedPersistence struct {
 	filePath   string
-	fileLock   sync.Mutex
+	fileLock   *persistenceFileLock
 	marshaller Marshaller
 }
 
@@ -50,13 +142,20 @@ type fileBasedPersistence struct {
 // The given filePath is evaluated to be relative to the given baseDirPath
 // If baseDirPath is empty then it creates the given filePath relative to the user's home directory
 func NewFileBasedPersistenceWithJsonFormat(filePath string, baseDirPath string) Persistence {
+	expandedFilePath := persistenceFilePath(filePath, baseDirPath)
+	return &fileBasedPersistence{filePath: expandedFilePath, fileLock: getPersistenceFileLock(expandedFilePath), marshaller: JsonMarshaller{}}
+}
+
+// Returns the given filePath evaluated relative to the given baseDirPath (or the user's home directory if baseDirPath
+// is empty) and creates its directory if needed
+func persistenceFilePath(filePath string, baseDirPath string) string {
 	dirPath := ""
 	if baseDirPath == "" {
 		// Get user's home directory path
 		homeDirPath, err := homedir.Dir()
 		if err != nil {
 			// Cannot
-			log.Fatalf("Cannot get user's home directory path: Error %v\n", err)
+			logger.withError(err).fatalf("Cannot get user's home directory path")
 		}
 		dirPath = homeDirPath
 	} else {
@@ -69,47 +168,136 @@ func NewFileBasedPersistenceWithJsonFormat(filePath string, baseDirPath string)
 	if _, err := os.Stat(expandedDirPath); os.IsNotExist(err) {
 		os.MkdirAll(expandedDirPath, os.ModePerm)
 	}
-
-	return &fileBasedPersistence{filePath: expandedFilePath, fileLock: sync.Mutex{}, marshaller: JsonMarshaller{}}
+	return expandedFilePath
 }
 
-// Save saves a representation of v to the file at path.
-func (persistence fileBasedPersistence) Save(v interface{}) error {
+// Save saves a representation of v to the file at path. The file is written to a temporary file first and renamed
+// once synced to disk, so a crash leaves either the previous or the new file and never a partially written one.
+func (persistence *fileBasedPersistence) Save(v interface{}) error {
 	persistence.fileLock.Lock()
 	defer persistence.fileLock.Unlock()
-	f, err := os.Create(persistence.filePath)
-	if err != nil {
+	if err := persistence.fileLock.lockAgainstOtherProcesses(persistence.filePath); err != nil {
 		return err
 	}
-	defer f.Close()
+
 	r, err := persistence.marshaller.marshal(v)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(f, r)
-	return err
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	checksum, err := persistenceChecksum(data)
+	if err != nil {
+		return err
+	}
+	format := persistenceFileFormat
+	b, err := json.MarshalIndent(&persistedFile{Format: &format, Checksum: checksum, Data: data}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tempFilePath := persistence.filePath + ".tmp"
+	if err := writeFileSynced(tempFilePath, b); err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+	if err := os.Rename(tempFilePath, persistence.filePath); err != nil {
+		os.Remove(tempFilePath)
+		return err
+	}
+	syncDir(filepath.Dir(persistence.filePath))
+	return nil
 }
 
 // Load loads the file at path into v.
 // Use os.IsNotExist() to see if the returned error is due
-// to the file being missing.
-func (persistence fileBasedPersistence) Load(v interface{}) error {
+// to the file being missing. A *CorruptFileError is returned if the file is corrupt.
+func (persistence *fileBasedPersistence) Load(v interface{}) error {
 	persistence.fileLock.Lock()
 	defer persistence.fileLock.Unlock()
-	f, err := os.Open(persistence.filePath)
+	if err := persistence.fileLock.lockAgainstOtherProcesses(persistence.filePath); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(persistence.filePath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return persistence.marshaller.unmarshal(f, v)
+	data, err := persistence.verify(b)
+	if err == nil {
+		err = persistence.marshaller.unmarshal(bytes.NewReader(data), v)
+	}
+	if err != nil {
+		corruptFilePath := persistence.filePath + ".corrupt"
+		if renameErr := os.Rename(persistence.filePath, corruptFilePath); renameErr != nil {
+			corruptFilePath = persistence.filePath
+		}
+		return &CorruptFileError{Path: persistence.filePath, MovedTo: corruptFilePath, Err: err}
+	}
+	return nil
 }
 
-func (persistence fileBasedPersistence) Clean() error {
+// Returns the saved value of the given file contents after checking its format version and checksum
+func (persistence *fileBasedPersistence) verify(b []byte) ([]byte, error) {
+	if !json.Valid(b) {
+		return nil, errors.New("invalid JSON")
+	}
+	var file persistedFile
+	if err := json.Unmarshal(b, &file); err != nil || file.Format == nil {
+		// Saved by an older version, without format version nor checksum
+		return b, nil
+	}
+	if *file.Format > persistenceFileFormat {
+		return nil, fmt.Errorf("unsupported file format version %v, the highest supported version is %v", *file.Format, persistenceFileFormat)
+	}
+	checksum, err := persistenceChecksum(file.Data)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != file.Checksum {
+		return nil, fmt.Errorf("checksum mismatch, expected %v but the data has %v", file.Checksum, checksum)
+	}
+	return file.Data, nil
+}
+
+func (persistence *fileBasedPersistence) Clean() error {
 	persistence.fileLock.Lock()
 	defer persistence.fileLock.Unlock()
+	if err := persistence.fileLock.lockAgainstOtherProcesses(persistence.filePath); err != nil {
+		return err
+	}
 	err := os.Remove(persistence.filePath)
 	if err != nil {
 		return err
 	}
 	return err
 }
+
+// Returns the checksum of the given JSON data, regardless of its indentation
+func persistenceChecksum(data []byte) (string, error) {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, data); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(compacted.Bytes())
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Writes the given data to the file at the given path and syncs it to disk
+func writeFileSynced(filePath string, data []byte) error {
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
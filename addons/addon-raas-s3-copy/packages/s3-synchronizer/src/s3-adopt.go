@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Outcome of adopting the local files of a mount
+type adoptStats struct {
+	lock sync.Mutex
+	// Number of files with the content of their object, recorded as downloaded
+	adopted int
+	// Number of files with a different content than their object, left to the download
+	differing int
+	errors    int
+}
+
+func (stats *adoptStats) record(adopted bool, err error) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	switch {
+	case err != nil:
+		stats.errors++
+	case adopted:
+		stats.adopted++
+	default:
+		stats.differing++
+	}
+}
+
+// Adopts the files already in the local directory of the given mount (e.g., restored from a snapshot or copied from
+// another instance) that have the content of their objects in S3, so that they are not downloaded again. Each file of
+// an object without an up-to-date record in the synchronizer state is compared with the object by size, then by
+// content against the ETag of the object (the MD5 of the content, or the MD5 of the MD5s of the parts for objects
+// uploaded in multiple parts) and the additional checksums stored with the object. The files that match are recorded
+// as downloaded. The other files are left to the download, which replaces them (or resolves the conflict with the
+// conflict policy for writeable mounts).
+func adoptLocalFiles(sess *session.Session, config *mountConfiguration, transfers *transferConfiguration) *adoptStats {
+	stats := &adoptStats{}
+	svc := s3.New(sess)
+
+	// Hash the files concurrently while the objects are being listed
+	items := make(chan *s3.Object)
+	var workers sync.WaitGroup
+	for i := 0; i < transfers.objectConcurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for item := range items {
+				if !config.isStopped() {
+					adoptLocalFile(svc, config, item, stats)
+				}
+			}
+		}()
+	}
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(config.bucket),
+		Prefix: aws.String(config.keys.keyPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			if !strings.HasSuffix(*item.Key, "/") && synchronizerState.HasFileChangedInS3(config.stateNamespace(), item) {
+				items <- item
+			}
+		}
+		return !config.isStopped()
+	})
+	close(items)
+	workers.Wait()
+	if err != nil {
+		// The files not adopted yet are downloaded
+		config.logger.withOp("adopt").withError(err).errorf("Unable to list objects to adopt the local files")
+		stats.record(false, err)
+	}
+
+	if stats.adopted > 0 || stats.differing > 0 || stats.errors > 0 {
+		config.logger.withOp("adopt").infof("Adopted local files: %d with the content of their object, %d different and downloaded, %d errors",
+			stats.adopted, stats.differing, stats.errors)
+	}
+	return stats
+}
+
+// Records the local file of the given object as downloaded if it has the content of the object
+func adoptLocalFile(svc *s3.S3, config *mountConfiguration, item *s3.Object, stats *adoptStats) {
+	filePath, err := config.localPathForKey(*item.Key)
+	if err != nil {
+		return
+	}
+	adoptLogger := config.logger.withOp("adopt").withKey(*item.Key).withPath(filePath)
+	fi, err := os.Stat(filePath)
+	if err != nil || !fi.Mode().IsRegular() || config.filter.excludesObject(item, filePath) {
+		// Nothing to adopt, the object is downloaded (unless excluded)
+		return
+	}
+	if fi.Size() != aws.Int64Value(item.Size) {
+		adoptLogger.debugf("The file does not have the size of the object, not adopting it")
+		stats.record(false, nil)
+		return
+	}
+
+	// Get the part size of multipart objects and the additional checksums, pinned to the listed version of the object
+	digests, err := headObjectDigests(svc, config.bucket, *item.Key, aws.StringValue(item.ETag))
+	if err != nil {
+		adoptLogger.withError(err).errorf("Error getting object digests")
+		stats.record(false, err)
+		return
+	}
+	if len(digests.checks()) == 0 {
+		// E.g., an object encrypted with SSE-KMS without additional checksums, or a multipart object with unknown
+		// part size. The content can not be compared.
+		adoptLogger.debugf("No digests to compare the file with, not adopting it")
+		stats.record(false, nil)
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		stats.record(false, err)
+		return
+	}
+	defer file.Close()
+	if err := digests.verify(file); err != nil {
+		adoptLogger.withError(err).debugf("The file does not have the content of the object, not adopting it")
+		stats.record(false, nil)
+		return
+	}
+	if after, err := os.Stat(filePath); err != nil || !newFileFingerprint(fi).matches(after) {
+		// Changed while it was being compared
+		stats.record(false, nil)
+		return
+	}
+
+	fingerprint := newFileFingerprint(fi)
+	if digests.etagIsDigest && digestPartCount(digests.etag) == 0 {
+		// The content was verified against the ETag, i.e., its MD5
+		fingerprint.MD5 = digests.etag
+	}
+	synchronizerState.RecordFileDownloadToLocal(config.stateNamespace(), item, fingerprint)
+	adoptLogger.withBytes(fi.Size()).debugf("The file has the content of the object, adopted it")
+	stats.record(true, nil)
+}
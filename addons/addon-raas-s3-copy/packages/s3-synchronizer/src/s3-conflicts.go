@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// How to resolve a conflict, i.e., a file of a writeable mount changed locally and in S3 since it was last downloaded
+type conflictPolicy string
+
+const (
+	// Download the object from S3 overwriting the local changes
+	conflictPolicyRemoteWins conflictPolicy = "remote-wins"
+	// Keep the local file and upload it to S3 overwriting the changes in S3
+	conflictPolicyLocalWins conflictPolicy = "local-wins"
+	// Keep the local file as "<name>.conflict-<timestamp>" and download the object from S3
+	conflictPolicyKeepBoth conflictPolicy = "keep-both"
+)
+
+const defaultConflictPolicy = conflictPolicyRemoteWins
+
+// Timestamp format used in the name of the local copies kept by the keep-both policy
+const conflictTimestampFormat = "20060102T150405Z"
+
+func isValidConflictPolicy(policy string) bool {
+	switch conflictPolicy(policy) {
+	case conflictPolicyRemoteWins, conflictPolicyLocalWins, conflictPolicyKeepBoth:
+		return true
+	default:
+		return false
+	}
+}
+
+// The outcome of checking a local file against the changed object in S3
+type localFileStatus int
+
+const (
+	// The local file did not change since the object was last downloaded, the object can be downloaded
+	localFileUnchanged localFileStatus = iota
+	// The local file already has the content of the object (e.g., it was uploaded from here), nothing to download
+	localFileInSync
+	// The local file changed since the object was last downloaded and has different content than the object
+	localFileInConflict
+)
+
+// Checks the local file against the given object that changed in S3 since it was last downloaded
+func checkLocalFile(svc *s3.S3, config *mountConfiguration, filePath string, fi os.FileInfo, item *s3.Object) localFileStatus {
+	fingerprint := synchronizerState.GetLocalFingerprint(config.stateNamespace(), *item.Key)
+	if fingerprint != nil && fingerprint.matches(fi) {
+		if fingerprint.contentMatches(item) {
+			// The object was uploaded from this file
+			return localFileInSync
+		}
+		return localFileUnchanged
+	}
+	// The file changed locally or it was never downloaded, this is not a conflict if the content is the same
+	if localFileMatchesObject(svc, config, filePath, fi, item) {
+		return localFileInSync
+	}
+	return localFileInConflict
+}
+
+// Returns flag indicating if the content of the local file matches the digests of the given object, i.e., its ETag
+// and additional checksums
+func localFileMatchesObject(svc *s3.S3, config *mountConfiguration, filePath string, fi os.FileInfo, item *s3.Object) bool {
+	if fi.Size() != aws.Int64Value(item.Size) {
+		return false
+	}
+	// The ETag of objects encrypted with SSE-KMS or SSE-C looks like an MD5 but is not the MD5 of the content, the
+	// encryption of the object tells if it is. Pinned to the listed version of the object.
+	digests, err := headObjectDigests(svc, config.bucket, *item.Key, aws.StringValue(item.ETag))
+	if err != nil || len(digests.checks()) == 0 {
+		// E.g., an object encrypted with SSE-KMS without additional checksums, or a multipart object with unknown
+		// part size. The content can not be compared.
+		return false
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return digests.verify(file) == nil
+}
+
+// Returns the path of the local copy of the given file kept by the keep-both policy
+func conflictCopyPath(filePath string, at time.Time) string {
+	return fmt.Sprintf("%s.conflict-%s", filePath, at.UTC().Format(conflictTimestampFormat))
+}
+
+// Keeps a copy of the local file before it is overwritten by the object from S3. The copy is a hard link when possible,
+// the file is replaced by renaming the downloaded file over it so the link keeps the local content.
+func keepConflictCopy(filePath string) (string, error) {
+	copyPath := conflictCopyPath(filePath, time.Now())
+	if err := os.Link(filePath, copyPath); err == nil {
+		return copyPath, nil
+	}
+
+	// Hard links are not supported by all file systems, fall back to copying the file
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(copyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, downloadedFileMode)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(copyPath)
+		return "", err
+	}
+	return copyPath, dst.Close()
+}
+
+// Applies the conflict policy of the mount to the given local file that changed locally and in S3.
+// Returns flag indicating if the object should be downloaded.
+func resolveConflict(svc *s3.S3, config *mountConfiguration, item *s3.Object, filePath string, stats *downloadStats) bool {
+	stats.recordConflict()
+	conflictLogger := config.logger.withKey(*item.Key).withPath(filePath).withOp("conflict")
+	conflictLogger.warnf("Conflict, the file changed locally and in S3 since it was last downloaded, resolving with %v", config.conflictPolicy)
+
+	switch config.conflictPolicy {
+	case conflictPolicyLocalWins:
+		file, err := os.Open(filePath)
+		if err != nil {
+			conflictLogger.withError(err).errorf("Error opening the file to upload")
+			stats.recordError(item.Key)
+			return false
+		}
+		defer file.Close()
+		if err := uploadFileToS3(svc, config, file, *item.Key); err != nil {
+			stats.recordError(item.Key)
+		}
+		// The upload is recorded, the uploaded object is not downloaded back
+		return false
+	case conflictPolicyKeepBoth:
+		copyPath, err := keepConflictCopy(filePath)
+		if err != nil {
+			// Do not lose the local changes
+			conflictLogger.withError(err).errorf("Error keeping a copy of the file, skipping download")
+			stats.recordError(item.Key)
+			return false
+		}
+		conflictLogger.infof("Kept local changes in '%v'", copyPath)
+		return true
+	default:
+		return true
+	}
+}
@@ -8,12 +8,19 @@ import "encoding/json"
 //	bucket: Name of the S3 bucket to load data from
 //	prefix: The S3 prefix path to load data from
 //	writeable: Optional boolean flag indicating if the specified S3 prefix location should be treated as writeable or READ-only. Default is false.
+//	conflictPolicy: Optional, how to resolve files of writeable mounts changed locally and in S3. One of "remote-wins", "local-wins" or "keep-both". Default is "remote-wins".
+//	include, exclude, excludePresets, maxFileSize, maxAge: Optional filter rules, see mountFilterSettings. Default is to synchronize all files.
 //	kmsKeyId: Optional, KMS Key ARN. Default is empty string. NOTE: This attribute is not used by the program at the moment. The program assumes S3 being configured with default server side encryption.
 func getDefaultMounts(defaultS3Mounts string) (*[]s3Mount, error) {
 	mounts := make([]s3Mount, 0)
 
 	err := json.Unmarshal([]byte(defaultS3Mounts), &mounts)
-	// Set defaults for any optional parameters not set in JSON
+	setMountDefaults(mounts)
+	return &mounts, err
+}
+
+// Set defaults for any optional parameters not set in JSON
+func setMountDefaults(mounts []s3Mount) {
 	for i, mount := range mounts {
 		if mount.Writeable == nil {
 			mounts[i].Writeable = Bool(false)
@@ -23,9 +30,11 @@ func getDefaultMounts(defaultS3Mounts string) (*[]s3Mount, error) {
 			mounts[i].KmsArn = &emptyString
 		}
 		if mount.RoleArn == nil {
-		    emptyString := ""
-		    mounts[i].RoleArn = &emptyString
+			emptyString := ""
+			mounts[i].RoleArn = &emptyString
+		}
+		if mount.ConflictPolicy == nil {
+			mounts[i].ConflictPolicy = String(string(defaultConflictPolicy))
 		}
 	}
-	return &mounts, err
 }
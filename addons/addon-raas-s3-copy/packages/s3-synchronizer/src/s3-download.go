@@ -2,8 +2,10 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"io"
 	"math"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -19,8 +22,14 @@ import (
 // Global Variable to hold map of S3 object path vs their ETags
 // This map is to avoid unnecessary re-downloads
 // If the program is restarted this map will be re-initialized from the persistent state
-// (currently implemented as a state file under user home directory)
-var synchronizerState = NewPersistentSynchronizerState()
+// (implemented as a state file in the state directory, opened by openStateFiles)
+var synchronizerState SynchronizerState
+
+// The number of consecutive failed attempts to list the objects of a mount before giving up the synchronization
+const maxListAttempts = 3
+
+// The time to wait before listing the objects again after a failed attempt
+var listRetryBackoff = time.Duration(10) * time.Second
 
 // To hold the number retrieved files and other download related statistics
 type downloadStats struct {
@@ -29,6 +38,19 @@ type downloadStats struct {
 	numberOfRetrievedFiles int
 	totalRetrievedBytes    int64
 	errorPrefixes          []*string
+	// Number of downloads whose content did not match the digests of the object in S3 (including retried downloads)
+	integrityFailures int
+	// Keys of the objects that failed verification repeatedly and were quarantined
+	quarantinedKeys []*string
+	// Number of files that changed locally and in S3 since they were last downloaded
+	conflicts int
+	// Keys of the objects that were not synchronized because they can not be safely mapped to local paths
+	rejectedKeys []*string
+	// Set if the synchronization could not complete (e.g., the objects could not be listed)
+	err error
+
+	// The objects of a mount are downloaded concurrently so guard the counters above
+	lock sync.Mutex
 }
 
 func newDownloadStats() *downloadStats {
@@ -36,151 +58,295 @@ func newDownloadStats() *downloadStats {
 	return &stats
 }
 
+func (stats *downloadStats) recordDownload(numBytes int64) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.numberOfRetrievedFiles++
+	stats.totalRetrievedBytes = stats.totalRetrievedBytes + numBytes
+}
+
+func (stats *downloadStats) recordError(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.errorPrefixes = append(stats.errorPrefixes, key)
+}
+
+func (stats *downloadStats) recordIntegrityFailure() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.integrityFailures++
+}
+
+func (stats *downloadStats) recordConflict() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.conflicts++
+}
+
+func (stats *downloadStats) recordRejectedKey(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.rejectedKeys = append(stats.rejectedKeys, key)
+}
+
+func (stats *downloadStats) recordQuarantine(key *string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.quarantinedKeys = append(stats.quarantinedKeys, key)
+}
+
 type mountConfiguration struct {
+	id          string
 	bucket      string
 	prefix      string
 	destination string
 	writeable   bool
 	kmsKeyId    string
 	roleArn     string
+	// How to resolve files changed locally and in S3 since they were last downloaded (writeable mounts only)
+	conflictPolicy conflictPolicy
+	// Decides which files are synchronized
+	filter *mountFilter
+	// Maps the keys of the objects to local paths and back
+	keys *keyMapper
+
+	// Closed to signal the recurring downloads and the upload watchers of the mount to stop
+	stopCh chan struct{}
+	// Keeps track of the go routines working on the mount so the mount can be cleaned up after they stop
+	activeRoutines sync.WaitGroup
+	// Set if the state of the mount is kept in the synchronizer directory of the mount, it is detached once the mount
+	// is stopped
+	stateAttached bool
+	// Logs with the id and bucket of the mount
+	logger *structuredLogger
+
+	pendingUploadsLock sync.RWMutex
+	// Tells if the local changes of a file are waiting to be uploaded, set by the upload watcher of a writeable mount
+	pendingUploads func(path string) bool
 }
 
-func newMountConfiguration(bucket string, prefix string, destination string, writeable bool, kmsKeyId string, roleArn string) *mountConfiguration {
-	config := mountConfiguration{
-		bucket:      bucket,
-		prefix:      prefix,
-		destination: destination,
-		writeable:   writeable,
-		kmsKeyId:    kmsKeyId,
-		roleArn:     roleArn,
+func newMountConfiguration(id string, bucket string, prefix string, destination string, writeable bool, kmsKeyId string, roleArn string, conflictPolicy conflictPolicy, filterSettings mountFilterSettings) *mountConfiguration {
+	return &mountConfiguration{
+		id:             id,
+		bucket:         bucket,
+		prefix:         prefix,
+		destination:    destination,
+		writeable:      writeable,
+		kmsKeyId:       kmsKeyId,
+		roleArn:        roleArn,
+		conflictPolicy: conflictPolicy,
+		filter:         newMountFilter(destination, filterSettings),
+		keys:           newKeyMapper(prefix, destination, windowsFileNames, caseInsensitiveFileNames),
+		stopCh:         make(chan struct{}),
+		logger:         logger.withMount(id, bucket),
 	}
-	return &config
 }
 
-// Downloads the files based on the given mount configuration from S3 using
-// s3Manager https://docs.aws.amazon.com/sdk-for-go/api/service/s3/s3manager/#NewDownloader.
-// It downloads each file as multipart download (i.e., downloads in chunks).
-func downloadFiles(sess *session.Session, config *mountConfiguration, concurrency int, debug bool) {
+// Sets the function telling if the local changes of a file are waiting to be uploaded
+func (config *mountConfiguration) setPendingUploads(pendingUploads func(path string) bool) {
+	config.pendingUploadsLock.Lock()
+	defer config.pendingUploadsLock.Unlock()
+	config.pendingUploads = pendingUploads
+}
 
-	destination := config.destination
-	bucket := config.bucket
-	prefix := config.prefix
+// Returns flag indicating if the local changes of the given file are waiting to be uploaded
+func (config *mountConfiguration) isUploadPending(path string) bool {
+	config.pendingUploadsLock.RLock()
+	defer config.pendingUploadsLock.RUnlock()
+	return config.pendingUploads != nil && config.pendingUploads(path)
+}
 
-	if debug {
-		log.Println("Getting all files from the s3 bucket :", bucket, " and prefix: ", prefix)
-		log.Println("And will download them to :", destination)
+// Returns flag indicating if the mount has been removed and all work on it should stop
+func (config *mountConfiguration) isStopped() bool {
+	select {
+	case <-config.stopCh:
+		return true
+	default:
+		return false
 	}
+}
+
+// Returns flag indicating if the given mount configuration has the same settings as this one
+func (config *mountConfiguration) hasSameSettings(other *mountConfiguration) bool {
+	return config.id == other.id &&
+		config.bucket == other.bucket &&
+		config.prefix == other.prefix &&
+		config.destination == other.destination &&
+		config.writeable == other.writeable &&
+		config.kmsKeyId == other.kmsKeyId &&
+		config.roleArn == other.roleArn &&
+		config.conflictPolicy == other.conflictPolicy &&
+		config.filter.settings.equal(other.filter.settings)
+}
+
+// Downloads the files based on the given mount configuration from S3 using
+// s3Manager https://docs.aws.amazon.com/sdk-for-go/api/service/s3/s3manager/#NewDownloader.
+// It downloads multiple files concurrently and each large file as multipart download (i.e., downloads in chunks).
+func downloadFiles(sess *session.Session, config *mountConfiguration, transfers *transferConfiguration) {
+	config.logger.debugf("Getting all files from the s3 bucket %v and prefix %v and will download them to %v", config.bucket, config.prefix, config.destination)
 
-	stats := syncS3ToLocal(sess, config, concurrency, debug)
-	reportDownloadStats(stats, debug)
+	stats := syncS3ToLocal(sess, config, transfers)
+	reportDownloadStats(config, stats)
 }
 
-func reportDownloadStats(stats *downloadStats, debug bool) {
+func reportDownloadStats(config *mountConfiguration, stats *downloadStats) {
 	end := time.Now()
 	duration := end.Sub(stats.start)
 	seconds := duration.Seconds()
-	if debug {
-		log.Printf("Downloaded %d files - %d bytes total at %.1f MB/s\n",
+	statsLogger := config.logger.withOp("download").withBytes(stats.totalRetrievedBytes).withDuration(duration)
+	if stats.numberOfRetrievedFiles > 0 {
+		statsLogger.infof("Downloaded %d files - %d bytes total at %.1f MB/s",
 			stats.numberOfRetrievedFiles, stats.totalRetrievedBytes, float64(stats.totalRetrievedBytes)/float64(1e6)/seconds)
-		if len(stats.errorPrefixes) > 0 {
-			log.Println("The following objects had errors:")
-			for _, p := range stats.errorPrefixes {
-				log.Println("- ", *p)
-			}
-		}
+	} else {
+		statsLogger.debugf("Downloaded 0 files")
+	}
+	for _, p := range stats.errorPrefixes {
+		config.logger.withOp("download").withKey(*p).warnf("The object had errors")
+	}
+	// Always report integrity failures, they indicate corruption in transit or at rest
+	if stats.integrityFailures > 0 {
+		config.logger.warnf("%d downloads did not match the digests of the objects in S3", stats.integrityFailures)
+	}
+	if stats.conflicts > 0 {
+		config.logger.warnf("%d files changed locally and in S3 since they were last downloaded", stats.conflicts)
+	}
+	for _, key := range stats.quarantinedKeys {
+		config.logger.withOp("quarantine").withKey(*key).errorf("Quarantined the object after %d failed verifications", maxIntegrityAttempts)
+	}
+	if len(stats.rejectedKeys) > 0 {
+		config.logger.warnf("%d objects were not synchronized because their keys can not be safely mapped to local paths", len(stats.rejectedKeys))
 	}
 }
 
-func syncS3ToLocal(sess *session.Session, config *mountConfiguration, concurrency int, debug bool) *downloadStats {
+func syncS3ToLocal(sess *session.Session, config *mountConfiguration, transfers *transferConfiguration) *downloadStats {
 	destination := config.destination
 	// Ensure the destination directory exists
 	if _, err := os.Stat(destination); os.IsNotExist(err) {
 		os.MkdirAll(destination, os.ModePerm)
 	}
 
+	// Wait for our turn, the number of mounts synchronizing at the same time is limited so that
+	// the mounts get the global transfer budget in a fair manner
+	mountStatuses.queued(config)
+	transfers.acquireMountSlot()
+	defer transfers.releaseMountSlot()
+
 	stats := newDownloadStats()
 	stats.start = time.Now()
+	mountStatuses.syncing(config, stats.start)
+	defer mountStatuses.synced(config, stats)
+
+	// Pick up changes to the ignore file of the mount
+	config.filter.refresh()
 
 	truncatedListing := true
+	listAttempts := 0
 
 	// accumulate responses of s3.ListObjectsV2 calls through all pages in case s3.ListObjectsV2 is paginated
 	// the accumulated listObjectResponses will then be used to find file on local filesystem that are not there in S3
 	var listObjectResponses []*s3.ListObjectsV2Output
 
 	bucket := config.bucket
-	prefix := config.prefix
+	// List the objects under the prefix as a directory, e.g., "data/" and not "data2/" for the prefix "data"
+	prefix := config.keys.keyPrefix
 	svc := s3.New(sess)
 
-	if debug {
-		log.Println("Listing", bucket, "for prefix", prefix)
-	}
+	config.logger.withOp("list").debugf("Listing %v for prefix %v", bucket, prefix)
 
-	var query *s3.ListObjectsV2Input
-	if prefix == "/" {
-		query = &s3.ListObjectsV2Input{
-			Bucket: aws.String(bucket),
-			Prefix: aws.String(""),
-		}
-	} else {
-		query = &s3.ListObjectsV2Input{
-			Bucket: aws.String(bucket),
-			Prefix: aws.String(prefix),
-		}
+	query := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
 	}
 
+	// Download the objects in a pool of workers while listing the rest of the objects
+	workers := startDownloadWorkers(sess, config, transfers, stats)
+	collisions := newKeyCollisions(caseInsensitiveFileNames)
+	config.keys.beginListing()
+
 	for truncatedListing {
+		if config.isStopped() {
+			// The mount was removed, do not continue with the partial listing as it would cause
+			// deletion of local files that are still in S3
+			config.logger.debugf("Mount for bucket %v and prefix %v was removed, stopping download", bucket, prefix)
+			config.keys.endListing(false)
+			workers.wait()
+			stats.end = time.Now()
+			return stats
+		}
 		resp, err := svc.ListObjectsV2(query)
 
 		if err != nil {
-			log.Println("Failed to list objects for bucket", bucket, "and prefix", prefix, ":", err)
-			// 10 seconds backoff
-			time.Sleep(time.Duration(10) * time.Second)
+			config.logger.withOp("list").withError(err).errorf("Failed to list objects for bucket %v and prefix %v", bucket, prefix)
+			listAttempts++
+			if listAttempts >= maxListAttempts {
+				// Give up this time instead of holding the mount slot, the next recurring download will try again
+				config.keys.endListing(false)
+				workers.wait()
+				stats.err = fmt.Errorf("failed to list objects for bucket %v and prefix %v after %v attempts: %v", bucket, prefix, listAttempts, err)
+				stats.end = time.Now()
+				return stats
+			}
+			time.Sleep(listRetryBackoff)
 			continue
 		}
+		listAttempts = 0
 		listObjectResponses = append(listObjectResponses, resp)
-		downloadAllObjects(resp, sess, config, concurrency, stats, debug)
+		downloadAllObjects(resp, config, collisions, workers, stats)
 
 		query.ContinuationToken = resp.NextContinuationToken
 		truncatedListing = *resp.IsTruncated
 	}
 
-	err := deleteLocalFilesNotInS3(listObjectResponses, config, debug)
+	// Wait for all downloads to complete before looking for local files to delete
+	workers.wait()
+
+	discardStalePartialDownloads(listObjectResponses, config)
+
+	err := deleteLocalFilesNotInS3(svc, listObjectResponses, config)
 	if err != nil {
-		log.Println("Error: ", err)
+		config.logger.withOp("delete").withError(err).errorf("Error deleting the local files not in S3")
 	}
+	// The keys of the listing are all the keys still in S3
+	config.keys.endListing(true)
 
 	stats.end = time.Now()
 	return stats
 }
 
-func deleteLocalFilesNotInS3(listObjectResponses []*s3.ListObjectsV2Output, config *mountConfiguration, debug bool) error {
+func deleteLocalFilesNotInS3(svc *s3.S3, listObjectResponses []*s3.ListObjectsV2Output, config *mountConfiguration) error {
 	destination := config.destination
-	prefix := config.prefix
 
-	findInS3 := func(path string) *s3.Object {
-		for _, listObjectResponse := range listObjectResponses {
-			for _, item := range listObjectResponse.Contents {
-				// Strip the base s3 prefix
-				destFilename := strings.TrimPrefix(*item.Key, prefix)
-				destFilePath := filepath.Join(destination, destFilename)
-				if path == destFilePath {
-					return item
-				}
+	// Map of local path vs the object in S3, the objects with keys that can not be mapped to local paths are ignored
+	objectsInS3 := make(map[string]*s3.Object)
+	for _, listObjectResponse := range listObjectResponses {
+		for _, item := range listObjectResponse.Contents {
+			if destFilePath, err := config.localPathForKey(*item.Key); err == nil {
+				objectsInS3[destFilePath] = item
 			}
 		}
-		return nil
+	}
+	findInS3 := func(path string) *s3.Object {
+		return objectsInS3[filepath.Clean(path)]
 	}
 
 	walkerFn := func(path string, info os.FileInfo, err error) error {
 		// Don't do anything if there was any error during walking the file tree
 		if err != nil {
-			log.Printf("\nError walking the file tree: \"%s\". Error: %v\n", path, err)
+			config.logger.withPath(path).withError(err).warnf("Error walking the file tree")
 			return nil
 		}
 		if info.Mode().IsDir() {
+			if info.Name() == synchronizerDirName || config.filter.excludesFile(path, info) {
+				// Skip the files managed by the synchronizer and the excluded directories
+				return filepath.SkipDir
+			}
 			// Ignore directories
 			return nil
 		}
+		if isDownloadTempFile(path) || config.filter.excludesFile(path, info) {
+			// Ignore the temp files of downloads and the excluded files, they are not synchronized
+			return nil
+		}
 
 		fileInS3 := findInS3(path)
 		if fileInS3 == nil {
@@ -194,15 +360,32 @@ func deleteLocalFilesNotInS3(listObjectResponses []*s3.ListObjectsV2Output, conf
 			//			-- DO NOT delete the file from local file system in this case
 			//		2.2 The file mount is NOT "writeable"
 			//			-- Delete the file from local file system in this case
+			if path == filepath.Join(destination, syncIgnoreFileName) && !synchronizerState.IsFileDownloadedFromS3(path, config) {
+				// The ignore file created locally configures the mount, keep it even on read-only mounts
+				return nil
+			}
 			if !config.writeable || synchronizerState.IsFileDownloadedFromS3(path, config) {
-				if debug {
-					log.Printf("\n\nFile '%s' removed from S3 so deleting it from local file system\n\n", path)
+				if config.writeable && config.isUploadPending(path) {
+					// The local changes of the file are uploaded instead
+					config.logger.withOp("delete").withPath(path).debugf("File removed from S3 but its upload is pending, keeping it")
+					return nil
+				}
+				if config.writeable && config.conflictPolicy != conflictPolicyRemoteWins && !isFileUnchangedSinceSync(config, path) {
+					// Changed locally and deleted in S3, the local change wins and is uploaded by the upload watcher
+					config.logger.withOp("delete").withPath(path).debugf("File removed from S3 but changed locally, keeping it with %v", config.conflictPolicy)
+					return nil
 				}
+				if config.writeable && !isObjectDeletedFromS3(svc, config, path) {
+					// The file was uploaded after the objects were listed
+					return nil
+				}
+				deleteLogger := config.logger.withOp("delete").withPath(path)
+				deleteLogger.debugf("File removed from S3 so deleting it from local file system")
 				error := os.Remove(path)
 				if error == nil {
 					synchronizerState.RecordFileDeletionFromLocal(path, config)
 				} else {
-					log.Printf("\nError deleting file: \"%s\". Error: %v\n", path, error)
+					deleteLogger.withError(error).errorf("Error deleting file")
 				}
 			}
 		}
@@ -213,10 +396,22 @@ func deleteLocalFilesNotInS3(listObjectResponses []*s3.ListObjectsV2Output, conf
 	return err
 }
 
-func setupRecurringDownloads(wg *sync.WaitGroup, sess *session.Session, config *mountConfiguration, concurrency int, debug bool, downloadInterval int, stopRecurringDownloadsAfter int) {
+// Returns flag indicating if the object of the given local file is confirmed to be not in S3
+func isObjectDeletedFromS3(svc *s3.S3, config *mountConfiguration, path string) bool {
+	key, err := config.keys.keyForLocalPath(path)
+	if err != nil {
+		return false
+	}
+	_, err = svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(config.bucket), Key: aws.String(key)})
+	requestFailure, ok := err.(awserr.RequestFailure)
+	return ok && requestFailure.StatusCode() == http.StatusNotFound
+}
+
+func setupRecurringDownloads(wg *sync.WaitGroup, sess *session.Session, config *mountConfiguration, transfers *transferConfiguration, downloadInterval int, stopRecurringDownloadsAfter int) {
 	// Increment wait group counter everytime we spawn recurring downloads thread to make sure
 	// the caller (main) can wait
 	wg.Add(1)
+	config.activeRoutines.Add(1)
 
 	statsCh := make(chan *downloadStats, 50)
 
@@ -227,8 +422,11 @@ func setupRecurringDownloads(wg *sync.WaitGroup, sess *session.Session, config *
 	// This thread will push download stats to stats channel and the reporter thread will receive stats from the
 	// stats channel and report (print) the stats
 	go func() {
+		defer config.activeRoutines.Done()
+		defer close(statsCh)
+
 		for continueRecurringDownloads {
-			stats := syncS3ToLocal(sess, config, concurrency, debug)
+			stats := syncS3ToLocal(sess, config, transfers)
 
 			statsCh <- stats // Push download stats to the stats channel. The reporter will read from statsCh and report it
 
@@ -247,46 +445,92 @@ func setupRecurringDownloads(wg *sync.WaitGroup, sess *session.Session, config *
 					wg.Done()
 				}
 			}
-			// Sleep for the download interval duration
-			time.Sleep(time.Duration(downloadInterval) * time.Second)
+			// Sleep for the download interval duration or until the mount is removed
+			select {
+			case <-time.After(time.Duration(downloadInterval) * time.Second):
+			case <-config.stopCh:
+				config.logger.debugf("Stopping recurring downloads for removed mount %v", config.destination)
+				if continueRecurringDownloads {
+					continueRecurringDownloads = false
+					wg.Done()
+				}
+			}
 		}
 	}()
 
 	// Kick off reporter thread for recurring reporting of the download stats
 	go func() {
-		for continueRecurringDownloads {
-			stats := <-statsCh
-
-			reportDownloadStats(stats, debug)
+		for stats := range statsCh {
+			reportDownloadStats(config, stats)
 		}
 	}()
 }
 
+// Pool of workers downloading objects of a single mount concurrently
+type downloadWorkers struct {
+	objectsCh chan *s3.Object
+	workersWg sync.WaitGroup
+}
+
+// Starts transfers.objectConcurrency workers downloading the objects submitted to the returned pool.
+// The number of concurrent requests across all workers of all mounts is limited by the global transfer budget.
+func startDownloadWorkers(sess *session.Session, config *mountConfiguration, transfers *transferConfiguration, stats *downloadStats) *downloadWorkers {
+	workers := &downloadWorkers{objectsCh: make(chan *s3.Object, transfers.objectConcurrency)}
+	downloader := s3manager.NewDownloader(sess)
+	svc := s3.New(sess)
+
+	for i := 0; i < transfers.objectConcurrency; i++ {
+		workers.workersWg.Add(1)
+		go func() {
+			defer workers.workersWg.Done()
+			for item := range workers.objectsCh {
+				if config.isStopped() {
+					// Drain the remaining objects without downloading them
+					continue
+				}
+				downloadObject(downloader, svc, item, config, transfers, stats)
+			}
+		}()
+	}
+	return workers
+}
+
+func (workers *downloadWorkers) submit(item *s3.Object) {
+	workers.objectsCh <- item
+}
+
+// Waits until all submitted objects are downloaded. No more objects can be submitted after this.
+func (workers *downloadWorkers) wait() {
+	close(workers.objectsCh)
+	workers.workersWg.Wait()
+}
+
+// Submits the objects in the given listing that are not downloaded yet or have changed in S3 to the download workers
 func downloadAllObjects(
 	bucketObjectsList *s3.ListObjectsV2Output,
-	sess *session.Session,
 	config *mountConfiguration,
-	concurrency int,
+	collisions *keyCollisions,
+	workers *downloadWorkers,
 	stats *downloadStats,
-	debug bool,
-) *downloadStats {
-	bucket := config.bucket
-	destination := config.destination
-	prefix := config.prefix
-
+) {
 	for _, item := range bucketObjectsList.Contents {
-		// Strip the s3 prefix
-		destFilename := strings.TrimPrefix(*item.Key, prefix)
-		destFilePath := filepath.Join(destination, destFilename)
 		// Skip objects ending in / - we can't store these on the file system
 		if strings.HasSuffix(*item.Key, "/") {
 			continue
 		}
-
-		// Ensure the directory exists
-		destDirPath := filepath.Dir(destFilePath)
-		if _, err := os.Stat(destDirPath); os.IsNotExist(err) {
-			os.MkdirAll(destDirPath, os.ModePerm)
+		relativePath, err := config.keys.relativeLocalPath(*item.Key)
+		if err == nil {
+			err = collisions.claim(*item.Key, relativePath)
+		}
+		if err != nil {
+			config.logger.withKey(*item.Key).withError(err).warnf("Not synchronizing the object")
+			stats.recordRejectedKey(item.Key)
+			continue
+		}
+		destFilePath := filepath.Join(config.destination, filepath.FromSlash(relativePath))
+		if config.filter.excludesObject(item, destFilePath) {
+			config.logger.withKey(*item.Key).tracef("Excluded by the filter rules of the mount. Skip downloading")
+			continue
 		}
 
 		shouldDownload := true
@@ -296,49 +540,182 @@ func downloadAllObjects(
 		// The correct way to check if file exists is using !os.IsNotExist(fileError)
 		if _, fileError := os.Stat(destFilePath); !os.IsNotExist(fileError) {
 			// If the file has not changed in S3 since last download then skip downloading it
-			shouldDownload = synchronizerState.HasFileChangedInS3(item)
-			if !shouldDownload && debug {
-				log.Printf("'%v' already exists and is up-to-date. Skip downloading '%v'\n", destFilePath, *item.Key)
+			shouldDownload = synchronizerState.HasFileChangedInS3(config.stateNamespace(), item)
+			if !shouldDownload {
+				config.logger.withKey(*item.Key).tracef("'%v' already exists and is up-to-date. Skip downloading", destFilePath)
 			}
 		}
 		if !shouldDownload {
 			continue
 		}
+		if isQuarantined(config, item) {
+			config.logger.withKey(*item.Key).debugf("'%v' failed verification repeatedly and is quarantined. Skip downloading", destFilePath)
+			continue
+		}
+
+		workers.submit(item)
+	}
+}
+
+// Downloads the given object to the mount's destination directory and verifies the downloaded content against the
+// digests of the object in S3. Downloads that do not match are retried and quarantined if they keep failing.
+func downloadObject(
+	downloader *s3manager.Downloader,
+	svc *s3.S3,
+	item *s3.Object,
+	config *mountConfiguration,
+	transfers *transferConfiguration,
+	stats *downloadStats,
+) {
+	bucket := config.bucket
+	downloadLogger := config.logger.withKey(*item.Key).withOp("download")
+
+	// The keys are validated before they are submitted for download
+	destFilePath, err := config.localPathForKey(*item.Key)
+	if err != nil {
+		downloadLogger.withError(err).warnf("Not synchronizing the object")
+		stats.recordRejectedKey(item.Key)
+		return
+	}
 
-		if debug {
-			log.Printf("%v -> %v\n", *item.Key, destFilePath)
+	// Do not lose local changes to files of writeable mounts that also changed in S3
+	if config.writeable {
+		if fi, err := os.Stat(destFilePath); err == nil && fi.Mode().IsRegular() {
+			switch checkLocalFile(svc, config, destFilePath, fi, item) {
+			case localFileInSync:
+				downloadLogger.debugf("'%v' already has the content of the object. Skip downloading", destFilePath)
+				fingerprint := synchronizerState.GetLocalFingerprint(config.stateNamespace(), *item.Key)
+				if fingerprint == nil || !fingerprint.matches(fi) {
+					fingerprint = newFileFingerprint(fi)
+				}
+				synchronizerState.RecordFileDownloadToLocal(config.stateNamespace(), item, fingerprint)
+				return
+			case localFileInConflict:
+				if !resolveConflict(svc, config, item, destFilePath, stats) {
+					return
+				}
+			}
 		}
+	}
 
-		destFile, err := os.Create(destFilePath)
-		if err != nil {
-			if debug {
-				log.Println("Create file error: ", err.Error())
+	// Ensure the directory exists
+	destDirPath := filepath.Dir(destFilePath)
+	if _, err := os.Stat(destDirPath); os.IsNotExist(err) {
+		os.MkdirAll(destDirPath, os.ModePerm)
+	}
+
+	// Adapt the part size and number of concurrent parts to the size of the object and wait for these parts
+	// to be available in the global budget
+	partSize, partConcurrency := transfers.downloadPartSettings(aws.Int64Value(item.Size))
+	acquired := transfers.acquire(partConcurrency)
+	defer transfers.release(acquired)
+
+	downloadLogger.debugf("%v -> %v (part size: %v, concurrent parts: %v)", *item.Key, destFilePath, partSize, acquired)
+	start := time.Now()
+
+	// Get the digests to verify the download against. Pin the download to the listed version of the object so that
+	// the content matches the digests.
+	digests, err := headObjectDigests(svc, bucket, *item.Key, aws.StringValue(item.ETag))
+	if err != nil {
+		downloadLogger.withError(err).errorf("Error getting object digests")
+		stats.recordError(item.Key)
+		return
+	}
+
+	var numBytes int64
+	for attempt := 1; ; attempt++ {
+		verify := func(file *os.File, n int64) error {
+			err := digests.verify(io.NewSectionReader(file, 0, n))
+			if _, ok := err.(*integrityError); ok && attempt >= maxIntegrityAttempts {
+				// Keep the corrupt content aside for inspection
+				if qErr := quarantineFile(config, item, file.Name()); qErr != nil {
+					downloadLogger.withOp("quarantine").withError(qErr).errorf("Error quarantining the object")
+				}
 			}
-			stats.errorPrefixes = append(stats.errorPrefixes, item.Key)
-			continue
+			return err
 		}
 
-		downloader := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) {
-			d.PartSize = 100 * 1024 * 1024 // 100MB per part
-			d.Concurrency = concurrency
-		})
-		numBytes, err := downloader.Download(destFile,
-			&s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(*item.Key),
+		if partConcurrency > 1 {
+			// Large objects are downloaded in parts that are recorded as they complete so that the download can be
+			// resumed after an interruption
+			numBytes, err = downloadObjectResumable(svc, config, item, destFilePath, partSize, int(acquired), verify)
+		} else {
+			// Download to a temp file and move it into place once complete and verified so that the file is never seen
+			// partially downloaded and a failed or corrupt download does not leave a corrupt file behind
+			err = writeFileAtomically(destFilePath, func(destFile *os.File) error {
+				n, err := downloader.Download(destFile,
+					&s3.GetObjectInput{
+						Bucket:  aws.String(bucket),
+						Key:     aws.String(*item.Key),
+						IfMatch: item.ETag,
+					}, func(d *s3manager.Downloader) {
+						d.PartSize = partSize
+						d.Concurrency = int(acquired)
+					})
+				if err != nil {
+					return err
+				}
+				numBytes = n
+				return verify(destFile, n)
 			})
-		if err != nil {
-			if debug {
-				log.Println("Error downloading file: ", err.Error())
+		}
+		if _, ok := err.(*integrityError); ok {
+			stats.recordIntegrityFailure()
+			downloadLogger.withError(err).warnf("Download did not pass verification (attempt %d of %d)", attempt, maxIntegrityAttempts)
+			if attempt < maxIntegrityAttempts {
+				continue
 			}
-			stats.errorPrefixes = append(stats.errorPrefixes, item.Key)
-			continue
+			stats.recordQuarantine(item.Key)
 		}
+		break
+	}
+	if err != nil {
+		downloadLogger.withError(err).errorf("Error downloading file")
+		stats.recordError(item.Key)
+		return
+	}
 
-		stats.numberOfRetrievedFiles++
-		stats.totalRetrievedBytes = stats.totalRetrievedBytes + numBytes
+	stats.recordDownload(numBytes)
+	downloadLogger.withBytes(numBytes).withDuration(time.Since(start)).debugf("Downloaded to '%v'", destFilePath)
 
-		synchronizerState.RecordFileDownloadToLocal(item)
+	// Remember the downloaded file to tell local changes from changes in S3. The fingerprint is the one of the file
+	// that was moved into place, a local change made since then is not mistaken for the download.
+	fingerprint := synchronizerState.GetLocalWrite(destFilePath)
+	if fingerprint != nil && digests.etagIsDigest && digestPartCount(digests.etag) == 0 {
+		// The content was verified against the ETag, i.e., its MD5
+		fingerprint.MD5 = digests.etag
 	}
-	return stats
+	synchronizerState.RecordFileDownloadToLocal(config.stateNamespace(), item, fingerprint)
+	synchronizerState.RemoveLocalWrite(destFilePath)
+}
+
+// Downloads the given object resuming the previous download of the same version of the object, if any, verifies the
+// complete content and moves it into place. A download that fails is kept to be resumed by the next attempt, a download
+// that does not pass verification starts over.
+func downloadObjectResumable(
+	svc *s3.S3,
+	config *mountConfiguration,
+	item *s3.Object,
+	destFilePath string,
+	partSize int64,
+	concurrency int,
+	verify func(file *os.File, n int64) error,
+) (int64, error) {
+	tempFile, err := downloadResumable(svc, config, item, destFilePath, partSize, concurrency)
+	if err != nil {
+		return 0, err
+	}
+	// The download is complete, whether it is moved into place or not it is not resumed from here on
+	defer discardPartialDownload(synchronizerState.GetPartialDownload(config.stateNamespace(), *item.Key))
+
+	numBytes := aws.Int64Value(item.Size)
+	if err := verify(tempFile, numBytes); err != nil {
+		tempFile.Close()
+		return 0, err
+	}
+	if err := commitDownloadTempFile(tempFile, destFilePath); err != nil {
+		tempFile.Close()
+		return 0, err
+	}
+	return numBytes, nil
 }
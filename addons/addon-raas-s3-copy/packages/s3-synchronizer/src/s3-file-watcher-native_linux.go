@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The events watched in each directory
+const inotifyWatchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// The time to wait for the IN_MOVED_TO half of a rename before reporting the IN_MOVED_FROM half as moved away. Both
+// halves are queued together by the kernel, they are only split if they do not fit in the same read. The wait is a
+// deadline of the read so that the events are always sent in the order they were read.
+const inotifyMoveTimeout = 100 * time.Millisecond
+
+// File watcher backend using inotify directly. Unlike fsnotify it reports when a writer is done with a file
+// (IN_CLOSE_WRITE) and pairs the two halves of a rename (IN_MOVED_FROM and IN_MOVED_TO) by their cookie into a
+// single move event.
+type inotifyFileWatcherBackend struct {
+	fd int
+	// The file of the descriptor is only used to read the events, Fd() must not be called as it makes reads blocking
+	file   *os.File
+	events chan fileWatcherEvent
+	errors chan error
+	done   chan struct{}
+
+	lock sync.Mutex
+	// Map of watch descriptor vs path of the watched directory, and back
+	paths map[int32]string
+	wds   map[string]int32
+	// The IN_MOVED_FROM half of a rename waiting for its IN_MOVED_TO half
+	pendingMove *inotifyPendingMove
+	closed      bool
+}
+
+type inotifyPendingMove struct {
+	cookie   uint32
+	name     string
+	deadline time.Time
+}
+
+func newNativeFileWatcherBackend() (fileWatcherBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	backend := &inotifyFileWatcherBackend{
+		fd: fd,
+		// The file of a non-blocking descriptor uses the runtime poller, closing it unblocks the pending read
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan fileWatcherEvent),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+		paths:  make(map[int32]string),
+		wds:    make(map[string]int32),
+	}
+	go backend.readEvents()
+	return backend, nil
+}
+
+func (backend *inotifyFileWatcherBackend) Add(dirPath string) error {
+	dirPath = filepath.Clean(dirPath)
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	if backend.closed {
+		return errors.New("inotify watcher is closed")
+	}
+	wd, err := syscall.InotifyAddWatch(backend.fd, dirPath, inotifyWatchMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	// Watching the same directory again returns the same descriptor
+	if previous, ok := backend.paths[int32(wd)]; ok {
+		delete(backend.wds, previous)
+	}
+	backend.paths[int32(wd)] = dirPath
+	backend.wds[dirPath] = int32(wd)
+	return nil
+}
+
+func (backend *inotifyFileWatcherBackend) Remove(dirPath string) error {
+	dirPath = filepath.Clean(dirPath)
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	wd, ok := backend.wds[dirPath]
+	if !ok || backend.closed {
+		return fmt.Errorf("can't remove non-existent inotify watch for: %s", dirPath)
+	}
+	delete(backend.wds, dirPath)
+	delete(backend.paths, wd)
+	if _, err := syscall.InotifyRmWatch(backend.fd, uint32(wd)); err != nil {
+		return os.NewSyscallError("inotify_rm_watch", err)
+	}
+	return nil
+}
+
+func (backend *inotifyFileWatcherBackend) Events() <-chan fileWatcherEvent {
+	return backend.events
+}
+
+func (backend *inotifyFileWatcherBackend) Errors() <-chan error {
+	return backend.errors
+}
+
+func (backend *inotifyFileWatcherBackend) Close() error {
+	backend.lock.Lock()
+	if backend.closed {
+		backend.lock.Unlock()
+		return nil
+	}
+	backend.closed = true
+	backend.pendingMove = nil
+	backend.lock.Unlock()
+
+	close(backend.done)
+	return backend.file.Close()
+}
+
+func (backend *inotifyFileWatcherBackend) readEvents() {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		if !backend.setReadDeadline() {
+			// Without a deadline the read could hold back the pending move until the next event, report it now
+			if !backend.sendPendingMove() {
+				return
+			}
+		}
+		n, err := backend.file.Read(buf[:])
+		if os.IsTimeout(err) {
+			// The IN_MOVED_TO half of the pending move did not come
+			if !backend.sendPendingMove() {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			select {
+			case <-backend.done:
+				// Closed
+			default:
+				backend.sendError(err)
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+			if !backend.processEvent(raw.Wd, raw.Mask, raw.Cookie, name) {
+				return
+			}
+		}
+	}
+}
+
+// Sets the deadline of the next read to the deadline of the pending move, if any. Returns false if the deadline can
+// not be set.
+func (backend *inotifyFileWatcherBackend) setReadDeadline() bool {
+	backend.lock.Lock()
+	var deadline time.Time
+	if backend.pendingMove != nil {
+		deadline = backend.pendingMove.deadline
+	}
+	backend.lock.Unlock()
+	return backend.file.SetReadDeadline(deadline) == nil || deadline.IsZero()
+}
+
+// Sends the rename event of the pending move if there is one, returns false if the backend is closed
+func (backend *inotifyFileWatcherBackend) sendPendingMove() bool {
+	backend.lock.Lock()
+	if backend.pendingMove == nil {
+		backend.lock.Unlock()
+		return true
+	}
+	event := backend.takePendingMove()
+	backend.lock.Unlock()
+	return backend.sendEvent(event)
+}
+
+// Translates a single inotify event, returns false if the backend is closed
+func (backend *inotifyFileWatcherBackend) processEvent(wd int32, mask uint32, cookie uint32, name string) bool {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// The events that did not fit in the queue are lost, the consumer has to scan the watched directories again
+		if !backend.sendPendingMove() {
+			return false
+		}
+		return backend.sendEvent(fileWatcherEvent{Op: fileWatcherOverflow})
+	}
+
+	backend.lock.Lock()
+	dirPath, ok := backend.paths[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		// The watch was removed or the watched directory was deleted
+		if ok {
+			delete(backend.paths, wd)
+			if backend.wds[dirPath] == wd {
+				delete(backend.wds, dirPath)
+			}
+		}
+		backend.lock.Unlock()
+		return true
+	}
+	if !ok || name == "" {
+		// Events of the watched directory itself are reported by the watch of its parent
+		backend.lock.Unlock()
+		return true
+	}
+	path := filepath.Join(dirPath, name)
+
+	var events []fileWatcherEvent
+	if backend.pendingMove != nil && (mask&syscall.IN_MOVED_TO == 0 || backend.pendingMove.cookie != cookie) {
+		// The other half of the rename did not come next, the entry was moved out of the watched directories
+		events = append(events, backend.takePendingMove())
+	}
+	switch {
+	case mask&syscall.IN_MOVED_FROM != 0:
+		backend.pendingMove = &inotifyPendingMove{cookie: cookie, name: path, deadline: time.Now().Add(inotifyMoveTimeout)}
+	case mask&syscall.IN_MOVED_TO != 0:
+		if backend.pendingMove != nil {
+			oldName := backend.pendingMove.name
+			backend.pendingMove = nil
+			if mask&syscall.IN_ISDIR != 0 {
+				// The watches of the moved directory and its subdirectories moved with it
+				backend.renameWatches(oldName, path)
+			}
+			events = append(events, fileWatcherEvent{Name: path, OldName: oldName, Op: fileWatcherMove})
+		} else {
+			// Moved in from a directory that is not watched
+			events = append(events, fileWatcherEvent{Name: path, Op: fileWatcherCreate})
+		}
+	case mask&syscall.IN_CREATE != 0:
+		events = append(events, fileWatcherEvent{Name: path, Op: fileWatcherCreate})
+	case mask&syscall.IN_CLOSE_WRITE != 0:
+		events = append(events, fileWatcherEvent{Name: path, Op: fileWatcherCloseWrite})
+	case mask&syscall.IN_MODIFY != 0:
+		events = append(events, fileWatcherEvent{Name: path, Op: fileWatcherWrite})
+	case mask&syscall.IN_DELETE != 0:
+		events = append(events, fileWatcherEvent{Name: path, Op: fileWatcherRemove})
+	}
+	backend.lock.Unlock()
+
+	for _, event := range events {
+		if !backend.sendEvent(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the rename event of the pending IN_MOVED_FROM half of a rename and clears it, must be called with the lock held
+func (backend *inotifyFileWatcherBackend) takePendingMove() fileWatcherEvent {
+	move := backend.pendingMove
+	backend.pendingMove = nil
+	return fileWatcherEvent{Name: move.name, Op: fileWatcherRename}
+}
+
+// Updates the paths of the watches of the given directory and its subdirectories, must be called with the lock held
+func (backend *inotifyFileWatcherBackend) renameWatches(oldDirPath string, newDirPath string) {
+	for wd, path := range backend.paths {
+		var renamed string
+		if path == oldDirPath {
+			renamed = newDirPath
+		} else if strings.HasPrefix(path, oldDirPath+string(os.PathSeparator)) {
+			renamed = newDirPath + path[len(oldDirPath):]
+		} else {
+			continue
+		}
+		delete(backend.wds, path)
+		backend.paths[wd] = renamed
+		backend.wds[renamed] = wd
+	}
+}
+
+func (backend *inotifyFileWatcherBackend) sendEvent(event fileWatcherEvent) bool {
+	select {
+	case backend.events <- event:
+		return true
+	case <-backend.done:
+		return false
+	}
+}
+
+func (backend *inotifyFileWatcherBackend) sendError(err error) bool {
+	select {
+	case backend.errors <- err:
+		return true
+	case <-backend.done:
+		return false
+	}
+}
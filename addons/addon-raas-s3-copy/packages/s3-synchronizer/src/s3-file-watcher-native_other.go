@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// Only Linux has a native file watcher backend, fsnotify is used on the other platforms
+func newNativeFileWatcherBackend() (fileWatcherBackend, error) {
+	return nil, errors.New("no native file watcher on this platform")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The kind of change reported by a file watcher backend
+type fileWatcherOp uint32
+
+const (
+	// A file or directory was created (or moved in from a directory that is not watched)
+	fileWatcherCreate fileWatcherOp = 1 << iota
+	// A file was modified, it may still be being written
+	fileWatcherWrite
+	// A file opened for writing was closed, i.e., the writer is done with it
+	fileWatcherCloseWrite
+	// A file or directory was deleted
+	fileWatcherRemove
+	// A file or directory was moved away, the new name is not known (e.g., it was moved out of the watched directories)
+	fileWatcherRename
+	// A file or directory was moved from OldName to Name within the watched directories
+	fileWatcherMove
+	// Changes were lost because the event queue overflowed, the watched directories must be scanned again
+	fileWatcherOverflow
+)
+
+// A change of an entry of a watched directory
+type fileWatcherEvent struct {
+	Name string
+	// The previous name of the entry for move events
+	OldName string
+	Op      fileWatcherOp
+}
+
+func (event fileWatcherEvent) String() string {
+	names := map[fileWatcherOp]string{
+		fileWatcherCreate:     "CREATE",
+		fileWatcherWrite:      "WRITE",
+		fileWatcherCloseWrite: "CLOSE_WRITE",
+		fileWatcherRemove:     "REMOVE",
+		fileWatcherRename:     "RENAME",
+		fileWatcherMove:       "MOVE",
+		fileWatcherOverflow:   "OVERFLOW",
+	}
+	if event.Op == fileWatcherMove {
+		return `"` + event.OldName + `" -> "` + event.Name + `": ` + names[event.Op]
+	}
+	return `"` + event.Name + `": ` + names[event.Op]
+}
+
+// A mechanism to watch directories for changes of their entries. The directories are watched individually, i.e.,
+// not recursively.
+type fileWatcherBackend interface {
+	Add(dirPath string) error
+	Remove(dirPath string) error
+	Events() <-chan fileWatcherEvent
+	Errors() <-chan error
+	Close() error
+}
+
+// Returns the native file watcher backend of the platform if there is one, otherwise the portable fsnotify backend
+func newFileWatcherBackend() (fileWatcherBackend, error) {
+	backend, err := newNativeFileWatcherBackend()
+	if err == nil {
+		return backend, nil
+	}
+	logger.withError(err).debugf("Native file watcher is not available, falling back to fsnotify")
+	return newFsnotifyFileWatcherBackend()
+}
+
+// ------------------------------- fsnotify -------------------------------/
+
+// Portable file watcher backend. It does not tell when a writer is done with a file and reports renames as a rename of
+// the old name followed by a create of the new name.
+type fsnotifyFileWatcherBackend struct {
+	watcher   *fsnotify.Watcher
+	events    chan fileWatcherEvent
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+	// Closed once the errors are no longer translated, i.e., no more events are sent by translateErrors
+	errorsDone chan struct{}
+}
+
+func newFsnotifyFileWatcherBackend() (fileWatcherBackend, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	backend := &fsnotifyFileWatcherBackend{watcher: watcher, events: make(chan fileWatcherEvent), errors: make(chan error), done: make(chan struct{}), errorsDone: make(chan struct{})}
+	go backend.translateEvents()
+	go backend.translateErrors()
+	return backend, nil
+}
+
+func (backend *fsnotifyFileWatcherBackend) translateEvents() {
+	defer func() {
+		<-backend.errorsDone
+		close(backend.events)
+	}()
+	for event := range backend.watcher.Events {
+		var op fileWatcherOp
+		switch {
+		case event.Op&fsnotify.Remove == fsnotify.Remove:
+			op = fileWatcherRemove
+		case event.Op&fsnotify.Rename == fsnotify.Rename:
+			op = fileWatcherRename
+		case event.Op&fsnotify.Create == fsnotify.Create:
+			op = fileWatcherCreate
+		case event.Op&fsnotify.Write == fsnotify.Write:
+			op = fileWatcherWrite
+		default:
+			// Permission changes are not synchronized
+			continue
+		}
+		select {
+		case backend.events <- fileWatcherEvent{Name: event.Name, Op: op}:
+		case <-backend.done:
+			return
+		}
+	}
+}
+
+// Reports the overflow of the event queue as an event so that the consumer scans the watched directories again
+func (backend *fsnotifyFileWatcherBackend) translateErrors() {
+	defer close(backend.errorsDone)
+	defer close(backend.errors)
+	for err := range backend.watcher.Errors {
+		if err == fsnotify.ErrEventOverflow {
+			select {
+			case backend.events <- fileWatcherEvent{Op: fileWatcherOverflow}:
+			case <-backend.done:
+				return
+			}
+			continue
+		}
+		select {
+		case backend.errors <- err:
+		case <-backend.done:
+			return
+		}
+	}
+}
+
+func (backend *fsnotifyFileWatcherBackend) Add(dirPath string) error {
+	return backend.watcher.Add(dirPath)
+}
+
+func (backend *fsnotifyFileWatcherBackend) Remove(dirPath string) error {
+	return backend.watcher.Remove(dirPath)
+}
+
+func (backend *fsnotifyFileWatcherBackend) Events() <-chan fileWatcherEvent {
+	return backend.events
+}
+
+func (backend *fsnotifyFileWatcherBackend) Errors() <-chan error {
+	return backend.errors
+}
+
+func (backend *fsnotifyFileWatcherBackend) Close() error {
+	backend.closeOnce.Do(func() {
+		close(backend.done)
+	})
+	return backend.watcher.Close()
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Name of the file at the root of a mount with additional exclude patterns, using the .gitignore syntax
+const syncIgnoreFileName = ".s3syncignore"
+
+// Patterns of files that are never synchronized (editor swap files, temp files and the Windows recycle bin)
+var defaultExcludePatterns = []string{"*.swp", "*.tmp", "$RECYCLE.BIN/"}
+
+// Named sets of exclude patterns that mounts can opt into with "excludePresets"
+var excludePresets = map[string][]string{
+	// Jupyter checkpoints, Python bytecode caches and virtual environments
+	"notebooks": {".ipynb_checkpoints/", "__pycache__/", ".venv/"},
+}
+
+// The filter rules of a mount as specified in its definition
+type mountFilterSettings struct {
+	// Patterns of the files to synchronize, all files are synchronized if empty
+	include []string
+	// Patterns of the files not to synchronize, in addition to the default patterns and the presets
+	exclude []string
+	// Names of the exclude presets to apply (see excludePresets)
+	excludePresets []string
+	// Files larger than this are not synchronized, no limit if zero
+	maxFileSize int64
+	// Files last modified longer ago than this are not synchronized, no limit if zero
+	maxAge time.Duration
+}
+
+func (settings mountFilterSettings) equal(other mountFilterSettings) bool {
+	return equalStrings(settings.include, other.include) &&
+		equalStrings(settings.exclude, other.exclude) &&
+		equalStrings(settings.excludePresets, other.excludePresets) &&
+		settings.maxFileSize == other.maxFileSize &&
+		settings.maxAge == other.maxAge
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// A single pattern using the .gitignore syntax
+type filterPattern struct {
+	// Pattern re-including paths excluded by a previous pattern, i.e., starting with "!"
+	negate bool
+	// Pattern matching directories only, i.e., ending with "/"
+	dirOnly bool
+	regex   *regexp.Regexp
+}
+
+// Parses the given pattern, returns nil for blank lines and comments
+func parseFilterPattern(line string) (*filterPattern, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimSuffix(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	original := line
+	pattern := &filterPattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if line == "" {
+		return nil, fmt.Errorf("pattern %q does not match any path", original)
+	}
+
+	// A pattern with a slash is relative to the root of the mount, otherwise it matches at any level
+	var expr string
+	if strings.Contains(line, "/") {
+		expr = "^" + globToRegexp(strings.TrimPrefix(line, "/")) + "$"
+	} else {
+		expr = "^(?:.*/)?" + globToRegexp(line) + "$"
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("pattern %q is not valid: %v", original, err)
+	}
+	pattern.regex = regex
+	return pattern, nil
+}
+
+// Translates the given glob to a regular expression. "*" and "?" do not match "/", "**" matches across directories.
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return expr.String()
+}
+
+// Parses the given patterns, skipping blank lines and comments
+func parseFilterPatterns(lines []string) ([]*filterPattern, error) {
+	patterns := make([]*filterPattern, 0, len(lines))
+	for _, line := range lines {
+		pattern, err := parseFilterPattern(line)
+		if err != nil {
+			return nil, err
+		}
+		if pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// Returns flag indicating if any of the given patterns matches the given path and, if so, if the last matching
+// pattern is a negated pattern
+func matchPatterns(patterns []*filterPattern, relPath string, isDir bool) (matched bool, negated bool) {
+	for _, pattern := range patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regex.MatchString(relPath) {
+			matched = true
+			negated = pattern.negate
+		}
+	}
+	return matched, negated
+}
+
+// Returns the parent directories of the given relative path, outermost first
+func parentDirs(relPath string) []string {
+	dirs := make([]string, 0)
+	for i := 0; i < len(relPath); i++ {
+		if relPath[i] == '/' {
+			dirs = append(dirs, relPath[:i])
+		}
+	}
+	return dirs
+}
+
+// Decides which files of a mount are synchronized. The same filter applies to the objects listed in S3, the files
+// downloaded, the local files deleted because they were deleted from S3 and the local files uploaded to S3.
+type mountFilter struct {
+	// The destination directory of the mount
+	root     string
+	settings mountFilterSettings
+	include  []*filterPattern
+	// The default patterns, the presets and the patterns of the mount
+	exclude []*filterPattern
+
+	// The patterns in the ignore file at the root of the mount, reloaded when the file changes
+	lock           sync.RWMutex
+	ignoreFileInfo os.FileInfo
+	ignorePatterns []*filterPattern
+}
+
+// Creates the filter of the mount with the given destination. The settings are expected to be validated
+// (see validateMountFilter).
+func newMountFilter(root string, settings mountFilterSettings) *mountFilter {
+	excludeLines := append([]string{}, defaultExcludePatterns...)
+	for _, preset := range settings.excludePresets {
+		excludeLines = append(excludeLines, excludePresets[preset]...)
+	}
+	excludeLines = append(excludeLines, settings.exclude...)
+
+	filter := &mountFilter{root: root, settings: settings}
+	var err error
+	if filter.include, err = parseFilterPatterns(settings.include); err != nil {
+		logger.withPath(root).withError(err).warnf("Ignoring invalid include patterns")
+	}
+	if filter.exclude, err = parseFilterPatterns(excludeLines); err != nil {
+		logger.withPath(root).withError(err).warnf("Ignoring invalid exclude patterns")
+		filter.exclude, _ = parseFilterPatterns(defaultExcludePatterns)
+	}
+	filter.refresh()
+	return filter
+}
+
+// Reloads the patterns of the ignore file at the root of the mount if the file changed since it was last loaded
+func (filter *mountFilter) refresh() {
+	ignoreFilePath := filepath.Join(filter.root, syncIgnoreFileName)
+	fi, err := os.Stat(ignoreFilePath)
+	if err != nil {
+		fi = nil
+	}
+
+	filter.lock.RLock()
+	previous := filter.ignoreFileInfo
+	filter.lock.RUnlock()
+	if fi == nil && previous == nil {
+		return
+	}
+	if fi != nil && previous != nil && fi.Size() == previous.Size() && fi.ModTime().Equal(previous.ModTime()) {
+		return
+	}
+
+	var patterns []*filterPattern
+	if fi != nil {
+		patterns, err = readIgnoreFile(ignoreFilePath)
+		if err != nil {
+			logger.withPath(ignoreFilePath).withError(err).warnf("Error reading the ignore file, ignoring it")
+		}
+	}
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+	filter.ignoreFileInfo = fi
+	filter.ignorePatterns = patterns
+}
+
+func readIgnoreFile(ignoreFilePath string) ([]*filterPattern, error) {
+	file, err := os.Open(ignoreFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseFilterPatterns(lines)
+}
+
+// Returns true if the file or directory at the given path, relative to the root of the mount, must not be synchronized.
+// A path is excluded if the last pattern matching it (or any of its parent directories) is not negated. Files not
+// matching the include patterns (if any) are excluded as well.
+func (filter *mountFilter) excludesPath(relPath string, isDir bool) bool {
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	if relPath == "" || relPath == "." {
+		return false
+	}
+
+	filter.lock.RLock()
+	patterns := append(append([]*filterPattern{}, filter.exclude...), filter.ignorePatterns...)
+	filter.lock.RUnlock()
+
+	// Like .gitignore, files in an excluded directory can not be re-included
+	for _, dir := range parentDirs(relPath) {
+		if matched, negated := matchPatterns(patterns, dir, true); matched && !negated {
+			return true
+		}
+	}
+	if matched, negated := matchPatterns(patterns, relPath, isDir); matched && !negated {
+		return true
+	}
+
+	if isDir || len(filter.include) == 0 {
+		return false
+	}
+	included := false
+	for _, path := range append(parentDirs(relPath), relPath) {
+		if matched, negated := matchPatterns(filter.include, path, path != relPath); matched {
+			included = !negated
+		}
+	}
+	return !included
+}
+
+// Returns true if a file of the given size last modified at the given time must not be synchronized
+func (filter *mountFilter) excludesSize(size int64, lastModified time.Time) bool {
+	if filter.settings.maxFileSize > 0 && size > filter.settings.maxFileSize {
+		return true
+	}
+	if filter.settings.maxAge > 0 && !lastModified.IsZero() && time.Since(lastModified) > filter.settings.maxAge {
+		return true
+	}
+	return false
+}
+
+// Returns true if the given object, with the given local path, must not be synchronized
+func (filter *mountFilter) excludesObject(item *s3.Object, path string) bool {
+	return filter.excludesLocalPath(path, false) ||
+		filter.excludesSize(aws.Int64Value(item.Size), aws.TimeValue(item.LastModified))
+}
+
+// Returns true if the given local file or directory must not be synchronized
+func (filter *mountFilter) excludesFile(path string, fi os.FileInfo) bool {
+	if fi.IsDir() {
+		return filter.excludesLocalPath(path, true)
+	}
+	return filter.excludesLocalPath(path, false) || filter.excludesSize(fi.Size(), fi.ModTime())
+}
+
+// Returns true if the given local path must not be synchronized based on its name only (e.g., for removed files)
+func (filter *mountFilter) excludesLocalPath(path string, isDir bool) bool {
+	relPath, err := filepath.Rel(filter.root, path)
+	if err != nil {
+		return false
+	}
+	return filter.excludesPath(relPath, isDir)
+}
+
+// Returns the problems found in the filter rules of a mount
+func validateMountFilter(mount *s3Mount) []string {
+	problems := make([]string, 0)
+	for _, pattern := range mount.Include {
+		if _, err := parseFilterPattern(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf(`"include" %v`, err))
+		}
+	}
+	for _, pattern := range mount.Exclude {
+		if _, err := parseFilterPattern(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf(`"exclude" %v`, err))
+		}
+	}
+	for _, preset := range mount.ExcludePresets {
+		if _, ok := excludePresets[preset]; !ok {
+			problems = append(problems, fmt.Sprintf(`"excludePresets" %q is not a known preset`, preset))
+		}
+	}
+	if mount.MaxFileSize != nil && *mount.MaxFileSize < 0 {
+		problems = append(problems, fmt.Sprintf(`"maxFileSize" %d must not be negative`, *mount.MaxFileSize))
+	}
+	if mount.MaxAge != nil {
+		if maxAge, err := time.ParseDuration(*mount.MaxAge); err != nil || maxAge < 0 {
+			problems = append(problems, fmt.Sprintf(`"maxAge" %q must be a non-negative duration, e.g., "720h"`, *mount.MaxAge))
+		}
+	}
+	return problems
+}
+
+// Returns the filter settings of the given mount, the mount is expected to be validated
+func mountFilterSettingsOf(mount *s3Mount) mountFilterSettings {
+	settings := mountFilterSettings{
+		include:        mount.Include,
+		exclude:        mount.Exclude,
+		excludePresets: mount.ExcludePresets,
+	}
+	if mount.MaxFileSize != nil {
+		settings.maxFileSize = *mount.MaxFileSize
+	}
+	if mount.MaxAge != nil {
+		settings.maxAge, _ = time.ParseDuration(*mount.MaxAge)
+	}
+	return settings
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// The number of times an object is downloaded (or uploaded) before giving up when its content does not match
+// the digests of the object in S3
+const maxIntegrityAttempts = 3
+
+// Part sizes commonly used by S3 clients (the SDKs, the AWS CLI and the console). These are tried when the part size
+// of a multipart object cannot be determined from S3.
+var commonPartSizes = []int64{
+	5 * 1024 * 1024,
+	8 * 1024 * 1024,
+	15 * 1024 * 1024,
+	16 * 1024 * 1024,
+	32 * 1024 * 1024,
+	64 * 1024 * 1024,
+	100 * 1024 * 1024,
+	128 * 1024 * 1024,
+	256 * 1024 * 1024,
+	512 * 1024 * 1024,
+	1024 * 1024 * 1024,
+}
+
+// The additional checksums S3 may store with an object, keyed by the algorithm name used in the
+// "x-amz-checksum-<algorithm>" headers. The checksums are base64 encoded.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// Returned when the content of a file does not match the digests of the object in S3
+type integrityError struct {
+	key     string
+	details []string
+}
+
+func (e *integrityError) Error() string {
+	return fmt.Sprintf("content of '%v' does not match S3: %s", e.key, strings.Join(e.details, "; "))
+}
+
+// The digests of an object in S3 the content of a file can be verified against
+type objectDigests struct {
+	key  string
+	size int64
+	// The ETag without quotes. It is the MD5 of the content for single part objects and the MD5 of the MD5s of
+	// the parts followed by "-<number of parts>" for multipart objects.
+	etag string
+	// The ETag is not derived from the content for objects encrypted with SSE-KMS or SSE-C
+	etagIsDigest bool
+	// The size of the parts of a multipart object, 0 if the object is not multipart or the part size is not known
+	partSize int64
+	// Additional checksums stored with the object, keyed by algorithm name. The values of multipart objects may be
+	// composite checksums (i.e., checksum of the checksums of the parts followed by "-<number of parts>")
+	checksums map[string]string
+}
+
+// Returns the number of parts encoded in a multipart ETag or composite checksum, 0 for whole object digests
+func digestPartCount(digest string) int {
+	i := strings.LastIndex(digest, "-")
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(digest[i+1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Returns true if the given part size is consistent with an object of the given size made of the given number of parts
+func isPartSizeConsistent(size int64, partSize int64, parts int) bool {
+	return partSize > 0 && int64(parts-1)*partSize < size && size <= int64(parts)*partSize
+}
+
+// Makes the request return the additional checksums of the object and captures the response headers, the checksums
+// are not part of the HeadObjectOutput of the SDK
+func withChecksumHeaders(headers *http.Header) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.HTTPResponse != nil {
+				*headers = r.HTTPResponse.Header
+			}
+		})
+	}
+}
+
+// Gets the digests of the given version (ETag) of the object from S3
+func headObjectDigests(svc *s3.S3, bucket string, key string, etag string) (*objectDigests, error) {
+	var headers http.Header
+	input := &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	resp, err := svc.HeadObjectWithContext(aws.BackgroundContext(), input, withChecksumHeaders(&headers))
+	if err != nil {
+		return nil, err
+	}
+
+	digests := &objectDigests{
+		key:          key,
+		size:         aws.Int64Value(resp.ContentLength),
+		etag:         strings.Trim(aws.StringValue(resp.ETag), `"`),
+		etagIsDigest: aws.StringValue(resp.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms && aws.StringValue(resp.SSECustomerAlgorithm) == "",
+		checksums:    make(map[string]string),
+	}
+	for algorithm := range checksumAlgorithms {
+		if value := headers.Get("X-Amz-Checksum-" + algorithm); value != "" {
+			digests.checksums[algorithm] = value
+		}
+	}
+
+	// The size of the first part is the part size of multipart objects
+	if parts := digestPartCount(digests.etag); parts > 1 {
+		partResp, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			IfMatch:    resp.ETag,
+			PartNumber: aws.Int64(1),
+		})
+		if err == nil && isPartSizeConsistent(digests.size, aws.Int64Value(partResp.ContentLength), parts) {
+			digests.partSize = aws.Int64Value(partResp.ContentLength)
+		}
+	}
+	return digests, nil
+}
+
+// Computes the digest of the whole content and, if partSize is set, the digest of the digests of each part of the
+// content while the content is written to it
+type partDigester struct {
+	newHash  func() hash.Hash
+	partSize int64
+
+	whole       hash.Hash
+	part        hash.Hash
+	partWritten int64
+	partDigests []byte
+	parts       int
+}
+
+func newPartDigester(newHash func() hash.Hash, partSize int64) *partDigester {
+	return &partDigester{newHash: newHash, partSize: partSize, whole: newHash(), part: newHash()}
+}
+
+func (d *partDigester) Write(p []byte) (int, error) {
+	n := len(p)
+	d.whole.Write(p)
+	if d.partSize <= 0 {
+		return n, nil
+	}
+	for len(p) > 0 {
+		chunk := d.partSize - d.partWritten
+		if int64(len(p)) < chunk {
+			chunk = int64(len(p))
+		}
+		d.part.Write(p[:chunk])
+		d.partWritten += chunk
+		p = p[chunk:]
+		if d.partWritten == d.partSize {
+			d.endPart()
+		}
+	}
+	return n, nil
+}
+
+func (d *partDigester) endPart() {
+	d.partDigests = append(d.partDigests, d.part.Sum(nil)...)
+	d.parts++
+	d.part = d.newHash()
+	d.partWritten = 0
+}
+
+// Returns the digest of the whole content
+func (d *partDigester) sum() []byte {
+	return d.whole.Sum(nil)
+}
+
+// Returns the digest of the digests of the parts and the number of parts
+func (d *partDigester) compositeSum() ([]byte, int) {
+	if d.partWritten > 0 || d.parts == 0 {
+		d.endPart()
+	}
+	composite := d.newHash()
+	composite.Write(d.partDigests)
+	return composite.Sum(nil), d.parts
+}
+
+// A single digest of the object to verify the content against
+type digestCheck struct {
+	name     string
+	expected string
+	// Digesters of the content, one for each candidate part size. The content matches if any of them matches.
+	digesters []*partDigester
+	// Formats the computed digest and number of parts (0 for whole content digests) like the expected digest
+	format func(digest []byte, parts int) string
+}
+
+func (c *digestCheck) matches() bool {
+	for _, d := range c.digesters {
+		var actual string
+		if d.partSize > 0 {
+			actual = c.format(d.compositeSum())
+		} else {
+			actual = c.format(d.sum(), 0)
+		}
+		if actual == c.expected {
+			return true
+		}
+	}
+	return false
+}
+
+func formatETag(digest []byte, parts int) string {
+	if parts > 0 {
+		return fmt.Sprintf("%s-%d", hex.EncodeToString(digest), parts)
+	}
+	return hex.EncodeToString(digest)
+}
+
+func formatChecksum(digest []byte, parts int) string {
+	if parts > 0 {
+		return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(digest), parts)
+	}
+	return base64.StdEncoding.EncodeToString(digest)
+}
+
+// Returns the part sizes to try for a digest of the object made of the given number of parts
+func (digests *objectDigests) candidatePartSizes(parts int) []int64 {
+	if parts == 0 {
+		// Single part uploads have whole content digests
+		return []int64{0}
+	}
+	if parts == 1 {
+		// Multipart upload with a single part
+		if digests.size == 0 {
+			return []int64{1}
+		}
+		return []int64{digests.size}
+	}
+	if digests.partSize > 0 {
+		return []int64{digests.partSize}
+	}
+	candidates := make([]int64, 0)
+	for _, partSize := range commonPartSizes {
+		if isPartSizeConsistent(digests.size, partSize, parts) {
+			candidates = append(candidates, partSize)
+		}
+	}
+	return candidates
+}
+
+// Returns the checks to verify the content against. Digests of multipart objects with unknown part size can not
+// be verified and are skipped.
+func (digests *objectDigests) checks() []*digestCheck {
+	checks := make([]*digestCheck, 0)
+	addCheck := func(name string, expected string, newHash func() hash.Hash, format func([]byte, int) string) {
+		parts := digestPartCount(expected)
+		check := &digestCheck{name: name, expected: expected, format: format}
+		for _, partSize := range digests.candidatePartSizes(parts) {
+			check.digesters = append(check.digesters, newPartDigester(newHash, partSize))
+		}
+		if len(check.digesters) > 0 {
+			checks = append(checks, check)
+		}
+	}
+
+	if digests.etagIsDigest && digests.etag != "" {
+		addCheck("ETag", digests.etag, md5.New, formatETag)
+	}
+	for algorithm, expected := range digests.checksums {
+		addCheck(strings.ToUpper(algorithm), expected, checksumAlgorithms[algorithm], formatChecksum)
+	}
+	return checks
+}
+
+// Verifies the given content against the digests of the object. The content is read once for all digests.
+// Returns an integrityError if any of the digests does not match.
+func (digests *objectDigests) verify(content io.Reader) error {
+	checks := digests.checks()
+	if len(checks) == 0 {
+		logger.withKey(digests.key).debugf("No digests to verify the object against, skipping verification")
+		return nil
+	}
+
+	writers := make([]io.Writer, 0)
+	for _, check := range checks {
+		for _, d := range check.digesters {
+			writers = append(writers, d)
+		}
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), content); err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, check := range checks {
+		if !check.matches() {
+			mismatches = append(mismatches, fmt.Sprintf("%v mismatch, expected %v", check.name, check.expected))
+		}
+	}
+	if len(mismatches) > 0 {
+		return &integrityError{key: digests.key, details: mismatches}
+	}
+	return nil
+}
+
+// Returns the path the corrupt content of the given version of the object is kept at for inspection
+func quarantinePath(config *mountConfiguration, item *s3.Object) string {
+	// Only objects with keys that map to local paths are downloaded (and quarantined)
+	relativePath, _ := config.keys.relativeLocalPath(*item.Key)
+	etag := strings.Trim(aws.StringValue(item.ETag), `"`)
+	return filepath.Join(config.destination, synchronizerDirName, "quarantine", relativePath+"."+etag)
+}
+
+// Returns true if the given version of the object failed verification repeatedly and was quarantined.
+// The object is downloaded again once it changes in S3 or the quarantined file is deleted.
+func isQuarantined(config *mountConfiguration, item *s3.Object) bool {
+	_, err := os.Stat(quarantinePath(config, item))
+	return err == nil
+}
+
+// Moves the file with the corrupt content of the given object to the quarantine directory of the mount
+func quarantineFile(config *mountConfiguration, item *s3.Object, filePath string) error {
+	path := quarantinePath(config, item)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(filePath, path)
+}
+
+// Returns the part size the uploader uses for a file of the given size, the part size is increased for large files
+// to stay within the maximum number of parts
+func uploadPartSize(size int64) int64 {
+	partSize := s3manager.DefaultUploadPartSize
+	if size/partSize >= int64(s3manager.MaxUploadParts) {
+		partSize = size/int64(s3manager.MaxUploadParts) + 1
+	}
+	return partSize
+}
+
+// Uploads the given file and verifies that the object in S3 matches the content of the file.
+// Each part is sent with its Content-MD5 (added by the SDK) and single part uploads are also sent with their SHA-256
+// checksum so that S3 rejects content corrupted in transit. The upload is retried if the uploaded object does
+// not match the file. Returns the fingerprint of the file with the content that was uploaded and the ETag of the object.
+func uploadAndVerify(uploader *s3manager.Uploader, svc *s3.S3, uploadInput *s3manager.UploadInput, file *os.File, uploadLogger *structuredLogger) (*fileFingerprint, string, error) {
+	key := aws.StringValue(uploadInput.Key)
+
+	for attempt := 1; ; attempt++ {
+		fi, err := file.Stat()
+		if err != nil {
+			return nil, "", err
+		}
+		size := fi.Size()
+		partSize := uploadPartSize(size)
+
+		// Compute the digests the uploaded object is expected to have
+		md5Digester := newPartDigester(md5.New, 0)
+		if size > partSize {
+			md5Digester = newPartDigester(md5.New, partSize)
+		}
+		sha256Digester := newPartDigester(sha256.New, 0)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, "", err
+		}
+		if _, err := io.Copy(io.MultiWriter(md5Digester, sha256Digester), file); err != nil {
+			return nil, "", err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, "", err
+		}
+		var expected *objectDigests
+		if size > partSize {
+			expected = &objectDigests{key: key, size: size, etag: formatETag(md5Digester.compositeSum()), partSize: partSize}
+		} else {
+			expected = &objectDigests{key: key, size: size, etag: formatETag(md5Digester.sum(), 0)}
+		}
+		sha256Checksum := formatChecksum(sha256Digester.sum(), 0)
+
+		_, err = uploader.Upload(uploadInput, func(u *s3manager.Uploader) {
+			u.PartSize = partSize
+			u.RequestOptions = append(u.RequestOptions, func(r *request.Request) {
+				if r.Operation.Name == "PutObject" {
+					r.HTTPRequest.Header.Set("X-Amz-Checksum-Sha256", sha256Checksum)
+				}
+			})
+		})
+		if err != nil {
+			return nil, "", err
+		}
+
+		uploaded, err := headObjectDigests(svc, aws.StringValue(uploadInput.Bucket), key, "")
+		if err != nil {
+			return nil, "", err
+		}
+		mismatches := make([]string, 0)
+		if uploaded.size != size {
+			mismatches = append(mismatches, fmt.Sprintf("size mismatch, expected %v but was %v", size, uploaded.size))
+		}
+		if uploaded.etagIsDigest && uploaded.etag != expected.etag {
+			mismatches = append(mismatches, fmt.Sprintf("ETag mismatch, expected %v but was %v", expected.etag, uploaded.etag))
+		}
+		if checksum, ok := uploaded.checksums["sha256"]; ok && size <= partSize && checksum != sha256Checksum {
+			mismatches = append(mismatches, fmt.Sprintf("SHA256 mismatch, expected %v but was %v", sha256Checksum, checksum))
+		}
+		if len(mismatches) == 0 {
+			// The fingerprint of the file when its content was read, the object has this content
+			fingerprint := &fileFingerprint{Size: size, ModTime: fi.ModTime(), MD5: hex.EncodeToString(md5Digester.sum())}
+			return fingerprint, `"` + uploaded.etag + `"`, nil
+		}
+
+		// The file may have changed while it was being uploaded, try again with the current content
+		integrityErr := &integrityError{key: key, details: mismatches}
+		if attempt >= maxIntegrityAttempts {
+			return nil, "", integrityErr
+		}
+		uploadLogger.withError(integrityErr).warnf("Uploaded object does not match the local file, retrying upload")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// S3 keys are arbitrary strings and anyone with write access to a bucket can create objects with keys that, naively joined
+// with the destination directory, point outside of the mount (e.g., "../../.bashrc") or at files managed by the synchronizer.
+// The keys are validated before they are mapped to local paths, the objects with keys that can not be safely mapped are
+// not synchronized and reported instead.
+//
+// The keys of a mount are the keys under the mount's prefix taken as a directory, i.e., the prefix "data" (or "data/")
+// covers "data/file" but not "data2/file". Each key maps to the local path of its remainder after the prefix. Path
+// components longer than the file system allows are escaped and the mapping remembers the escaped paths so that the
+// local files map back to their original keys.
+
+// Whether the local file names must follow the rules of Windows file systems
+var windowsFileNames = runtime.GOOS == "windows"
+
+// Whether the local file system ignores the case of file names by default
+var caseInsensitiveFileNames = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// Device names reserved on Windows, with or without an extension (e.g., "nul.txt")
+var windowsReservedNameRegex = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9¹²³]|lpt[0-9¹²³]|conin\$|conout\$)(\..*)?$`)
+
+// Characters not allowed in file names on Windows, in addition to the control characters
+const windowsReservedChars = `<>:"/\|?*`
+
+// The maximum length of a file name in bytes on common file systems (e.g., ext4, XFS, APFS, NTFS in UTF-16 code units)
+const maxFileNameBytes = 255
+
+// The maximum length of an S3 key in bytes
+const maxKeyBytes = 1024
+
+// Escaped names end with this separator followed by the first hex digits of the SHA-256 of the original name
+// and the extension of the original name, e.g., "some-very-long-name~0123456789abcdef.csv"
+const (
+	escapedNameSeparator = "~"
+	escapedNameHashChars = 16
+	maxEscapedNameExt    = 32
+)
+
+// Error describing why the key of an object can not be mapped to a local path
+type rejectedKeyError struct {
+	key    string
+	reason string
+}
+
+func (e *rejectedKeyError) Error() string {
+	return fmt.Sprintf("key %q can not be synchronized, it %s", e.key, e.reason)
+}
+
+// Returns the key prefix of the objects of a mount with the given prefix, i.e., the prefix with a trailing slash or empty
+// for the whole bucket
+func normalizeKeyPrefix(prefix string) string {
+	if prefix == "" || prefix == "/" {
+		return ""
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		return prefix + "/"
+	}
+	return prefix
+}
+
+// Returns the path of the local file for the object with the given key, relative to the destination of the mount with the
+// given prefix and using slashes as separators. Returns a rejectedKeyError if the key does not map to a file within the
+// destination, i.e., if it has "." or ".." segments, is an absolute path or contains NUL characters, or if it uses names
+// that are reserved on the local file system or by the synchronizer. The names reserved by the synchronizer are compared
+// ignoring case if caseInsensitive is set, so that no key can map to the files of the synchronizer.
+func keyToRelativePath(key string, prefix string, windows bool, caseInsensitive bool) (string, error) {
+	reject := func(format string, a ...interface{}) (string, error) {
+		return "", &rejectedKeyError{key: key, reason: fmt.Sprintf(format, a...)}
+	}
+
+	keyPrefix := normalizeKeyPrefix(prefix)
+	if !strings.HasPrefix(key, keyPrefix) {
+		return reject("is not under the prefix %q", keyPrefix)
+	}
+	relativePath := strings.TrimPrefix(key, keyPrefix)
+	if keyPrefix == "" {
+		// Keys of whole bucket mounts map to the same paths with or without a leading slash
+		relativePath = strings.TrimPrefix(relativePath, "/")
+	}
+
+	if relativePath == "" {
+		return reject("has no name after the prefix %q", keyPrefix)
+	}
+	if strings.ContainsRune(relativePath, 0) {
+		return reject("contains a NUL character")
+	}
+	if strings.HasPrefix(relativePath, "/") || windows && (strings.HasPrefix(relativePath, `\`) || len(relativePath) >= 2 && relativePath[1] == ':') {
+		return reject("is an absolute path")
+	}
+
+	for _, segment := range strings.Split(relativePath, "/") {
+		switch {
+		case segment == "":
+			return reject("has an empty path segment")
+		case segment == "." || segment == "..":
+			return reject("has a %q path segment", segment)
+		case isSynchronizerName(segment, caseInsensitive):
+			return reject("uses the name %q reserved by the synchronizer", segment)
+		}
+		if windows {
+			if reason := windowsFileNameProblem(segment); reason != "" {
+				return reject("has the name %q that %s", segment, reason)
+			}
+		}
+	}
+	return relativePath, nil
+}
+
+// Returns the reason the given file name is not valid on Windows, empty if it is valid
+func windowsFileNameProblem(name string) string {
+	for _, c := range name {
+		if c < 32 || strings.ContainsRune(windowsReservedChars, c) {
+			return fmt.Sprintf("contains the character %q not allowed on Windows", c)
+		}
+	}
+	if windowsReservedNameRegex.MatchString(name) {
+		return "is reserved on Windows"
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "ends with a dot or space not allowed on Windows"
+	}
+	return ""
+}
+
+// Returns the given file name if it fits in maxFileNameBytes, otherwise the name truncated and suffixed with a hash of the
+// full name and its extension. The same name is always escaped the same way.
+func escapeFileName(name string) string {
+	if len(name) <= maxFileNameBytes {
+		return name
+	}
+	hash := sha256.Sum256([]byte(name))
+	suffix := escapedNameSeparator + hex.EncodeToString(hash[:])[:escapedNameHashChars]
+	if ext := path.Ext(name); len(ext) <= maxEscapedNameExt && utf8.ValidString(ext) {
+		suffix += ext
+	}
+
+	truncated := name[:maxFileNameBytes-len(suffix)]
+	// Do not cut a multi-byte character in half
+	for len(truncated) > 0 && !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	// Windows does not allow names ending with a dot or space
+	truncated = strings.TrimRight(truncated, ". ")
+	return truncated + suffix
+}
+
+// Returns the given relative path in the form used to tell if two paths refer to the same local file, i.e., in Unicode
+// NFC and, on case-insensitive file systems, in lower case
+func pathIdentity(relativePath string, caseInsensitive bool) string {
+	identity := norm.NFC.String(relativePath)
+	if caseInsensitive {
+		identity = strings.ToLower(identity)
+	}
+	return identity
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Maps the keys of the objects of a mount to local paths and the local paths back to keys. A key maps to the local path
+// of its remainder after the mount's prefix with long names escaped (see escapeFileName). A local path maps to the key of
+// the object it was downloaded from, if any, otherwise to the key with the same remainder. This guarantees that every
+// file downloaded from a key is uploaded back to the same key.
+type keyMapper struct {
+	// The key prefix of the mount (see normalizeKeyPrefix)
+	keyPrefix   string
+	destination string
+	windows     bool
+	// Whether the local file system ignores the case of file names
+	caseInsensitive bool
+
+	lock sync.RWMutex
+	// The keys (or their parent "directories") whose local paths differ from their remainders or may be reported
+	// differently by the file system (i.e., non-ASCII names), by the identity of the relative local path
+	keysByPath map[string]string
+	// The keys mapped since the listing of the objects of the mount began, nil if no listing is in progress. They
+	// replace keysByPath once the listing is complete so that the keys deleted from S3 are forgotten.
+	listedKeysByPath map[string]string
+}
+
+func newKeyMapper(prefix string, destination string, windows bool, caseInsensitive bool) *keyMapper {
+	return &keyMapper{
+		keyPrefix:       normalizeKeyPrefix(prefix),
+		destination:     destination,
+		windows:         windows,
+		caseInsensitive: caseInsensitive,
+		keysByPath:      make(map[string]string),
+	}
+}
+
+// Returns the path of the local file for the object with the given key, relative to the destination of the mount
+// and using slashes as separators
+func (mapper *keyMapper) relativeLocalPath(key string) (string, error) {
+	remainder, err := keyToRelativePath(key, mapper.keyPrefix, mapper.windows, mapper.caseInsensitive)
+	if err != nil {
+		return "", err
+	}
+
+	segments := strings.Split(remainder, "/")
+	for i, segment := range segments {
+		segments[i] = escapeFileName(segment)
+	}
+	relativePath := strings.Join(segments, "/")
+
+	if relativePath != remainder || !isASCII(remainder) || mapper.keyPrefix+remainder != key {
+		// Remember how the local path and each of its parent directories map back to the key
+		mapper.lock.Lock()
+		keyPrefix := strings.TrimSuffix(key, remainder)
+		localPrefix := ""
+		for i, remainderSegment := range strings.Split(remainder, "/") {
+			if i > 0 {
+				localPrefix += "/"
+				keyPrefix += "/"
+			}
+			localPrefix += segments[i]
+			keyPrefix += remainderSegment
+			mapper.keysByPath[pathIdentity(localPrefix, false)] = keyPrefix
+			if mapper.listedKeysByPath != nil {
+				mapper.listedKeysByPath[pathIdentity(localPrefix, false)] = keyPrefix
+			}
+		}
+		mapper.lock.Unlock()
+	}
+	return relativePath, nil
+}
+
+// Starts collecting the keys mapped while the objects of the mount are listed
+func (mapper *keyMapper) beginListing() {
+	mapper.lock.Lock()
+	defer mapper.lock.Unlock()
+	mapper.listedKeysByPath = make(map[string]string)
+}
+
+// Replaces the mapped keys with the keys mapped since beginListing if the listing is complete, i.e., forgets the keys
+// that are no longer in S3. The keys of an incomplete listing are added to the mapped keys only.
+func (mapper *keyMapper) endListing(complete bool) {
+	mapper.lock.Lock()
+	defer mapper.lock.Unlock()
+	if complete && mapper.listedKeysByPath != nil {
+		mapper.keysByPath = mapper.listedKeysByPath
+	}
+	mapper.listedKeysByPath = nil
+}
+
+// Returns the path of the local file for the object with the given key
+func (mapper *keyMapper) localPath(key string) (string, error) {
+	relativePath, err := mapper.relativeLocalPath(key)
+	if err != nil {
+		return "", err
+	}
+	// The key is validated above, double check that the path is within the destination in case anything was missed
+	localPath := filepath.Join(mapper.destination, filepath.FromSlash(relativePath))
+	if rel, err := filepath.Rel(mapper.destination, localPath); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &rejectedKeyError{key: key, reason: "resolves outside of the mount"}
+	}
+	return localPath, nil
+}
+
+// Returns the key of the object for the local file or directory at the given path
+func (mapper *keyMapper) keyForLocalPath(localPath string) (string, error) {
+	rel, err := filepath.Rel(mapper.destination, localPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%v' is not within the mount directory '%v'", localPath, mapper.destination)
+	}
+	relativePath := filepath.ToSlash(rel)
+
+	key := mapper.keyPrefix + relativePath
+	mapper.lock.RLock()
+	// Use the key of the closest path (the file itself or one of its parent directories) downloaded from S3, if any
+	for localPrefix := relativePath; localPrefix != ""; {
+		if keyPrefix, ok := mapper.keysByPath[pathIdentity(localPrefix, false)]; ok {
+			key = keyPrefix + relativePath[len(localPrefix):]
+			break
+		}
+		i := strings.LastIndex(localPrefix, "/")
+		if i < 0 {
+			break
+		}
+		localPrefix = localPrefix[:i]
+	}
+	mapper.lock.RUnlock()
+
+	if len(key) > maxKeyBytes {
+		return "", fmt.Errorf("the key of '%v' is longer than %d bytes", localPath, maxKeyBytes)
+	}
+	return key, nil
+}
+
+// Detects the keys of a listing that map to the same local path as another key, either to the same file (e.g., Unicode
+// NFC and NFD variants of the same name) or to a file and a directory (e.g., "a" and "a/b"). The first key in the order
+// of the listing (i.e., in lexicographic order) wins, the later colliding keys are rejected.
+type keyCollisions struct {
+	caseInsensitive bool
+	// The key of the file at each relative path, by identity of the path
+	files map[string]string
+	// The first key under each directory, by identity of the path
+	dirs map[string]string
+}
+
+func newKeyCollisions(caseInsensitive bool) *keyCollisions {
+	return &keyCollisions{caseInsensitive: caseInsensitive, files: make(map[string]string), dirs: make(map[string]string)}
+}
+
+// Claims the given relative local path for the given key, returns a rejectedKeyError if the path collides with
+// the path of a key claimed before
+func (collisions *keyCollisions) claim(key string, relativePath string) error {
+	identity := pathIdentity(filepath.ToSlash(relativePath), collisions.caseInsensitive)
+	if other, ok := collisions.files[identity]; ok {
+		return &rejectedKeyError{key: key, reason: fmt.Sprintf("maps to the same local file as the key %q", other)}
+	}
+	if other, ok := collisions.dirs[identity]; ok {
+		return &rejectedKeyError{key: key, reason: fmt.Sprintf("maps to the local directory of the key %q", other)}
+	}
+	dirs := parentDirs(identity)
+	for _, dir := range dirs {
+		if other, ok := collisions.files[dir]; ok {
+			return &rejectedKeyError{key: key, reason: fmt.Sprintf("maps into the local file of the key %q", other)}
+		}
+	}
+
+	collisions.files[identity] = key
+	for _, dir := range dirs {
+		if _, ok := collisions.dirs[dir]; !ok {
+			collisions.dirs[dir] = key
+		}
+	}
+	return nil
+}
+
+// Returns the path of the local file for the object with the given key
+func (config *mountConfiguration) localPathForKey(key string) (string, error) {
+	return config.keys.localPath(key)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Keeps track of the mounts being synchronized. Newly added mounts are pushed to the mounts channel
+// to start downloading (and watching, if writeable), removed mounts are signalled to stop.
+type mountManager struct {
+	destinationBase        string
+	deleteRemovedMountData bool
+
+	mountsCh chan *mountConfiguration
+	wg       *sync.WaitGroup
+
+	// Map of mountToString vs the mount configuration currently being synchronized
+	currentMounts map[string]*mountConfiguration
+	lock          sync.Mutex
+}
+
+func newMountManager(destinationBase string, deleteRemovedMountData bool, mountsCh chan *mountConfiguration, wg *sync.WaitGroup) *mountManager {
+	return &mountManager{
+		destinationBase:        destinationBase,
+		deleteRemovedMountData: deleteRemovedMountData,
+		mountsCh:               mountsCh,
+		wg:                     wg,
+		currentMounts:          make(map[string]*mountConfiguration),
+	}
+}
+
+// Updates the mounts being synchronized to the given mounts.
+// Mounts not currently synchronized are started, mounts not in the given list are stopped and mounts
+// whose settings (e.g., writeable) changed are restarted.
+func (manager *mountManager) updateMounts(s3Mounts []s3Mount) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	logger.debugf("Parsing mounts...")
+	setMountDefaults(s3Mounts)
+	validMounts, validationErrors := validateMounts(s3Mounts, manager.destinationBase)
+	for _, err := range validationErrors {
+		// Skip the invalid mounts and let the valid mounts proceed
+		logger.withError(err).errorf("Skipping mount")
+	}
+
+	desiredMounts := make(map[string]*mountConfiguration, len(validMounts))
+	for _, mount := range validMounts {
+		s := mountToString(&mount)
+		if _, exists := desiredMounts[s]; exists {
+			continue
+		}
+		desiredMounts[s] = newMountConfiguration(
+			*mount.Id,
+			*mount.Bucket,
+			*mount.Prefix,
+			filepath.Join(manager.destinationBase, *mount.Id),
+			*mount.Writeable,
+			*mount.KmsArn,
+			*mount.RoleArn,
+			conflictPolicy(*mount.ConflictPolicy),
+			mountFilterSettingsOf(&mount),
+		)
+	}
+
+	stoppedMounts := make(map[string]*mountConfiguration)
+	for s, existing := range manager.currentMounts {
+		desired, keep := desiredMounts[s]
+		if keep && existing.hasSameSettings(desired) {
+			continue
+		}
+		// Only delete the local data if the mount is removed, not when it is restarted with different settings
+		manager.stopMount(s, existing, !keep && manager.deleteRemovedMountData)
+		stoppedMounts[s] = existing
+	}
+
+	for s, desired := range desiredMounts {
+		_, exists := manager.currentMounts[s]
+
+		desired.logger.debugf("Mount: %v, Adding to mount queue: %t", desired.destination, !exists)
+		if !exists {
+			manager.startMount(s, desired, stoppedMounts[s])
+		}
+	}
+}
+
+// Pushes the given mount configuration to the mounts channel. If the mount is being restarted, the
+// configuration is pushed only after all go routines of the previous configuration have stopped.
+func (manager *mountManager) startMount(s string, config *mountConfiguration, previous *mountConfiguration) {
+	manager.currentMounts[s] = config
+
+	manager.wg.Add(1) // Increment wait group counter everytime we push config to the mount channel
+	config.logger.debugf("Increment wg counter")
+	// Count the time the configuration waits in the channel as activity on the mount so it isn't
+	// considered stopped before the mount consumer picks it up
+	config.activeRoutines.Add(1)
+
+	if previous == nil {
+		manager.mountsCh <- config
+		return
+	}
+	go func() {
+		previous.activeRoutines.Wait()
+		manager.mountsCh <- config
+	}()
+}
+
+// Signals all go routines working on the given mount to stop and optionally deletes the mount's local
+// directory once they have stopped
+func (manager *mountManager) stopMount(s string, config *mountConfiguration, deleteData bool) {
+	delete(manager.currentMounts, s)
+
+	config.logger.infof("Stopping synchronization of mount %v", config.destination)
+	close(config.stopCh)
+
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+
+		// Wait for the recurring downloads and upload watchers to stop before touching the directory,
+		// the upload watcher would otherwise delete the files from S3 as well
+		config.activeRoutines.Wait()
+		mountStatuses.remove(config)
+		if deleteData {
+			// The files are deleted by us, not by the user. Forget them before they are deleted so that their objects
+			// are not deleted when the mount is added again and the files are missing.
+			synchronizerState.ForgetMountState(config.stateNamespace())
+		}
+		if config.stateAttached {
+			synchronizerState.DetachMountState(config.stateNamespace())
+		}
+		if !deleteData {
+			config.logger.infof("Stopped synchronization of mount %v keeping local data", config.destination)
+			return
+		}
+		if err := os.RemoveAll(config.destination); err != nil {
+			config.logger.withError(err).errorf("Error deleting local data of removed mount '%v'", config.destination)
+			return
+		}
+		config.logger.infof("Stopped synchronization of mount %v and deleted local data", config.destination)
+	}()
+}
+
+// Watches for changes in the mounts and pushes the new list of mounts to the given channel.
+// The mounts are reloaded when the configuration document at configFilePath is modified
+// (checked every reloadInterval) or when the process receives SIGHUP.
+func watchMountSources(reloadConfig func() (*synchronizerConfig, error), configFilePath string, reloadInterval time.Duration, mountsUpdateCh chan<- []s3Mount) {
+	sighupCh := make(chan os.Signal, 1)
+	signal.Notify(sighupCh, syscall.SIGHUP)
+	defer signal.Stop(sighupCh)
+
+	// There is no file to check for modifications when the document is read from stdin
+	watchFile := configFilePath != "" && configFilePath != "-" && reloadInterval > 0
+	var tickCh <-chan time.Time
+	if watchFile {
+		ticker := time.NewTicker(reloadInterval)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
+	lastModTime := configFileModTime(configFilePath)
+
+	reload := func() {
+		config, err := reloadConfig()
+		if err != nil {
+			logger.withError(err).errorf("Error reloading mounts, keeping the current mounts")
+			return
+		}
+		mountsUpdateCh <- config.Mounts
+	}
+
+	for {
+		select {
+		case <-sighupCh:
+			logger.infof("Received SIGHUP, reloading mounts")
+			reload()
+		case <-tickCh:
+			modTime := configFileModTime(configFilePath)
+			if modTime.Equal(lastModTime) {
+				continue
+			}
+			lastModTime = modTime
+			logger.debugf("Config file %v changed, reloading mounts", configFilePath)
+			reload()
+		}
+	}
+}
+
+func configFileModTime(configFilePath string) time.Time {
+	fi, err := os.Stat(configFilePath)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/orcaman/concurrent-map"
+)
+
+// Global Variable to hold the status of each mount being synchronized
+// The statuses are also saved to a status file (in the state directory, opened by openStateFiles) shortly after they
+// change so the progress of each mount can be checked from outside of the program
+var mountStatuses *mountStatusRegistry
+
+// Name of the status file in the state directory
+const mountStatusFileName = "s3-synchronizer-status"
+
+// The changes of the statuses are saved at the latest this long after they were made, all the changes made in the
+// meantime (e.g., the pending uploads of every file scheduled by a crawl) are saved at once
+var mountStatusSaveInterval = time.Second
+
+type mountState string
+
+const (
+	// The mount is waiting for its turn to synchronize
+	mountStateQueued mountState = "queued"
+	// The mount is downloading changes from S3
+	mountStateSyncing mountState = "syncing"
+	// The last synchronization completed, the mount is waiting for the next recurring download (if any)
+	mountStateIdle mountState = "idle"
+	// The last synchronization failed, the mount will be retried with the next recurring download (if any)
+	mountStateFailed mountState = "failed"
+)
+
+// Status of a single mount
+type mountStatus struct {
+	Id                        string     `json:"id"`
+	Bucket                    string     `json:"bucket"`
+	Prefix                    string     `json:"prefix"`
+	Destination               string     `json:"destination"`
+	State                     mountState `json:"state"`
+	LastSyncStart             time.Time  `json:"lastSyncStart,omitempty"`
+	LastSyncEnd               time.Time  `json:"lastSyncEnd,omitempty"`
+	LastSyncFiles             int        `json:"lastSyncFiles"`
+	LastSyncBytes             int64      `json:"lastSyncBytes"`
+	LastSyncErrors            int        `json:"lastSyncErrors"`
+	LastSyncIntegrityFailures int        `json:"lastSyncIntegrityFailures"`
+	LastSyncQuarantined       int        `json:"lastSyncQuarantined"`
+	LastSyncConflicts         int        `json:"lastSyncConflicts"`
+	LastSyncRejectedKeys      int        `json:"lastSyncRejectedKeys"`
+	PendingUploads            int        `json:"pendingUploads"`
+	OutboxSize                int        `json:"outboxSize"`
+	LastError                 string     `json:"lastError,omitempty"`
+	SuccessfulSyncs           int        `json:"successfulSyncs"`
+	FailedSyncs               int        `json:"failedSyncs"`
+	LastSuccessfulAt          time.Time  `json:"lastSuccessfulAt,omitempty"`
+}
+
+type mountStatusRegistry struct {
+	// Map of mount destination vs *mountStatus
+	statuses    cmap.ConcurrentMap
+	persistence Persistence
+	// Serializes updates to the statuses
+	lock sync.Mutex
+	// Whether the statuses changed since they were last saved, and whether a save is scheduled
+	dirty         bool
+	saveScheduled bool
+	// Serializes saving the statuses, the statuses can be updated while they are being saved
+	saveLock sync.Mutex
+}
+
+func newMountStatusRegistry(persistence Persistence) *mountStatusRegistry {
+	return &mountStatusRegistry{statuses: cmap.New(), persistence: persistence}
+}
+
+// Applies the given update to the status of the given mount and saves the statuses
+func (registry *mountStatusRegistry) update(config *mountConfiguration, updateFn func(status *mountStatus)) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	var status *mountStatus
+	if existing, ok := registry.statuses.Get(config.destination); ok {
+		status = existing.(*mountStatus)
+	} else {
+		status = &mountStatus{Id: config.id, Bucket: config.bucket, Prefix: config.prefix, Destination: config.destination}
+		registry.statuses.Set(config.destination, status)
+	}
+	updateFn(status)
+
+	registry.changedLocked()
+}
+
+// Marks the given mount as waiting for its turn to synchronize
+func (registry *mountStatusRegistry) queued(config *mountConfiguration) {
+	registry.update(config, func(status *mountStatus) {
+		status.State = mountStateQueued
+	})
+}
+
+// Marks the given mount as synchronizing
+func (registry *mountStatusRegistry) syncing(config *mountConfiguration, start time.Time) {
+	registry.update(config, func(status *mountStatus) {
+		status.State = mountStateSyncing
+		status.LastSyncStart = start
+	})
+}
+
+// Records the outcome of a synchronization of the given mount
+func (registry *mountStatusRegistry) synced(config *mountConfiguration, stats *downloadStats) {
+	registry.update(config, func(status *mountStatus) {
+		status.LastSyncEnd = stats.end
+		status.LastSyncFiles = stats.numberOfRetrievedFiles
+		status.LastSyncBytes = stats.totalRetrievedBytes
+		status.LastSyncErrors = len(stats.errorPrefixes)
+		status.LastSyncIntegrityFailures = stats.integrityFailures
+		status.LastSyncQuarantined = len(stats.quarantinedKeys)
+		status.LastSyncConflicts = stats.conflicts
+		status.LastSyncRejectedKeys = len(stats.rejectedKeys)
+		if stats.err != nil {
+			status.State = mountStateFailed
+			status.LastError = stats.err.Error()
+			status.FailedSyncs++
+			config.logger.withError(stats.err).errorf("Synchronization failed")
+			return
+		}
+		status.State = mountStateIdle
+		status.LastError = ""
+		status.SuccessfulSyncs++
+		status.LastSuccessfulAt = stats.end
+	})
+}
+
+// Records the number of changed files of the given mount waiting to be uploaded
+func (registry *mountStatusRegistry) uploadsPending(config *mountConfiguration, pending int) {
+	registry.update(config, func(status *mountStatus) {
+		status.PendingUploads = pending
+	})
+}
+
+// Records the number of local changes of the given mount not applied to S3 yet
+func (registry *mountStatusRegistry) outboxSizeChanged(config *mountConfiguration, size int) {
+	registry.update(config, func(status *mountStatus) {
+		status.OutboxSize = size
+	})
+}
+
+// Removes the status of the given mount (e.g., when the mount is removed)
+func (registry *mountStatusRegistry) remove(config *mountConfiguration) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.statuses.Remove(config.destination)
+	registry.changedLocked()
+}
+
+// Returns a copy of the status of the given mount
+func (registry *mountStatusRegistry) get(config *mountConfiguration) (mountStatus, bool) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	existing, ok := registry.statuses.Get(config.destination)
+	if !ok {
+		return mountStatus{}, false
+	}
+	return *existing.(*mountStatus), true
+}
+
+// Must be called with the lock held
+func (registry *mountStatusRegistry) changedLocked() {
+	registry.dirty = true
+	if !registry.saveScheduled {
+		registry.saveScheduled = true
+		time.AfterFunc(mountStatusSaveInterval, registry.flush)
+	}
+}
+
+// Saves the statuses if they changed since they were last saved
+func (registry *mountStatusRegistry) flush() {
+	registry.saveLock.Lock()
+	defer registry.saveLock.Unlock()
+
+	registry.lock.Lock()
+	registry.saveScheduled = false
+	if !registry.dirty {
+		registry.lock.Unlock()
+		return
+	}
+	registry.dirty = false
+	snapshot := make(map[string]mountStatus, registry.statuses.Count())
+	for item := range registry.statuses.IterBuffered() {
+		snapshot[item.Key] = *item.Val.(*mountStatus)
+	}
+	registry.lock.Unlock()
+
+	if err := registry.persistence.Save(snapshot); err != nil {
+		logger.withError(err).errorf("Error saving mount statuses")
+	}
+}
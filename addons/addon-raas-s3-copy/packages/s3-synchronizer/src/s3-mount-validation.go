@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// See https://docs.aws.amazon.com/AmazonS3/latest/userguide/bucketnamingrules.html
+var bucketNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// E.g., arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab or arn:aws:kms:us-east-1:123456789012:alias/some-alias
+var kmsArnRegex = regexp.MustCompile(`^arn:aws[a-z-]*:kms:[a-z0-9-]+:\d{12}:(key|alias)/[a-zA-Z0-9/_-]+$`)
+
+// E.g., arn:aws:iam::123456789012:role/some-role or arn:aws:iam::123456789012:role/some/path/some-role
+var roleArnRegex = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/[\w+=,.@/-]+$`)
+
+// Error describing all problems found with a single mount definition
+type mountValidationError struct {
+	// Position of the mount in the list of mounts
+	index int
+	// The id of the mount, if specified
+	id       string
+	problems []string
+}
+
+func (e *mountValidationError) Error() string {
+	return fmt.Sprintf("invalid mount #%d (id: %q): %s", e.index, e.id, strings.Join(e.problems, "; "))
+}
+
+// Validates the given mounts and returns the valid mounts along with an error for each invalid mount.
+// The mounts are expected to have their defaults set (see setMountDefaults).
+func validateMounts(mounts []s3Mount, destinationBase string) ([]s3Mount, []error) {
+	validMounts := make([]s3Mount, 0, len(mounts))
+	validationErrors := make([]error, 0)
+
+	// Map of mount id vs the destination of the valid mounts seen so far
+	destinations := make(map[string]string)
+
+	for i, mount := range mounts {
+		problems := validateMount(&mount)
+
+		if mount.Id != nil && len(problems) == 0 {
+			id := *mount.Id
+			destination := normalizeDestination(filepath.Join(destinationBase, id))
+			for otherId, otherDestination := range destinations {
+				if otherId == id {
+					problems = append(problems, "duplicate id, another mount with the same id is already defined")
+				} else if otherDestination == destination {
+					problems = append(problems, fmt.Sprintf("destination overlaps with the destination of mount %q", otherId))
+				} else if strings.HasPrefix(destination, otherDestination+"/") || strings.HasPrefix(otherDestination, destination+"/") {
+					problems = append(problems, fmt.Sprintf("destination is nested with the destination of mount %q", otherId))
+				}
+			}
+			if len(problems) == 0 {
+				destinations[id] = destination
+			}
+		}
+
+		if len(problems) > 0 {
+			id := ""
+			if mount.Id != nil {
+				id = *mount.Id
+			}
+			validationErrors = append(validationErrors, &mountValidationError{index: i, id: id, problems: problems})
+			continue
+		}
+		validMounts = append(validMounts, mount)
+	}
+	return validMounts, validationErrors
+}
+
+// Returns the problems found in the given mount's own attributes
+func validateMount(mount *s3Mount) []string {
+	problems := make([]string, 0)
+
+	if mount.Id == nil || strings.TrimSpace(*mount.Id) == "" {
+		problems = append(problems, `"id" is required`)
+	} else {
+		problems = append(problems, validateMountId(*mount.Id)...)
+	}
+
+	if mount.Bucket == nil || *mount.Bucket == "" {
+		problems = append(problems, `"bucket" is required`)
+	} else if !isValidBucketName(*mount.Bucket) {
+		problems = append(problems, fmt.Sprintf(`"bucket" %q is not a valid S3 bucket name`, *mount.Bucket))
+	}
+
+	if mount.Prefix == nil {
+		problems = append(problems, `"prefix" is required, use "/" for the whole bucket`)
+	}
+
+	if mount.KmsArn != nil && *mount.KmsArn != "" && !kmsArnRegex.MatchString(*mount.KmsArn) {
+		problems = append(problems, fmt.Sprintf(`"kmsArn" %q is not a valid KMS key ARN`, *mount.KmsArn))
+	}
+
+	if mount.RoleArn != nil && *mount.RoleArn != "" && !roleArnRegex.MatchString(*mount.RoleArn) {
+		problems = append(problems, fmt.Sprintf(`"roleArn" %q is not a valid IAM role ARN`, *mount.RoleArn))
+	}
+
+	if mount.ConflictPolicy != nil && !isValidConflictPolicy(*mount.ConflictPolicy) {
+		problems = append(problems, fmt.Sprintf(`"conflictPolicy" %q must be one of %q, %q or %q`, *mount.ConflictPolicy,
+			conflictPolicyRemoteWins, conflictPolicyLocalWins, conflictPolicyKeepBoth))
+	}
+
+	problems = append(problems, validateMountFilter(mount)...)
+
+	return problems
+}
+
+// The mount id is used as the name of the mount's directory under the destination base directory
+// so make sure it cannot point outside of the destination base directory
+func validateMountId(id string) []string {
+	if strings.ContainsRune(id, 0) {
+		return []string{`"id" must not contain NUL characters`}
+	}
+	if filepath.IsAbs(id) || strings.HasPrefix(id, "/") || strings.HasPrefix(id, `\`) {
+		return []string{fmt.Sprintf(`"id" %q must not be an absolute path`, id)}
+	}
+	for _, segment := range strings.FieldsFunc(id, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == "." || segment == ".." {
+			return []string{fmt.Sprintf(`"id" %q must not contain "." or ".." path segments`, id)}
+		}
+	}
+	return nil
+}
+
+func isValidBucketName(bucket string) bool {
+	if !bucketNameRegex.MatchString(bucket) {
+		return false
+	}
+	if strings.Contains(bucket, "..") || strings.Contains(bucket, ".-") || strings.Contains(bucket, "-.") {
+		return false
+	}
+	// Bucket names must not be formatted as an IP address
+	if net.ParseIP(bucket) != nil {
+		return false
+	}
+	return true
+}
+
+// Returns the destination in a form that can be compared with other destinations, ignoring the case as
+// the default file systems on Windows and macOS are case-insensitive
+func normalizeDestination(destination string) string {
+	return strings.ToLower(filepath.ToSlash(filepath.Clean(destination)))
+}
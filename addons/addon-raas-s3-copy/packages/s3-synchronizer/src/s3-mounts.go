@@ -1,10 +1,5 @@
 package main
 
-import (
-	"path/filepath"
-	"strings"
-)
-
 // Use pointers in this struct so its easy to tell if a value was not in JSON (ie the ptr is nil)
 type s3Mount struct {
 	Id        *string `json:"id,omitempty"`
@@ -13,6 +8,18 @@ type s3Mount struct {
 	Writeable *bool   `json:"writeable,omitempty"`
 	KmsArn    *string `json:"kmsArn,omitempty"`
 	RoleArn   *string `json:"roleArn,omitempty"`
+	// How to resolve files changed locally and in S3, one of "remote-wins" (default), "local-wins" or "keep-both"
+	ConflictPolicy *string `json:"conflictPolicy,omitempty"`
+	// Patterns (.gitignore syntax) of the files to synchronize, all files are synchronized if not specified
+	Include []string `json:"include,omitempty"`
+	// Patterns (.gitignore syntax) of the files not to synchronize
+	Exclude []string `json:"exclude,omitempty"`
+	// Names of predefined sets of exclude patterns, e.g., "notebooks"
+	ExcludePresets []string `json:"excludePresets,omitempty"`
+	// Files larger than this number of bytes are not synchronized
+	MaxFileSize *int64 `json:"maxFileSize,omitempty"`
+	// Files last modified longer ago than this duration (e.g., "720h") are not synchronized
+	MaxAge *string `json:"maxAge,omitempty"`
 }
 
 func mountToString(mount *s3Mount) string {
@@ -21,28 +28,3 @@ func mountToString(mount *s3Mount) string {
 
 func Bool(v bool) *bool       { return &v }
 func String(v string) *string { return &v }
-
-// Returns S3 object key based on file path and mountConfiguration
-func ToS3Key(filePath string, config *mountConfiguration) string {
-	return ToS3KeyForFile(filePath, config.prefix, config.destination)
-}
-
-// Returns S3 object key based on file path, prefix and sync dir
-func ToS3KeyForFile(filePath string, prefix string, syncDir string) string {
-	// if prefix ends with trailing slash then remove extra slash
-	s3Prefix := filepath.ToSlash(prefix)
-	if strings.HasSuffix(s3Prefix, "/") {
-		s3Prefix = strings.TrimSuffix(s3Prefix, "/")
-	}
-
-	normalizedSyncDir := filepath.ToSlash(syncDir)
-	normalizedFilePath := filepath.ToSlash(filePath)
-	s3FilePath := strings.TrimPrefix(normalizedFilePath, normalizedSyncDir)
-	// if s3 file path starts with a trailing slash then remove extra slash
-	if strings.HasPrefix(s3FilePath, "/") {
-		s3FilePath = strings.TrimPrefix(s3FilePath, "/")
-	}
-
-	s3Key := filepath.ToSlash(s3Prefix + "/" + s3FilePath)
-	return s3Key
-}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Outcome of reconciling the local changes of a writeable mount made while the synchronizer was not running
+type reconcileStats struct {
+	uploaded    int
+	deletedInS3 int
+	conflicts   int
+	errors      int
+	// The files deleted locally whose objects were not deleted, they are downloaded again
+	skippedDeletions int
+}
+
+// Applies the changes made to the files of the given writeable mount while the synchronizer was not running, before the
+// mount is downloaded. Each file synchronized before is compared with the object in S3 and with the base record of both
+// when they were last synchronized:
+// - changed locally only: the file is uploaded
+// - deleted locally only: the object is deleted
+// - changed in S3 only: nothing to do here, the object is downloaded (or the local file deleted) by the download
+// - changed (or deleted) on both sides: a conflict, resolved with the conflict policy of the mount
+// Files created locally are uploaded by the upload watcher as usual.
+// The objects of the files deleted locally are only deleted if the local directory of the mount still has files (i.e.,
+// it is not a volume that is not attached or a directory that was wiped) and, unless maxDeletions is negative, if there
+// are no more than maxDeletions of them. The files are downloaded again otherwise.
+func reconcileLocalChanges(sess *session.Session, config *mountConfiguration, maxDeletions int) *reconcileStats {
+	stats := &reconcileStats{}
+	bases := synchronizerState.GetSyncBases(config.stateNamespace(), config.keys.keyPrefix)
+	if len(bases) == 0 {
+		return stats
+	}
+
+	svc := s3.New(sess)
+	objects := make(map[string]*s3.Object)
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(config.bucket),
+		Prefix: aws.String(config.keys.keyPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			objects[aws.StringValue(item.Key)] = item
+		}
+		return !config.isStopped()
+	})
+	if err != nil || config.isStopped() {
+		// Without the complete listing the changes can not be told apart, the upload watcher uploads the changed files
+		config.logger.withOp("reconcile").withError(err).errorf("Unable to list objects to reconcile local changes")
+		stats.errors++
+		return stats
+	}
+
+	deletedBases := make([]*syncBase, 0)
+	for _, base := range bases {
+		if config.isStopped() {
+			break
+		}
+		filePath, err := config.keys.localPath(base.Key)
+		if err != nil || config.filter.excludesLocalPath(filePath, false) {
+			continue
+		}
+		item := objects[base.Key]
+		changedInS3 := item != nil && aws.StringValue(item.ETag) != base.ETag
+
+		fi, err := os.Stat(filePath)
+		if os.IsNotExist(err) {
+			deletedBases = append(deletedBases, base)
+			continue
+		}
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		reconcileLocalFile(svc, config, base, filePath, item, changedInS3, stats)
+	}
+	if !config.isStopped() {
+		reconcileLocalDeletions(sess, config, deletedBases, objects, maxDeletions, stats)
+	}
+
+	if stats.uploaded > 0 || stats.deletedInS3 > 0 || stats.conflicts > 0 || stats.errors > 0 || stats.skippedDeletions > 0 {
+		config.logger.withOp("reconcile").infof("Reconciled local changes made while stopped: %d uploaded, %d deleted in S3, %d deletions skipped, %d conflicts, %d errors",
+			stats.uploaded, stats.deletedInS3, stats.skippedDeletions, stats.conflicts, stats.errors)
+	}
+	return stats
+}
+
+// Reconciles the given files deleted locally, unless the deletions look like the local data is missing rather than
+// deleted by the user
+func reconcileLocalDeletions(sess *session.Session, config *mountConfiguration, deletedBases []*syncBase, objects map[string]*s3.Object, maxDeletions int, stats *reconcileStats) {
+	reconcileLogger := config.logger.withOp("reconcile")
+	objectsToDelete := 0
+	for _, base := range deletedBases {
+		if objects[base.Key] != nil {
+			objectsToDelete++
+		}
+	}
+	if len(deletedBases) == 0 {
+		return
+	}
+	if objectsToDelete > 0 && !hasLocalFiles(config.destination) {
+		reconcileLogger.warnf("The local directory %v of the mount is missing or has no files, not deleting the objects of the %d files synchronized before. The files are downloaded again",
+			config.destination, objectsToDelete)
+		stats.skippedDeletions += objectsToDelete
+		return
+	}
+	if maxDeletions >= 0 && objectsToDelete > maxDeletions {
+		reconcileLogger.warnf("%d files synchronized before were deleted locally while stopped, more than the %d objects that can be deleted without confirmation. Not deleting the objects, the files are downloaded again. Set confirmReconcileDeletions to delete them",
+			objectsToDelete, maxDeletions)
+		stats.skippedDeletions += objectsToDelete
+		return
+	}
+	for _, base := range deletedBases {
+		if config.isStopped() {
+			return
+		}
+		filePath, err := config.keys.localPath(base.Key)
+		if err != nil {
+			continue
+		}
+		item := objects[base.Key]
+		changedInS3 := item != nil && aws.StringValue(item.ETag) != base.ETag
+		reconcileLocalDeletion(sess, config, base, filePath, item, changedInS3, stats)
+	}
+}
+
+var errFoundLocalFile = errors.New("found local file")
+
+// Returns flag indicating if the given local directory of a mount exists and has at least one file, other than the
+// files managed by the synchronizer
+func hasLocalFiles(dirPath string) bool {
+	err := filepath.Walk(dirPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			if path != dirPath && fi.Name() == synchronizerDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isSynchronizerPath(path) {
+			return nil
+		}
+		return errFoundLocalFile
+	})
+	return err == errFoundLocalFile
+}
+
+// Reconciles the given file deleted locally
+func reconcileLocalDeletion(sess *session.Session, config *mountConfiguration, base *syncBase, filePath string, item *s3.Object, changedInS3 bool, stats *reconcileStats) {
+	reconcileLogger := config.logger.withOp("reconcile").withKey(base.Key).withPath(filePath)
+	if item == nil {
+		// Deleted on both sides
+		synchronizerState.RecordFileDeletionFromLocal(filePath, config)
+		return
+	}
+	if changedInS3 {
+		stats.conflicts++
+		reconcileLogger.warnf("Conflict, the file was deleted locally and changed in S3 since it was last synchronized, resolving with %v",
+			config.conflictPolicy)
+		if config.conflictPolicy != conflictPolicyLocalWins {
+			// The object is downloaded again
+			return
+		}
+	}
+	reconcileLogger.debugf("The file was deleted locally, deleting the object from S3")
+	if err := deleteFromS3(sess, config.keys, filePath, config.bucket, config.logger); err != nil {
+		stats.errors++
+		return
+	}
+	synchronizerState.RecordFileDeletionFromLocal(filePath, config)
+	stats.deletedInS3++
+}
+
+// Reconciles the given file that still exists locally
+func reconcileLocalFile(svc *s3.S3, config *mountConfiguration, base *syncBase, filePath string, item *s3.Object, changedInS3 bool, stats *reconcileStats) {
+	reconcileLogger := config.logger.withOp("reconcile").withKey(base.Key).withPath(filePath)
+	if base.Local != nil {
+		if fi, err := os.Stat(filePath); err == nil && base.Local.matches(fi) {
+			// Unchanged locally
+			return
+		}
+	}
+	if changedInS3 {
+		// Changed on both sides, unless the content is the same. The download compares the content and applies the
+		// conflict policy.
+		return
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		stats.errors++
+		return
+	}
+	defer file.Close()
+	if item != nil && !hasFileChangedLocally(svc, config, file, base.Key) {
+		// Touched but not changed
+		return
+	}
+	if item == nil {
+		stats.conflicts++
+		reconcileLogger.warnf("Conflict, the file was changed locally and deleted in S3 since it was last synchronized, resolving with %v",
+			config.conflictPolicy)
+		if config.conflictPolicy == conflictPolicyRemoteWins {
+			// The local file is deleted by the download
+			return
+		}
+	}
+	reconcileLogger.debugf("The file was changed locally, uploading it")
+	if err := uploadFileToS3(svc, config, file, base.Key); err != nil {
+		stats.errors++
+		return
+	}
+	stats.uploaded++
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A range of bytes [Start, End) of an object
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Progress of the download of a large object that can be resumed after an interruption (e.g., a restart)
+type partialDownload struct {
+	// The mount the download is for, empty for the downloads of older versions not claimed by a mount yet
+	MountId string `json:"mountId,omitempty"`
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	// The version of the object being downloaded, the download starts over if the object changes in S3
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+	// Absolute path of the temp file the object is downloaded to
+	TempFile string `json:"tempFile"`
+	// The byte ranges downloaded and synced to the temp file so far, sorted and merged
+	Completed []byteRange `json:"completed"`
+}
+
+// Returns the namespace of the download in the synchronizer state
+func (download *partialDownload) namespace() stateNamespace {
+	return stateNamespace{MountId: download.MountId, Bucket: download.Bucket}
+}
+
+// Returns a copy of the download with the given range completed
+func (download *partialDownload) withCompleted(completed byteRange) *partialDownload {
+	ranges := append(append([]byteRange{}, download.Completed...), completed)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	merged := make([]byteRange, 0, len(ranges))
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			if r.End > merged[n-1].End {
+				merged[n-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	updated := *download
+	updated.Completed = merged
+	return &updated
+}
+
+// Returns the ranges still to be downloaded split in parts of at most partSize bytes
+func (download *partialDownload) missingRanges(partSize int64) []byteRange {
+	missing := make([]byteRange, 0)
+	addMissing := func(start int64, end int64) {
+		for ; start < end; start += partSize {
+			partEnd := start + partSize
+			if partEnd > end {
+				partEnd = end
+			}
+			missing = append(missing, byteRange{Start: start, End: partEnd})
+		}
+	}
+
+	var position int64
+	for _, r := range download.Completed {
+		addMissing(position, r.Start)
+		position = r.End
+	}
+	addMissing(position, download.Size)
+	return missing
+}
+
+// Writes to the underlying file at the given offset
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// Removes the temp file and the progress of the given download
+func discardPartialDownload(download *partialDownload) {
+	if download == nil {
+		return
+	}
+	downloadLogger := logger.withMount(download.MountId, download.Bucket).withKey(download.Key).withOp("download")
+	downloadLogger.debugf("Discarding partial download (ETag: %v)", download.ETag)
+	if err := os.Remove(download.TempFile); err != nil && !os.IsNotExist(err) {
+		downloadLogger.withPath(download.TempFile).withError(err).errorf("Error removing temp file of partial download")
+	}
+	synchronizerState.RemovePartialDownload(download.namespace(), download.Key)
+}
+
+// Discards the partial downloads of the given mount whose objects are no longer in S3
+func discardStalePartialDownloads(listObjectResponses []*s3.ListObjectsV2Output, config *mountConfiguration) {
+	listed := make(map[string]bool)
+	for _, listObjectResponse := range listObjectResponses {
+		for _, item := range listObjectResponse.Contents {
+			listed[*item.Key] = true
+		}
+	}
+	ns := config.stateNamespace()
+	for _, download := range synchronizerState.GetPartialDownloads() {
+		if download.namespace() == ns && strings.HasPrefix(download.Key, config.keys.keyPrefix) && !listed[download.Key] {
+			discardPartialDownload(download)
+		}
+	}
+}
+
+// Downloads the given object to a temp file in parts, recording the progress in the synchronizer state after each part
+// so that the download can be resumed with the remaining parts after an interruption. The previous download of the object
+// is resumed if it is of the same version (ETag) of the object, otherwise the download starts over.
+// Returns the temp file with the complete content. The temp file is kept if the download fails so that it can be resumed.
+func downloadResumable(svc *s3.S3, config *mountConfiguration, item *s3.Object, destFilePath string, partSize int64, concurrency int) (*os.File, error) {
+	bucket := config.bucket
+	key := aws.StringValue(item.Key)
+	downloadLogger := config.logger.withKey(key).withOp("download")
+	download := synchronizerState.GetPartialDownload(config.stateNamespace(), key)
+	if download != nil && (download.ETag != aws.StringValue(item.ETag) || download.Size != aws.Int64Value(item.Size)) {
+		// The object changed in S3 since the download started
+		discardPartialDownload(download)
+		download = nil
+	}
+
+	var tempFile *os.File
+	if download != nil {
+		var err error
+		tempFile, err = os.OpenFile(download.TempFile, os.O_RDWR, 0)
+		if err != nil {
+			downloadLogger.withError(err).warnf("Cannot resume download, starting over")
+			discardPartialDownload(download)
+			download = nil
+		} else {
+			downloadLogger.debugf("Resuming download (%d ranges completed)", len(download.Completed))
+		}
+	}
+	if download == nil {
+		var err error
+		tempFile, err = createDownloadTempFile(destFilePath)
+		if err != nil {
+			return nil, err
+		}
+		tempFilePath, err := filepath.Abs(tempFile.Name())
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+			return nil, err
+		}
+		download = &partialDownload{
+			MountId:  config.id,
+			Bucket:   bucket,
+			Key:      key,
+			ETag:     aws.StringValue(item.ETag),
+			Size:     aws.Int64Value(item.Size),
+			TempFile: tempFilePath,
+		}
+		synchronizerState.RecordPartialDownload(download)
+	}
+
+	ranges := download.missingRanges(partSize)
+	rangesCh := make(chan byteRange, len(ranges))
+	for _, r := range ranges {
+		rangesCh <- r
+	}
+	close(rangesCh)
+
+	var lock sync.Mutex
+	var firstErr error
+	var workersWg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			for r := range rangesCh {
+				lock.Lock()
+				failed := firstErr != nil
+				lock.Unlock()
+				if failed {
+					// Leave the remaining ranges for the next attempt
+					continue
+				}
+
+				err := downloadRange(svc, bucket, item, r, tempFile)
+				if err == nil {
+					// Make sure the range is on disk before recording it as completed
+					err = tempFile.Sync()
+				}
+
+				lock.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					download = download.withCompleted(r)
+					synchronizerState.RecordPartialDownload(download)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	workersWg.Wait()
+
+	if firstErr != nil {
+		tempFile.Close()
+		if requestFailure, ok := firstErr.(awserr.RequestFailure); ok && requestFailure.StatusCode() == http.StatusPreconditionFailed {
+			// The object changed in S3 since it was listed, the next download starts over with the new version
+			discardPartialDownload(download)
+		}
+		return nil, firstErr
+	}
+	return tempFile, nil
+}
+
+// Downloads the given range of the listed version of the object to the same range of the given file
+func downloadRange(svc *s3.S3, bucket string, item *s3.Object, r byteRange, file *os.File) error {
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     item.Key,
+		IfMatch: item.ETag,
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", r.Start, r.End-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(&offsetWriter{file: file, offset: r.Start}, resp.Body)
+	if err != nil {
+		return err
+	}
+	if n != r.End-r.Start {
+		return fmt.Errorf("incomplete range %d-%d of '%v', received %d bytes", r.Start, r.End-1, *item.Key, n)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Objects up to this size are copied with a single CopyObject request, larger objects with a multipart copy
+var maxSingleCopySize int64 = 5 * 1024 * 1024 * 1024
+
+// Size of the parts of a multipart copy, increased for objects that would otherwise need more than maxCopyParts parts
+var copyPartSize int64 = 512 * 1024 * 1024
+
+const maxCopyParts = 10000
+
+// Maximum number of keys per DeleteObjects request
+const maxDeleteObjectsKeys = 1000
+
+// Moves the object of a file renamed or moved within the mount from the old key to the new key with a server side copy
+// instead of uploading the file again. The object is only moved if it still has the content of the renamed file, i.e.,
+// the file is unchanged since it was last downloaded or uploaded and the object is unchanged in S3 since then.
+// Returns flag indicating if the object was moved, the file has to be uploaded otherwise.
+func moveFileInS3(svc *s3.S3, config *mountConfiguration, oldPath string, newPath string) bool {
+	oldKey, err := config.keys.keyForLocalPath(oldPath)
+	if err != nil {
+		return false
+	}
+	newKey, err := config.keys.keyForLocalPath(newPath)
+	if err != nil {
+		return false
+	}
+	if !copyObjectIfUnchanged(svc, config, oldKey, newKey, newPath) {
+		return false
+	}
+	if err := deleteObjectsFromS3(svc, config.bucket, []string{oldKey}, config.logger); err != nil {
+		config.logger.withOp("move").withKey(oldKey).withError(err).errorf("Failed to delete the object after copying it to %v", newKey)
+	}
+	return true
+}
+
+// Moves the objects under the directory renamed or moved within the mount from the old directory key to the new one
+// with server side copies, then deletes all the objects under the old directory key. The objects that no longer have
+// the content of the corresponding file under the new directory are not copied, the files are uploaded when the new
+// directory is crawled.
+func moveDirInS3(svc *s3.S3, config *mountConfiguration, oldDirPath string, newDirPath string, excludes func(path string) bool) error {
+	bucket := config.bucket
+	oldDirKey, err := config.keys.keyForLocalPath(oldDirPath)
+	if err != nil {
+		return err
+	}
+	newDirKey, err := config.keys.keyForLocalPath(newDirPath)
+	if err != nil {
+		return err
+	}
+	moveLogger := config.logger.withOp("move").withKey(oldDirKey)
+	moveLogger.debugf("Moving directory %v to %v in S3: %v", oldDirKey, newDirKey, bucket)
+
+	// The old directory key itself is deleted as well, in case the directory was created as an empty object.
+	// List with a trailing slash, e.g., "data/" and not "data2/" for the dir "data"
+	oldKeys := []string{oldDirKey}
+	copied := 0
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(oldDirKey + "/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			oldKey := aws.StringValue(item.Key)
+			oldKeys = append(oldKeys, oldKey)
+			newKey := newDirKey + strings.TrimPrefix(oldKey, oldDirKey)
+			newPath, err := config.keys.localPath(newKey)
+			if err != nil || excludes(newPath) {
+				continue
+			}
+			if copyObjectIfUnchanged(svc, config, oldKey, newKey, newPath) {
+				copied++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		moveLogger.withOp("list").withError(err).errorf("Failed to list objects")
+		return err
+	}
+	moveLogger.debugf("Copied %v of %v objects from %v to %v", copied, len(oldKeys)-1, oldDirKey, newDirKey)
+	return deleteObjectsFromS3(svc, bucket, oldKeys, config.logger)
+}
+
+// Copies the object with the old key to the new key if the file at the given path still has the content of the object,
+// and records the copy for the file. Returns flag indicating if the object was copied.
+func copyObjectIfUnchanged(svc *s3.S3, config *mountConfiguration, oldKey string, newKey string, newPath string) bool {
+	bucket := config.bucket
+	ns := config.stateNamespace()
+	copyLogger := config.logger.withOp("copy").withKey(oldKey)
+	fi, err := os.Stat(newPath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	// A rename keeps the size and modification time of the file
+	fingerprint := synchronizerState.GetLocalFingerprint(ns, oldKey)
+	if fingerprint == nil || !fingerprint.matches(fi) {
+		copyLogger.debugf("'%v' changed since it was last synchronized, not copying the object", newPath)
+		return false
+	}
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(oldKey)})
+	if err != nil {
+		copyLogger.withError(err).debugf("Unable to get the object to copy it")
+		return false
+	}
+	if synchronizerState.HasFileChangedInS3(ns, &s3.Object{Key: aws.String(oldKey), ETag: head.ETag}) {
+		copyLogger.debugf("The object changed in S3 since it was last synchronized, not copying it")
+		return false
+	}
+
+	start := time.Now()
+	etag, err := copyObject(svc, bucket, oldKey, newKey, aws.StringValue(head.ETag), aws.Int64Value(head.ContentLength), config.kmsKeyId)
+	if err != nil {
+		copyLogger.withError(err).errorf("Unable to copy the object to %v", newKey)
+		return false
+	}
+	copyLogger.withBytes(aws.Int64Value(head.ContentLength)).withDuration(time.Since(start)).debugf("Successfully copied %v to %v", bucket+"/"+oldKey, bucket+"/"+newKey)
+	synchronizerState.RecordObjectMove(ns, oldKey, newKey, etag)
+	return true
+}
+
+// Copies the object with the given ETag and size to the new key and returns the ETag of the copy. The copy fails if
+// the object changed in the meantime.
+func copyObject(svc *s3.S3, bucket string, oldKey string, newKey string, etag string, size int64, kmsKeyId string) (string, error) {
+	copySource := (&url.URL{Path: bucket + "/" + oldKey}).EscapedPath()
+	if size <= maxSingleCopySize {
+		input := &s3.CopyObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(newKey),
+			CopySource:        aws.String(copySource),
+			CopySourceIfMatch: aws.String(etag),
+			ACL:               aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
+		}
+		if strings.TrimSpace(kmsKeyId) != "" {
+			input.ServerSideEncryption = aws.String("aws:kms")
+			input.SSEKMSKeyId = aws.String(kmsKeyId)
+		}
+		resp, err := svc.CopyObject(input)
+		if err != nil {
+			return "", err
+		}
+		if resp.CopyObjectResult == nil {
+			return "", errors.New("no copy result")
+		}
+		return aws.StringValue(resp.CopyObjectResult.ETag), nil
+	}
+
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(newKey),
+		ACL:    aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
+	}
+	if strings.TrimSpace(kmsKeyId) != "" {
+		createInput.ServerSideEncryption = aws.String("aws:kms")
+		createInput.SSEKMSKeyId = aws.String(kmsKeyId)
+	}
+	upload, err := svc.CreateMultipartUpload(createInput)
+	if err != nil {
+		return "", err
+	}
+	abort := func(err error) (string, error) {
+		svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(bucket), Key: aws.String(newKey), UploadId: upload.UploadId})
+		return "", err
+	}
+
+	partSize := copyPartSize
+	if minPartSize := (size + maxCopyParts - 1) / maxCopyParts; partSize < minPartSize {
+		partSize = minPartSize
+	}
+	var parts []*s3.CompletedPart
+	for partNumber, start := int64(1), int64(0); start < size; partNumber, start = partNumber+1, start+partSize {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		resp, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(newKey),
+			UploadId:          upload.UploadId,
+			PartNumber:        aws.Int64(partNumber),
+			CopySource:        aws.String(copySource),
+			CopySourceIfMatch: aws.String(etag),
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: resp.CopyPartResult.ETag, PartNumber: aws.Int64(partNumber)})
+	}
+	resp, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(newKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return aws.StringValue(resp.ETag), nil
+}
+
+// Deletes the objects with the given keys in batches
+func deleteObjectsFromS3(svc *s3.S3, bucket string, keys []string, logger *structuredLogger) error {
+	deleteLogger := logger.withOp("delete")
+	for start := 0; start < len(keys); start += maxDeleteObjectsKeys {
+		end := start + maxDeleteObjectsKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var objectIdentifiers []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objectIdentifiers = append(objectIdentifiers, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		resp, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objectIdentifiers, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			deleteLogger.withError(err).errorf("Failed to delete objects")
+			return err
+		}
+		if len(resp.Errors) > 0 {
+			deleteLogger.errorf("Failed to delete some objects: %v", resp.Errors)
+			return fmt.Errorf("failed to delete %v objects", len(resp.Errors))
+		}
+		deleteLogger.debugf("Successfully deleted %v objects from %v", end-start, bucket)
+	}
+	return nil
+}
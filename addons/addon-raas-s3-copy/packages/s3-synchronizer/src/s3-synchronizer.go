@@ -3,34 +3,48 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"io"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 func main() {
-	defaultS3Mounts, region, profile, destinationBase, concurrency, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, debug, err := readConfigFromArgs()
+	config, reloadConfig, err := readConfigFromArgs()
 	if err != nil {
-		log.Fatal(err)
+		logger.fatalf("%v", err)
 	}
+	openStateFiles(config.StateDir)
 
-	sess := makeSession(profile, region)
+	sess := makeSession(config.Profile, config.Region)
 
 	// Passing stopUploadWatchersAfter as -1 to let file watchers continue indefinitely if mount is writeable
 	stopUploadWatchersAfter := -1
 
-	mainImpl(sess, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, defaultS3Mounts, destinationBase, region)
+	// Keep watching for added or removed mounts while the mounts are being synchronized
+	var mountsUpdateCh chan []s3Mount
+	if config.RecurringDownloads {
+		mountsUpdateCh = make(chan []s3Mount)
+		reloadInterval := time.Duration(config.MountsReloadInterval) * time.Second
+		go watchMountSources(reloadConfig, config.configFilePath, reloadInterval, mountsUpdateCh)
+	}
+
+	mainImpl(sess, config, stopUploadWatchersAfter, mountsUpdateCh)
 }
 
-func mainImpl(sess *session.Session, debug bool, recurringDownloads bool, stopRecurringDownloadsAfter int, downloadInterval int, stopUploadWatchersAfter int, concurrency int, defaultS3Mounts string, destinationBase string, region string) error {
-	// Use a map to emulate a set to keep track of existing mounts
-	currentMounts := make(map[string]struct{}, 0)
+// Synchronizes the mounts in the given configuration. If mountsUpdateCh is not nil, the mounts are updated
+// every time a new list of mounts is received from the channel until the channel is closed.
+func mainImpl(sess *session.Session, config *synchronizerConfig, stopUploadWatchersAfter int, mountsUpdateCh <-chan []s3Mount) error {
+	transfers := newTransferConfiguration(config.Concurrency, config.ObjectConcurrency, config.MaxConcurrentTransfers, config.MaxConcurrentMounts)
+	destinationBase := config.Destination
+
 	mountsCh := make(chan *mountConfiguration, 50)
 
 	// Create wait group to keep track of go routines being spawned
@@ -38,153 +52,206 @@ func mainImpl(sess *session.Session, debug bool, recurringDownloads bool, stopRe
 	var wg sync.WaitGroup
 
 	// In another thread, get the next mount configuration from the buffered channel
-	// and download the files. If the share is marked as writeable then start the
-	// file watchers in another thread (because the setup function won't return)
+	// and process each mount in its own thread so a large or failing mount does not hold up the others.
+	// The number of mounts downloading at the same time is limited by maxConcurrentMounts.
 	go func() {
 		for {
 			mountConfig := <-mountsCh
-			if debug {
-				log.Printf("Received mount configuration from channel: %+v\n", mountConfig)
-			}
-			var sessionToUse *session.Session = sess
-			var studyId string = filepath.Base(mountConfig.destination)
-			if !(strings.TrimSpace(mountConfig.roleArn) == "") {
-				sessionToUse = makeSession(studyId, region)
-			}
-			bucket := mountConfig.bucket
-			awsRegion, err := s3manager.GetBucketRegion(context.Background(), sessionToUse, bucket, *sess.Config.Region)
-			if debug {
-				log.Println("Bucket", bucket, "region is", awsRegion)
-			}
-			if err != nil {
-				log.Println("Error getting region of the bucket", bucket, err)
-			} else {
-				sessionToUse = session.Must(session.NewSession(sessionToUse.Config))
-				sessionToUse.Config.WithRegion(awsRegion)
-			}
-			if recurringDownloads {
-				// Trigger recurring download
-				setupRecurringDownloads(&wg, sessionToUse, mountConfig, concurrency, debug, downloadInterval, stopRecurringDownloadsAfter)
-			} else {
-				downloadFiles(sessionToUse, mountConfig, concurrency, debug)
-			}
-			if mountConfig.writeable {
-				go func() {
-					err := setupUploadWatcher(&wg, sessionToUse, mountConfig, stopUploadWatchersAfter, debug)
-					if err != nil {
-						log.Printf("Error setting up file watcher: " + err.Error())
-					}
-				}()
-			}
-			if debug {
-				log.Printf("Decrement wg counter")
-			}
-			wg.Done() // Decrement wait group counter everytime we receive config from the mount channel and complete processing it
+			mountConfig.logger.debugf("Received mount configuration from channel: %+v", mountConfig)
+			go processMount(&wg, sess, mountConfig, config, transfers, stopUploadWatchersAfter)
 		}
 	}()
 
-	if debug {
-		log.Println("Fetching environment info")
-	}
+	manager := newMountManager(destinationBase, config.DeleteRemovedMountData, mountsCh, &wg)
+	manager.updateMounts(config.Mounts)
 
-	var s3MountsPtr *[]s3Mount
-	var err error
-	if defaultS3Mounts != "" {
-		s3MountsPtr, err = getDefaultMounts(defaultS3Mounts)
+	if mountsUpdateCh != nil {
+		// Keep the program running while we are watching for changes in the mounts
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s3Mounts := range mountsUpdateCh {
+				manager.updateMounts(s3Mounts)
+			}
+		}()
 	}
 
-	if err != nil {
-		log.Print("Error getting environment info: " + err.Error())
-		return err
-	}
+	wg.Wait() // Wait until all spawned go routines complete before existing the program
 
-	var s3Mounts []s3Mount
-	if s3MountsPtr != nil {
-		s3Mounts = *s3MountsPtr
+	// Write the changes of the synchronizer state and of the mount statuses not saved yet
+	if err := synchronizerState.Flush(); err != nil {
+		logger.withError(err).errorf("Error saving synchronizerState")
 	}
+	mountStatuses.flush()
+
+	return nil
+}
 
-	if debug {
-		log.Println("Parsing mounts...")
+// Downloads the files of the given mount and sets up the recurring downloads and the upload watcher as configured.
+// If the mount is marked as writeable then start the file watchers in another thread (because the setup function won't return)
+func processMount(wg *sync.WaitGroup, sess *session.Session, mountConfig *mountConfiguration, config *synchronizerConfig, transfers *transferConfiguration, stopUploadWatchersAfter int) {
+	mountLogger := mountConfig.logger
+
+	// Decrement wait group counter everytime we receive config from the mount channel and complete processing it
+	defer wg.Done()
+	defer mountConfig.activeRoutines.Done()
+
+	if mountConfig.isStopped() {
+		// The mount was removed before we got to it
+		return
 	}
-	for _, mount := range s3Mounts {
-		s := mountToString(&mount)
-		_, exists := currentMounts[s]
 
-		if debug {
-			log.Printf("Mount: %v, Adding to mount queue: %t\n", *mount.Id, !exists)
-		}
+	// Move the state of the objects of the mount saved by an older version into the namespace of the mount
+	if claimed := synchronizerState.ClaimLegacyEntries(mountConfig.stateNamespace(), mountConfig.keys.keyPrefix); claimed > 0 {
+		mountLogger.infof("Migrated %v entries of the synchronizer state of an older version", claimed)
+	}
 
-		if !exists {
-			destination := filepath.Join(destinationBase, *mount.Id)
-			config := newMountConfiguration(
-				*mount.Bucket,
-				*mount.Prefix,
-				destination,
-				*mount.Writeable,
-				*mount.KmsArn,
-				*mount.RoleArn,
-			)
-			wg.Add(1) // Increment wait group counter everytime we push config to the mount channel
-			if debug {
-				log.Printf("Increment wg counter")
-			}
-			mountsCh <- config
+	if config.StateInMounts {
+		// Keep the state of the mount with its data, the temp files of the downloads that can be resumed are only
+		// known once the state is attached
+		if err := synchronizerState.AttachMountState(mountConfig.stateNamespace(), filepath.Join(mountConfig.destination, synchronizerDirName)); err != nil {
+			mountLogger.withError(err).errorf("Unable to open the synchronizer state of the mount, not synchronizing the mount")
+			return
 		}
-
-		// Add to the currentMounts
-		currentMounts[s] = struct{}{}
+		mountConfig.stateAttached = true
 	}
 
-	wg.Wait() // Wait until all spawned go routines complete before existing the program
+	// Remove the temp files of any downloads interrupted by a crash or restart
+	cleanupDownloadTempFiles(mountConfig.destination)
 
-	return nil
+	var sessionToUse *session.Session = sess
+	var studyId string = filepath.Base(mountConfig.destination)
+	if !(strings.TrimSpace(mountConfig.roleArn) == "") {
+		sessionToUse = makeSession(studyId, config.Region)
+	}
+	bucket := mountConfig.bucket
+	awsRegion, err := s3manager.GetBucketRegion(context.Background(), sessionToUse, bucket, *sess.Config.Region)
+	mountLogger.debugf("Bucket %v region is %v", bucket, awsRegion)
+	if err != nil {
+		mountLogger.withError(err).errorf("Error getting region of the bucket %v", bucket)
+	} else {
+		sessionToUse = session.Must(session.NewSession(sessionToUse.Config))
+		sessionToUse.Config.WithRegion(awsRegion)
+	}
+	if config.Adopt {
+		// Record the local files that already have the content of their objects so they are not downloaded again
+		adoptLocalFiles(sessionToUse, mountConfig, transfers)
+	}
+	if mountConfig.writeable {
+		// Upload the changes made while the synchronizer was not running before the download overwrites them
+		reconcileLocalChanges(sessionToUse, mountConfig, config.reconcileMaxDeletions())
+	}
+	if config.RecurringDownloads {
+		// Trigger recurring download
+		setupRecurringDownloads(wg, sessionToUse, mountConfig, transfers, config.DownloadInterval, config.StopRecurringDownloadsAfter)
+	} else {
+		downloadFiles(sessionToUse, mountConfig, transfers)
+	}
+	if mountConfig.writeable {
+		mountConfig.activeRoutines.Add(1)
+		go func() {
+			defer mountConfig.activeRoutines.Done()
+			err := setupUploadWatcher(wg, sessionToUse, mountConfig, config.uploadQuietPeriod(), config.uploadMaxDelay(), stopUploadWatchersAfter)
+			if err != nil {
+				mountLogger.withError(err).errorf("Error setting up file watcher")
+			}
+		}()
+	}
+	mountLogger.debugf("Decrement wg counter")
 }
 
-// Read configuration information fro the program arguments
-func readConfigFromArgs() (string, string, string, string, int, bool, int, int, bool, error) {
-	defaultS3MountsPtr := flag.String("defaultS3Mounts", "", `A JSON string containing information about the default S3 mounts E.g., [{"id":"some-id","bucket":"some-s3-bucket-name","prefix":"some/s3/prefix/path","writeable":false,"kmsKeyId":"some-kms-key-arn"}]`)
-	regionPtr := flag.String("region", "us-east-1", "The aws region to use for the session")
-	profilePtr := flag.String("profile", "", "AWS Credentials profile. Default is no profile. The code will look for credentials in the following order: ENV variables, default credentials profile, EC2 instance metadata")
-	destinationBasePtr := flag.String("destination", "./", "The directory to download to")
-	concurrencyPtr := flag.Int("concurrency", 20, "The number of concurrent parts to download")
-	recurringDownloadsPtr := flag.Bool("recurringDownloads", false, "Whether to periodically download changes from S3")
-	stopRecurringDownloadsAfterPtr := flag.Int("stopRecurringDownloadsAfter", -1, "Stop recurring downloads after certain number of seconds. ZERO or Negative value means continue indefinitely.")
-	downloadIntervalPtr := flag.Int("downloadInterval", 60, "The interval at which to re-download changes from S3 in seconds. This is only applicable when recurringDownloads is true")
-	debugPtr := flag.Bool("debug", false, "Whether to print debug information")
-
+// Read configuration information from the configuration document, environment variables and the program arguments.
+// Also returns a function to re-read the configuration from the same sources (e.g., when the configuration document changes).
+func readConfigFromArgs() (*synchronizerConfig, func() (*synchronizerConfig, error), error) {
+	flags := newFlagConfigSource(flag.CommandLine)
 	flag.Parse()
 
-	defaultS3Mounts := *defaultS3MountsPtr
-	log.Print("defaultS3Mounts: " + defaultS3Mounts)
-
-	region := *regionPtr
-	log.Print("region: " + region)
-
-	profile := *profilePtr
-	log.Print("profile: " + profile)
-
-	destinationBase := *destinationBasePtr
-	log.Print("destinationBase: " + destinationBase)
-
-	concurrency := *concurrencyPtr
-	log.Printf("concurrency: %v", concurrency)
+	configFilePath := flags.configFilePath()
+	sources := make([]configSource, 0)
+	if configFilePath != "" {
+		sources = append(sources, newFileConfigSource(configFilePath))
+	}
+	sources = append(sources, newEnvConfigSource(), flags)
 
-	recurringDownloads := *recurringDownloadsPtr
-	log.Printf("recurringDownloads: %v", recurringDownloads)
+	reloadConfig := func() (*synchronizerConfig, error) {
+		config, err := loadConfig(sources...)
+		if err != nil {
+			return nil, err
+		}
+		config.configFilePath = configFilePath
+		return config, nil
+	}
 
-	stopRecurringDownloadsAfter := *stopRecurringDownloadsAfterPtr
-	log.Printf("stopRecurringDownloadsAfter: %v", stopRecurringDownloadsAfter)
+	config, err := reloadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := configureLogging(config); err != nil {
+		return nil, nil, err
+	}
+	if configFilePath != "" {
+		logger.infof("config: %v", configFilePath)
+	}
 
-	downloadInterval := *downloadIntervalPtr
-	log.Printf("downloadInterval: %v", downloadInterval)
-	if downloadInterval <= 0 {
-		return "", "", "", "", 0, false, -1, 0, false, fmt.Errorf("incorrect downloadInterval %v specified; the downloadInterval must be a positive integer", downloadInterval)
+	mountIds := make([]string, 0, len(config.Mounts))
+	for _, mount := range config.Mounts {
+		if mount.Id != nil {
+			mountIds = append(mountIds, *mount.Id)
+		}
 	}
+	logger.infof("mounts: %v", mountIds)
+	logger.infof("region: %v", config.Region)
+	logger.infof("profile: %v", config.Profile)
+	logger.infof("destinationBase: %v", config.Destination)
+	logger.infof("concurrency: %v", config.Concurrency)
+	logger.infof("objectConcurrency: %v", config.ObjectConcurrency)
+	logger.infof("maxConcurrentTransfers: %v", config.MaxConcurrentTransfers)
+	logger.infof("maxConcurrentMounts: %v", config.MaxConcurrentMounts)
+	logger.infof("recurringDownloads: %v", config.RecurringDownloads)
+	logger.infof("stopRecurringDownloadsAfter: %v", config.StopRecurringDownloadsAfter)
+	logger.infof("downloadInterval: %v", config.DownloadInterval)
+	logger.infof("mountsReloadInterval: %v", config.MountsReloadInterval)
+	logger.infof("deleteRemovedMountData: %v", config.DeleteRemovedMountData)
+	logger.infof("uploadQuietPeriod: %v", config.UploadQuietPeriod)
+	logger.infof("uploadMaxDelay: %v", config.UploadMaxDelay)
+	logger.infof("stateDir: %v", config.StateDir)
+	logger.infof("stateInMounts: %v", config.StateInMounts)
+	logger.infof("adopt: %v", config.Adopt)
+	logger.infof("reconcileMaxDeletions: %v", config.ReconcileMaxDeletions)
+	logger.infof("confirmReconcileDeletions: %v", config.ConfirmReconcileDeletions)
+	logger.infof("logLevel: %v", config.logLevel())
+	logger.infof("logFormat: %v", config.LogFormat)
+	logger.infof("logFile: %v", config.LogFile)
+	logger.infof("logFileMaxSize: %v", config.LogFileMaxSize)
+	logger.infof("logFileMaxBackups: %v", config.LogFileMaxBackups)
+
+	return config, reloadConfig, nil
+}
 
-	debug := *debugPtr
-	log.Printf("debug: %v", debug)
+// Sets the level, format and output of the logger as configured. The lines written with the log package (e.g., by
+// the libraries) are logged at the info level.
+func configureLogging(config *synchronizerConfig) error {
+	var w io.Writer = os.Stderr
+	if config.LogFile != "" {
+		if err := os.MkdirAll(filepath.Dir(config.LogFile), 0755); err != nil {
+			return err
+		}
+		fileWriter, err := newRotatingFileWriter(config.LogFile, int64(config.LogFileMaxSize)*1024*1024, config.LogFileMaxBackups)
+		if err != nil {
+			return err
+		}
+		w = fileWriter
+	}
+	logger.configure(w, config.logLevel(), config.LogFormat)
+	log.SetFlags(0)
+	log.SetOutput(&stdLogWriter{logger: logger, level: levelInfo})
+	return nil
+}
 
-	return defaultS3Mounts, region, profile, destinationBase, concurrency, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, debug, nil
+// Opens the synchronizer state and the status file in the given directory (the user's home directory if empty)
+func openStateFiles(stateDirPath string) {
+	synchronizerState = NewPersistentSynchronizerState(stateDirPath)
+	mountStatuses = newMountStatusRegistry(NewFileBasedPersistenceWithJsonFormat(mountStatusFileName, stateDirPath))
 }
 
 func makeSession(profile string, region string) *session.Session {
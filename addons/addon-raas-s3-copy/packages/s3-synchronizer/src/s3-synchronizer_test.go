@@ -2,28 +2,42 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/johannesboyne/gofakes3"
 	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/orcaman/concurrent-map"
+	"hash/crc32"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 var testAwsSession *session.Session
 
 const testRegion = "us-east-1"
-const debug = true
+
+// The level of the lines logged by the code under test
+const testLogLevel = levelDebug
 
 // A test destination directory path. The test creates this directory and populates it with simulated downloads
 // This directory is cleaned up at the end of the test.
@@ -35,133 +49,2434 @@ const destinationBase = buildDir + "/temp-output"
 
 const testFakeBucketName = "test-bucket"
 
-const testFileContentTemplate = "test file content for file = %d"
-const testFileUpdatedContentTemplate = "UPDATED -- test file content for file = %d"
+const testFileContentTemplate = "test file content for file = %d"
+const testFileUpdatedContentTemplate = "UPDATED -- test file content for file = %d"
+
+// ------------------------------- Test Cases -------------------------------/
+
+// ######### Tests for Initial Downloads #########
+
+// Test for single S3Mount
+func TestMainImplForInitialDownloadSingleMount(t *testing.T) {
+
+	// ---- Data setup ----
+	noOfMounts := 1
+	testMounts := make([]s3Mount, noOfMounts)
+	testMountId := "TestMainImplForInitialDownloadSingleMount"
+	noOfFilesInMount := 5
+	testMounts[0] = *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	testMountsJsonBytes, err := json.Marshal(testMounts)
+	testMountsJson := string(testMountsJsonBytes)
+
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error creating test mount setup data %s", err)
+	}
+
+	// ---- Inputs ----
+	concurrency := 2
+
+	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+
+	// ---- Run code under test ----
+	err = runMainImpl(false, -1, 60, -1, concurrency, testMountsJson)
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
+		t.Errorf("Error: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, noOfFilesInMount)
+}
+
+// Test for multiple S3Mounts
+func TestMainImplForInitialDownloadMultipleMounts(t *testing.T) {
+	// ---- Data setup ----
+	noOfMounts := 3
+	testMounts := make([]s3Mount, noOfMounts)
+	testBucketName := "test-bucket"
+
+	testMountId1 := "TestMainImplForInitialDownloadMultipleMounts1"
+	noOfFilesInMount1 := 5
+	testMounts[0] = *putReadOnlyTestMountFiles(t, testBucketName, testMountId1, noOfFilesInMount1)
+
+	testMountId2 := "TestMainImplForInitialDownloadMultipleMounts2"
+	noOfFilesInMount2 := 1
+	testMounts[1] = *putReadOnlyTestMountFiles(t, testBucketName, testMountId2, noOfFilesInMount2)
+
+	testMountId3 := "TestMainImplForInitialDownloadMultipleMounts3"
+	noOfFilesInMount3 := 0 // Test mount containing no files (simulating empty folder in S3)
+	testMounts[2] = *putReadOnlyTestMountFiles(t, testBucketName, testMountId3, noOfFilesInMount3)
+
+	testMountsJsonBytes, err := json.Marshal(testMounts)
+	testMountsJson := string(testMountsJsonBytes)
+
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error creating test mount setup data %s", err)
+	}
+
+	// ---- Inputs ----
+	concurrency := 2
+
+	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+
+	// ---- Run code under test ----
+	err = runMainImpl(false, -1, 60, -1, concurrency, testMountsJson)
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
+		t.Errorf("Error: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId1, noOfFilesInMount1)
+	assertFilesDownloaded(t, testMountId2, noOfFilesInMount2)
+	assertFilesDownloaded(t, testMountId3, noOfFilesInMount3)
+}
+
+// Test for s3Mounts json being empty array
+func TestMainImplForInitialDownloadEmptyMounts(t *testing.T) {
+	// ---- Data setup ----
+	var testMounts []s3Mount
+
+	testMountsJsonBytes, err := json.Marshal(testMounts)
+	testMountsJson := string(testMountsJsonBytes)
+
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error creating test mount setup data %s", err)
+	}
+
+	// ---- Inputs ----
+	concurrency := 2
+
+	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+
+	// ---- Run code under test ----
+	err = runMainImpl(false, -1, 60, -1, concurrency, testMountsJson)
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
+		t.Errorf("Error: %v", err)
+	}
+}
+
+// Negative test: Test for invalid s3Mounts json
+func TestMainImplForInitialDownloadInvalidMounts(t *testing.T) {
+	// ---- Inputs ----
+	concurrency := 2
+
+	testMountsJson := "some invalid json"
+	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+
+	// ---- Run code under test ----
+	err := runMainImpl(false, -1, 60, -1, concurrency, testMountsJson)
+	if err == nil {
+		// Fail test in case of no errors since we are expecting errors when passing invalid json for mounting
+		t.Logf("Expecting error when running the main s3-synchronizer with invalid testMountsJson but it ran fine")
+	}
+}
+
+// Test for multiple S3Mounts with many files downloaded concurrently under a global transfer budget smaller than the
+// per object part concurrency
+func TestMainImplForInitialDownloadWithTransferBudget(t *testing.T) {
+	// ---- Data setup ----
+	testMountId1 := "TestMainImplForInitialDownloadWithTransferBudget1"
+	noOfFilesInMount1 := 25
+	testMountId2 := "TestMainImplForInitialDownloadWithTransferBudget2"
+	noOfFilesInMount2 := 15
+	testMounts := []s3Mount{
+		*putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId1, noOfFilesInMount1),
+		*putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId2, noOfFilesInMount2),
+	}
+	testMountsJsonBytes, err := json.Marshal(testMounts)
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error creating test mount setup data %s", err)
+	}
+
+	// ---- Inputs ----
+	config, err := makeTestConfig(false, -1, 60, 5, string(testMountsJsonBytes))
+	if err != nil {
+		t.Fatalf("Error creating test config: %v", err)
+	}
+	config.ObjectConcurrency = 4
+	config.MaxConcurrentTransfers = 2
+
+	// ---- Run code under test ----
+	err = mainImpl(testAwsSession, config, -1, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId1, noOfFilesInMount1)
+	assertFilesDownloaded(t, testMountId2, noOfFilesInMount2)
+}
+
+// Test that the part size and the number of concurrent parts adapt to the object size
+func TestDownloadPartSettings(t *testing.T) {
+	const mb = int64(1024 * 1024)
+	transfers := newTransferConfiguration(10, 4, 20, 1)
+
+	testCases := []struct {
+		size                    int64
+		expectedPartSize        int64
+		expectedPartConcurrency int
+	}{
+		{0, minDownloadPartSize, 1},
+		{1 * mb, minDownloadPartSize, 1},
+		{8 * mb, minDownloadPartSize, 1},
+		{20 * mb, minDownloadPartSize, 3},
+		{400 * mb, 10 * mb, 10},
+		{100 * 1024 * mb, maxDownloadPartSize, 10},
+	}
+	for _, testCase := range testCases {
+		partSize, partConcurrency := transfers.downloadPartSettings(testCase.size)
+		if partSize != testCase.expectedPartSize || partConcurrency != testCase.expectedPartConcurrency {
+			t.Errorf("ASSERT_FAILURE: Expected: part size %v and %v concurrent parts for object of size %v | Actual: part size %v and %v concurrent parts",
+				testCase.expectedPartSize, testCase.expectedPartConcurrency, testCase.size, partSize, partConcurrency)
+		}
+	}
+}
+
+// Negative test: Test that a mount failing to synchronize does not hold up the other mounts when only one mount
+// is allowed to synchronize at a time and that the outcome of each mount is reflected in its status
+func TestMainImplForInitialDownloadWithFailingMount(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestMainImplForInitialDownloadWithFailingMount"
+	noOfFilesInMount := 3
+	validMount := *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	failingMountId := "TestMainImplForInitialDownloadWithFailingMountMissingBucket"
+	testMountsJson := fmt.Sprintf(`[{"id":"%s","bucket":"some-missing-bucket","prefix":"studies/Organization/%s"},{"id":"%s","bucket":"%s","prefix":"%s"}]`,
+		failingMountId, failingMountId, *validMount.Id, *validMount.Bucket, *validMount.Prefix)
+
+	previousListRetryBackoff := listRetryBackoff
+	listRetryBackoff = 10 * time.Millisecond
+	defer func() { listRetryBackoff = previousListRetryBackoff }()
+
+	// ---- Inputs ----
+	config, err := makeTestConfig(false, -1, 60, 2, testMountsJson)
+	if err != nil {
+		t.Fatalf("Error creating test config: %v", err)
+	}
+	config.MaxConcurrentMounts = 1
+
+	// ---- Run code under test ----
+	err = mainImpl(testAwsSession, config, -1, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, noOfFilesInMount)
+
+	validStatus, ok := mountStatuses.get(newMountConfiguration(testMountId, testFakeBucketName, *validMount.Prefix, filepath.Join(destinationBase, testMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{}))
+	if !ok || validStatus.State != mountStateIdle || validStatus.LastSyncFiles != noOfFilesInMount {
+		t.Errorf("ASSERT_FAILURE: Expected: mount %v to be %v after downloading %v files | Actual: %+v", testMountId, mountStateIdle, noOfFilesInMount, validStatus)
+	}
+	failingStatus, ok := mountStatuses.get(newMountConfiguration(failingMountId, "some-missing-bucket", "", filepath.Join(destinationBase, failingMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{}))
+	if !ok || failingStatus.State != mountStateFailed || failingStatus.LastError == "" {
+		t.Errorf("ASSERT_FAILURE: Expected: mount %v to be %v with an error | Actual: %+v", failingMountId, mountStateFailed, failingStatus)
+	}
+}
+
+// Negative test: Test that invalid mounts are skipped and the valid mounts are still downloaded
+func TestMainImplForInitialDownloadPartiallyInvalidMounts(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestMainImplForInitialDownloadPartiallyInvalidMounts"
+	noOfFilesInMount := 2
+	validMount := *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	testMountsJson := fmt.Sprintf(`[{"id":"missing-bucket","prefix":"studies/Organization/missing-bucket"},{"id":"missing-prefix","bucket":"%s"},{"bucket":"%s","prefix":"missing-id"},{"id":"%s","bucket":"%s","prefix":"%s"}]`,
+		testFakeBucketName, testFakeBucketName, *validMount.Id, *validMount.Bucket, *validMount.Prefix)
+
+	// ---- Inputs ----
+	concurrency := 2
+
+	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+
+	// ---- Run code under test ----
+	err := runMainImpl(false, -1, 60, -1, concurrency, testMountsJson)
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
+		t.Errorf("Error: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, noOfFilesInMount)
+}
+
+// Test that the temp files left behind by interrupted downloads are cleaned up at startup and that the downloads do not
+// leave any temp files behind
+func TestMainImplForInitialDownloadCleansUpTempFiles(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestMainImplForInitialDownloadCleansUpTempFiles"
+	noOfFilesInMount := 3
+	testMounts := []s3Mount{*putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)}
+	testMountsJsonBytes, err := json.Marshal(testMounts)
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error creating test mount setup data %s", err)
+	}
+	staleTempFile := filepath.Join(destinationBase, testMountId, "sub-dir", downloadTempFilePrefix+"12345"+downloadTempFileSuffix)
+	if err := os.MkdirAll(filepath.Dir(staleTempFile), os.ModePerm); err != nil {
+		t.Fatalf("Error creating test directory: %v", err)
+	}
+	if err := ioutil.WriteFile(staleTempFile, []byte("partial content"), 0600); err != nil {
+		t.Fatalf("Error creating stale temp file: %v", err)
+	}
+
+	// ---- Run code under test ----
+	err = runMainImpl(false, -1, 60, -1, 2, string(testMountsJsonBytes))
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, noOfFilesInMount)
+	filepath.Walk(filepath.Join(destinationBase, testMountId), func(path string, info os.FileInfo, err error) error {
+		if err == nil && isDownloadTempFile(path) {
+			t.Errorf("ASSERT_FAILURE: Expected: no download temp files after download | Actual: Found %v", path)
+		}
+		return nil
+	})
+}
+
+// Negative test: Test that a failed download leaves the existing file untouched and does not leave a temp file behind
+func TestWriteFileAtomicallyFailure(t *testing.T) {
+	// ---- Data setup ----
+	dir := filepath.Join(destinationBase, "TestWriteFileAtomicallyFailure")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatalf("Error creating test directory: %v", err)
+	}
+	destFilePath := filepath.Join(dir, "test.txt")
+	if err := ioutil.WriteFile(destFilePath, []byte("original content"), 0644); err != nil {
+		t.Fatalf("Error creating test file: %v", err)
+	}
+
+	// ---- Run code under test ----
+	err := writeFileAtomically(destFilePath, func(file *os.File) error {
+		file.WriteString("partial")
+		return fmt.Errorf("simulated download failure")
+	})
+
+	// ---- Assertions ----
+	if err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the download failure to be returned | Actual: no error")
+	}
+	content, _ := ioutil.ReadFile(destFilePath)
+	if string(content) != "original content" {
+		t.Errorf(`ASSERT_FAILURE: Expected: File "%v" to contain "original content" | Actual: The file contains "%v" instead`, destFilePath, string(content))
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: only %v in %v | Actual: %v files", destFilePath, dir, len(files))
+	}
+}
+
+// Test that downloaded content is verified against the ETag (MD5 or multipart ETag) and the additional checksums of the object
+func TestObjectDigestsVerify(t *testing.T) {
+	content := []byte("0123456789")
+	md5Of := func(b []byte) []byte { h := md5.Sum(b); return h[:] }
+	sha256Of := func(b []byte) []byte { h := sha256.Sum256(b); return h[:] }
+	crc32cOf := func(b []byte) []byte {
+		h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		h.Write(b)
+		return h.Sum(nil)
+	}
+	// Multipart ETag of the content uploaded in parts of 4 bytes
+	multipartETag := formatETag(md5Of(append(append(md5Of(content[:4]), md5Of(content[4:8])...), md5Of(content[8:])...)), 3)
+	compositeSha256 := formatChecksum(sha256Of(append(append(sha256Of(content[:4]), sha256Of(content[4:8])...), sha256Of(content[8:])...)), 3)
+
+	testCases := []struct {
+		name          string
+		digests       objectDigests
+		expectedMatch bool
+	}{
+		{"single part ETag", objectDigests{etag: hex.EncodeToString(md5Of(content)), etagIsDigest: true}, true},
+		{"wrong single part ETag", objectDigests{etag: hex.EncodeToString(md5Of([]byte("corrupt"))), etagIsDigest: true}, false},
+		{"multipart ETag", objectDigests{etag: multipartETag, etagIsDigest: true, partSize: 4}, true},
+		{"multipart ETag with wrong part size", objectDigests{etag: multipartETag, etagIsDigest: true, partSize: 5}, false},
+		{"multipart ETag with unknown part size", objectDigests{etag: multipartETag, etagIsDigest: true}, true},
+		{"SSE-KMS ETag", objectDigests{etag: "not-a-digest", etagIsDigest: false}, true},
+		{"SHA256 checksum", objectDigests{checksums: map[string]string{"sha256": formatChecksum(sha256Of(content), 0)}}, true},
+		{"wrong SHA256 checksum", objectDigests{checksums: map[string]string{"sha256": formatChecksum(sha256Of([]byte("corrupt")), 0)}}, false},
+		{"composite SHA256 checksum", objectDigests{checksums: map[string]string{"sha256": compositeSha256}, partSize: 4}, true},
+		{"CRC32C checksum", objectDigests{checksums: map[string]string{"crc32c": formatChecksum(crc32cOf(content), 0)}}, true},
+		{"wrong CRC32C checksum with matching ETag", objectDigests{etag: hex.EncodeToString(md5Of(content)), etagIsDigest: true, checksums: map[string]string{"crc32c": formatChecksum(crc32cOf([]byte("corrupt")), 0)}}, false},
+	}
+	for _, testCase := range testCases {
+		digests := testCase.digests
+		digests.key = testCase.name
+		digests.size = int64(len(content))
+
+		err := digests.verify(bytes.NewReader(content))
+
+		if testCase.expectedMatch && err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: %v to match | Actual: %v", testCase.name, err)
+		}
+		if _, ok := err.(*integrityError); !testCase.expectedMatch && !ok {
+			t.Errorf("ASSERT_FAILURE: Expected: %v to not match | Actual: %v", testCase.name, err)
+		}
+	}
+}
+
+// Adds a wrong SHA-256 checksum to the responses for the given key to simulate corrupt downloads
+type corruptChecksumTransport struct {
+	key string
+}
+
+func (transport *corruptChecksumTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil && strings.HasSuffix(req.URL.Path, transport.key) {
+		resp.Header.Set("X-Amz-Checksum-Sha256", formatChecksum(make([]byte, sha256.Size), 0))
+	}
+	return resp, err
+}
+
+// Negative test: Test that downloads not matching the digests of the object are retried, counted and quarantined
+// and that the quarantined objects are not downloaded again
+func TestDownloadQuarantinesCorruptObjects(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestDownloadQuarantinesCorruptObjects"
+	noOfFilesInMount := 2
+	testMount := putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	corruptKey := *testMount.Prefix + "/test1.txt"
+
+	// ---- Inputs ----
+	sess := testAwsSession.Copy(&aws.Config{HTTPClient: &http.Client{Transport: &corruptChecksumTransport{key: corruptKey}}})
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(2, 2, 10, 1)
+
+	// ---- Run code under test ----
+	stats := syncS3ToLocal(sess, config, transfers)
+	statsAfterQuarantine := syncS3ToLocal(sess, config, transfers)
+
+	// ---- Assertions ----
+	assertObjectInS3WithContent(t, testFakeBucketName, corruptKey, testFileContentTemplate, 1)
+	assertFileDeleted(t, testMountId, 1)
+	if _, err := os.Stat(filepath.Join(destinationBase, testMountId, "test0.txt")); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the valid object to be downloaded | Actual: %v", err)
+	}
+	if stats.integrityFailures != maxIntegrityAttempts || len(stats.quarantinedKeys) != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: %v integrity failures and 1 quarantined object | Actual: %v integrity failures and %v quarantined objects",
+			maxIntegrityAttempts, stats.integrityFailures, len(stats.quarantinedKeys))
+	}
+	quarantined := quarantinePath(config, &s3.Object{Key: aws.String(corruptKey), ETag: aws.String(fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf(testFileContentTemplate, 1)))))})
+	if _, err := os.Stat(quarantined); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the corrupt download to be quarantined at %v | Actual: %v", quarantined, err)
+	}
+	if statsAfterQuarantine.integrityFailures != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the quarantined object not to be downloaded again | Actual: %v integrity failures", statsAfterQuarantine.integrityFailures)
+	}
+}
+
+// Test that the completed ranges of a partial download are merged and the missing ranges are split in parts
+func TestPartialDownloadRanges(t *testing.T) {
+	download := &partialDownload{Size: 100}
+	download = download.withCompleted(byteRange{Start: 40, End: 50})
+	download = download.withCompleted(byteRange{Start: 0, End: 10})
+	download = download.withCompleted(byteRange{Start: 10, End: 20})
+
+	expectedCompleted := []byteRange{{0, 20}, {40, 50}}
+	if fmt.Sprint(download.Completed) != fmt.Sprint(expectedCompleted) {
+		t.Errorf("ASSERT_FAILURE: Expected: completed ranges %v | Actual: %v", expectedCompleted, download.Completed)
+	}
+	expectedMissing := []byteRange{{20, 35}, {35, 40}, {50, 65}, {65, 80}, {80, 95}, {95, 100}}
+	if missing := download.missingRanges(15); fmt.Sprint(missing) != fmt.Sprint(expectedMissing) {
+		t.Errorf("ASSERT_FAILURE: Expected: missing ranges %v | Actual: %v", expectedMissing, missing)
+	}
+}
+
+// Records the ranged GET requests and fails the requests for ranges starting at or after failFrom (if not negative)
+// to simulate an interrupted download
+type rangeRecordingTransport struct {
+	failFrom int64
+	lock     sync.Mutex
+	starts   []int64
+}
+
+func (transport *rangeRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var start, end int64
+	if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); req.Method == http.MethodGet && err == nil {
+		transport.lock.Lock()
+		transport.starts = append(transport.starts, start)
+		transport.lock.Unlock()
+		if transport.failFrom >= 0 && start >= transport.failFrom {
+			// Let the other ranges start before failing
+			time.Sleep(200 * time.Millisecond)
+			return nil, fmt.Errorf("simulated interruption")
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Test that an interrupted download of a large object is resumed with the missing ranges only
+func TestDownloadResumesInterruptedDownload(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestDownloadResumesInterruptedDownload"
+	mountPrefix := fmt.Sprintf("studies/Organization/%s", testMountId)
+	key := mountPrefix + "/large.bin"
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20*1024*1024/16)
+	_, err := s3.New(testAwsSession).PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(key), Body: bytes.NewReader(content)})
+	if err != nil {
+		t.Fatalf("Could not put test file to fake S3 server for testing: %v", err)
+	}
+
+	// ---- Inputs ----
+	config := newMountConfiguration(testMountId, testFakeBucketName, mountPrefix, filepath.Join(destinationBase, testMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(10, 4, 50, 1)
+	interruptedTransport := &rangeRecordingTransport{failFrom: minDownloadPartSize}
+	interruptedSess := testAwsSession.Copy(&aws.Config{MaxRetries: aws.Int(0), HTTPClient: &http.Client{Transport: interruptedTransport}})
+	resumedTransport := &rangeRecordingTransport{failFrom: -1}
+	resumedSess := testAwsSession.Copy(&aws.Config{HTTPClient: &http.Client{Transport: resumedTransport}})
+
+	// ---- Run code under test ----
+	interruptedStats := syncS3ToLocal(interruptedSess, config, transfers)
+	download := synchronizerState.GetPartialDownload(config.stateNamespace(), key)
+	// Simulate a restart
+	cleanupDownloadTempFiles(config.destination)
+	resumedStats := syncS3ToLocal(resumedSess, config, transfers)
+
+	// ---- Assertions ----
+	if len(interruptedStats.errorPrefixes) != 1 || download == nil || len(download.Completed) != 1 || download.Completed[0] != (byteRange{0, minDownloadPartSize}) {
+		t.Fatalf("ASSERT_FAILURE: Expected: the first part to be recorded after the interrupted download | Actual: %+v", download)
+	}
+	for _, start := range resumedTransport.starts {
+		if start < minDownloadPartSize {
+			t.Errorf("ASSERT_FAILURE: Expected: the resumed download to request the missing ranges only | Actual: requested range starting at %v", start)
+		}
+	}
+	if resumedStats.numberOfRetrievedFiles != 1 || len(resumedStats.errorPrefixes) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the resumed download to complete | Actual: %v files downloaded, %v errors", resumedStats.numberOfRetrievedFiles, len(resumedStats.errorPrefixes))
+	}
+	downloaded, err := ioutil.ReadFile(filepath.Join(config.destination, "large.bin"))
+	if err != nil || !bytes.Equal(downloaded, content) {
+		t.Errorf("ASSERT_FAILURE: Expected: the resumed download to have the content of the object | Actual: %v bytes, error %v", len(downloaded), err)
+	}
+	if synchronizerState.GetPartialDownload(config.stateNamespace(), key) != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the partial download to be removed after completion | Actual: %+v", synchronizerState.GetPartialDownload(config.stateNamespace(), key))
+	}
+	if _, err := os.Stat(download.TempFile); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: the temp file %v to be moved into place | Actual: %v", download.TempFile, err)
+	}
+}
+
+// Test that files of writeable mounts changed locally and in S3 are resolved with the conflict policy of the mount
+func TestDownloadResolvesConflicts(t *testing.T) {
+	const localContentTemplate = "LOCAL -- test file content for file = %d"
+	for _, policy := range []conflictPolicy{conflictPolicyRemoteWins, conflictPolicyLocalWins, conflictPolicyKeepBoth} {
+		t.Run(string(policy), func(t *testing.T) {
+			// ---- Data setup ----
+			testMountId := "TestDownloadResolvesConflicts-" + string(policy)
+			testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 1)
+			key := *testMount.Prefix + "/test0.txt"
+
+			// ---- Inputs ----
+			config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), true, "", "", policy, mountFilterSettings{})
+			transfers := newTransferConfiguration(1, 1, 10, 1)
+			filePath := filepath.Join(config.destination, "test0.txt")
+
+			// ---- Run code under test ----
+			syncS3ToLocal(testAwsSession, config, transfers)
+			if err := ioutil.WriteFile(filePath, []byte(fmt.Sprintf(localContentTemplate, 0)), 0644); err != nil {
+				t.Fatalf("Could not update test file on local file system for testing: %v", err)
+			}
+			updateTestMountFiles(t, testFakeBucketName, testMountId, 1)
+			stats := syncS3ToLocal(testAwsSession, config, transfers)
+			statsAfterConflict := syncS3ToLocal(testAwsSession, config, transfers)
+
+			// ---- Assertions ----
+			if stats.conflicts != 1 || statsAfterConflict.conflicts != 0 {
+				t.Errorf("ASSERT_FAILURE: Expected: 1 conflict, then none once resolved | Actual: %v conflicts, then %v", stats.conflicts, statsAfterConflict.conflicts)
+			}
+			conflictCopies, _ := filepath.Glob(filePath + ".conflict-*")
+			switch policy {
+			case conflictPolicyRemoteWins:
+				assertUpdatedFilesDownloaded(t, testMountId, 1)
+				assertObjectInS3WithContent(t, testFakeBucketName, key, testFileUpdatedContentTemplate, 0)
+			case conflictPolicyLocalWins:
+				assertFilesDownloadedWithContent(t, testMountId, 1, localContentTemplate)
+				assertObjectInS3WithContent(t, testFakeBucketName, key, localContentTemplate, 0)
+			case conflictPolicyKeepBoth:
+				assertUpdatedFilesDownloaded(t, testMountId, 1)
+				if len(conflictCopies) != 1 {
+					t.Fatalf("ASSERT_FAILURE: Expected: a copy of the local changes | Actual: %v", conflictCopies)
+				}
+				kept, err := ioutil.ReadFile(conflictCopies[0])
+				if err != nil || string(kept) != fmt.Sprintf(localContentTemplate, 0) {
+					t.Errorf("ASSERT_FAILURE: Expected: %v to contain the local changes | Actual: %q, error %v", conflictCopies[0], kept, err)
+				}
+			}
+			if policy != conflictPolicyKeepBoth && len(conflictCopies) != 0 {
+				t.Errorf("ASSERT_FAILURE: Expected: no copy of the local changes | Actual: %v", conflictCopies)
+			}
+		})
+	}
+}
+
+// Marks the objects as encrypted with SSE-KMS in the responses, with the given SHA-256 checksum if not empty
+type sseKmsTransport struct {
+	sha256Checksum string
+}
+
+func (transport *sseKmsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		resp.Header.Set("X-Amz-Server-Side-Encryption", s3.ServerSideEncryptionAwsKms)
+		if transport.sha256Checksum != "" {
+			resp.Header.Set("X-Amz-Checksum-Sha256", transport.sha256Checksum)
+		}
+	}
+	return resp, err
+}
+
+// Test that the ETag of objects encrypted with SSE-KMS is not compared with the MD5 of the local file, and that the
+// local file is compared with the additional checksums of the object instead
+func TestLocalFileMatchesSseKmsObject(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestLocalFileMatchesSseKmsObject"
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 1)
+	key := *testMount.Prefix + "/test0.txt"
+	content := fmt.Sprintf(testFileContentTemplate, 0)
+	head, err := s3.New(testAwsSession).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(key)})
+	if err != nil {
+		t.Fatalf("Could not get test object from fake S3 server for testing: %v", err)
+	}
+	item := &s3.Object{Key: aws.String(key), ETag: head.ETag, Size: head.ContentLength}
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+	os.MkdirAll(config.destination, os.ModePerm)
+	sameFile := filepath.Join(config.destination, "same.txt")
+	differentFile := filepath.Join(config.destination, "different.txt")
+	ioutil.WriteFile(sameFile, []byte(content), 0644)
+	ioutil.WriteFile(differentFile, []byte(strings.ToUpper(content)), 0644)
+	checksum := sha256.Sum256([]byte(content))
+
+	testCases := []struct {
+		name           string
+		sha256Checksum string
+		filePath       string
+		expectedMatch  bool
+	}{
+		// The ETag of the fake object is the MD5 of the content, it must not be used for SSE-KMS objects
+		{"same content without checksums", "", sameFile, false},
+		{"same content with checksum", formatChecksum(checksum[:], 0), sameFile, true},
+		{"different content with checksum", formatChecksum(checksum[:], 0), differentFile, false},
+	}
+
+	for _, testCase := range testCases {
+		// ---- Inputs ----
+		sess := testAwsSession.Copy(&aws.Config{HTTPClient: &http.Client{Transport: &sseKmsTransport{sha256Checksum: testCase.sha256Checksum}}})
+		fi, _ := os.Stat(testCase.filePath)
+
+		// ---- Run code under test ----
+		match := localFileMatchesObject(s3.New(sess), config, testCase.filePath, fi, item)
+
+		// ---- Assertions ----
+		if match != testCase.expectedMatch {
+			t.Errorf("ASSERT_FAILURE: Expected: %v to match = %v | Actual: %v", testCase.name, testCase.expectedMatch, match)
+		}
+	}
+}
+
+// Test the .gitignore semantics of the filter rules, the include patterns, the size and age limits and the ignore file
+func TestMountFilterRules(t *testing.T) {
+	// ---- Data setup ----
+	root := filepath.Join(destinationBase, "TestMountFilterRules")
+	os.MkdirAll(root, os.ModePerm)
+
+	// ---- Inputs ----
+	filter := newMountFilter(root, mountFilterSettings{
+		exclude:        []string{"*.log", "!keep.log", "/build/", "docs/**/*.pdf", `\#notes`},
+		excludePresets: []string{"notebooks"},
+		maxFileSize:    10,
+		maxAge:         time.Hour,
+	})
+	includeFilter := newMountFilter(root, mountFilterSettings{include: []string{"*.ipynb", "data/"}})
+	cases := []struct {
+		filter   *mountFilter
+		relPath  string
+		isDir    bool
+		excluded bool
+	}{
+		{filter, "notes.txt", false, false},
+		{filter, "a.log", false, true},
+		{filter, "sub/a.log", false, true},
+		{filter, "keep.log", false, false},
+		{filter, "build", true, true},
+		{filter, "build/out.txt", false, true},
+		{filter, "build", false, false},
+		{filter, "src/build", true, false},
+		{filter, "docs/c.pdf", false, true},
+		{filter, "docs/a/b/c.pdf", false, true},
+		{filter, "other/docs/c.pdf", false, false},
+		{filter, "#notes", false, true},
+		{filter, "sub/.ipynb_checkpoints/nb-checkpoint.ipynb", false, true},
+		{filter, "__pycache__", true, true},
+		{filter, ".venv/bin/python", false, true},
+		{filter, "file.swp", false, true},
+		{filter, "$RECYCLE.BIN/file.txt", false, true},
+		{includeFilter, "nb.ipynb", false, false},
+		{includeFilter, "sub/nb.ipynb", false, false},
+		{includeFilter, "data/x.csv", false, false},
+		{includeFilter, "notes.txt", false, true},
+		{includeFilter, "sub", true, false},
+	}
+
+	// ---- Run code under test & Assertions ----
+	for _, c := range cases {
+		if excluded := c.filter.excludesPath(c.relPath, c.isDir); excluded != c.excluded {
+			t.Errorf("ASSERT_FAILURE: Expected: %q (dir: %v) excluded = %v | Actual: %v", c.relPath, c.isDir, c.excluded, excluded)
+		}
+	}
+	if !filter.excludesSize(11, time.Now()) || filter.excludesSize(10, time.Now()) || !filter.excludesSize(1, time.Now().Add(-2*time.Hour)) {
+		t.Errorf("ASSERT_FAILURE: Expected: files larger than 10 bytes or older than 1 hour to be excluded | Actual: size and age limits not applied")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, syncIgnoreFileName), []byte("# secrets\nsecret*\n!secret.pub\n"), 0644); err != nil {
+		t.Fatalf("Could not create ignore file for testing: %v", err)
+	}
+	filter.refresh()
+	if !filter.excludesPath("sub/secret.key", false) || filter.excludesPath("secret.pub", false) {
+		t.Errorf("ASSERT_FAILURE: Expected: the patterns of the ignore file to be applied | Actual: not applied")
+	}
+	os.Remove(filepath.Join(root, syncIgnoreFileName))
+	filter.refresh()
+	if filter.excludesPath("sub/secret.key", false) {
+		t.Errorf("ASSERT_FAILURE: Expected: the patterns of the removed ignore file not to be applied | Actual: still applied")
+	}
+}
+
+// Test that objects excluded by the filter rules are not downloaded and that excluded local files are not deleted
+func TestDownloadAppliesFilterRules(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestDownloadAppliesFilterRules"
+	noOfFilesInMount := 2
+	testMount := putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	s3Client := s3.New(testAwsSession)
+	for key, content := range map[string]string{
+		"/.ipynb_checkpoints/nb-checkpoint.ipynb": "{}",
+		"/large.bin": strings.Repeat("x", 200),
+	} {
+		if _, err := s3Client.PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(*testMount.Prefix + key), Body: strings.NewReader(content)}); err != nil {
+			t.Fatalf("Could not put test files to fake S3 server for testing: %v", err)
+		}
+	}
+	destination := filepath.Join(destinationBase, testMountId)
+	localOnlyFile := filepath.Join(destination, "__pycache__", "mod.pyc")
+	os.MkdirAll(filepath.Dir(localOnlyFile), os.ModePerm)
+	ioutil.WriteFile(localOnlyFile, []byte("local"), 0644)
+	ioutil.WriteFile(filepath.Join(destination, syncIgnoreFileName), []byte("test1.txt\n"), 0644)
+
+	// ---- Inputs ----
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, destination, false, "", "", defaultConflictPolicy,
+		mountFilterSettings{excludePresets: []string{"notebooks"}, maxFileSize: 100})
+	transfers := newTransferConfiguration(2, 2, 10, 1)
+
+	// ---- Run code under test ----
+	stats := syncS3ToLocal(testAwsSession, config, transfers)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, 1)
+	assertFileDeleted(t, testMountId, 1)
+	if stats.numberOfRetrievedFiles != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: only the included object to be downloaded | Actual: %v files downloaded", stats.numberOfRetrievedFiles)
+	}
+	for _, excluded := range []string{".ipynb_checkpoints", "large.bin"} {
+		if _, err := os.Stat(filepath.Join(destination, excluded)); !os.IsNotExist(err) {
+			t.Errorf("ASSERT_FAILURE: Expected: excluded %v not to be downloaded | Actual: %v", excluded, err)
+		}
+	}
+	for _, kept := range []string{localOnlyFile, filepath.Join(destination, syncIgnoreFileName)} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: local file %v not to be deleted | Actual: %v", kept, err)
+		}
+	}
+}
+
+// Negative test: Test that keys that would map to paths outside of the mount, to absolute paths or to names reserved
+// on the local file system or by the synchronizer are rejected
+func TestKeyToRelativePathRejectsHostileKeys(t *testing.T) {
+	// ---- Inputs ----
+	prefix := "studies/Organization/some-study"
+	validKeys := map[string]string{
+		prefix + "/file.txt":              "file.txt",
+		prefix + "/dir/file.txt":          "dir/file.txt",
+		prefix + "/..hidden/..x":          "..hidden/..x",
+		prefix + "/.s3syncignore":         ".s3syncignore",
+		prefix + "/con.txt":               "con.txt",
+		prefix + "/dir/with space/a b.md": "dir/with space/a b.md",
+	}
+	hostileKeys := []string{
+		prefix + "/../escape.txt",
+		prefix + "/../../../../etc/passwd",
+		prefix + "/dir/../../escape.txt",
+		prefix + "/./file.txt",
+		prefix + "/dir/..",
+		prefix + "//etc/passwd",
+		prefix + "/dir//file.txt",
+		prefix + "/file\x00.txt",
+		prefix + "/nul\x00/../../escape",
+		prefix + "/.s3sync/quarantine/file.txt",
+		prefix + "/dir/.s3sync-1234.download",
+		prefix,
+		prefix + "/",
+		"studies/Organization/other-study/file.txt",
+	}
+	windowsHostileKeys := []string{
+		prefix + "/..\\..\\escape.txt",
+		prefix + "/\\\\server\\share\\file.txt",
+		prefix + "/C:\\Windows\\win.ini",
+		prefix + "/C:file.txt",
+		prefix + "/con.txt",
+		prefix + "/dir/LPT1",
+		prefix + "/dir/name.",
+		prefix + "/dir/name ",
+		prefix + "/dir/a:b",
+		prefix + "/dir/a\tb",
+	}
+	// Names of the synchronizer in another case refer to the same files on case-insensitive file systems
+	caseInsensitiveHostileKeys := []string{
+		prefix + "/.S3SYNC/state.db",
+		prefix + "/x/.S3Sync/outbox",
+		prefix + "/dir/.S3SYNC-1234.DOWNLOAD",
+	}
+
+	// ---- Run code under test & Assertions ----
+	for _, windows := range []bool{false, true} {
+		for key, expected := range validKeys {
+			if windows && key == prefix+"/con.txt" {
+				continue
+			}
+			relativePath, err := keyToRelativePath(key, prefix, windows, windows)
+			if err != nil || filepath.ToSlash(relativePath) != expected {
+				t.Errorf("ASSERT_FAILURE: Expected: key %q to map to %q (windows: %v) | Actual: %q, error %v", key, expected, windows, relativePath, err)
+			}
+		}
+		for _, key := range hostileKeys {
+			if relativePath, err := keyToRelativePath(key, prefix, windows, windows); err == nil {
+				t.Errorf("ASSERT_FAILURE: Expected: key %q to be rejected (windows: %v) | Actual: mapped to %q", key, windows, relativePath)
+			} else if _, ok := err.(*rejectedKeyError); !ok {
+				t.Errorf("ASSERT_FAILURE: Expected: rejectedKeyError | Actual: %v", err)
+			}
+		}
+	}
+	for _, key := range windowsHostileKeys {
+		if relativePath, err := keyToRelativePath(key, prefix, true, true); err == nil {
+			t.Errorf("ASSERT_FAILURE: Expected: key %q to be rejected on Windows | Actual: mapped to %q", key, relativePath)
+		}
+	}
+	for _, key := range caseInsensitiveHostileKeys {
+		if relativePath, err := keyToRelativePath(key, prefix, false, true); err == nil {
+			t.Errorf("ASSERT_FAILURE: Expected: key %q to be rejected on case-insensitive file systems | Actual: mapped to %q", key, relativePath)
+		}
+		if _, err := keyToRelativePath(key, prefix, false, false); err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: key %q to be valid on case-sensitive file systems | Actual: %v", key, err)
+		}
+	}
+	if relativePath, err := keyToRelativePath("/etc/passwd", "/", false, false); err != nil || relativePath != filepath.FromSlash("etc/passwd") {
+		t.Errorf("ASSERT_FAILURE: Expected: keys of whole bucket mounts to map relative to the mount | Actual: %q, error %v", relativePath, err)
+	}
+}
+
+// Negative test: Test that objects with hostile keys are reported and never written outside of the mount
+func TestDownloadRejectsHostileKeys(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestDownloadRejectsHostileKeys"
+	testMount := putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, 1)
+	outsideFile := filepath.Join(destinationBase, testMountId+"-outside.txt")
+	os.MkdirAll(destinationBase, os.ModePerm)
+	ioutil.WriteFile(outsideFile, []byte("outside"), 0644)
+
+	// ---- Inputs ----
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+	listing := &s3.ListObjectsV2Output{Contents: []*s3.Object{
+		{Key: aws.String(*testMount.Prefix + "/../" + testMountId + "-outside.txt"), Size: aws.Int64(1), ETag: aws.String(`"x"`)},
+		{Key: aws.String(*testMount.Prefix + "/dir/../../" + testMountId + "-outside.txt"), Size: aws.Int64(1), ETag: aws.String(`"x"`)},
+		{Key: aws.String(*testMount.Prefix + "/.s3sync/quarantine/test0.txt.x"), Size: aws.Int64(1), ETag: aws.String(`"x"`)},
+		{Key: aws.String(*testMount.Prefix + "/test\x00.txt"), Size: aws.Int64(1), ETag: aws.String(`"x"`)},
+	}}
+
+	// ---- Run code under test ----
+	stats := syncS3ToLocal(testAwsSession, config, transfers)
+	workers := startDownloadWorkers(testAwsSession, config, transfers, stats)
+	downloadAllObjects(listing, config, newKeyCollisions(false), workers, stats)
+	workers.wait()
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, 1)
+	if len(stats.rejectedKeys) != len(listing.Contents) {
+		t.Errorf("ASSERT_FAILURE: Expected: %v rejected keys | Actual: %v", len(listing.Contents), len(stats.rejectedKeys))
+	}
+	if content, err := ioutil.ReadFile(outsideFile); err != nil || string(content) != "outside" {
+		t.Errorf("ASSERT_FAILURE: Expected: the file outside of the mount to be untouched | Actual: %q, error %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(config.destination, synchronizerDirName)); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: nothing to be written to the synchronizer directory | Actual: %v", err)
+	}
+}
+
+// Test that keys map to local paths and back to the same keys, including escaped long names, Unicode variants and
+// keys of whole bucket mounts, and that the prefix of a mount is taken as a directory
+func TestKeyMapperRoundTrip(t *testing.T) {
+	// ---- Inputs ----
+	destination := filepath.Join(destinationBase, "TestKeyMapperRoundTrip")
+	mapper := newKeyMapper("data", destination, false, false)
+	longName := strings.Repeat("a", 300) + ".csv"
+	longMultiByteName := strings.Repeat("é", 200)
+	keys := []string{
+		"data/file.txt",
+		"data/dir/file.txt",
+		"data/" + longName,
+		"data/" + longName + "/file.txt",
+		"data/" + longMultiByteName,
+		"data/cafe\u0301.txt",
+		"data/caf\u00e9/file.txt",
+	}
+
+	// ---- Run code under test & Assertions ----
+	for _, key := range keys {
+		localPath, err := mapper.localPath(key)
+		if err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: key %q to map to a local path | Actual: %v", key, err)
+			continue
+		}
+		for _, name := range strings.Split(filepath.ToSlash(strings.TrimPrefix(localPath, destination)), "/") {
+			if len(name) > maxFileNameBytes || !utf8.ValidString(name) {
+				t.Errorf("ASSERT_FAILURE: Expected: valid names of at most %v bytes | Actual: %q (%v bytes)", maxFileNameBytes, name, len(name))
+			}
+		}
+		if again, _ := newKeyMapper("data", destination, false, false).localPath(key); again != localPath {
+			t.Errorf("ASSERT_FAILURE: Expected: key %q to always map to %q | Actual: %q", key, localPath, again)
+		}
+		if roundTrip, err := mapper.keyForLocalPath(localPath); err != nil || roundTrip != key {
+			t.Errorf("ASSERT_FAILURE: Expected: %q to map back to key %q | Actual: %q, error %v", localPath, key, roundTrip, err)
+		}
+	}
+	if !strings.HasSuffix(escapeFileName(longName), ".csv") {
+		t.Errorf("ASSERT_FAILURE: Expected: escaped name to keep the extension | Actual: %q", escapeFileName(longName))
+	}
+
+	escapedDir, _ := mapper.localPath("data/" + longName + "/file.txt")
+	newFile := filepath.Join(filepath.Dir(escapedDir), "new.txt")
+	if key, err := mapper.keyForLocalPath(newFile); err != nil || key != "data/"+longName+"/new.txt" {
+		t.Errorf("ASSERT_FAILURE: Expected: new file in an escaped directory to map to a key in the original directory | Actual: %q, error %v", key, err)
+	}
+	nfcPath := filepath.Join(destination, "caf\u00e9.txt")
+	if key, err := mapper.keyForLocalPath(nfcPath); err != nil || key != "data/cafe\u0301.txt" {
+		t.Errorf("ASSERT_FAILURE: Expected: the NFC variant of a downloaded NFD name to map to the NFD key | Actual: %q, error %v", key, err)
+	}
+	if key, err := mapper.keyForLocalPath(filepath.Join(destination, "local.txt")); err != nil || key != "data/local.txt" {
+		t.Errorf("ASSERT_FAILURE: Expected: local file to map to the key with the same path under the prefix | Actual: %q, error %v", key, err)
+	}
+	if _, err := mapper.localPath("data2/file.txt"); err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: key of a sibling prefix to be rejected | Actual: mapped")
+	}
+	if key, err := mapper.keyForLocalPath(filepath.Join(destination, "..", "outside.txt")); err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: path outside of the mount not to map to a key | Actual: %q", key)
+	}
+
+	wholeBucket := newKeyMapper("/", destination, false, false)
+	for _, key := range []string{"file.txt", "/rooted/file.txt"} {
+		localPath, err := wholeBucket.localPath(key)
+		if roundTrip, _ := wholeBucket.keyForLocalPath(localPath); err != nil || roundTrip != key {
+			t.Errorf("ASSERT_FAILURE: Expected: key %q of whole bucket mount to round-trip | Actual: %q, error %v", key, roundTrip, err)
+		}
+	}
+
+	escapedPath, _ := mapper.localPath("data/" + longName)
+	mapper.beginListing()
+	mapper.localPath("data/cafe\u0301.txt")
+	mapper.endListing(false)
+	if key, _ := mapper.keyForLocalPath(escapedPath); key != "data/"+longName {
+		t.Errorf("ASSERT_FAILURE: Expected: the keys to be kept after an incomplete listing | Actual: %q", key)
+	}
+	mapper.beginListing()
+	mapper.localPath("data/cafe\u0301.txt")
+	mapper.endListing(true)
+	if key, _ := mapper.keyForLocalPath(escapedPath); key == "data/"+longName {
+		t.Errorf("ASSERT_FAILURE: Expected: the keys no longer listed to be forgotten after a complete listing | Actual: %q", key)
+	}
+	if key, _ := mapper.keyForLocalPath(nfcPath); key != "data/cafe\u0301.txt" {
+		t.Errorf("ASSERT_FAILURE: Expected: the listed keys to be kept after a complete listing | Actual: %q", key)
+	}
+}
+
+// Test that keys mapping to the same local file or to a file and a directory are detected and the first key wins
+func TestKeyCollisions(t *testing.T) {
+	// ---- Inputs ----
+	cases := []struct {
+		caseInsensitive bool
+		paths           []string
+		rejected        []bool
+	}{
+		{false, []string{"a", "a/b", "a.txt"}, []bool{false, true, false}},
+		{false, []string{"x/y/z", "x/y", "x"}, []bool{false, true, true}},
+		{false, []string{"cafe\u0301.txt", "caf\u00e9.txt"}, []bool{false, true}},
+		{false, []string{"caf\u00e9/a", "cafe\u0301"}, []bool{false, true}},
+		{false, []string{"README.md", "readme.md"}, []bool{false, false}},
+		{true, []string{"README.md", "readme.md"}, []bool{false, true}},
+		{true, []string{"Dir/a", "dir"}, []bool{false, true}},
+	}
+
+	// ---- Run code under test & Assertions ----
+	for _, c := range cases {
+		collisions := newKeyCollisions(c.caseInsensitive)
+		for i, path := range c.paths {
+			err := collisions.claim("prefix/"+path, path)
+			if (err != nil) != c.rejected[i] {
+				t.Errorf("ASSERT_FAILURE: Expected: %q of %q rejected = %v (case-insensitive: %v) | Actual: %v", path, c.paths, c.rejected[i], c.caseInsensitive, err)
+			}
+		}
+	}
+}
+
+// Test that the prefix of a mount does not cover sibling prefixes, that colliding keys are reported and not downloaded
+// and that long names are downloaded to escaped names
+func TestDownloadMapsAwkwardKeys(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestDownloadMapsAwkwardKeys"
+	testMount := putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, 1)
+	longName := strings.Repeat("n", 300) + ".txt"
+	s3Client := s3.New(testAwsSession)
+	for _, key := range []string{
+		*testMount.Prefix + "2/sibling.txt",
+		*testMount.Prefix + "/test0.txt/nested.txt",
+		*testMount.Prefix + "/" + longName,
+	} {
+		if _, err := s3Client.PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(key), Body: strings.NewReader(key)}); err != nil {
+			t.Fatalf("Could not put test files to fake S3 server for testing: %v", err)
+		}
+	}
+
+	// ---- Inputs ----
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+
+	// ---- Run code under test ----
+	stats := syncS3ToLocal(testAwsSession, config, transfers)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId, 1)
+	if _, err := os.Stat(filepath.Join(config.destination, "2")); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: objects of the sibling prefix not to be downloaded | Actual: %v", err)
+	}
+	if len(stats.rejectedKeys) != 1 || *stats.rejectedKeys[0] != *testMount.Prefix+"/test0.txt/nested.txt" {
+		t.Errorf("ASSERT_FAILURE: Expected: the key colliding with test0.txt to be rejected | Actual: %v rejected keys", len(stats.rejectedKeys))
+	}
+	escaped, err := ioutil.ReadFile(filepath.Join(config.destination, escapeFileName(longName)))
+	if err != nil || string(escaped) != *testMount.Prefix+"/"+longName {
+		t.Errorf("ASSERT_FAILURE: Expected: the object with a long name to be downloaded to an escaped name | Actual: %q, error %v", escaped, err)
+	}
+}
+
+// Test that uploads are decided by the content of the files and not by their size, and that the uploaded files are
+// neither uploaded again nor downloaded back until they change
+func TestUploadDetectsContentChanges(t *testing.T) {
+	const sameSizeContentTemplate = "TEST file content for file = %d"
+	const localContentTemplate = "LOCAL -- test file content for file = %d"
+	// ---- Data setup ----
+	testMountId := "TestUploadDetectsContentChanges"
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 2)
+	newKey := *testMount.Prefix + "/new.txt"
+	// An object whose key starts with the key of the new file and has the same size as the new file
+	if _, err := s3.New(testAwsSession).PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(newKey + ".bak"), Body: strings.NewReader(fmt.Sprintf(testFileContentTemplate, 0))}); err != nil {
+		t.Fatalf("Could not put test files to fake S3 server for testing: %v", err)
+	}
+
+	// ---- Inputs ----
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+	localFiles := map[string]string{
+		// Same size as the downloaded file
+		"test0.txt": fmt.Sprintf(sameSizeContentTemplate, 0),
+		// Changed object is not overwritten once the file is uploaded
+		"test1.txt": fmt.Sprintf(localContentTemplate, 1),
+		"new.txt":   fmt.Sprintf(testFileContentTemplate, 0),
+	}
+
+	// ---- Run code under test ----
+	syncS3ToLocal(testAwsSession, config, transfers)
+	uploadErrs := make([]error, 0)
+	for _, name := range []string{"test0.txt", "test1.txt"} {
+		// Nothing to upload, the files were just downloaded
+		uploadErrs = append(uploadErrs, uploadToS3(testAwsSession, config, filepath.Join(config.destination, name)))
+	}
+	for name, content := range localFiles {
+		path := filepath.Join(config.destination, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Could not update test file on local file system for testing: %v", err)
+		}
+		uploadErrs = append(uploadErrs, uploadToS3(testAwsSession, config, path))
+	}
+	statsAfterUpload := syncS3ToLocal(testAwsSession, config, transfers)
+	if _, err := s3.New(testAwsSession).PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(*testMount.Prefix + "/test1.txt"), Body: strings.NewReader(fmt.Sprintf(testFileUpdatedContentTemplate, 1))}); err != nil {
+		t.Fatalf("Could not put test files to fake S3 server for testing: %v", err)
+	}
+	uploadErrs = append(uploadErrs, uploadToS3(testAwsSession, config, filepath.Join(config.destination, "test1.txt")))
+
+	// ---- Assertions ----
+	for _, err := range uploadErrs {
+		if err != nil {
+			t.Errorf("ASSERT_FAILURE: Expected: uploads to succeed | Actual: %v", err)
+		}
+	}
+	if statsAfterUpload.numberOfRetrievedFiles != 0 || statsAfterUpload.conflicts != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the uploaded files not to be downloaded back | Actual: %v downloads, %v conflicts",
+			statsAfterUpload.numberOfRetrievedFiles, statsAfterUpload.conflicts)
+	}
+	assertObjectInS3WithContent(t, testFakeBucketName, *testMount.Prefix+"/test0.txt", sameSizeContentTemplate, 0)
+	assertObjectInS3WithContent(t, testFakeBucketName, *testMount.Prefix+"/test1.txt", testFileUpdatedContentTemplate, 1)
+	assertObjectInS3WithContent(t, testFakeBucketName, newKey, testFileContentTemplate, 0)
+}
+
+// Test that the files written by downloads are not uploaded and the uploaded objects are recorded as synchronized
+func TestUploadSuppressesEchoes(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestUploadSuppressesEchoes"
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 1)
+	emptyKey := *testMount.Prefix + "/empty.txt"
+
+	// ---- Inputs ----
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+	filePath := filepath.Join(config.destination, "test0.txt")
+	emptyFilePath := filepath.Join(config.destination, "empty.txt")
+
+	// ---- Run code under test ----
+	syncS3ToLocal(testAwsSession, config, transfers)
+	// A download moved into place but not recorded yet
+	tempFile, err := createDownloadTempFile(filePath)
+	if err != nil {
+		t.Fatalf("Could not create temp file for testing: %v", err)
+	}
+	tempFile.WriteString(fmt.Sprintf(testFileUpdatedContentTemplate, 0))
+	if err := commitDownloadTempFile(tempFile, filePath); err != nil {
+		t.Fatalf("Could not move temp file into place for testing: %v", err)
+	}
+	inProgressUploadErr := uploadToS3(testAwsSession, config, filePath)
+	synchronizerState.RemoveLocalWrite(filePath)
+	if err := ioutil.WriteFile(emptyFilePath, []byte{}, 0644); err != nil {
+		t.Fatalf("Could not create test file on local file system for testing: %v", err)
+	}
+	emptyUploadErr := uploadToS3(testAwsSession, config, emptyFilePath)
+	head, headErr := s3.New(testAwsSession).HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(emptyKey)})
+
+	// ---- Assertions ----
+	if inProgressUploadErr != nil || emptyUploadErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: uploads to succeed | Actual: %v, %v", inProgressUploadErr, emptyUploadErr)
+	}
+	assertObjectInS3WithContent(t, testFakeBucketName, *testMount.Prefix+"/test0.txt", testFileContentTemplate, 0)
+	if headErr != nil {
+		t.Fatalf("ASSERT_FAILURE: Expected: the empty file to be uploaded | Actual: %v", headErr)
+	}
+	if synchronizerState.HasFileChangedInS3(config.stateNamespace(), &s3.Object{Key: aws.String(emptyKey), ETag: head.ETag}) {
+		t.Errorf("ASSERT_FAILURE: Expected: the uploaded object to be recorded as synchronized | Actual: recorded as changed in S3")
+	}
+}
+
+// Test that the uploads of changed files are coalesced until the files are quiet, bounded by the maximum delay, and
+// cancelled when the files are deleted or renamed
+func TestUploadScheduler(t *testing.T) {
+	// ---- Data setup ----
+	var lock sync.Mutex
+	uploaded := make(map[string]int)
+	pendingCounts := make([]int, 0)
+	scheduler := newUploadScheduler(200*time.Millisecond, 600*time.Millisecond,
+		func(path string) {
+			lock.Lock()
+			defer lock.Unlock()
+			uploaded[path]++
+		},
+		func(pending int) {
+			pendingCounts = append(pendingCounts, pending)
+		})
+	stopCh := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case path := <-scheduler.due:
+				scheduler.uploadIfDue(path)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	defer close(stopCh)
+
+	// ---- Inputs ----
+	quiet := filepath.Join("mount", "quiet.txt")
+	busy := filepath.Join("mount", "busy.txt")
+	deleted := filepath.Join("mount", "deleted.txt")
+	inRenamedDir := filepath.Join("mount", "dir", "file.txt")
+
+	// ---- Run code under test ----
+	scheduler.schedule(deleted)
+	scheduler.schedule(inRenamedDir)
+	pendingBeforeCancel := scheduler.pendingCount()
+	scheduler.cancel(deleted)
+	scheduler.cancel(filepath.Join("mount", "dir"))
+	for i := 0; i < 5; i++ {
+		scheduler.schedule(quiet)
+		time.Sleep(50 * time.Millisecond)
+	}
+	uploadedWhileWriting := 0
+	for i := 0; i < 10; i++ {
+		scheduler.schedule(busy)
+		time.Sleep(100 * time.Millisecond)
+		lock.Lock()
+		uploadedWhileWriting = uploaded[busy]
+		lock.Unlock()
+	}
+	time.Sleep(500 * time.Millisecond)
+	scheduler.schedule(quiet)
+	pendingBeforeFlush := scheduler.pendingCount()
+	scheduler.flush()
+
+	// ---- Assertions ----
+	lock.Lock()
+	defer lock.Unlock()
+	if pendingBeforeCancel != 2 || pendingBeforeFlush != 1 || scheduler.pendingCount() != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: 2, 1 and 0 pending uploads | Actual: %v, %v and %v", pendingBeforeCancel, pendingBeforeFlush, scheduler.pendingCount())
+	}
+	if len(pendingCounts) == 0 || pendingCounts[len(pendingCounts)-1] != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the pending count changes to be reported | Actual: %v", pendingCounts)
+	}
+	if uploaded[deleted] != 0 || uploaded[inRenamedDir] != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: cancelled uploads not to happen | Actual: %v", uploaded)
+	}
+	if uploaded[quiet] != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: the events of the quiet file to be coalesced into one upload, the last one is flushed without a file | Actual: %v uploads", uploaded[quiet])
+	}
+	if uploadedWhileWriting < 1 || uploaded[busy] < 2 {
+		t.Errorf("ASSERT_FAILURE: Expected: the busy file to be uploaded after the maximum delay and once quiet | Actual: %v uploads while writing, %v in total", uploadedWhileWriting, uploaded[busy])
+	}
+}
+
+// Persistence counting the saves, keeping the last saved value
+type countingPersistence struct {
+	lock  sync.Mutex
+	saves int
+	last  []byte
+}
+
+func (persistence *countingPersistence) Save(v interface{}) error {
+	data, err := json.Marshal(v)
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	persistence.saves++
+	persistence.last = data
+	return err
+}
+
+func (persistence *countingPersistence) Load(v interface{}) error { return nil }
+
+func (persistence *countingPersistence) Clean() error { return nil }
+
+// Test that the changes of the mount statuses made in a short time (e.g., the pending uploads of each file scheduled by
+// a crawl) are saved at once
+func TestMountStatusSavesAreCoalesced(t *testing.T) {
+	// ---- Data setup ----
+	persistence := &countingPersistence{}
+	registry := newMountStatusRegistry(persistence)
+	config := newMountConfiguration("TestMountStatusSavesAreCoalesced", testFakeBucketName, "", filepath.Join(destinationBase, "TestMountStatusSavesAreCoalesced"), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+
+	// ---- Run code under test ----
+	for pending := 1; pending <= 1000; pending++ {
+		registry.uploadsPending(config, pending)
+	}
+	time.Sleep(mountStatusSaveInterval + 500*time.Millisecond)
+	registry.flush()
+
+	// ---- Assertions ----
+	persistence.lock.Lock()
+	defer persistence.lock.Unlock()
+	var saved map[string]mountStatus
+	json.Unmarshal(persistence.last, &saved)
+	if persistence.saves != 1 || saved[config.destination].PendingUploads != 1000 {
+		t.Errorf("ASSERT_FAILURE: Expected: the statuses to be saved once with 1000 pending uploads | Actual: %v saves, %+v", persistence.saves, saved)
+	}
+}
+
+// Test that the native file watcher reports when a writer is done with a file and reports renames as single move
+// events, including for the entries of a renamed directory
+func TestNativeFileWatcherBackend(t *testing.T) {
+	// ---- Data setup ----
+	backend, err := newNativeFileWatcherBackend()
+	if err != nil {
+		t.Skip("No native file watcher on this platform:", err)
+	}
+	defer backend.Close()
+	root := filepath.Join(destinationBase, "TestNativeFileWatcherBackend")
+	outside := filepath.Join(destinationBase, "TestNativeFileWatcherBackendOutside")
+	os.RemoveAll(root)
+	os.RemoveAll(outside)
+	os.MkdirAll(filepath.Join(root, "dir"), os.ModePerm)
+	os.MkdirAll(outside, os.ModePerm)
+	for _, dir := range []string{root, filepath.Join(root, "dir")} {
+		if err := backend.Add(dir); err != nil {
+			t.Fatalf("Unable to watch %v: %v", dir, err)
+		}
+	}
+	nextEvents := func(count int) []fileWatcherEvent {
+		events := make([]fileWatcherEvent, 0, count)
+		for len(events) < count {
+			select {
+			case event := <-backend.Events():
+				if event.Op == fileWatcherWrite {
+					// Depending on the write sizes there may be any number of write events
+					continue
+				}
+				events = append(events, event)
+			case <-time.After(2 * time.Second):
+				return events
+			}
+		}
+		return events
+	}
+
+	// ---- Inputs ----
+	file := filepath.Join(root, "file.txt")
+	renamedFile := filepath.Join(root, "dir", "renamed.txt")
+	renamedDir := filepath.Join(root, "renamedDir")
+
+	// ---- Run code under test ----
+	ioutil.WriteFile(file, []byte("content"), 0644)
+	written := nextEvents(2)
+	os.Rename(file, renamedFile)
+	moved := nextEvents(1)
+	os.Rename(filepath.Join(root, "dir"), renamedDir)
+	movedDir := nextEvents(1)
+	ioutil.WriteFile(filepath.Join(renamedDir, "new.txt"), []byte("content"), 0644)
+	writtenInMovedDir := nextEvents(2)
+	os.Rename(filepath.Join(renamedDir, "renamed.txt"), filepath.Join(outside, "renamed.txt"))
+	movedOut := nextEvents(1)
+
+	// ---- Assertions ----
+	expected := []fileWatcherEvent{{Name: file, Op: fileWatcherCreate}, {Name: file, Op: fileWatcherCloseWrite}}
+	if fmt.Sprint(written) != fmt.Sprint(expected) {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", expected, written)
+	}
+	expected = []fileWatcherEvent{{Name: renamedFile, OldName: file, Op: fileWatcherMove}}
+	if fmt.Sprint(moved) != fmt.Sprint(expected) {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", expected, moved)
+	}
+	expected = []fileWatcherEvent{{Name: renamedDir, OldName: filepath.Join(root, "dir"), Op: fileWatcherMove}}
+	if fmt.Sprint(movedDir) != fmt.Sprint(expected) {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", expected, movedDir)
+	}
+	newFile := filepath.Join(renamedDir, "new.txt")
+	expected = []fileWatcherEvent{{Name: newFile, Op: fileWatcherCreate}, {Name: newFile, Op: fileWatcherCloseWrite}}
+	if fmt.Sprint(writtenInMovedDir) != fmt.Sprint(expected) {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", expected, writtenInMovedDir)
+	}
+	expected = []fileWatcherEvent{{Name: filepath.Join(renamedDir, "renamed.txt"), Op: fileWatcherRename}}
+	if fmt.Sprint(movedOut) != fmt.Sprint(expected) {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", expected, movedOut)
+	}
+}
+
+// Test that the native file watcher reports the overflow of its event queue as an event, so that the mount is scanned
+// again, instead of as an error
+func TestNativeFileWatcherBackendReportsOverflow(t *testing.T) {
+	// ---- Data setup ----
+	maxQueuedEvents, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_queued_events")
+	if err != nil {
+		t.Skip("Unable to read the size of the inotify event queue:", err)
+	}
+	queueSize, err := strconv.Atoi(strings.TrimSpace(string(maxQueuedEvents)))
+	if err != nil || queueSize > 100000 {
+		t.Skip("The inotify event queue is too large to overflow in a test:", string(maxQueuedEvents))
+	}
+	backend, err := newNativeFileWatcherBackend()
+	if err != nil {
+		t.Skip("No native file watcher on this platform:", err)
+	}
+	defer backend.Close()
+	root := filepath.Join(destinationBase, "TestNativeFileWatcherBackendReportsOverflow")
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+	defer os.RemoveAll(root)
+	if err := backend.Add(root); err != nil {
+		t.Fatalf("Unable to watch %v: %v", root, err)
+	}
+
+	// ---- Run code under test ----
+	// Each file is at least a create and a close write event, none of them are consumed until all files are written
+	for i := 0; i < queueSize; i++ {
+		ioutil.WriteFile(filepath.Join(root, fmt.Sprintf("file%d.txt", i)), []byte("content"), 0644)
+	}
+	overflows := 0
+	var watcherErr error
+Events:
+	for {
+		select {
+		case event := <-backend.Events():
+			if event.Op == fileWatcherOverflow {
+				overflows++
+			}
+		case watcherErr = <-backend.Errors():
+		case <-time.After(2 * time.Second):
+			break Events
+		}
+	}
+
+	// ---- Assertions ----
+	if overflows != 1 || watcherErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: a single overflow event and no error | Actual: %v overflow events, error %v", overflows, watcherErr)
+	}
+}
+
+type failingListTransport struct{}
+
+func (transport failingListTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && req.URL.Query().Get("list-type") != "" {
+		return nil, errors.New("simulated network outage")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Test that deleting a directory returns the error when the objects can not be listed, so that the deletion is retried
+// by the outbox, and stops when the mount is stopped
+func TestDeleteDirFromS3ReturnsListingErrors(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestDeleteDirFromS3ReturnsListingErrors"
+	config := newMountConfiguration(testMountId, testFakeBucketName, testMountId, filepath.Join(destinationBase, testMountId), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+	failingSession := testAwsSession.Copy(&aws.Config{HTTPClient: &http.Client{Transport: failingListTransport{}}, MaxRetries: aws.Int(0)})
+
+	// ---- Inputs ----
+	dirPath := filepath.Join(config.destination, "dir")
+
+	// ---- Run code under test ----
+	listingErr := make(chan error, 1)
+	go func() {
+		listingErr <- deleteDirFromS3(failingSession, config, dirPath)
+	}()
+	var err error
+	select {
+	case err = <-listingErr:
+	case <-time.After(5 * time.Second):
+	}
+	close(config.stopCh)
+	stoppedErr := deleteDirFromS3(testAwsSession, config, dirPath)
+
+	// ---- Assertions ----
+	if err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the listing error to be returned | Actual: no error returned")
+	}
+	if stoppedErr != errMountStopped {
+		t.Errorf("ASSERT_FAILURE: Expected: %v | Actual: %v", errMountStopped, stoppedErr)
+	}
+}
+
+// Fails the deletion of the first object of DeleteObjects requests as if access was denied, and reports the other
+// objects as deleted without deleting them
+type failingDeleteObjectsTransport struct{}
+
+func (transport failingDeleteObjectsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.URL.Query()["delete"]; req.Method != http.MethodPost || !ok {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	var deleteRequest struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(req.Body).Decode(&deleteRequest); err != nil {
+		return nil, err
+	}
+	body := `<DeleteResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`
+	for i, object := range deleteRequest.Objects {
+		if i == 0 {
+			body += "<Error><Key>" + object.Key + "</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>"
+		} else {
+			body += "<Deleted><Key>" + object.Key + "</Key></Deleted>"
+		}
+	}
+	body += "</DeleteResult>"
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/xml"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// Test that deleting a directory returns an error when some of its objects could not be deleted while the others were,
+// so that the deletion is retried by the outbox
+func TestDeleteDirFromS3ReturnsDeleteErrors(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestDeleteDirFromS3ReturnsDeleteErrors"
+	config := newMountConfiguration(testMountId, testFakeBucketName, testMountId, filepath.Join(destinationBase, testMountId), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+	s3Client := s3.New(testAwsSession)
+	for i := 0; i < 2; i++ {
+		s3Client.PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(fmt.Sprintf("%s/dir/test%d.txt", testMountId, i)), Body: strings.NewReader("content")})
+	}
+	failingSession := testAwsSession.Copy(&aws.Config{HTTPClient: &http.Client{Transport: failingDeleteObjectsTransport{}}, MaxRetries: aws.Int(0)})
+
+	// ---- Run code under test ----
+	err := deleteDirFromS3(failingSession, config, filepath.Join(config.destination, "dir"))
+
+	// ---- Assertions ----
+	if err == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: an error for the objects that were not deleted | Actual: no error returned")
+	}
+	key := fmt.Sprintf("%s/dir/test0.txt", testMountId)
+	if _, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(key)}); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: %v to be kept | Actual: %v", key, err)
+	}
+}
+
+type copyCountingTransport struct {
+	lock    sync.Mutex
+	copies  int
+	uploads int
+}
+
+func (transport *copyCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut {
+		transport.lock.Lock()
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			transport.copies++
+		} else {
+			transport.uploads++
+		}
+		transport.lock.Unlock()
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Test that renamed files and directories are moved in S3 with server side copies, and that the objects that no longer
+// have the content of the renamed files are left for upload
+func TestServerSideMoveOnRename(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestServerSideMoveOnRename"
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 2)
+	prefix := *testMount.Prefix
+	s3Client := s3.New(testAwsSession)
+	for i, name := range []string{"dir/a.txt", "dir/b.txt"} {
+		if _, err := s3Client.PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(prefix + "/" + name), Body: strings.NewReader(fmt.Sprintf(testFileContentTemplate, 10+i))}); err != nil {
+			t.Fatalf("Could not put test object: %v", err)
+		}
+	}
+	config := newMountConfiguration(testMountId, testFakeBucketName, prefix, filepath.Join(destinationBase, testMountId), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+	syncS3ToLocal(testAwsSession, config, transfers)
+	transport := &copyCountingTransport{}
+	svc := s3.New(testAwsSession.Copy(&aws.Config{HTTPClient: &http.Client{Transport: transport}}))
+
+	// ---- Inputs ----
+	local := func(name string) string {
+		return filepath.Join(config.destination, filepath.FromSlash(name))
+	}
+	os.Rename(local("test0.txt"), local("moved.txt"))
+	ioutil.WriteFile(local("test1.txt"), []byte(fmt.Sprintf(testFileUpdatedContentTemplate, 1)), 0644)
+	os.Rename(local("test1.txt"), local("changed.txt"))
+	ioutil.WriteFile(local("dir/b.txt"), []byte(fmt.Sprintf(testFileUpdatedContentTemplate, 11)), 0644)
+	os.Rename(local("dir"), local("renamedDir"))
+
+	// ---- Run code under test ----
+	movedFile := moveFileInS3(svc, config, local("test0.txt"), local("moved.txt"))
+	movedChangedFile := moveFileInS3(svc, config, local("test1.txt"), local("changed.txt"))
+	dirErr := moveDirInS3(svc, config, local("dir"), local("renamedDir"), func(path string) bool { return false })
+
+	// ---- Assertions ----
+	if !movedFile || movedChangedFile || dirErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the unchanged file to be moved, the changed file not to be moved and the directory to be moved | Actual: %v, %v, %v", movedFile, movedChangedFile, dirErr)
+	}
+	if transport.copies != 2 || transport.uploads != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: 2 copies and no uploads | Actual: %v copies and %v uploads", transport.copies, transport.uploads)
+	}
+	assertObjectInS3WithContent(t, testFakeBucketName, prefix+"/moved.txt", testFileContentTemplate, 0)
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/test0.txt")
+	assertObjectInS3WithContent(t, testFakeBucketName, prefix+"/test1.txt", testFileContentTemplate, 1)
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/changed.txt")
+	assertObjectInS3WithContent(t, testFakeBucketName, prefix+"/renamedDir/a.txt", testFileContentTemplate, 10)
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/renamedDir/b.txt")
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/dir/")
+	for _, key := range []string{prefix + "/moved.txt", prefix + "/renamedDir/a.txt"} {
+		head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(key)})
+		if err != nil || synchronizerState.HasFileChangedInS3(config.stateNamespace(), &s3.Object{Key: aws.String(key), ETag: head.ETag}) {
+			t.Errorf("ASSERT_FAILURE: Expected: the copy of %v to be recorded as synchronized | Actual: %v", key, err)
+		}
+	}
+	if synchronizerState.GetLocalFingerprint(config.stateNamespace(), prefix+"/test0.txt") != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the state of the old key to be removed | Actual: still recorded")
+	}
+}
+
+// Test that the files of a writeable mount whose objects were deleted from S3 are kept if their upload is pending or,
+// with the local-wins and keep-both conflict policies, if they changed locally since they were last synchronized
+func TestDownloadKeepsLocallyChangedFilesDeletedFromS3(t *testing.T) {
+	for _, policy := range []conflictPolicy{conflictPolicyLocalWins, conflictPolicyKeepBoth} {
+		testDownloadOfLocallyChangedFilesDeletedFromS3(t, "TestDownloadKeepsLocallyChangedFilesDeletedFromS3-"+string(policy), policy, []bool{true, true, false})
+	}
+}
+
+// Test that with the remote-wins conflict policy the files of a writeable mount that changed locally are deleted when
+// their objects are deleted from S3, unless their upload is pending
+func TestDownloadDeletesLocallyChangedFilesDeletedFromS3WithRemoteWins(t *testing.T) {
+	testDownloadOfLocallyChangedFilesDeletedFromS3(t, "TestDownloadDeletesLocallyChangedFilesDeletedFromS3WithRemoteWins", conflictPolicyRemoteWins, []bool{false, true, false})
+}
+
+// Deletes the objects of a file changed locally, a file whose upload is pending and an unchanged file from S3, then
+// checks which of the files are still there after the next download
+func testDownloadOfLocallyChangedFilesDeletedFromS3(t *testing.T, testMountId string, policy conflictPolicy, expectedToExist []bool) {
+	// ---- Data setup ----
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 3)
+	prefix := *testMount.Prefix
+	config := newMountConfiguration(testMountId, testFakeBucketName, prefix, filepath.Join(destinationBase, testMountId), true, "", "", policy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+	syncS3ToLocal(testAwsSession, config, transfers)
+	local := func(i int) string {
+		return filepath.Join(config.destination, fmt.Sprintf("test%d.txt", i))
+	}
+
+	// ---- Inputs ----
+	ioutil.WriteFile(local(0), []byte(fmt.Sprintf(testFileUpdatedContentTemplate, 0)), 0644)
+	config.setPendingUploads(func(path string) bool {
+		return path == local(1)
+	})
+	s3Client := s3.New(testAwsSession)
+	for i := 0; i < 3; i++ {
+		s3Client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(fmt.Sprintf("%s/test%d.txt", prefix, i))})
+	}
+
+	// ---- Run code under test ----
+	syncS3ToLocal(testAwsSession, config, transfers)
+
+	// ---- Assertions ----
+	for i, expected := range expectedToExist {
+		_, err := os.Stat(local(i))
+		if exists := err == nil; exists != expected {
+			t.Errorf("ASSERT_FAILURE: Expected: %v to exist with %v: %v | Actual: %v", local(i), policy, expected, exists)
+		}
+	}
+}
+
+// Test that the changes made locally while the synchronizer was not running are uploaded before the mount is
+// downloaded, and that the changes made on both sides are resolved with the conflict policy
+func TestStartupReconciliation(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestStartupReconciliation"
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 5)
+	prefix := *testMount.Prefix
+	config := newMountConfiguration(testMountId, testFakeBucketName, prefix, filepath.Join(destinationBase, testMountId), true, "", "", conflictPolicyLocalWins, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+	syncS3ToLocal(testAwsSession, config, transfers)
+	local := func(i int) string {
+		return filepath.Join(config.destination, fmt.Sprintf("test%d.txt", i))
+	}
+
+	// ---- Inputs ----
+	// Changed locally only
+	ioutil.WriteFile(local(0), []byte(fmt.Sprintf(testFileUpdatedContentTemplate, 0)), 0644)
+	// Deleted locally only
+	os.Remove(local(1))
+	// Changed locally and deleted in S3
+	ioutil.WriteFile(local(2), []byte(fmt.Sprintf(testFileUpdatedContentTemplate, 2)), 0644)
+	deleteTestMountFile(t, testFakeBucketName, testMountId, 2)
+	// Deleted locally and changed in S3
+	os.Remove(local(3))
+	// Changed in S3 only
+	s3Client := s3.New(testAwsSession)
+	for _, i := range []int{3, 4} {
+		s3Client.PutObject(&s3.PutObjectInput{Bucket: aws.String(testFakeBucketName), Key: aws.String(fmt.Sprintf("%s/test%d.txt", prefix, i)), Body: strings.NewReader(fmt.Sprintf(testFileUpdatedContentTemplate, i))})
+	}
+
+	// ---- Run code under test ----
+	stats := reconcileLocalChanges(testAwsSession, config, newDefaultConfig().ReconcileMaxDeletions)
+	syncS3ToLocal(testAwsSession, config, transfers)
+
+	// ---- Assertions ----
+	if stats.uploaded != 2 || stats.deletedInS3 != 2 || stats.conflicts != 2 || stats.errors != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: 2 uploads, 2 deletes and 2 conflicts | Actual: %+v", *stats)
+	}
+	assertObjectInS3WithContent(t, testFakeBucketName, prefix+"/test0.txt", testFileUpdatedContentTemplate, 0)
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/test1.txt")
+	assertObjectInS3WithContent(t, testFakeBucketName, prefix+"/test2.txt", testFileUpdatedContentTemplate, 2)
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/test3.txt")
+	for _, i := range []int{1, 3} {
+		assertFileDeleted(t, testMountId, i)
+	}
+	for _, i := range []int{0, 2, 4} {
+		content, _ := ioutil.ReadFile(local(i))
+		if string(content) != fmt.Sprintf(testFileUpdatedContentTemplate, i) {
+			t.Errorf("ASSERT_FAILURE: Expected: %v to have the updated content | Actual: %q", local(i), content)
+		}
+	}
+}
+
+// Negative test: Test that the objects of the files missing locally are not deleted when the local directory of the
+// mount is missing (e.g., a volume that is not attached) or when more files are missing than the maximum number of
+// deletions without confirmation, and that the state of a mount is forgotten when its local data is deleted
+func TestStartupReconciliationKeepsObjectsOfMissingFiles(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestStartupReconciliationKeepsObjectsOfMissingFiles"
+	noOfFilesInMount := 3
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
+	prefix := *testMount.Prefix
+	config := newMountConfiguration(testMountId, testFakeBucketName, prefix, filepath.Join(destinationBase, testMountId), true, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+	syncS3ToLocal(testAwsSession, config, transfers)
+
+	// ---- Run code under test ----
+	// The local directory is gone
+	os.RemoveAll(config.destination)
+	missingDirStats := reconcileLocalChanges(testAwsSession, config, -1)
+	redownloadStats := syncS3ToLocal(testAwsSession, config, transfers)
+	// More files deleted than allowed without confirmation
+	os.Remove(filepath.Join(config.destination, "test0.txt"))
+	os.Remove(filepath.Join(config.destination, "test1.txt"))
+	cappedStats := reconcileLocalChanges(testAwsSession, config, 1)
+	confirmedStats := reconcileLocalChanges(testAwsSession, config, -1)
+	forgotten := synchronizerState.ForgetMountState(config.stateNamespace())
+
+	// ---- Assertions ----
+	if missingDirStats.deletedInS3 != 0 || missingDirStats.skippedDeletions != noOfFilesInMount {
+		t.Errorf("ASSERT_FAILURE: Expected: no objects deleted for the missing directory | Actual: %+v", *missingDirStats)
+	}
+	if redownloadStats.numberOfRetrievedFiles != noOfFilesInMount {
+		t.Errorf("ASSERT_FAILURE: Expected: the files of the missing directory to be downloaded again | Actual: %v files downloaded", redownloadStats.numberOfRetrievedFiles)
+	}
+	if cappedStats.deletedInS3 != 0 || cappedStats.skippedDeletions != 2 {
+		t.Errorf("ASSERT_FAILURE: Expected: no objects deleted past the maximum number of deletions | Actual: %+v", *cappedStats)
+	}
+	if confirmedStats.deletedInS3 != 2 {
+		t.Errorf("ASSERT_FAILURE: Expected: the objects to be deleted once confirmed | Actual: %+v", *confirmedStats)
+	}
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/test0.txt")
+	assertObjectDeletedFromS3(t, testFakeBucketName, prefix+"/test1.txt")
+	assertObjectInS3WithContent(t, testFakeBucketName, prefix+"/test2.txt", testFileContentTemplate, 2)
+	if bases := synchronizerState.GetSyncBases(config.stateNamespace(), config.keys.keyPrefix); forgotten == 0 || len(bases) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the state of the mount to be forgotten | Actual: %v entries forgotten, %v left", forgotten, len(bases))
+	}
+}
+
+// Test that the changes in the outbox are kept across restarts, retried with backoff until they are applied and
+// applied in order for overlapping paths
+func TestUploadOutbox(t *testing.T) {
+	// ---- Data setup ----
+	defer func(backoff time.Duration) { outboxInitialBackoff = backoff }(outboxInitialBackoff)
+	outboxInitialBackoff = 50 * time.Millisecond
+	dir := filepath.Join(destinationBase, "TestUploadOutbox")
+	os.RemoveAll(dir)
+	records := NewDirBasedPersistence(dir)
+	keyPrefix := stateNamespace{MountId: "TestUploadOutbox", Bucket: testFakeBucketName}.entryKey("")
+	otherKeyPrefix := stateNamespace{MountId: "TestUploadOutboxOther", Bucket: testFakeBucketName}.entryKey("")
+	var lock sync.Mutex
+	applied := make([]string, 0)
+	attempts := make(map[string]int)
+	apply := func(entry *outboxEntry) error {
+		if entry.Op == outboxMoveDir {
+			// Slow enough for the changes under the directory to be picked up by the other worker
+			time.Sleep(100 * time.Millisecond)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		attempts[entry.Path]++
+		if filepath.Base(entry.Path) == "flaky.txt" && attempts[entry.Path] < 3 {
+			return errors.New("simulated network outage")
+		}
+		applied = append(applied, string(entry.Op)+" "+filepath.ToSlash(entry.Path))
+		return nil
+	}
+	sizes := make([]int, 0)
+	onSizeChange := func(size int) {
+		lock.Lock()
+		defer lock.Unlock()
+		sizes = append(sizes, size)
+	}
+
+	// ---- Inputs ----
+	path := func(name string) string {
+		return filepath.Join("mount", filepath.FromSlash(name))
+	}
+
+	// ---- Run code under test ----
+	beforeRestart := newUploadOutbox(records, keyPrefix, logger, apply, nil)
+	beforeRestart.enqueue(outboxUpload, path("a.txt"), "")
+	beforeRestart.enqueue(outboxUpload, path("a.txt"), "")
+	beforeRestart.enqueue(outboxDelete, path("b.txt"), "")
+	otherMount := newUploadOutbox(records, otherKeyPrefix, logger, apply, nil)
+	otherMount.enqueue(outboxUpload, path("other.txt"), "")
+	outbox := newUploadOutbox(records, keyPrefix, logger, apply, onSizeChange)
+	replayed := outbox.size()
+	outbox.start()
+	defer outbox.stop()
+	outbox.enqueue(outboxUpload, path("flaky.txt"), "")
+	outbox.enqueue(outboxMoveDir, path("newDir"), path("dir"))
+	outbox.enqueue(outboxUpload, path("newDir/file.txt"), "")
+	for i := 0; i < 50 && outbox.size() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	saved := make([]string, 0)
+	loadErr := records.ForEach(outboxTable, func(key string, data []byte) error {
+		saved = append(saved, key)
+		return nil
+	})
+
+	// ---- Assertions ----
+	lock.Lock()
+	defer lock.Unlock()
+	if replayed != 2 {
+		t.Errorf("ASSERT_FAILURE: Expected: the 2 changes saved before the restart to be replayed | Actual: %v", replayed)
+	}
+	if outbox.size() != 0 || loadErr != nil || len(saved) != 1 || !strings.HasPrefix(saved[0], otherKeyPrefix) {
+		t.Errorf("ASSERT_FAILURE: Expected: all the changes to be applied and removed, except the change of the other mount | Actual: %v left, %q saved (%v)", outbox.size(), saved, loadErr)
+	}
+	if attempts[path("flaky.txt")] != 3 {
+		t.Errorf("ASSERT_FAILURE: Expected: the failing change to be retried until it is applied | Actual: %v attempts", attempts[path("flaky.txt")])
+	}
+	order := strings.Join(applied, ", ")
+	moveIdx := strings.Index(order, "moveDir mount/newDir")
+	uploadIdx := strings.Index(order, "upload mount/newDir/file.txt")
+	if len(applied) != 5 || moveIdx < 0 || uploadIdx < moveIdx {
+		t.Errorf("ASSERT_FAILURE: Expected: the 5 changes to be applied, the move of the directory before the upload under it | Actual: %v", order)
+	}
+	if len(sizes) == 0 || sizes[0] != 2 || sizes[len(sizes)-1] != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the outbox size changes to be reported | Actual: %v", sizes)
+	}
+}
+
+// Test that the outbox dedupes the uploads and applies the changes of overlapping paths in order when it has many
+// changes
+func TestUploadOutboxManyChanges(t *testing.T) {
+	// ---- Data setup ----
+	var lock sync.Mutex
+	applied := make(map[string]int)
+	order := 0
+	apply := func(entry *outboxEntry) error {
+		lock.Lock()
+		defer lock.Unlock()
+		order++
+		applied[string(entry.Op)+" "+filepath.ToSlash(entry.Path)] = order
+		return nil
+	}
+	dir := filepath.Join(destinationBase, "TestUploadOutboxManyChanges")
+	os.RemoveAll(dir)
+	outbox := newUploadOutbox(NewDirBasedPersistence(dir), "", logger, apply, nil)
+
+	// ---- Inputs ----
+	path := func(name string) string {
+		return filepath.Join("mount", filepath.FromSlash(name))
+	}
+	const files = 5000
+
+	// ---- Run code under test ----
+	for i := 0; i < files; i++ {
+		outbox.enqueue(outboxUpload, path(fmt.Sprintf("dir/sub%d/file.txt", i%10)), "")
+		outbox.enqueue(outboxUpload, path(fmt.Sprintf("dir/file%d.txt", i)), "")
+	}
+	queued := outbox.size()
+	outbox.enqueue(outboxMoveDir, path("newDir"), path("dir"))
+	outbox.enqueue(outboxUpload, path("newDir/file0.txt"), "")
+	outbox.start()
+	defer outbox.stop()
+	for i := 0; i < 100 && outbox.size() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// ---- Assertions ----
+	lock.Lock()
+	defer lock.Unlock()
+	if queued != files+10 {
+		t.Errorf("ASSERT_FAILURE: Expected: %v changes, the uploads of the same file waiting to be applied are deduped | Actual: %v", files+10, queued)
+	}
+	moveOrder := applied["moveDir mount/newDir"]
+	if len(applied) != files+12 || outbox.size() != 0 {
+		t.Fatalf("ASSERT_FAILURE: Expected: all %v changes to be applied | Actual: %v applied, %v left", files+12, len(applied), outbox.size())
+	}
+	for change, changeOrder := range applied {
+		if strings.HasPrefix(change, "upload mount/dir/") && changeOrder > moveOrder {
+			t.Fatalf("ASSERT_FAILURE: Expected: the changes under the directory to be applied before its move | Actual: %v applied after the move", change)
+		}
+	}
+	if applied["upload mount/newDir/file0.txt"] < moveOrder {
+		t.Errorf("ASSERT_FAILURE: Expected: the upload under the moved directory to be applied after the move | Actual: applied before")
+	}
+}
+
+// Test that mounts of different buckets with the same key layout do not share the state of their objects, i.e., a
+// download in one mount does not suppress the download of the same change in the other
+func TestStateNamespacedByMount(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestStateNamespacedByMount"
+	otherBucketName := "test-bucket-namespaced"
+	if _, err := s3.New(testAwsSession).CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(otherBucketName)}); err != nil {
+		t.Fatalf("Could not create bucket using fake S3 server for testing: %v", err)
+	}
+	testMount := putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, 2)
+	putReadOnlyTestMountFiles(t, otherBucketName, testMountId, 2)
+
+	// ---- Inputs ----
+	firstMountId := testMountId + "-first"
+	secondMountId := testMountId + "-second"
+	first := newMountConfiguration(firstMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, firstMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{})
+	second := newMountConfiguration(secondMountId, otherBucketName, *testMount.Prefix, filepath.Join(destinationBase, secondMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 1, 10, 1)
+
+	// ---- Run code under test ----
+	syncS3ToLocal(testAwsSession, first, transfers)
+	syncS3ToLocal(testAwsSession, second, transfers)
+	// The same change in both buckets, i.e., the objects have the same keys and ETags
+	updateTestMountFiles(t, testFakeBucketName, testMountId, 2)
+	updateTestMountFiles(t, otherBucketName, testMountId, 2)
+	firstStats := syncS3ToLocal(testAwsSession, first, transfers)
+	secondStats := syncS3ToLocal(testAwsSession, second, transfers)
+
+	// ---- Assertions ----
+	if firstStats.numberOfRetrievedFiles != 2 || secondStats.numberOfRetrievedFiles != 2 {
+		t.Errorf("ASSERT_FAILURE: Expected: the change to be downloaded by both mounts | Actual: %v and %v files downloaded",
+			firstStats.numberOfRetrievedFiles, secondStats.numberOfRetrievedFiles)
+	}
+	assertUpdatedFilesDownloaded(t, firstMountId, 2)
+	assertUpdatedFilesDownloaded(t, secondMountId, 2)
+}
+
+// Test that the entries of a flat state file of an older version are claimed by the mount of their objects and saved
+// in the namespace of the mount
+func TestStateMigratesFlatStateFile(t *testing.T) {
+	// ---- Data setup ----
+	dir := filepath.Join(destinationBase, "TestStateMigratesFlatStateFile")
+	os.RemoveAll(dir)
+	persistence := NewFileBasedPersistenceWithJsonFormat("state", dir)
+	flat := map[string]interface{}{
+		"fileETags": map[string]string{"studies/a/x.txt": `"etag-x"`, "studies/b/y.txt": `"etag-y"`},
+		"localFingerprints": map[string]*fileFingerprint{
+			"studies/a/x.txt": {Size: 10, ModTime: time.Unix(1600000000, 0).UTC()},
+		},
+		"partialDownloads": map[string]*partialDownload{
+			"studies/a/large.bin": {Bucket: "other-bucket", Key: "studies/a/large.bin", ETag: `"etag-large"`, Size: 100},
+		},
+	}
+	if err := persistence.Save(&flat); err != nil {
+		t.Fatalf("Could not save flat state file for testing: %v", err)
+	}
+	newState := func() *persistentSynchronizerState {
+		state := &persistentSynchronizerState{s3FileETagsMap: cmap.New(), localFingerprintsMap: cmap.New(), partialDownloadsMap: cmap.New(), localWritesMap: cmap.New(), persistence: persistence}
+		if err := state.Load(); err != nil {
+			t.Fatalf("Could not load the state: %v", err)
+		}
+		return state
+	}
+
+	// ---- Inputs ----
+	ns := stateNamespace{MountId: "a", Bucket: testFakeBucketName}
+	otherNs := stateNamespace{MountId: "b", Bucket: "other-bucket"}
+	x := &s3.Object{Key: aws.String("studies/a/x.txt"), ETag: aws.String(`"etag-x"`)}
+
+	// ---- Run code under test ----
+	state := newState()
+	changedBeforeClaim := state.HasFileChangedInS3(ns, x)
+	claimed := state.ClaimLegacyEntries(ns, "studies/a/")
+	reloaded := newState()
+	otherClaimed := reloaded.ClaimLegacyEntries(otherNs, "studies/")
+	var saved persistedSynchronizerState
+	loadErr := persistence.Load(&saved)
+
+	// ---- Assertions ----
+	if !changedBeforeClaim {
+		t.Errorf("ASSERT_FAILURE: Expected: the entries not to be visible to the mount before they are claimed | Actual: visible")
+	}
+	if claimed != 2 || otherClaimed != 2 {
+		t.Errorf("ASSERT_FAILURE: Expected: the ETag and fingerprint to be claimed by the first mount, the partial download and the other ETag by the mount of the other bucket | Actual: %v and %v claimed", claimed, otherClaimed)
+	}
+	if reloaded.HasFileChangedInS3(ns, x) || reloaded.GetLocalFingerprint(ns, "studies/a/x.txt") == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the claimed entries to be saved in the namespace of the mount | Actual: not found after reload")
+	}
+	if !reloaded.HasFileChangedInS3(stateNamespace{MountId: "a", Bucket: "other-bucket"}, x) {
+		t.Errorf("ASSERT_FAILURE: Expected: the claimed entries not to be visible to other namespaces | Actual: visible")
+	}
+	if download := reloaded.GetPartialDownload(otherNs, "studies/a/large.bin"); download == nil || download.MountId != "b" {
+		t.Errorf("ASSERT_FAILURE: Expected: the partial download to be claimed by the mount of its bucket | Actual: %+v", download)
+	}
+	if loadErr != nil || saved.Version != synchronizerStateVersion || len(saved.Mounts) != 2 || len(saved.FileETags) != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the state to be saved with version %v and 2 mounts | Actual: %+v (%v)", synchronizerStateVersion, saved, loadErr)
+	}
+}
+
+// Test that the bolt persistence saves records one by one, keeps them across restarts and compacts the database
+func TestBoltPersistence(t *testing.T) {
+	// ---- Data setup ----
+	dir := filepath.Join(destinationBase, "TestBoltPersistence")
+	os.RemoveAll(dir)
+	defaultCompactMinSize := boltCompactMinSize
+	boltCompactMinSize = 64 * 1024
+	defer func() { boltCompactMinSize = defaultCompactMinSize }()
+	open := func() RecordPersistence {
+		persistence, err := NewBoltPersistence("state.db", dir)
+		if err != nil {
+			t.Fatalf("Could not open the database: %v", err)
+		}
+		return persistence
+	}
+	readTable := func(persistence RecordPersistence, table string) map[string]string {
+		records := make(map[string]string)
+		err := persistence.ForEach(table, func(key string, data []byte) error {
+			var value string
+			err := json.Unmarshal(data, &value)
+			records[key] = value
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Could not read table %v: %v", table, err)
+		}
+		return records
+	}
+
+	// ---- Inputs ----
+	filler := strings.Repeat("x", 1024)
+	fillerCount := 2 * boltMaxBatchSize
+
+	// ---- Run code under test ----
+	persistence := open()
+	persistence.Put("etags", "a", "etag-a")
+	persistence.Put("etags", "b", "etag-b")
+	persistence.Delete("etags", "b")
+	persistence.Put("other", "a", "other-a")
+	queued := readTable(persistence, "etags")
+	for i := 0; i < fillerCount; i++ {
+		persistence.Put("filler", strconv.Itoa(i), filler)
+	}
+	persistence.Flush()
+	fillers := len(readTable(persistence, "filler"))
+	for i := 0; i < fillerCount; i++ {
+		persistence.Delete("filler", strconv.Itoa(i))
+	}
+	closeErr := persistence.Close()
+	fiBeforeCompaction, _ := os.Stat(filepath.Join(dir, "state.db"))
+
+	reopened := open()
+	etags := readTable(reopened, "etags")
+	other := readTable(reopened, "other")
+	remainingFillers := len(readTable(reopened, "filler"))
+	fiAfterCompaction, _ := os.Stat(filepath.Join(dir, "state.db"))
+	_, lockedErr := NewBoltPersistence("state.db", dir)
+	cleanErr := reopened.Clean()
+	cleaned := len(readTable(reopened, "etags"))
+	reopened.Close()
+
+	// ---- Assertions ----
+	if len(queued) != 1 || queued["a"] != "etag-a" {
+		t.Errorf("ASSERT_FAILURE: Expected: the queued changes to be visible to ForEach | Actual: %v", queued)
+	}
+	if fillers != fillerCount {
+		t.Errorf("ASSERT_FAILURE: Expected: %v records | Actual: %v", fillerCount, fillers)
+	}
+	if closeErr != nil || len(etags) != 1 || etags["a"] != "etag-a" || other["a"] != "other-a" || remainingFillers != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the records to be kept after a restart | Actual: %v, %v, %v fillers (%v)", etags, other, remainingFillers, closeErr)
+	}
+	if fiBeforeCompaction == nil || fiAfterCompaction == nil || fiAfterCompaction.Size() >= fiBeforeCompaction.Size()/2 {
+		t.Errorf("ASSERT_FAILURE: Expected: the database of mostly deleted records to be compacted when opened | Actual: %v before, %v after", fiBeforeCompaction, fiAfterCompaction)
+	}
+	if lockedErr == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the compacted database to stay locked | Actual: opened again")
+	}
+	if cleanErr != nil || cleaned != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: Clean to remove all the records | Actual: %v records (%v)", cleaned, cleanErr)
+	}
+}
+
+// Test that the state saved as JSON by an older version is imported once into the database
+func TestStateImportsLegacyStateFile(t *testing.T) {
+	// ---- Data setup ----
+	dir := filepath.Join(destinationBase, "TestStateImportsLegacyStateFile")
+	os.RemoveAll(dir)
+	ns := stateNamespace{MountId: "a", Bucket: testFakeBucketName}
+	legacy := newPersistentSynchronizerState(NewFileBasedPersistenceWithJsonFormat(synchronizerStateFileName, dir), nil)
+	legacy.RecordFileUploadToS3(ns, "studies/a/x.txt", `"etag-x"`, &fileFingerprint{Size: 10, ModTime: time.Unix(1600000000, 0).UTC()})
+	legacy.RecordPartialDownload(&partialDownload{MountId: "a", Bucket: testFakeBucketName, Key: "studies/a/large.bin", ETag: `"etag-large"`, Size: 100})
+
+	// ---- Inputs ----
+	x := &s3.Object{Key: aws.String("studies/a/x.txt"), ETag: aws.String(`"etag-x"`)}
+	y := &s3.Object{Key: aws.String("studies/a/y.txt"), ETag: aws.String(`"etag-y"`)}
+
+	// ---- Run code under test ----
+	state := newPersistentSynchronizerStateIn(dir)
+	usesDatabase := state.records != nil
+	state.RecordFileDownloadToLocal(ns, y, nil)
+	state.RemovePartialDownload(ns, "studies/a/large.bin")
+	flushErr := state.Flush()
+	if usesDatabase {
+		state.records.Close()
+	}
+	_, legacyErr := os.Stat(filepath.Join(dir, synchronizerStateFileName))
+	_, importedErr := os.Stat(filepath.Join(dir, synchronizerStateFileName+".imported"))
+	reopened := newPersistentSynchronizerStateIn(dir)
+	if reopened.records != nil {
+		defer reopened.records.Close()
+	}
+
+	// ---- Assertions ----
+	if !usesDatabase || flushErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the state to be saved in the database | Actual: saved in the database %v (%v)", usesDatabase, flushErr)
+	}
+	if !os.IsNotExist(legacyErr) || importedErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the JSON state file to be renamed once imported | Actual: %v, %v", legacyErr, importedErr)
+	}
+	if reopened.HasFileChangedInS3(ns, x) || reopened.GetLocalFingerprint(ns, "studies/a/x.txt") == nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the imported entries to be kept after a restart | Actual: not found")
+	}
+	if reopened.HasFileChangedInS3(ns, y) {
+		t.Errorf("ASSERT_FAILURE: Expected: the entries recorded after the import to be kept after a restart | Actual: not found")
+	}
+	if download := reopened.GetPartialDownload(ns, "studies/a/large.bin"); download != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the removed entries to stay removed after a restart | Actual: %+v", download)
+	}
+}
+
+// Test that the files saved by the file based persistence are checksummed and that corrupt files are reported
+func TestFileBasedPersistenceDetectsCorruptFiles(t *testing.T) {
+	// ---- Data setup ----
+	dir := filepath.Join(destinationBase, "TestFileBasedPersistenceDetectsCorruptFiles")
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, os.ModePerm)
+	type value struct {
+		Name  string
+		Count int
+	}
+	write := func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write file for testing: %v", err)
+		}
+	}
+	saved := NewFileBasedPersistenceWithJsonFormat("saved", dir)
+	if err := saved.Save(&value{Name: "a", Count: 1}); err != nil {
+		t.Fatalf("Could not save file for testing: %v", err)
+	}
+	savedContent, _ := ioutil.ReadFile(filepath.Join(dir, "saved"))
+	write("tampered", strings.Replace(string(savedContent), `"Count": 1`, `"Count": 2`, 1))
+	write("truncated", string(savedContent[:len(savedContent)/2]))
+	write("legacy", `{"Name": "legacy", "Count": 3}`)
+	write("newer", `{"format": 99, "checksum": "", "data": {}}`)
 
-// ------------------------------- Test Cases -------------------------------/
+	// ---- Inputs ----
+	load := func(name string) (*value, error) {
+		var v value
+		err := NewFileBasedPersistenceWithJsonFormat(name, dir).Load(&v)
+		return &v, err
+	}
 
-// ######### Tests for Initial Downloads #########
+	// ---- Run code under test ----
+	loaded, loadErr := load("saved")
+	_, tmpErr := os.Stat(filepath.Join(dir, "saved.tmp"))
+	_, tamperedErr := load("tampered")
+	_, tamperedFileErr := os.Stat(filepath.Join(dir, "tampered.corrupt"))
+	_, truncatedErr := load("truncated")
+	legacy, legacyErr := load("legacy")
+	_, newerErr := load("newer")
 
-// Test for single S3Mount
-func TestMainImplForInitialDownloadSingleMount(t *testing.T) {
+	// ---- Assertions ----
+	if loadErr != nil || loaded.Name != "a" || loaded.Count != 1 {
+		t.Errorf("ASSERT_FAILURE: Expected: the saved value to be loaded | Actual: %+v (%v)", loaded, loadErr)
+	}
+	if !os.IsNotExist(tmpErr) {
+		t.Errorf("ASSERT_FAILURE: Expected: the temporary file to be renamed | Actual: %v", tmpErr)
+	}
+	for name, err := range map[string]error{"tampered": tamperedErr, "truncated": truncatedErr, "newer": newerErr} {
+		var corruptErr *CorruptFileError
+		if !errors.As(err, &corruptErr) || os.IsNotExist(err) {
+			t.Errorf("ASSERT_FAILURE: Expected: the %v file to be reported as corrupt | Actual: %v", name, err)
+		}
+	}
+	if tamperedFileErr != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the corrupt file to be moved aside | Actual: %v", tamperedFileErr)
+	}
+	if legacyErr != nil || legacy.Name != "legacy" || legacy.Count != 3 {
+		t.Errorf("ASSERT_FAILURE: Expected: the files saved by older versions to be loaded | Actual: %+v (%v)", legacy, legacyErr)
+	}
+}
 
+// Test that a file of the file based persistence can not be used by another process
+func TestFileBasedPersistenceIsLocked(t *testing.T) {
 	// ---- Data setup ----
-	noOfMounts := 1
-	testMounts := make([]s3Mount, noOfMounts)
-	testMountId := "TestMainImplForInitialDownloadSingleMount"
-	noOfFilesInMount := 5
-	testMounts[0] = *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, noOfFilesInMount)
-	testMountsJsonBytes, err := json.Marshal(testMounts)
-	testMountsJson := string(testMountsJsonBytes)
-
+	dir := filepath.Join(destinationBase, "TestFileBasedPersistenceIsLocked")
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, os.ModePerm)
+	// Lock the file of another persistence the way another process would
+	otherProcessLock, err := os.OpenFile(filepath.Join(dir, "locked.lock"), os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		// Fail test in case of any errors
-		t.Logf("Error creating test mount setup data %s", err)
+		t.Fatalf("Could not create lock file for testing: %v", err)
+	}
+	defer otherProcessLock.Close()
+	if err := lockFile(otherProcessLock); err != nil {
+		t.Fatalf("Could not lock file for testing: %v", err)
 	}
 
 	// ---- Inputs ----
-	concurrency := 2
-
-	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+	first := NewFileBasedPersistenceWithJsonFormat("shared", dir)
+	second := NewFileBasedPersistenceWithJsonFormat("shared", dir)
+	locked := NewFileBasedPersistenceWithJsonFormat("locked", dir)
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase, testRegion)
-	if err != nil {
-		// Fail test in case of any errors
-		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
-		t.Errorf("Error: %v", err)
-	}
+	firstErr := first.Save("first")
+	secondErr := second.Save("second")
+	var loaded string
+	loadErr := first.Load(&loaded)
+	lockedErr := locked.Save("locked")
 
 	// ---- Assertions ----
-	assertFilesDownloaded(t, testMountId, noOfFilesInMount)
+	if firstErr != nil || secondErr != nil || loadErr != nil || loaded != "second" {
+		t.Errorf("ASSERT_FAILURE: Expected: the persistences of the same file in the process to share the file | Actual: %q (%v, %v, %v)", loaded, firstErr, secondErr, loadErr)
+	}
+	if !errors.Is(lockedErr, errPersistenceLocked) {
+		t.Errorf("ASSERT_FAILURE: Expected: the file locked by another process not to be saved | Actual: %v", lockedErr)
+	}
 }
 
-// Test for multiple S3Mounts
-func TestMainImplForInitialDownloadMultipleMounts(t *testing.T) {
+// Test that the state of a mount kept in the directory of the mount is carried with the data of the mount
+func TestStateInMounts(t *testing.T) {
 	// ---- Data setup ----
-	noOfMounts := 3
-	testMounts := make([]s3Mount, noOfMounts)
-	testBucketName := "test-bucket"
-
-	testMountId1 := "TestMainImplForInitialDownloadMultipleMounts1"
-	noOfFilesInMount1 := 5
-	testMounts[0] = *putReadOnlyTestMountFiles(t, testBucketName, testMountId1, noOfFilesInMount1)
+	dir := filepath.Join(destinationBase, "TestStateInMounts")
+	os.RemoveAll(dir)
+	mountStateDir := filepath.Join(dir, "mount", synchronizerDirName)
+	ns := stateNamespace{MountId: "a", Bucket: testFakeBucketName}
+	otherNs := stateNamespace{MountId: "b", Bucket: testFakeBucketName}
+	x := &s3.Object{Key: aws.String("studies/a/x.txt"), ETag: aws.String(`"etag-x"`)}
+	y := &s3.Object{Key: aws.String("studies/a/y.txt"), ETag: aws.String(`"etag-y"`)}
+	z := &s3.Object{Key: aws.String("studies/b/z.txt"), ETag: aws.String(`"etag-z"`)}
 
-	testMountId2 := "TestMainImplForInitialDownloadMultipleMounts2"
-	noOfFilesInMount2 := 1
-	testMounts[1] = *putReadOnlyTestMountFiles(t, testBucketName, testMountId2, noOfFilesInMount2)
+	// ---- Inputs ----
+	shared := newPersistentSynchronizerStateIn(filepath.Join(dir, "instance1"))
+	states := newMountSynchronizerStates(shared)
+	states.RecordFileDownloadToLocal(ns, x, nil)
+	states.RecordFileDownloadToLocal(otherNs, z, nil)
 
-	testMountId3 := "TestMainImplForInitialDownloadMultipleMounts3"
-	noOfFilesInMount3 := 0 // Test mount containing no files (simulating empty folder in S3)
-	testMounts[2] = *putReadOnlyTestMountFiles(t, testBucketName, testMountId3, noOfFilesInMount3)
+	// ---- Run code under test ----
+	attachErr := states.AttachMountState(ns, mountStateDir)
+	states.RecordFileDownloadToLocal(ns, y, nil)
+	movedFromShared := !shared.HasFileChangedInS3(ns, x) || !shared.HasFileChangedInS3(ns, y)
+	states.DetachMountState(ns)
+	states.Flush()
+	shared.records.Close()
+
+	// The data of the mount is moved to another instance
+	movedShared := newPersistentSynchronizerStateIn(filepath.Join(dir, "instance2"))
+	defer movedShared.records.Close()
+	movedStates := newMountSynchronizerStates(movedShared)
+	movedAttachErr := movedStates.AttachMountState(ns, mountStateDir)
+	defer movedStates.DetachMountState(ns)
 
-	testMountsJsonBytes, err := json.Marshal(testMounts)
-	testMountsJson := string(testMountsJsonBytes)
+	// ---- Assertions ----
+	if attachErr != nil || movedAttachErr != nil {
+		t.Fatalf("ASSERT_FAILURE: Expected: the state of the mount to be attached | Actual: %v, %v", attachErr, movedAttachErr)
+	}
+	if movedFromShared {
+		t.Errorf("ASSERT_FAILURE: Expected: the entries of the mount to be kept in the state of the mount only | Actual: found in the shared state")
+	}
+	if states.HasFileChangedInS3(otherNs, z) {
+		t.Errorf("ASSERT_FAILURE: Expected: the entries of the other mounts to be kept in the shared state | Actual: not found")
+	}
+	if movedStates.HasFileChangedInS3(ns, x) || movedStates.HasFileChangedInS3(ns, y) {
+		t.Errorf("ASSERT_FAILURE: Expected: the state of the mount to be carried with the data of the mount | Actual: not found on the other instance")
+	}
+	if _, err := os.Stat(filepath.Join(mountStateDir, mountStateFileName)); err != nil {
+		t.Errorf("ASSERT_FAILURE: Expected: the state of the mount to be saved in the directory of the mount | Actual: %v", err)
+	}
+}
 
-	if err != nil {
-		// Fail test in case of any errors
-		t.Logf("Error creating test mount setup data %s", err)
+// Test that the local files with the content of their objects are adopted and only the other files are downloaded
+func TestAdoptLocalFiles(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestAdoptLocalFiles"
+	testMount := putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId, 4)
+	config := newMountConfiguration(testMountId, testFakeBucketName, *testMount.Prefix, filepath.Join(destinationBase, testMountId), false, "", "", defaultConflictPolicy, mountFilterSettings{})
+	transfers := newTransferConfiguration(1, 2, 10, 1)
+	local := func(i int) string {
+		return filepath.Join(config.destination, fmt.Sprintf("test%d.txt", i))
 	}
+	os.MkdirAll(config.destination, os.ModePerm)
+	restoredAt := time.Now().Add(-time.Hour).Truncate(time.Second)
 
 	// ---- Inputs ----
-	concurrency := 2
-
-	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+	// Restored with the content of the object
+	ioutil.WriteFile(local(0), []byte(fmt.Sprintf(testFileContentTemplate, 0)), 0644)
+	// Same size, different content
+	content := []byte(fmt.Sprintf(testFileContentTemplate, 1))
+	content[0] = '#'
+	ioutil.WriteFile(local(1), content, 0644)
+	// Different size
+	ioutil.WriteFile(local(2), []byte("stale"), 0644)
+	// test3.txt is not restored
+	for i := 0; i < 3; i++ {
+		os.Chtimes(local(i), restoredAt, restoredAt)
+	}
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase, testRegion)
-	if err != nil {
-		// Fail test in case of any errors
-		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
-		t.Errorf("Error: %v", err)
-	}
+	stats := adoptLocalFiles(testAwsSession, config, transfers)
+	downloadStats := syncS3ToLocal(testAwsSession, config, transfers)
+	statsAfterAdoption := adoptLocalFiles(testAwsSession, config, transfers)
 
 	// ---- Assertions ----
-	assertFilesDownloaded(t, testMountId1, noOfFilesInMount1)
-	assertFilesDownloaded(t, testMountId2, noOfFilesInMount2)
-	assertFilesDownloaded(t, testMountId3, noOfFilesInMount3)
+	if stats.adopted != 1 || stats.differing != 2 || stats.errors != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: 1 file adopted and 2 different files | Actual: %v adopted, %v different, %v errors", stats.adopted, stats.differing, stats.errors)
+	}
+	if downloadStats.numberOfRetrievedFiles != 3 {
+		t.Errorf("ASSERT_FAILURE: Expected: only the files that were not adopted to be downloaded | Actual: %v downloaded", downloadStats.numberOfRetrievedFiles)
+	}
+	if fi, err := os.Stat(local(0)); err != nil || !fi.ModTime().Equal(restoredAt) {
+		t.Errorf("ASSERT_FAILURE: Expected: the adopted file not to be written | Actual: %v (%v)", fi, err)
+	}
+	assertFilesDownloaded(t, testMountId, 4)
+	if statsAfterAdoption.adopted != 0 || statsAfterAdoption.differing != 0 {
+		t.Errorf("ASSERT_FAILURE: Expected: the files recorded in the state not to be compared again | Actual: %v adopted, %v different", statsAfterAdoption.adopted, statsAfterAdoption.differing)
+	}
 }
 
-// Test for s3Mounts json being empty array
-func TestMainImplForInitialDownloadEmptyMounts(t *testing.T) {
+// Test that the lines below the level of the logger are not written and that the fields of the lines are written in
+// the text and JSON formats
+func TestStructuredLogger(t *testing.T) {
 	// ---- Data setup ----
-	var testMounts []s3Mount
+	var text bytes.Buffer
+	var jsonLines bytes.Buffer
+	textLogger := newStructuredLogger(&text, levelInfo, logFormatText)
+	jsonLogger := newStructuredLogger(&jsonLines, levelDebug, logFormatJson)
+	awsErr := awserr.New("AccessDenied", "Access Denied", nil)
 
-	testMountsJsonBytes, err := json.Marshal(testMounts)
-	testMountsJson := string(testMountsJsonBytes)
+	// ---- Run code under test ----
+	for _, l := range []*structuredLogger{textLogger, jsonLogger} {
+		downloadLogger := l.withMount("some-id", "some-bucket").withKey("data/a file.txt").withOp("download")
+		downloadLogger.withBytes(42).withDuration(1500*time.Millisecond).infof("Downloaded %v", "a file")
+		downloadLogger.withError(fmt.Errorf("wrapped: %w", awsErr)).errorf("Error downloading file")
+		downloadLogger.debugf("Debug line")
+		downloadLogger.tracef("Trace line")
+	}
 
-	if err != nil {
-		// Fail test in case of any errors
-		t.Logf("Error creating test mount setup data %s", err)
+	// ---- Assertions ----
+	textOutput := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if len(textOutput) != 2 {
+		t.Fatalf("ASSERT_FAILURE: Expected: only the info and error lines | Actual: %q", textOutput)
+	}
+	expectedText := ` INFO  Downloaded a file mount=some-id bucket=some-bucket key="data/a file.txt" op=download bytes=42 duration=1.5s`
+	if !strings.HasSuffix(textOutput[0], expectedText) {
+		t.Errorf("ASSERT_FAILURE: Expected: line ending with %q | Actual: %q", expectedText, textOutput[0])
+	}
+	if !strings.Contains(textOutput[1], " ERROR Error downloading file ") || !strings.HasSuffix(textOutput[1], " errorCode=AccessDenied") {
+		t.Errorf("ASSERT_FAILURE: Expected: error line with the AWS error code | Actual: %q", textOutput[1])
 	}
 
-	// ---- Inputs ----
-	concurrency := 2
+	jsonOutput := strings.Split(strings.TrimSpace(jsonLines.String()), "\n")
+	if len(jsonOutput) != 3 {
+		t.Fatalf("ASSERT_FAILURE: Expected: the info, error and debug lines | Actual: %q", jsonOutput)
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonOutput[0]), &line); err != nil {
+		t.Fatalf("ASSERT_FAILURE: Expected: JSON line | Actual: %q (%v)", jsonOutput[0], err)
+	}
+	expectedFields := map[string]interface{}{"level": "info", "msg": "Downloaded a file", "mount": "some-id", "bucket": "some-bucket",
+		"key": "data/a file.txt", "op": "download", "bytes": float64(42), "duration": 1.5}
+	for name, expected := range expectedFields {
+		if line[name] != expected {
+			t.Errorf("ASSERT_FAILURE: Expected: %v = %v | Actual: %v", name, expected, line[name])
+		}
+	}
+	if err := json.Unmarshal([]byte(jsonOutput[1]), &line); err != nil || line["errorCode"] != "AccessDenied" || line["level"] != "error" {
+		t.Errorf("ASSERT_FAILURE: Expected: JSON error line with the AWS error code | Actual: %q", jsonOutput[1])
+	}
+}
 
-	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+// Test that the log file is rotated once it reaches its maximum size and only the given number of rotated files is kept
+func TestRotatingFileWriter(t *testing.T) {
+	// ---- Data setup ----
+	dir := filepath.Join(destinationBase, "TestRotatingFileWriter")
+	os.MkdirAll(dir, os.ModePerm)
+	logFile := filepath.Join(dir, "s3-synchronizer.log")
+	w, err := newRotatingFileWriter(logFile, 20, 2)
+	if err != nil {
+		t.Fatalf("Error opening the log file: %v", err)
+	}
+	defer w.Close()
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase, testRegion)
-	if err != nil {
-		// Fail test in case of any errors
-		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
-		t.Errorf("Error: %v", err)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(w, "line %d 0123456789\n", i)
+	}
+
+	// ---- Assertions ----
+	expectedFiles := map[string]string{
+		logFile:        "line 4 0123456789\n",
+		logFile + ".1": "line 3 0123456789\n",
+		logFile + ".2": "line 2 0123456789\n",
+	}
+	for path, expected := range expectedFiles {
+		content, err := ioutil.ReadFile(path)
+		if err != nil || string(content) != expected {
+			t.Errorf("ASSERT_FAILURE: Expected: %v to contain %q | Actual: %q (%v)", path, expected, content, err)
+		}
+	}
+	if _, err := os.Stat(logFile + ".3"); !os.IsNotExist(err) {
+		t.Errorf("ASSERT_FAILURE: Expected: only 2 rotated files to be kept | Actual: %v exists", logFile+".3")
 	}
 }
 
-// Negative test: Test for invalid s3Mounts json
-func TestMainImplForInitialDownloadInvalidMounts(t *testing.T) {
-	// ---- Inputs ----
-	concurrency := 2
+// Test that each invalid mount is reported with a mount specific error and the valid mounts are retained
+func TestValidateMounts(t *testing.T) {
+	validMount := func(id string) s3Mount {
+		return s3Mount{Id: String(id), Bucket: String("some-bucket"), Prefix: String("studies/" + id)}
+	}
+	withBucket := func(mount s3Mount, bucket string) s3Mount {
+		mount.Bucket = String(bucket)
+		return mount
+	}
+	withKmsArn := func(mount s3Mount, kmsArn string) s3Mount {
+		mount.KmsArn = String(kmsArn)
+		return mount
+	}
+	withRoleArn := func(mount s3Mount, roleArn string) s3Mount {
+		mount.RoleArn = String(roleArn)
+		return mount
+	}
+	withConflictPolicy := func(mount s3Mount, policy string) s3Mount {
+		mount.ConflictPolicy = String(policy)
+		return mount
+	}
 
-	testMountsJson := "some invalid json"
-	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
+	// ---- Inputs ----
+	mounts := []s3Mount{
+		withKmsArn(withRoleArn(validMount("valid-1"), "arn:aws:iam::123456789012:role/some-role"), "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"),
+		{Bucket: String("some-bucket"), Prefix: String("studies/missing-id")},
+		{Id: String("missing-bucket"), Prefix: String("studies/missing-bucket")},
+		{Id: String("missing-prefix"), Bucket: String("some-bucket")},
+		withBucket(validMount("invalid-bucket-1"), "Some_Bucket"),
+		withBucket(validMount("invalid-bucket-2"), "192.168.1.1"),
+		withBucket(validMount("invalid-bucket-3"), "some..bucket"),
+		withKmsArn(validMount("invalid-kms-arn"), "some-kms-key"),
+		withRoleArn(validMount("invalid-role-arn"), "arn:aws:iam::1234:user/some-user"),
+		withConflictPolicy(validMount("invalid-conflict-policy"), "newest-wins"),
+		{Id: String("invalid-filter"), Bucket: String("some-bucket"), Prefix: String("studies/invalid-filter"), ExcludePresets: []string{"unknown"}, MaxAge: String("a month")},
+		validMount("valid-1"), // duplicate id
+		validMount("VALID-1"), // overlapping destination on case-insensitive file systems
+		validMount("valid-1/nested"),
+		validMount("../outside"),
+		withConflictPolicy(validMount("valid-2"), "keep-both"),
+	}
+	setMountDefaults(mounts)
 
 	// ---- Run code under test ----
-	err := mainImpl(testAwsSession, debug, false, -1, 60, -1, concurrency, testMountsJson, destinationBase, testRegion)
-	if err == nil {
-		// Fail test in case of no errors since we are expecting errors when passing invalid json for mounting
-		t.Logf("Expecting error when running the main s3-synchronizer with invalid testMountsJson but it ran fine")
+	validMounts, validationErrors := validateMounts(mounts, destinationBase)
+
+	// ---- Assertions ----
+	if len(validMounts) != 2 || *validMounts[0].Id != "valid-1" || *validMounts[1].Id != "valid-2" {
+		t.Errorf("ASSERT_FAILURE: Expected: mounts \"valid-1\" and \"valid-2\" to be valid | Actual: %v valid mounts", len(validMounts))
+	}
+	if len(validationErrors) != len(mounts)-2 {
+		t.Errorf("ASSERT_FAILURE: Expected: %v validation errors | Actual: %v", len(mounts)-2, len(validationErrors))
+	}
+	for _, err := range validationErrors {
+		validationError, ok := err.(*mountValidationError)
+		if !ok {
+			t.Errorf("ASSERT_FAILURE: Expected: mountValidationError | Actual: %v", err)
+			continue
+		}
+		if validationError.index == 0 || validationError.index == len(mounts)-1 {
+			t.Errorf("ASSERT_FAILURE: Expected: valid mount #%v to pass validation | Actual: %v", validationError.index, err)
+		}
+		fmt.Println(err)
 	}
 }
 
@@ -200,7 +2515,7 @@ func TestMainImplForSyncSingleMount(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, -1, concurrency, testMountsJson, destinationBase, testRegion)
+		err = runMainImpl(recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, -1, concurrency, testMountsJson)
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -307,7 +2622,7 @@ func TestMainImplForSyncMultipleMounts(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, -1, concurrency, testMountsJson, destinationBase, testRegion)
+		err = runMainImpl(recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, -1, concurrency, testMountsJson)
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -401,7 +2716,7 @@ func TestMainImplForRecurringDownloadEmptyMounts(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err = mainImpl(testAwsSession, debug, true, 5, 1, -1, concurrency, testMountsJson, destinationBase, testRegion)
+	err = runMainImpl(true, 5, 1, -1, concurrency, testMountsJson)
 	if err != nil {
 		// Fail test in case of any errors
 		t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -418,7 +2733,7 @@ func TestMainImplForRecurringDownloadInvalidMounts(t *testing.T) {
 	fmt.Printf("Input: \n\n%s\n\n", testMountsJson)
 
 	// ---- Run code under test ----
-	err := mainImpl(testAwsSession, debug, true, 5, 1, -1, concurrency, testMountsJson, destinationBase, testRegion)
+	err := runMainImpl(true, 5, 1, -1, concurrency, testMountsJson)
 	if err == nil {
 		// Fail test in case of no errors since we are expecting errors when passing invalid json for mounting
 		t.Logf("Expecting error when running the main s3-synchronizer with invalid testMountsJson but it ran fine")
@@ -469,7 +2784,7 @@ func TestMainImplForBiDirectionalSyncSingleMount(t *testing.T) {
 	go func() {
 
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, testMountsJson, destinationBase, testRegion)
+		err = runMainImpl(recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, testMountsJson)
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -702,7 +3017,7 @@ func TestMainImplForBiDirectionalSyncMultipleMounts(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		// ---- Run code under test ----
-		err = mainImpl(testAwsSession, debug, recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, testMountsJson, destinationBase, testRegion)
+		err = runMainImpl(recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, stopUploadWatchersAfter, concurrency, testMountsJson)
 		if err != nil {
 			// Fail test in case of any errors
 			t.Logf("Error running the main s3-synchronizer with testMountsJson %s", testMountsJson)
@@ -916,6 +3231,227 @@ func TestMainImplForBiDirectionalSyncMultipleMounts(t *testing.T) {
 	wg.Wait() // Wait until all spawned go routines complete before existing the test case
 }
 
+// ######### Tests for Configuration #########
+
+// Test that local files excluded by the filter rules of a writeable mount are not uploaded
+func TestMainImplForUploadsAppliesFilterRules(t *testing.T) {
+	// ---- Data setup ----
+	testMountId := "TestMainImplForUploadsAppliesFilterRules"
+	testMount := putWriteableTestMountFiles(t, testFakeBucketName, testMountId, 1)
+	testMount.Exclude = []string{"*.log"}
+	testMount.ExcludePresets = []string{"notebooks"}
+	testMountsJsonBytes, err := json.Marshal([]s3Mount{*testMount})
+	if err != nil {
+		t.Fatalf("Error creating test mount setup data %s", err)
+	}
+	destination := filepath.Join(destinationBase, testMountId)
+
+	// ---- Inputs ----
+	stopAfter := 6
+	localFiles := map[string]bool{
+		"notebook.ipynb": true,
+		"debug.log":      false,
+		".ipynb_checkpoints/notebook-checkpoint.ipynb": false,
+		"secret.txt": false,
+	}
+
+	// ---- Run code under test ----
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := runMainImpl(true, stopAfter, 1, stopAfter, 5, string(testMountsJsonBytes)); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}()
+	time.Sleep(2 * time.Second)
+	ioutil.WriteFile(filepath.Join(destination, syncIgnoreFileName), []byte("secret*\n"), 0644)
+	time.Sleep(500 * time.Millisecond)
+	for name := range localFiles {
+		path := filepath.Join(destination, name)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(testFileContentTemplate, 0)), 0644); err != nil {
+			t.Fatalf("Could not create test files on local file system for testing: %v", err)
+		}
+	}
+	wg.Wait()
+
+	// ---- Assertions ----
+	for name, uploaded := range localFiles {
+		key := *testMount.Prefix + "/" + name
+		if uploaded {
+			assertObjectInS3WithContent(t, testFakeBucketName, key, testFileContentTemplate, 0)
+		} else {
+			assertObjectDeletedFromS3(t, testFakeBucketName, key)
+		}
+	}
+}
+
+// Test that settings are resolved in the order: defaults, config document, environment variables, program arguments
+func TestLoadConfigPrecedence(t *testing.T) {
+	// ---- Inputs ----
+	configDocument := `
+version: 1
+region: us-west-2
+destination: /data
+concurrency: 7
+downloadInterval: 30
+stateDir: /var/lib/s3-synchronizer
+mounts:
+  - id: study-1
+    bucket: some-bucket
+    prefix: studies/study-1
+    writeable: true
+`
+	env := map[string]string{
+		"S3_SYNCHRONIZER_DOWNLOAD_INTERVAL": "15",
+		"S3_SYNCHRONIZER_DEBUG":             "true",
+		"S3_SYNCHRONIZER_STATE_IN_MOUNTS":   "true",
+		"S3_SYNCHRONIZER_LOG_FORMAT":        "json",
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagSource := newFlagConfigSource(flags)
+	if err := flags.Parse([]string{"-concurrency=3", "-stateDir=/state", "-logLevel=trace"}); err != nil {
+		t.Fatalf("Error parsing test flags: %v", err)
+	}
+
+	// ---- Run code under test ----
+	config, err := loadConfig(
+		newReaderConfigSource("test", strings.NewReader(configDocument)),
+		&envConfigSource{lookupEnv: func(key string) (string, bool) {
+			v, ok := env[key]
+			return v, ok
+		}},
+		flagSource,
+	)
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	// ---- Assertions ----
+	if config.Region != "us-west-2" || config.Destination != "/data" {
+		t.Errorf("ASSERT_FAILURE: Expected: settings from the config document | Actual: region = %v, destination = %v", config.Region, config.Destination)
+	}
+	if config.DownloadInterval != 15 || !config.Debug {
+		t.Errorf("ASSERT_FAILURE: Expected: environment variables to override the config document | Actual: downloadInterval = %v, debug = %v", config.DownloadInterval, config.Debug)
+	}
+	if config.Concurrency != 3 || config.StateDir != "/state" {
+		t.Errorf("ASSERT_FAILURE: Expected: program arguments to override the config document | Actual: concurrency = %v, stateDir = %v", config.Concurrency, config.StateDir)
+	}
+	if !config.StateInMounts || config.LogFormat != logFormatJson {
+		t.Errorf("ASSERT_FAILURE: Expected: environment variables to override the defaults | Actual: stateInMounts = %v, logFormat = %v", config.StateInMounts, config.LogFormat)
+	}
+	if config.logLevel() != levelTrace {
+		t.Errorf("ASSERT_FAILURE: Expected: program arguments to override the debug setting with a more verbose level | Actual: log level = %v", config.logLevel())
+	}
+	if config.StopRecurringDownloadsAfter != -1 || config.Profile != "" {
+		t.Errorf("ASSERT_FAILURE: Expected: defaults for settings not specified anywhere | Actual: stopRecurringDownloadsAfter = %v, profile = %v", config.StopRecurringDownloadsAfter, config.Profile)
+	}
+	if len(config.Mounts) != 1 || *config.Mounts[0].Id != "study-1" || !*config.Mounts[0].Writeable || *config.Mounts[0].RoleArn != "" {
+		t.Errorf("ASSERT_FAILURE: Expected: mounts from the config document with defaults set | Actual: %+v", config.Mounts)
+	}
+}
+
+// Negative test: Test that invalid config documents are rejected
+func TestLoadConfigInvalidDocuments(t *testing.T) {
+	invalidDocuments := map[string]string{
+		"missing version":        `{"region": "us-west-2"}`,
+		"unsupported version":    `{"version": 2}`,
+		"unknown setting":        `{"version": 1, "downloadIntervl": 5}`,
+		"invalid interval":       `{"version": 1, "downloadInterval": 0}`,
+		"invalid quiet period":   `{"version": 1, "uploadQuietPeriod": "2"}`,
+		"negative max delay":     `{"version": 1, "uploadMaxDelay": "-1m"}`,
+		"invalid log level":      `{"version": 1, "logLevel": "verbose"}`,
+		"invalid log format":     `{"version": 1, "logFormat": "xml"}`,
+		"negative max deletions": `{"version": 1, "reconcileMaxDeletions": -1}`,
+		"invalid document":       `some invalid json`,
+	}
+	for name, document := range invalidDocuments {
+		_, err := loadConfig(newReaderConfigSource(name, strings.NewReader(document)))
+		if err == nil {
+			t.Errorf("ASSERT_FAILURE: Expected: error loading config with %v | Actual: loaded fine", name)
+		}
+	}
+}
+
+// ######### Tests for Adding and Removing Mounts #########
+
+// Test for adding and removing mounts while the synchronizer is running
+// - Make sure added mounts are downloaded automatically
+// - Make sure removed writeable mounts stop syncing and their local data is deleted without deleting it from S3
+func TestMainImplForHotAddAndRemoveMounts(t *testing.T) {
+	// ---- Data setup ----
+	testMountId1 := "TestMainImplForHotAddAndRemoveMounts1"
+	noOfFilesInMount1 := 3
+	testMount1 := *putWriteableTestMountFiles(t, testFakeBucketName, testMountId1, noOfFilesInMount1)
+
+	testMountId2 := "TestMainImplForHotAddAndRemoveMounts2"
+	noOfFilesInMount2 := 2
+	testMount2 := *putReadOnlyTestMountFiles(t, testFakeBucketName, testMountId2, noOfFilesInMount2)
+
+	testMountsJsonBytes, err := json.Marshal([]s3Mount{testMount1})
+	if err != nil {
+		// Fail test in case of any errors
+		t.Logf("Error creating test mount setup data %s", err)
+	}
+	testMountsJson := string(testMountsJsonBytes)
+
+	// ---- Inputs ----
+	concurrency := 5
+	downloadInterval := 1
+	config, err := makeTestConfig(true, 10, downloadInterval, concurrency, testMountsJson)
+	if err != nil {
+		t.Fatalf("Error creating test config: %v", err)
+	}
+	config.DeleteRemovedMountData = true
+	mountsUpdateCh := make(chan []s3Mount)
+
+	var wg sync.WaitGroup
+
+	// Trigger recurring download in a separate thread and increment the wait group counter
+	wg.Add(1)
+	go func() {
+		// ---- Run code under test ----
+		err := mainImpl(testAwsSession, config, 10, mountsUpdateCh)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		wg.Done()
+	}()
+
+	time.Sleep(time.Duration(2*downloadInterval) * time.Second)
+	assertFilesDownloaded(t, testMountId1, noOfFilesInMount1)
+
+	// TEST FOR ADD -- NEW MOUNT --> DOWNLOADED WITHOUT RESTART
+	// ------------------------------------------------------------
+	mountsUpdateCh <- []s3Mount{testMount1, testMount2}
+	time.Sleep(time.Duration(2*downloadInterval) * time.Second)
+
+	// ---- Assertions ----
+	assertFilesDownloaded(t, testMountId1, noOfFilesInMount1)
+	assertFilesDownloaded(t, testMountId2, noOfFilesInMount2)
+
+	// TEST FOR REMOVE -- REMOVED MOUNT --> STOPPED AND LOCAL DATA DELETED
+	// ------------------------------------------------------------
+	mountsUpdateCh <- []s3Mount{testMount2}
+	time.Sleep(time.Duration(2*downloadInterval) * time.Second)
+
+	// ---- Assertions ----
+	removedMountDir := filepath.Join(destinationBase, testMountId1)
+	if _, err := os.Stat(removedMountDir); !os.IsNotExist(err) {
+		t.Errorf(`ASSERT_FAILURE: Expected: Directory "%v" of removed mount to be deleted | Actual: The directory exists`, removedMountDir)
+	}
+	// Deleting the local data of the removed mount must not delete the data from S3
+	mountPrefix := fmt.Sprintf("studies/Organization/%s", testMountId1)
+	for i := 0; i < noOfFilesInMount1; i++ {
+		assertObjectInS3WithContent(t, testFakeBucketName, fmt.Sprintf("%s/test%d.txt", mountPrefix, i), testFileContentTemplate, i)
+	}
+	assertFilesDownloaded(t, testMountId2, noOfFilesInMount2)
+
+	close(mountsUpdateCh)
+	wg.Wait() // Wait until all spawned go routines complete before existing the test case
+}
+
 // ------------------------------- Setup code -------------------------------/
 
 // The main testing function that calls setup and shutdown and runs each test defined in this test file
@@ -926,6 +3462,46 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// Config source reading the mounts from the "defaultS3Mounts" JSON string
+type defaultMountsConfigSource struct {
+	defaultS3Mounts string
+}
+
+// Returns config source that sets the mounts from the given "defaultS3Mounts" JSON string
+func newDefaultMountsConfigSource(defaultS3Mounts string) configSource {
+	return &defaultMountsConfigSource{defaultS3Mounts: defaultS3Mounts}
+}
+
+func (source *defaultMountsConfigSource) apply(config *synchronizerConfig) error {
+	return applyDefaultS3Mounts(source.defaultS3Mounts, config)
+}
+
+// Returns the configuration built from the given settings and "defaultS3Mounts" JSON string
+func makeTestConfig(recurringDownloads bool, stopRecurringDownloadsAfter int, downloadInterval int, concurrency int, testMountsJson string) (*synchronizerConfig, error) {
+	config, err := loadConfig(newDefaultMountsConfigSource(testMountsJson))
+	if err != nil {
+		return nil, err
+	}
+	config.LogLevel = testLogLevel.String()
+	config.RecurringDownloads = recurringDownloads
+	config.StopRecurringDownloadsAfter = stopRecurringDownloadsAfter
+	config.DownloadInterval = downloadInterval
+	config.Concurrency = concurrency
+	config.Destination = destinationBase
+	config.Region = testRegion
+	config.UploadQuietPeriod = "200ms"
+	return config, nil
+}
+
+// Runs mainImpl with the configuration built from the given settings and "defaultS3Mounts" JSON string
+func runMainImpl(recurringDownloads bool, stopRecurringDownloadsAfter int, downloadInterval int, stopUploadWatchersAfter int, concurrency int, testMountsJson string) error {
+	config, err := makeTestConfig(recurringDownloads, stopRecurringDownloadsAfter, downloadInterval, concurrency, testMountsJson)
+	if err != nil {
+		return err
+	}
+	return mainImpl(testAwsSession, config, stopUploadWatchersAfter, nil)
+}
+
 func putReadOnlyTestMountFiles(t *testing.T, bucketName string, testMountId string, noOfFiles int) *s3Mount {
 	return putTestMountFiles(t, bucketName, testMountId, noOfFiles, false)
 }
@@ -1189,12 +3765,12 @@ func setup() *httptest.Server {
 	faker := gofakes3.New(backend)
 	fakeS3Server := httptest.NewServer(faker.Server())
 	testAwsSession = makeTestSession(fakeS3Server)
+	logger.setLevel(testLogLevel)
 
 	createFakeS3BucketForTesting()
 
-	var synchronizerState = NewPersistentSynchronizerState()
-
 	// Clean synchronizer state from any previous test runs
+	openStateFiles("")
 	synchronizerState.Clean()
 
 	// Clean test output files from previous runs if any
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Downloads are written to hidden temp files in the same directory as the destination file and renamed into place
+// once complete, so readers never see partially downloaded files and failed downloads never leave corrupt files behind.
+// The temp files are named ".s3sync-<random>.download"
+const (
+	downloadTempFilePrefix = ".s3sync-"
+	downloadTempFileSuffix = ".download"
+)
+
+// Directory at the root of each mount for files managed by the synchronizer (e.g., quarantined downloads). The files
+// under this directory are never synchronized.
+const synchronizerDirName = ".s3sync"
+
+// The permissions of newly downloaded files, same as the files created with os.Create under the usual umask
+const downloadedFileMode = os.FileMode(0644)
+
+// Returns true if the given path is a temp file of an in-progress (or interrupted) download
+func isDownloadTempFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, downloadTempFilePrefix) && strings.HasSuffix(name, downloadTempFileSuffix)
+}
+
+// Returns true if the given file name is reserved by the synchronizer, i.e., the synchronizer directory or a download
+// temp file. Names that differ only in case refer to the same file on case-insensitive file systems.
+func isSynchronizerName(name string, caseInsensitive bool) bool {
+	name = pathIdentity(name, caseInsensitive)
+	return name == synchronizerDirName || isDownloadTempFile(name)
+}
+
+// Returns true if the given path is a file or directory managed by the synchronizer that must not be synchronized,
+// i.e., a download temp file or anything under the synchronizer directory
+func isSynchronizerPath(path string) bool {
+	if isSynchronizerName(filepath.Base(path), caseInsensitiveFileNames) {
+		return true
+	}
+	for _, segment := range strings.Split(filepath.ToSlash(path), "/") {
+		if pathIdentity(segment, caseInsensitiveFileNames) == synchronizerDirName {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the file at destFilePath atomically. The given write function writes the content to a temp file in the same
+// directory, the temp file is then synced to disk and renamed to destFilePath. The temp file is removed if anything fails
+// and destFilePath is left untouched.
+func writeFileAtomically(destFilePath string, write func(file *os.File) error) error {
+	tempFile, err := createDownloadTempFile(destFilePath)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+		}
+	}()
+
+	if err := write(tempFile); err != nil {
+		return err
+	}
+	if err := commitDownloadTempFile(tempFile, destFilePath); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// Creates a new temp file to download the file at destFilePath to
+func createDownloadTempFile(destFilePath string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(destFilePath), downloadTempFilePrefix+"*"+downloadTempFileSuffix)
+}
+
+// Syncs the given temp file to disk, closes it and renames it to destFilePath
+func commitDownloadTempFile(tempFile *os.File, destFilePath string) error {
+	if err := tempFile.Sync(); err != nil {
+		return err
+	}
+	// Temp files are only readable by the owner, keep the permissions of the file being replaced (if any)
+	mode := downloadedFileMode
+	if fi, err := os.Stat(destFilePath); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := tempFile.Chmod(mode); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	// The file watcher ignores the events caused by moving the download into place, the download records the
+	// written file (and removes this record) once it is moved
+	fi, err := os.Stat(tempFile.Name())
+	if err != nil {
+		return err
+	}
+	synchronizerState.RecordLocalWrite(destFilePath, newFileFingerprint(fi))
+	if err := os.Rename(tempFile.Name(), destFilePath); err != nil {
+		synchronizerState.RemoveLocalWrite(destFilePath)
+		return err
+	}
+
+	syncDir(filepath.Dir(destFilePath))
+	return nil
+}
+
+// Syncs the directory entry changes (e.g., a rename) to disk. This is best effort, not all platforms support syncing
+// directories (e.g., Windows).
+func syncDir(dirPath string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dir.Sync()
+}
+
+// Removes the temp files left behind by downloads interrupted by a crash or restart under the given directory.
+// The temp files of downloads that can be resumed are kept.
+func cleanupDownloadTempFiles(dirPath string) {
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory may not exist yet, nothing to clean up in this case
+			return nil
+		}
+		if info.IsDir() && info.Name() == synchronizerDirName {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && isDownloadTempFile(path) && !synchronizerState.IsPartialDownloadFile(path) {
+			logger.withPath(path).debugf("Removing temp file of interrupted download")
+			if err := os.Remove(path); err != nil {
+				logger.withPath(path).withError(err).errorf("Error removing temp file of interrupted download")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.withPath(dirPath).withError(err).errorf("Error cleaning up temp files of interrupted downloads")
+	}
+}
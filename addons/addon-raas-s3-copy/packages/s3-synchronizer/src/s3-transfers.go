@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// Objects up to this size are downloaded with a single GET request
+	minDownloadPartSize = int64(8 * 1024 * 1024) // 8MB
+	// Upper bound for the part size of large objects so that a single slow part does not hold up the whole object
+	maxDownloadPartSize = int64(256 * 1024 * 1024) // 256MB
+	// Aim for each concurrent part stream to download a few parts of the object
+	partsPerPartStream = 4
+)
+
+// Settings for transferring objects from/to S3 shared by all mounts
+type transferConfiguration struct {
+	// The maximum number of concurrent parts (i.e., GET requests) when downloading a single large object
+	partConcurrency int
+	// The number of objects downloaded concurrently for a mount
+	objectConcurrency int
+	// The global budget of concurrent GET requests shared by all mounts
+	budget     *semaphore.Weighted
+	budgetSize int64
+	// Limits the number of mounts synchronizing at the same time. The waiting mounts are let in
+	// in the order they started waiting.
+	mountSlots *semaphore.Weighted
+}
+
+func newTransferConfiguration(partConcurrency int, objectConcurrency int, maxConcurrentTransfers int, maxConcurrentMounts int) *transferConfiguration {
+	return &transferConfiguration{
+		partConcurrency:   partConcurrency,
+		objectConcurrency: objectConcurrency,
+		budget:            semaphore.NewWeighted(int64(maxConcurrentTransfers)),
+		budgetSize:        int64(maxConcurrentTransfers),
+		mountSlots:        semaphore.NewWeighted(int64(maxConcurrentMounts)),
+	}
+}
+
+// Returns the part size and the number of concurrent parts to use for downloading an object of the given size.
+// Small objects are downloaded with a single request, larger objects are split in parts so that the number of parts
+// grows with the size of the object up to the configured partConcurrency.
+func (transfers *transferConfiguration) downloadPartSettings(size int64) (int64, int) {
+	if size <= minDownloadPartSize {
+		return minDownloadPartSize, 1
+	}
+
+	partSize := size / int64(transfers.partConcurrency*partsPerPartStream)
+	if partSize < minDownloadPartSize {
+		partSize = minDownloadPartSize
+	}
+	if partSize > maxDownloadPartSize {
+		partSize = maxDownloadPartSize
+	}
+
+	noOfParts := (size + partSize - 1) / partSize
+	partConcurrency := transfers.partConcurrency
+	if noOfParts < int64(partConcurrency) {
+		partConcurrency = int(noOfParts)
+	}
+	return partSize, partConcurrency
+}
+
+// Blocks until the given number of concurrent requests is available in the global budget.
+// Returns the number of requests acquired which must be passed to release after the transfer completes.
+func (transfers *transferConfiguration) acquire(requests int) int64 {
+	n := int64(requests)
+	// Never ask for more than the whole budget, the transfer would wait forever otherwise
+	if n > transfers.budgetSize {
+		n = transfers.budgetSize
+	}
+	// Acquire never fails with the background context
+	transfers.budget.Acquire(context.Background(), n)
+	return n
+}
+
+func (transfers *transferConfiguration) release(n int64) {
+	transfers.budget.Release(n)
+}
+
+// Blocks until the mount can start synchronizing
+func (transfers *transferConfiguration) acquireMountSlot() {
+	// Acquire never fails with the background context
+	transfers.mountSlots.Acquire(context.Background(), 1)
+}
+
+func (transfers *transferConfiguration) releaseMountSlot() {
+	transfers.mountSlots.Release(1)
+}
@@ -2,10 +2,12 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"log"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,20 +15,18 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/fsnotify/fsnotify"
 )
 
-func setupUploadWatcher(wg *sync.WaitGroup, sess *session.Session, config *mountConfiguration, stopUploadWatchersAfter int, debug bool) error {
+func setupUploadWatcher(wg *sync.WaitGroup, sess *session.Session, config *mountConfiguration, uploadQuietPeriod time.Duration, uploadMaxDelay time.Duration, stopUploadWatchersAfter int) error {
 	syncDir := config.destination
 	bucket := config.bucket
 	prefix := config.prefix
-	kmsKeyId := config.kmsKeyId
+	watchLogger := config.logger.withOp("watch")
 
-	if debug {
-		log.Println("syncDir: " + syncDir + " bucket: " + bucket + " prefix: " + prefix)
-	}
+	watchLogger.debugf("syncDir: %v bucket: %v prefix: %v", syncDir, bucket, prefix)
 
 	// This shouldn't happen, but make the directory if it doesn't exist
 	if _, err := os.Stat(syncDir); os.IsNotExist(err) {
@@ -47,6 +47,89 @@ func setupUploadWatcher(wg *sync.WaitGroup, sess *session.Session, config *mount
 	//	before the watching began.
 	dirRequiringCrawlCh := make(chan string, 1000)
 
+	// The local changes are applied to S3 from a persistent outbox so that failed changes are retried and the changes
+	// not applied yet when the program stops are applied when it starts again
+	applyChange := func(entry *outboxEntry) error {
+		if _, err := config.keys.keyForLocalPath(entry.Path); err != nil {
+			// Retrying does not help
+			config.logger.withOp(string(entry.Op)).withPath(entry.Path).withError(err).errorf("Unable to apply the change")
+			return nil
+		}
+		switch entry.Op {
+		case outboxUpload:
+			if _, err := os.Stat(entry.Path); os.IsNotExist(err) {
+				// Deleted or renamed in the meantime, the change is in the outbox as well
+				return nil
+			}
+			return uploadToS3(sess, config, entry.Path)
+		case outboxDelete:
+			if err := deleteFromS3(sess, config.keys, entry.Path, bucket, config.logger); err != nil {
+				return err
+			}
+			synchronizerState.RecordFileDeletionFromLocal(entry.Path, config)
+			return nil
+		case outboxDeleteDir:
+			if err := deleteDirFromS3(sess, config, entry.Path); err != nil {
+				return err
+			}
+			synchronizerState.RecordDirDeletionFromLocal(entry.Path, config)
+			return nil
+		case outboxMove:
+			if moveFileInS3(s3.New(sess), config, entry.OldPath, entry.Path) {
+				return nil
+			}
+			// The object no longer has the content of the file (or it was moved already), upload the file instead
+			if err := deleteFromS3(sess, config.keys, entry.OldPath, bucket, config.logger); err != nil {
+				return err
+			}
+			synchronizerState.RecordFileDeletionFromLocal(entry.OldPath, config)
+			if _, err := os.Stat(entry.Path); os.IsNotExist(err) {
+				return nil
+			}
+			return uploadToS3(sess, config, entry.Path)
+		case outboxMoveDir:
+			excludes := func(path string) bool {
+				fi, err := os.Stat(path)
+				return err != nil || config.filter.excludesFile(path, fi)
+			}
+			// The files whose objects are not copied are uploaded when the directory is crawled at its new path
+			if err := moveDirInS3(s3.New(sess), config, entry.OldPath, entry.Path, excludes); err != nil {
+				return err
+			}
+			// Forget the objects that were not copied, they are deleted
+			synchronizerState.RecordDirDeletionFromLocal(entry.OldPath, config)
+			return nil
+		}
+		return nil
+	}
+	outbox := newUploadOutbox(
+		synchronizerState.OutboxRecords(config.stateNamespace()),
+		config.stateNamespace().entryKey(""),
+		config.logger.withOp("outbox"),
+		applyChange,
+		func(size int) {
+			mountStatuses.outboxSizeChanged(config, size)
+		})
+	if size := outbox.size(); size > 0 {
+		config.logger.infof("Applying %v local changes not uploaded before the last stop", size)
+	}
+	outbox.start()
+
+	// Changed files are uploaded once they are quiet, the file watcher loop adds them to the outbox when they are due
+	uploads := newUploadScheduler(uploadQuietPeriod, uploadMaxDelay,
+		func(path string) {
+			// Most of the files seen when crawling the mount are unchanged, keep them out of the outbox
+			if !isFileUnchangedSinceSync(config, path) {
+				outbox.enqueue(outboxUpload, path, "")
+			}
+		},
+		func(pending int) {
+			mountStatuses.uploadsPending(config, pending)
+		})
+	// The downloads keep the files deleted from S3 whose local changes are not uploaded yet
+	config.setPendingUploads(func(path string) bool {
+		return uploads.isPending(path) || outbox.hasChange(path)
+	})
 
 	// There are two primary loops (running in go routines - similar to threads)
 	// 1. THE MAIN LOOP: It takes care of starting new file watcher go routine everytime it receives a signal from "startNewWatcherLoopCh" channel below.
@@ -63,167 +146,247 @@ func setupUploadWatcher(wg *sync.WaitGroup, sess *session.Session, config *mount
 		// Watch the syncDir and all it's children directories
 		err := filepath.Walk(
 			syncDir,
-			watchDirFactory(watcher, dirRequiringCrawlCh, debug))
+			watchDirFactory(watcher, config.filter, dirRequiringCrawlCh, watchLogger))
 
 		if err != nil {
-			log.Printf("Error setting up file watcher: %v\n", err)
+			watchLogger.withError(err).errorf("Error setting up file watcher")
 		}
 	}
 
-	processFileWatcherEvent := func(watcher *dirWatcher, event *fsnotify.Event) {
-		if debug {
-			log.Println("event:", event)
-		}
-		if event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove && !excludeFile(event.Name) {
-			if debug {
-				log.Println("renamed or deleted file:", event.Name)
-			}
+	// Restarts the watcher loop with a new directory watcher that re-watches all the way from the root of the mount,
+	// i.e., syncDir, and crawls every directory
+	restartWatcherLoop := func() {
+		// Send stop signal to the loop running the current watcher
+		watchLogger.tracef("Sending STOP signal to existing file watcher loop")
+		stopWatcherLoopCh <- true
+		watchLogger.tracef("Sent STOP signal to existing file watcher loop")
+
+		// Send signal to start new watcher loop
+		watchLogger.tracef("Sending START signal to start new file watcher loop")
+		startNewWatcherLoopCh <- true
+		watchLogger.tracef("Sent START signal to start new file watcher loop")
+	}
 
-			if watcher.IsBeingWatched(event.Name) {
-				if debug {
-					log.Printf("\nDirectory being watched is renamed or deleted: %v\n\n", event.Name)
+	// Scans the mount again after the file watcher lost events. Crawling the directories uploads the files created or
+	// changed in the meantime, the files synchronized before that are now missing were deleted in the meantime.
+	rescan := func() {
+		watchLogger.warnf("File watcher events were lost, scanning the mount again")
+		if hasLocalFiles(syncDir) {
+			ns := config.stateNamespace()
+			for _, base := range synchronizerState.GetSyncBases(ns, config.keys.keyPrefix) {
+				filePath, err := config.keys.localPath(base.Key)
+				if err != nil || config.filter.excludesLocalPath(filePath, false) {
+					continue
+				}
+				if _, err := os.Lstat(filePath); os.IsNotExist(err) {
+					uploads.cancel(filePath)
+					outbox.enqueue(outboxDelete, filePath, "")
 				}
-				// Directory that was being watched is renamed or deleted
-				// When dir is renamed event.Name has the dir's old name
-				// Remove the directory from the file watcher
-				watcher.UnwatchDir(event.Name)
-				// If it's rename, it will also cause "Create" event for the dir with new name if the dir is moved
-				// to a directory that is also monitored so delete the older directory from S3
-				deleteDirFromS3(sess, syncDir, event.Name, bucket, prefix, debug)
-			} else {
-				// When file is renamed event.Name has the file's old name
-				// Rename will also cause "Create" event for the file with new name if the file is moved
-				// to a directory that is also monitored so delete old file from S3
-				deleteFromS3(sess, syncDir, event.Name, bucket, prefix, debug)
 			}
+		}
+		restartWatcherLoop()
+	}
 
-		} else if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create && !excludeFile(event.Name) {
-			if debug {
-				log.Println("modified file:", event.Name)
-			}
-			// First check that this is a file
-			fi, err := os.Stat(event.Name)
-			if err != nil && os.IsNotExist(err) {
-				// We just received WRITE or CREATE event for the file but the file does not exist on the file system
-				// This can happen on Windows when a folder is renamed and new file is created or modified in the
-				// renamed folder
-				// Somehow, windows generates CREATE/WRITE events for the file under the old path
-				// For example, on Windows,
-				// When you manually create a directory, it’s created as "New directory" first and then when
-				// you rename it to say "d1" and add a file say "f1" to the directory, Windows generates file system
-				// CREATE event for file "New directory\f1" instead of "d1\f1"
-
-				if debug {
-					log.Println("Received CREATE or WRITE event for ", event.Name, " but the file or directory does not exist. This can happen when directory is renamed on Windows. Stopping existing file watcher loop and starting a new one.")
-				}
+	processRenamedOrDeleted := func(watcher *dirWatcher, name string) {
+		if config.filter.excludesLocalPath(name, watcher.IsBeingWatched(name)) {
+			watchLogger.withPath(name).tracef("renamed or deleted file is excluded by the filter rules of the mount")
+			return
+		}
+		watchLogger.withPath(name).debugf("renamed or deleted file")
+
+		if watcher.IsBeingWatched(name) {
+			watchLogger.withPath(name).debugf("Directory being watched is renamed or deleted")
+			// Directory that was being watched is renamed or deleted
+			// When dir is renamed event.Name has the dir's old name
+			// Remove the directory from the file watcher
+			watcher.UnwatchDir(name)
+			uploads.cancel(name)
+			// If it's rename, it will also cause "Create" event for the dir with new name if the dir is moved
+			// to a directory that is also monitored so delete the older directory from S3
+			outbox.enqueue(outboxDeleteDir, name, "")
+		} else {
+			// When file is renamed event.Name has the file's old name
+			// Rename will also cause "Create" event for the file with new name if the file is moved
+			// to a directory that is also monitored so delete old file from S3
+			uploads.cancel(name)
+			outbox.enqueue(outboxDelete, name, "")
+		}
+	}
 
-				// In this case restart the watcher and let it re-watch all the way from the root of the mount i.e., syncDir
-				// Send stop signal to the loop running the current watcher
-				if debug {
-					log.Println("Sending STOP signal to existing file watcher loop")
-				}
-				stopWatcherLoopCh <- true
-				if debug {
-					log.Println("Sent STOP signal to existing file watcher loop")
-				}
+	processCreatedOrModified := func(watcher *dirWatcher, event *fileWatcherEvent) {
+		watchLogger.withPath(event.Name).debugf("modified file")
+		// First check that this is a file
+		fi, err := os.Stat(event.Name)
+		if err != nil && os.IsNotExist(err) {
+			// We just received WRITE or CREATE event for the file but the file does not exist on the file system
+			// This can happen on Windows when a folder is renamed and new file is created or modified in the
+			// renamed folder
+			// Somehow, windows generates CREATE/WRITE events for the file under the old path
+			// For example, on Windows,
+			// When you manually create a directory, it’s created as "New directory" first and then when
+			// you rename it to say "d1" and add a file say "f1" to the directory, Windows generates file system
+			// CREATE event for file "New directory\f1" instead of "d1\f1"
+
+			watchLogger.withPath(event.Name).debugf("Received CREATE or WRITE event but the file or directory does not exist. This can happen when directory is renamed on Windows. Stopping existing file watcher loop and starting a new one.")
+
+			// In this case restart the watcher and let it re-watch all the way from the root of the mount i.e., syncDir
+			restartWatcherLoop()
+			return
+		} else if err != nil {
+			watchLogger.withPath(event.Name).withError(err).errorf("Unable to stat file")
+			return
+		}
 
-				// Send signal to start new watcher loop
-				if debug {
-					log.Println("Sending START signal to start new file watcher loop")
-				}
-				startNewWatcherLoopCh <- true
-				if debug {
-					log.Println("Sent START signal to start new file watcher loop")
+		if fi.Mode().IsDir() {
+			if event.Op == fileWatcherCreate {
+				watchLogger.withPath(event.Name).debugf("New directory, watching")
+				if err := filepath.Walk(
+					event.Name,
+					watchDirFactory(watcher, config.filter, dirRequiringCrawlCh, watchLogger),
+				); err != nil {
+					watchLogger.withPath(event.Name).withError(err).errorf("Unable to watch directory")
 				}
-
-				return
-			} else if err != nil {
-				log.Println("Unable to stat file", err)
 				return
 			}
+			watchLogger.withPath(event.Name).tracef("Directory, skipping")
+			return
+		}
+		if config.filter.excludesFile(event.Name, fi) {
+			watchLogger.withPath(event.Name).tracef("Excluded by the filter rules of the mount, skipping")
+			return
+		}
 
-			if fi.Mode().IsDir() {
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					if debug {
-						log.Println(event.Name, "is a new directory, watching")
-					}
-					if err := filepath.Walk(
-						event.Name,
-						watchDirFactory(watcher, dirRequiringCrawlCh, debug),
-					); err != nil {
-						log.Println("Unable to watch directory", err)
-					}
-					return
-				}
-				if debug {
-					log.Println(event.Name, "is a directory, skipping")
-				}
-				return
-			}
+		if event.Op == fileWatcherCloseWrite {
+			// The writer is done with the file, no need to wait for it to be quiet
+			uploads.scheduleNow(event.Name)
+		} else {
+			uploads.schedule(event.Name)
+		}
+	}
 
-			uploadToS3(sess, syncDir, event.Name, bucket, prefix, kmsKeyId, debug)
+	// The native file watcher reports a rename or move within the mount as a single event. The objects are then moved
+	// with server side copies instead of uploading the files again.
+	processMoved := func(watcher *dirWatcher, oldName string, newName string) {
+		isDir := watcher.IsBeingWatched(oldName)
+		if isSynchronizerPath(newName) || config.filter.excludesLocalPath(oldName, isDir) || config.filter.excludesLocalPath(newName, isDir) {
+			// Moved from or to a path that is not synchronized, same as a deletion followed by a creation
+			processRenamedOrDeleted(watcher, oldName)
+			if !isSynchronizerPath(newName) {
+				processCreatedOrModified(watcher, &fileWatcherEvent{Name: newName, Op: fileWatcherCreate})
+			}
+			return
 		}
+		watchLogger.withPath(newName).debugf("moved file from %v", oldName)
+
+		uploads.cancel(oldName)
+		if isDir {
+			// The native watcher keeps watching the moved directory, only its path changes
+			watcher.UnwatchDir(oldName)
+			outbox.enqueue(outboxMoveDir, newName, oldName)
+			// Watch the directory at its new path, crawling it uploads the files whose objects were not copied
+			processCreatedOrModified(watcher, &fileWatcherEvent{Name: newName, Op: fileWatcherCreate})
+			return
+		}
+		outbox.enqueue(outboxMove, newName, oldName)
 	}
 
-	uploadDir := func(watcher *dirWatcher, dirToUpload string, debug bool) {
-		if debug {
-			log.Println("Crawling directory", dirToUpload, "to upload file to s3 who may have been missed by file watcher")
+	processFileWatcherEvent := func(watcher *dirWatcher, event *fileWatcherEvent) {
+		watchLogger.tracef("event: %v", event)
+		if event.Op == fileWatcherOverflow {
+			rescan()
+			return
+		}
+		if isSynchronizerPath(event.Name) && (event.Op != fileWatcherMove || isSynchronizerPath(event.OldName)) {
+			// The temp files of in-progress downloads are renamed into place once complete, the event for
+			// the final file takes care of it. The other files managed by the synchronizer are never uploaded.
+			return
+		}
+		if filepath.Clean(event.Name) == filepath.Join(syncDir, syncIgnoreFileName) {
+			// The ignore file is synchronized like any other file, pick up its changes first
+			config.filter.refresh()
+		}
+		switch event.Op {
+		case fileWatcherRename, fileWatcherRemove:
+			processRenamedOrDeleted(watcher, event.Name)
+		case fileWatcherMove:
+			if isSynchronizerPath(event.OldName) {
+				// A download moved into place
+				processCreatedOrModified(watcher, &fileWatcherEvent{Name: event.Name, Op: fileWatcherCreate})
+				return
+			}
+			processMoved(watcher, event.OldName, event.Name)
+		case fileWatcherCreate, fileWatcherWrite, fileWatcherCloseWrite:
+			processCreatedOrModified(watcher, event)
 		}
+	}
+
+	uploadDir := func(watcher *dirWatcher, dirToUpload string) {
+		watchLogger.withPath(dirToUpload).debugf("Crawling directory to upload file to s3 who may have been missed by file watcher")
 		if err := filepath.Walk(
 			dirToUpload,
 			func(path string, fi os.FileInfo, err error) error {
 				if fi != nil && fi.Mode().IsDir() {
-					if debug {
-						log.Println(path, "is a new directory, watching")
+					if fi.Name() == synchronizerDirName || config.filter.excludesFile(path, fi) {
+						return filepath.SkipDir
 					}
+					watchLogger.withPath(path).debugf("New directory, watching")
 					if err := filepath.Walk(
 						path,
-						watchDirFactory(watcher, dirRequiringCrawlCh, debug),
+						watchDirFactory(watcher, config.filter, dirRequiringCrawlCh, watchLogger),
 					); err != nil {
-						log.Println("Unable to watch directory", err)
+						watchLogger.withPath(path).withError(err).errorf("Unable to watch directory")
 					}
 					return nil
 				} else if fi != nil && !fi.Mode().IsDir() {
-					if debug {
-						log.Println("Uploading file", path, "to S3")
+					if isSynchronizerPath(path) || config.filter.excludesFile(path, fi) {
+						return nil
 					}
-					uploadToS3(sess, syncDir, path, bucket, prefix, kmsKeyId, debug)
+					watchLogger.withPath(path).tracef("Scheduling upload of file to S3")
+					uploads.schedule(path)
 					return nil
 				}
 				return nil
 			},
 		); err != nil {
-			log.Println("Unable to upload directory", err)
+			watchLogger.withPath(dirToUpload).withError(err).errorf("Unable to upload directory")
 		}
 	}
 
+	startWatcherLoop := func() {
+		watcher := NewDirWatcher()
+		config.activeRoutines.Add(1)
+		go func() {
+			defer config.activeRoutines.Done()
+			runFileWatcherLoop(wg, watcher, stopUploadWatchersAfter, &dirRequiringCrawlCh, uploadDir, uploads, outbox, watchLogger, processFileWatcherEvent, &stopWatcherLoopCh, config.stopCh)
+		}()
+		addDirsToFileWatcher(watcher)
+	}
+
+	config.activeRoutines.Add(1)
 	go func() {
+		defer config.activeRoutines.Done()
 	TheMainLoop:
 		for {
 			if stopUploadWatchersAfter > 0 {
 				select {
 				case <-time.After(time.Duration(stopUploadWatchersAfter) * time.Second):
-					if debug {
-						log.Printf("\n\n THE MAIN LOOP TIMEOUT \n\n")
-					}
+					watchLogger.debugf("THE MAIN LOOP TIMEOUT")
+					break TheMainLoop
+				case <-config.stopCh:
+					watchLogger.debugf("THE MAIN LOOP STOPPED FOR REMOVED MOUNT")
 					break TheMainLoop
 				case <-startNewWatcherLoopCh:
-					if debug {
-						log.Printf("\n\n RECEIVED SIGNAL TO START NEW FILE WATCHER \n\n")
-					}
-					watcher := NewDirWatcher(debug)
-					go runFileWatcherLoop(wg, watcher, stopUploadWatchersAfter, &dirRequiringCrawlCh, uploadDir, debug, processFileWatcherEvent, &stopWatcherLoopCh)
-					addDirsToFileWatcher(watcher)
+					watchLogger.debugf("RECEIVED SIGNAL TO START NEW FILE WATCHER")
+					startWatcherLoop()
 				}
 			} else {
 				select {
+				case <-config.stopCh:
+					watchLogger.debugf("THE MAIN LOOP STOPPED FOR REMOVED MOUNT")
+					break TheMainLoop
 				case <-startNewWatcherLoopCh:
-					if debug {
-						log.Printf("\n\n RECEIVED SIGNAL TO START NEW FILE WATCHER \n\n")
-					}
-					watcher := NewDirWatcher(debug)
-					go runFileWatcherLoop(wg, watcher, stopUploadWatchersAfter, &dirRequiringCrawlCh, uploadDir, debug, processFileWatcherEvent, &stopWatcherLoopCh)
-					addDirsToFileWatcher(watcher)
+					watchLogger.debugf("RECEIVED SIGNAL TO START NEW FILE WATCHER")
+					startWatcherLoop()
 				}
 			}
 		}
@@ -235,18 +398,34 @@ func setupUploadWatcher(wg *sync.WaitGroup, sess *session.Session, config *mount
 	return nil
 }
 
-func runFileWatcherLoop(wg *sync.WaitGroup, watcher *dirWatcher, stopAfter int, dirRequiringCrawlCh *chan string, uploadDir func(dw *dirWatcher, dirToUpload string, debug bool), debug bool, processFileWatcherEvent func(dw *dirWatcher, event *fsnotify.Event), stopLoopCh *chan bool) *chan bool {
+func runFileWatcherLoop(wg *sync.WaitGroup, watcher *dirWatcher, stopAfter int, dirRequiringCrawlCh *chan string, uploadDir func(dw *dirWatcher, dirToUpload string), uploads *uploadScheduler, outbox *uploadOutbox, watchLogger *structuredLogger, processFileWatcherEvent func(dw *dirWatcher, event *fileWatcherEvent), stopLoopCh *chan bool, mountStopCh <-chan struct{}) *chan bool {
 	// Increment wait group counter everytime we spawn file upload watcher thread to make sure
 	// the caller (main) can wait
 	wg.Add(1)
+	// The wait group counter must only be decremented once either due to timeout or due to the mount being removed
+	var wgDoneOnce sync.Once
+	wgDone := func() {
+		wgDoneOnce.Do(wg.Done)
+	}
 
 	timeOut := func() {
-		if debug {
-			log.Printf("\n\n THE FILE WATCHER LOOP TIMEOUT \n\n")
-		}
+		watchLogger.debugf("THE FILE WATCHER LOOP TIMEOUT")
 		*stopLoopCh <- true
+		// Do not hold back the changed files waiting to be uploaded
+		uploads.flush()
+		outbox.flush()
 		// Decrement from the wait group indicating we are done
-		wg.Done()
+		wgDone()
+	}
+
+	mountRemoved := func() {
+		watchLogger.debugf("THE FILE WATCHER LOOP STOPPED FOR REMOVED MOUNT")
+		// Stop the watcher before returning so that the files of the removed mount can be safely
+		// deleted without triggering deletes in S3
+		watcher.Stop()
+		uploads.cancelAll()
+		outbox.discard()
+		wgDone()
 	}
 
 TheWatcherLoop:
@@ -256,37 +435,43 @@ TheWatcherLoop:
 			case <-time.After(time.Duration(stopAfter) * time.Second):
 				timeOut()
 				break
+			case <-mountStopCh:
+				mountRemoved()
+				break TheWatcherLoop
 			case <-*stopLoopCh:
-				if debug {
-					log.Printf("\n\n RECEIVED STOP SIGNAL IN THE FILE WATCHER LOOP \n\n")
-				}
+				watchLogger.debugf("RECEIVED STOP SIGNAL IN THE FILE WATCHER LOOP")
 				// Stop the watcher and exit
 				watcher.Stop()
 				break TheWatcherLoop
 			case dirToUpload := <-*dirRequiringCrawlCh:
-				uploadDir(watcher, dirToUpload, debug)
-			case event := <-watcher.FsEvents():
+				uploadDir(watcher, dirToUpload)
+			case path := <-uploads.due:
+				uploads.uploadIfDue(path)
+			case event := <-watcher.Events():
 				processFileWatcherEvent(watcher, &event)
-			case err := <-watcher.FsErrors():
-				log.Println("error:", err)
+			case err := <-watcher.Errors():
+				watchLogger.withError(err).errorf("File watcher error")
 				//log.Printf("\n\n WATCHER IS ALREADY STOPPED. EXITING THE WATCHER LOOP \n\n")
 				//break TheWatcherLoop
 			}
 		} else {
 			select {
+			case <-mountStopCh:
+				mountRemoved()
+				break TheWatcherLoop
 			case <-*stopLoopCh:
-				if debug {
-					log.Printf("\n\n RECEIVED STOP SIGNAL IN THE FILE WATCHER LOOP \n\n")
-				}
+				watchLogger.debugf("RECEIVED STOP SIGNAL IN THE FILE WATCHER LOOP")
 				// Stop the watcher and exit
 				watcher.Stop()
 				break TheWatcherLoop
 			case dirToUpload := <-*dirRequiringCrawlCh:
-				uploadDir(watcher, dirToUpload, debug)
-			case event := <-watcher.FsEvents():
+				uploadDir(watcher, dirToUpload)
+			case path := <-uploads.due:
+				uploads.uploadIfDue(path)
+			case event := <-watcher.Events():
 				processFileWatcherEvent(watcher, &event)
-			case err := <-watcher.FsErrors():
-				log.Println("error:", err)
+			case err := <-watcher.Errors():
+				watchLogger.withError(err).errorf("File watcher error")
 				//log.Printf("\n\n WATCHER IS ALREADY STOPPED. EXITING THE WATCHER LOOP \n\n")
 				//break TheWatcherLoop
 			}
@@ -295,36 +480,47 @@ TheWatcherLoop:
 	return stopLoopCh
 }
 
-func deleteFromS3(sess *session.Session, syncDir string, filename string, bucket string, prefix string, debug bool) error {
+func deleteFromS3(sess *session.Session, keys *keyMapper, filename string, bucket string, logger *structuredLogger) error {
 	svc := s3.New(sess)
-	fileKey := ToS3KeyForFile(filename, prefix, syncDir)
+	deleteLogger := logger.withOp("delete").withPath(filename)
+	fileKey, err := keys.keyForLocalPath(filename)
+	if err != nil {
+		deleteLogger.withError(err).errorf("Failed to delete object")
+		return err
+	}
+	deleteLogger = deleteLogger.withKey(fileKey)
 	deleteObjectInput := &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(fileKey)}
-	_, err := svc.DeleteObject(deleteObjectInput)
+	_, err = svc.DeleteObject(deleteObjectInput)
 
 	if err == nil {
-		if debug {
-			log.Println("Successfully deleted", filename, "from", bucket+"/"+fileKey)
-		}
+		deleteLogger.debugf("Successfully deleted %v from %v", filename, bucket+"/"+fileKey)
 	} else {
-		log.Println("Failed to delete object: ", err)
+		deleteLogger.withError(err).errorf("Failed to delete object")
 	}
 
 	return err
 }
 
-func deleteDirFromS3(sess *session.Session, syncDir string, dirName string, bucket string, prefix string, debug bool) error {
+// Returned when a change is not applied (or applied partially) because the synchronization of the mount was stopped
+var errMountStopped = errors.New("the synchronization of the mount was stopped")
+
+// Deletes the objects under the given local directory. Listing or deleting the objects is not retried here, the
+// returned error leaves the deletion in the outbox to be retried with backoff.
+func deleteDirFromS3(sess *session.Session, config *mountConfiguration, dirName string) error {
 	svc := s3.New(sess)
+	bucket := config.bucket
+	deleteLogger := config.logger.withOp("delete").withPath(dirName)
 
-	// Add trailing slash for the dir name if it doesn't exist
-	dirPrefixInS3 := filepath.ToSlash(dirName)
-	if !strings.HasSuffix(dirPrefixInS3, "/") {
-		dirPrefixInS3 = dirPrefixInS3 + "/"
+	dirKey, err := config.keys.keyForLocalPath(dirName)
+	if err != nil {
+		deleteLogger.withError(err).errorf("Failed to delete directory")
+		return err
 	}
-	dirKey := ToS3KeyForFile(dirPrefixInS3, prefix, syncDir)
+	// Add trailing slash for the dir key, e.g., "data/" and not "data2/" for the dir "data"
+	dirKey = dirKey + "/"
+	deleteLogger = deleteLogger.withKey(dirKey)
 
-	if debug {
-		fmt.Printf("Deleting directory: %v from S3: %v\n", dirKey, bucket)
-	}
+	deleteLogger.debugf("Deleting directory: %v from S3: %v", dirKey, bucket)
 	truncatedListing := true
 	query := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
@@ -332,44 +528,24 @@ func deleteDirFromS3(sess *session.Session, syncDir string, dirName string, buck
 	}
 
 	for truncatedListing {
+		if config.isStopped() {
+			return errMountStopped
+		}
 		resp, err := svc.ListObjectsV2(query)
 
 		if err != nil {
-			log.Println("Failed to list objects: ", err)
-			// 10 seconds backoff
-			time.Sleep(time.Duration(10) * time.Second)
-			continue
+			deleteLogger.withOp("list").withError(err).errorf("Failed to list objects")
+			return err
 		}
 
-		var objectIdentifiers []*s3.ObjectIdentifier
 		// If the directory path is not empty in S3 then first delete all objects under the directory
 		// (i.e., under the specific S3 suffix)
-		if len(resp.Contents) > 0 {
-			for _, item := range resp.Contents {
-				objectIdentifiers = append(objectIdentifiers, &s3.ObjectIdentifier{Key: item.Key})
-			}
-
-			deleteObjectsInput := &s3.DeleteObjectsInput{
-				Bucket: aws.String(bucket),
-				Delete: &s3.Delete{
-					Objects: objectIdentifiers,
-				},
-			}
-			if debug {
-				fmt.Printf("Deleting objects from old S3 path %v: %v\n", dirKey, deleteObjectsInput)
-			}
-			deleteObjectsResp, err := svc.DeleteObjects(deleteObjectsInput)
-			if err != nil {
-				log.Println("Failed to delete objects: ", err)
-				return err
-			}
-			if len(deleteObjectsResp.Errors) > 0 && len(deleteObjectsResp.Deleted) > 0 {
-				log.Println("Failed to delete some objects: ", deleteObjectsResp.Errors)
-			}
-			if len(deleteObjectsResp.Errors) > 0 && len(deleteObjectsResp.Deleted) == 0 {
-				log.Println("Failed to delete objects: ", deleteObjectsResp)
-				return errors.New(fmt.Sprintf("Failed to delete objects: %v\n", deleteObjectsResp.Errors))
-			}
+		keys := make([]string, 0, len(resp.Contents))
+		for _, item := range resp.Contents {
+			keys = append(keys, aws.StringValue(item.Key))
+		}
+		if err := deleteObjectsFromS3(svc, bucket, keys, deleteLogger); err != nil {
+			return err
 		}
 
 		query.ContinuationToken = resp.NextContinuationToken
@@ -378,128 +554,201 @@ func deleteDirFromS3(sess *session.Session, syncDir string, dirName string, buck
 
 	keyToDelete := strings.TrimSuffix(dirKey, "/")
 	deleteObjectInput := &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(keyToDelete)}
-	_, err := svc.DeleteObject(deleteObjectInput)
+	_, err = svc.DeleteObject(deleteObjectInput)
 	if err == nil {
-		if debug {
-			log.Println("Successfully deleted dir", keyToDelete, "from", bucket+"/"+keyToDelete)
-		}
+		deleteLogger.debugf("Successfully deleted dir %v from %v", keyToDelete, bucket+"/"+keyToDelete)
 	} else {
-		log.Println("Failed to delete dir ", keyToDelete, "from S3", err)
+		deleteLogger.withError(err).errorf("Failed to delete dir %v from S3", keyToDelete)
 	}
 	return err
 }
 
-func uploadToS3(sess *session.Session, syncDir string, filename string, bucket string, prefix string, kmsKeyId string, debug bool) error {
+func uploadToS3(sess *session.Session, config *mountConfiguration, filename string) error {
+	uploadLogger := config.logger.withOp("upload").withPath(filename)
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Println("Unable to open file", err)
+		uploadLogger.withError(err).errorf("Unable to open file")
 		return err
 	}
 	defer file.Close()
-	uploader := s3manager.NewUploader(sess)
-
-	fileKeyInS3 := ToS3KeyForFile(filename, prefix, syncDir)
-
-	// Do NOT upload if there is no change in file size (bytes)
-	// Without this there will be infinite loop between the downloader thread and the upload watcher thread as follows
-	// Say, the file watcher is watching directory "A", the downloader thread syncs all files from S3 to "A"
-	// This will trigger the file watcher events, the file watcher will upload them (if we don't check size)
-	// The upload in S3 will cause the file's ETag to change even though there is no change in file's content
-	// Due to this, the downloader thread will detect this as file update in S3 and download the file again
-	// This will cause file change event in file watcher and so on...
-
-	// Also, DO NOT upload file if the file is empty. The downloader thread on some platforms (e.g., on Windows) creates empty file on local file system first before writing stream of data from S3 to the file
-	// The creation of the empty file will cause the file CREATE event to trigger and we will end up uploading empty file to S3 if we don't check for non-empty here.
-	if areSizesDifferent(sess, bucket, fileKeyInS3, file) && !isEmptyFile(file) {
-		var uploadInput *s3manager.UploadInput
-		if strings.TrimSpace(kmsKeyId) == "" {
-			uploadInput = &s3manager.UploadInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(fileKeyInS3),
-				Body:   file,
-				ACL:    aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
-			}
-		} else {
-			uploadInput = &s3manager.UploadInput{
-				Bucket:               aws.String(bucket),
-				Key:                  aws.String(fileKeyInS3),
-				Body:                 file,
-				ServerSideEncryption: aws.String("aws:kms"),
-				SSEKMSKeyId:          aws.String(kmsKeyId),
-				ACL:                  aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
-			}
-		}
 
-		// upload file to S3
-		_, err = uploader.Upload(uploadInput)
+	fileKeyInS3, err := config.keys.keyForLocalPath(filename)
+	if err != nil {
+		uploadLogger.withError(err).errorf("Unable to upload")
+		return err
+	}
 
-		if err == nil {
-			if debug {
-				log.Println("Successfully uploaded", filename, "to", bucket+"/"+fileKeyInS3)
-			}
-		} else {
-			log.Println("Unable to upload", filename, bucket, err)
-		}
+	fi, err := file.Stat()
+	if err != nil {
+		uploadLogger.withError(err).errorf("Unable to upload")
+		return err
+	}
+	// Do NOT upload the files written by the downloader, the download records the file once it is in place
+	if synchronizerState.IsOwnLocalWrite(filename, fi) {
+		uploadLogger.debugf("Being downloaded from S3, skipping upload")
+		return nil
+	}
+	// Do NOT upload if the content of the file has not changed since it was last downloaded or uploaded
+	svc := s3.New(sess)
+	if !hasFileChangedLocally(svc, config, file, fileKeyInS3) {
+		uploadLogger.debugf("Content has not changed since last download or upload, skipping upload this time")
+		return nil
+	}
 
+	return uploadFileToS3(svc, config, file, fileKeyInS3)
+}
+
+// Uploads the given file to the given key in S3 and verifies the uploaded object matches the file
+func uploadFileToS3(svc *s3.S3, config *mountConfiguration, file *os.File, fileKeyInS3 string) error {
+	bucket := config.bucket
+	uploadLogger := config.logger.withOp("upload").withPath(file.Name()).withKey(fileKeyInS3)
+	kmsKeyId := config.kmsKeyId
+	var uploadInput *s3manager.UploadInput
+	if strings.TrimSpace(kmsKeyId) == "" {
+		uploadInput = &s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(fileKeyInS3),
+			Body:   file,
+			ACL:    aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
+		}
 	} else {
-		if debug {
-			log.Println(filename, " size has not changed since last upload or the file is empty, skipping upload this time")
+		uploadInput = &s3manager.UploadInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(fileKeyInS3),
+			Body:                 file,
+			ServerSideEncryption: aws.String("aws:kms"),
+			SSEKMSKeyId:          aws.String(kmsKeyId),
+			ACL:                  aws.String(s3.ObjectCannedACLBucketOwnerFullControl),
 		}
 	}
 
-	return nil
-}
+	// upload file to S3 and verify the uploaded object matches the file
+	start := time.Now()
+	fingerprint, etag, err := uploadAndVerify(s3manager.NewUploaderWithClient(svc), svc, uploadInput, file, uploadLogger)
 
-// Checks if the file's sizes are different on disk and in S3
-func areSizesDifferent(sess *session.Session, bucket string, fileKeyInS3 string, file *os.File) bool {
-	query := &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(fileKeyInS3),
+	if err == nil {
+		uploadLogger.withBytes(fingerprint.Size).withDuration(time.Since(start)).debugf("Successfully uploaded %v to %v", file.Name(), bucket+"/"+fileKeyInS3)
+		// Remember the upload so that the object is not downloaded back and the file is not uploaded again until
+		// either of them changes
+		synchronizerState.RecordFileUploadToS3(config.stateNamespace(), fileKeyInS3, etag, fingerprint)
+	} else {
+		uploadLogger.withError(err).errorf("Unable to upload")
 	}
-	svc := s3.New(sess)
-	resp, err := svc.ListObjectsV2(query)
+	return err
+}
+
+// Checks if the content of the given file differs from the content of the object with the given key in S3.
+// The fingerprint of the file recorded when it was last downloaded or uploaded is checked first, the content is only
+// read when the size or modification time of the file changed. The content is then compared with the cached MD5 of
+// the last synchronized content and with the ETag and checksums of the object in S3.
+func hasFileChangedLocally(svc *s3.S3, config *mountConfiguration, file *os.File, fileKeyInS3 string) bool {
+	ns := config.stateNamespace()
+	fileLogger := config.logger.withPath(file.Name()).withKey(fileKeyInS3)
+	fi, err := file.Stat()
 	if err != nil {
-		log.Println("Failed to list objects: ", err)
-		// 5 seconds backoff
-		time.Sleep(time.Duration(5) * time.Second)
+		fileLogger.withError(err).errorf("Failed to read file size")
+		return true
+	}
+	recorded := synchronizerState.GetLocalFingerprint(ns, fileKeyInS3)
+	if recorded != nil && recorded.matches(fi) {
+		return false
 	}
 
-	if len(resp.Contents) > 0 {
-		item := resp.Contents[0] // Expecting only one element since we are doing ListObjectsV2 on specific object path
+	fingerprint, err := newFileFingerprintWithContentHash(file)
+	if err != nil {
+		fileLogger.withError(err).errorf("Failed to read file")
+		return true
+	}
+	if recorded != nil && recorded.MD5 != "" && recorded.Size == fingerprint.Size && recorded.MD5 == fingerprint.MD5 {
+		// Only the modification time changed (e.g., the file was touched or saved without changes)
+		synchronizerState.RecordLocalFingerprint(ns, fileKeyInS3, fingerprint)
+		return false
+	}
 
-		fi, err := file.Stat()
-		if err != nil {
-			log.Printf("Failed to read file '%v' size, Error: %v\n", file.Name(), err)
-			return true
+	// Compare with the object itself, it may have the content already (e.g., the file is being downloaded from S3)
+	digests, err := headObjectDigests(svc, config.bucket, fileKeyInS3, "")
+	if err != nil {
+		if requestFailure, ok := err.(awserr.RequestFailure); !ok || requestFailure.StatusCode() != http.StatusNotFound {
+			fileLogger.withError(err).errorf("Failed to get object")
 		}
-		return *item.Size != fi.Size()
+		return true
 	}
+	if !fileContentMatchesObject(file, fingerprint, digests) {
+		return true
+	}
+	synchronizerState.RecordLocalFingerprint(ns, fileKeyInS3, fingerprint)
+	return false
+}
 
-	return true
+// Returns flag indicating if the file at the given path still has the size and modification time it had when it was
+// last downloaded or uploaded
+func isFileUnchangedSinceSync(config *mountConfiguration, filename string) bool {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	key, err := config.keys.keyForLocalPath(filename)
+	if err != nil {
+		return false
+	}
+	recorded := synchronizerState.GetLocalFingerprint(config.stateNamespace(), key)
+	return recorded != nil && recorded.matches(fi)
 }
 
-func isEmptyFile(file *os.File) bool {
+// Returns the fingerprint of the given file including the MD5 of its content
+func newFileFingerprintWithContentHash(file *os.File) (*fileFingerprint, error) {
 	fi, err := file.Stat()
 	if err != nil {
-		log.Printf("Failed to read file '%v' size, Error: %v\n", file.Name(), err)
-		return true
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
-	return !(fi.Size() > 0)
+	digest := md5.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	fingerprint := newFileFingerprint(fi)
+	fingerprint.MD5 = hex.EncodeToString(digest.Sum(nil))
+	return fingerprint, nil
+}
+
+// Returns flag indicating if the content of the given file with the given fingerprint matches the digests of the
+// object. Single part ETags are compared with the cached MD5, the content is read again for the other digests.
+func fileContentMatchesObject(file *os.File, fingerprint *fileFingerprint, digests *objectDigests) bool {
+	if digests.size != fingerprint.Size {
+		return false
+	}
+	if digests.etagIsDigest && digestPartCount(digests.etag) == 0 {
+		return digests.etag == fingerprint.MD5
+	}
+	if len(digests.checks()) == 0 {
+		// The content can not be compared (e.g., multipart object encrypted with SSE-KMS)
+		return false
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	defer file.Seek(0, io.SeekStart)
+	return digests.verify(file) == nil
 }
 
-func watchDirFactory(watcher *dirWatcher, dirRequiringCrawlCh chan string, debug bool) func(path string, fi os.FileInfo, err error) error {
+func watchDirFactory(watcher *dirWatcher, filter *mountFilter, dirRequiringCrawlCh chan string, watchLogger *structuredLogger) func(path string, fi os.FileInfo, err error) error {
 	return func(path string, fi os.FileInfo, err error) error {
 		// since fsnotify can watch all the files in a directory, watchers only need
 		// to be added to each nested directory
 		if fi != nil && fi.Mode().IsDir() {
+			if fi.Name() == synchronizerDirName || filter.excludesFile(path, fi) {
+				// Do not watch the files managed by the synchronizer and the excluded directories
+				return filepath.SkipDir
+			}
 			if watcher.IsBeingWatched(path) {
-				if debug {
-					log.Println("Directory", path, "is already being watched. Skipping registration for watcher.")
-				}
+				watchLogger.withPath(path).tracef("Directory is already being watched. Skipping registration for watcher.")
 			} else {
-				if debug {
-					log.Println("Watching directory", path)
-				}
+				watchLogger.withPath(path).debugf("Watching directory")
 				err := watcher.WatchDir(path)
 				dirRequiringCrawlCh <- path
 				return err
@@ -508,19 +757,3 @@ func watchDirFactory(watcher *dirWatcher, dirRequiringCrawlCh chan string, debug
 		return nil
 	}
 }
-
-func excludeFile(path string) bool {
-	// On Windows ignore the recycle bin
-	if strings.HasPrefix(path, "$RECYCLE.BIN") {
-		return true
-	}
-	var extension = filepath.Ext(path)
-	switch extension {
-	case ".swp":
-		return true
-	case ".tmp":
-		return true
-	default:
-		return false
-	}
-}
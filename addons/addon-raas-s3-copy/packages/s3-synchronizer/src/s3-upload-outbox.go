@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The backoff before retrying a failed change, doubled after each failure up to the maximum backoff
+var outboxInitialBackoff = time.Second
+var outboxMaxBackoff = 5 * time.Minute
+
+// Name of the table of the synchronizer state the changes of the outboxes are saved in, one record per change keyed by
+// the entry key prefix of the namespace of the mount followed by the Seq of the change
+const outboxTable = "outbox"
+
+// Number of workers applying the changes of the outbox of a mount to S3
+const outboxWorkers = 2
+
+type outboxOp string
+
+const (
+	// Upload the file at Path
+	outboxUpload outboxOp = "upload"
+	// Delete the object of the file at Path
+	outboxDelete outboxOp = "delete"
+	// Delete the objects under the directory at Path
+	outboxDeleteDir outboxOp = "deleteDir"
+	// Move the object of the file moved from OldPath to Path
+	outboxMove outboxOp = "move"
+	// Move the objects under the directory moved from OldPath to Path
+	outboxMoveDir outboxOp = "moveDir"
+)
+
+// A local change of a writeable mount waiting to be applied to S3
+type outboxEntry struct {
+	// Order in which the changes were made, changes of overlapping paths are applied in this order
+	Seq         int64     `json:"seq"`
+	Op          outboxOp  `json:"op"`
+	Path        string    `json:"path"`
+	OldPath     string    `json:"oldPath,omitempty"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// Returns the paths changed by this entry
+func (entry *outboxEntry) paths() []string {
+	if entry.OldPath == "" {
+		return []string{entry.Path}
+	}
+	return []string{entry.Path, entry.OldPath}
+}
+
+// Returns the directories the given local path is under, from its parent up to the root
+func parentDirPaths(path string) []string {
+	dirs := make([]string, 0)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if filepath.Dir(dir) == dir {
+			return dirs
+		}
+	}
+}
+
+// The Seq of changes of the outbox in ascending order. The Seq of the changes removed from the outbox are dropped
+// lazily, when they are at the front of the list or when they make up most of the list.
+type outboxSeqList struct {
+	seqs []int64
+	// Number of the seqs of changes still in the outbox
+	live int
+}
+
+// Persistent queue of the local changes of a writeable mount (uploads, deletes and moves) waiting to be applied to S3.
+// The changes are saved before they are applied and removed once applied, so the changes not applied yet when the
+// program stops (or fails) are applied when it starts again. Workers apply the changes concurrently, except for the
+// changes of overlapping paths that are applied in order. A failed change is retried with exponential backoff, so the
+// changes are kept while S3 can not be reached. The changes must be idempotent, a change may be applied again if the
+// program stops before the change is removed.
+// Each change is saved as its own record. The changes are indexed by path so that neither adding a change nor taking
+// the next change to apply goes through all the changes.
+type uploadOutbox struct {
+	records   RecordPersistence
+	keyPrefix string
+	logger    *structuredLogger
+	apply     func(entry *outboxEntry) error
+	// Called with the number of changes in the outbox every time it changes
+	onSizeChange func(size int)
+
+	lock sync.Mutex
+	// Map of Seq vs *outboxEntry for the changes waiting to be applied or being applied
+	entries map[int64]*outboxEntry
+	// Set of the Seq of the changes being applied
+	inFlight map[int64]bool
+	// The changes in the order they were made
+	order *outboxSeqList
+	// Map of path vs the changes of the path, and map of directory path vs the changes of the paths under it
+	byPath   map[string]*outboxSeqList
+	underDir map[string]*outboxSeqList
+	// Map of path vs Seq of the upload of the path that was not attempted yet
+	uploads map[string]int64
+	nextSeq int64
+	// Closed and replaced every time the outbox changes to wake up the workers
+	changed chan struct{}
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+// Returns the outbox saved in the given records under the given key prefix, with the changes not applied when it was
+// last used
+func newUploadOutbox(records RecordPersistence, keyPrefix string, logger *structuredLogger, apply func(entry *outboxEntry) error, onSizeChange func(size int)) *uploadOutbox {
+	outbox := &uploadOutbox{
+		records:      records,
+		keyPrefix:    keyPrefix,
+		logger:       logger,
+		apply:        apply,
+		onSizeChange: onSizeChange,
+		entries:      make(map[int64]*outboxEntry),
+		inFlight:     make(map[int64]bool),
+		order:        &outboxSeqList{},
+		byPath:       make(map[string]*outboxSeqList),
+		underDir:     make(map[string]*outboxSeqList),
+		uploads:      make(map[string]int64),
+		changed:      make(chan struct{}),
+		stopCh:       make(chan struct{}),
+	}
+	entries := make([]*outboxEntry, 0)
+	err := records.ForEach(outboxTable, func(key string, data []byte) error {
+		if !strings.HasPrefix(key, keyPrefix) {
+			return nil
+		}
+		entry := &outboxEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		outbox.logger.withError(err).errorf("Unable to load the pending changes to upload, they will be picked up by the next crawl")
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	for _, entry := range entries {
+		outbox.addLocked(entry)
+		outbox.nextSeq = entry.Seq + 1
+	}
+	outbox.sizeChanged()
+	return outbox
+}
+
+// Starts the workers applying the changes
+func (outbox *uploadOutbox) start() {
+	for i := 0; i < outboxWorkers; i++ {
+		outbox.workers.Add(1)
+		go outbox.work()
+	}
+}
+
+// Adds the given change to the outbox
+func (outbox *uploadOutbox) enqueue(op outboxOp, path string, oldPath string) {
+	path = filepath.Clean(path)
+	if oldPath != "" {
+		oldPath = filepath.Clean(oldPath)
+	}
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+
+	if op == outboxUpload {
+		if _, ok := outbox.uploads[path]; ok {
+			// Already waiting to be uploaded, the upload reads the file as it is then
+			return
+		}
+	}
+	entry := &outboxEntry{Seq: outbox.nextSeq, Op: op, Path: path, OldPath: oldPath, Queued: time.Now()}
+	outbox.nextSeq++
+	outbox.addLocked(entry)
+	outbox.saveLocked(entry)
+	outbox.changedLocked()
+}
+
+// Returns the number of changes not applied yet
+func (outbox *uploadOutbox) size() int {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	return len(outbox.entries)
+}
+
+// Returns flag indicating if a change of the given path is waiting to be applied or being applied
+func (outbox *uploadOutbox) hasChange(path string) bool {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	_, ok := outbox.byPath[filepath.Clean(path)]
+	return ok
+}
+
+func (outbox *uploadOutbox) work() {
+	defer outbox.workers.Done()
+	for {
+		entry, wait, changed := outbox.next(false, nil)
+		if entry == nil {
+			var retry <-chan time.Time
+			if wait > 0 {
+				retry = time.After(wait)
+			}
+			select {
+			case <-changed:
+			case <-retry:
+			case <-outbox.stopCh:
+				return
+			}
+			continue
+		}
+		outbox.done(entry, outbox.apply(entry))
+	}
+}
+
+// Takes the next change that can be applied, i.e., the oldest change whose backoff elapsed (or any change if
+// ignoreBackoff is set) that does not overlap an older change and is not in the given skip set. Returns nil if there
+// is none, with the time until the backoff of the next change elapses (zero if unknown) and a channel closed when the
+// outbox changes.
+func (outbox *uploadOutbox) next(ignoreBackoff bool, skip map[int64]bool) (*outboxEntry, time.Duration, <-chan struct{}) {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	outbox.dropRemovedLocked(outbox.order)
+	for _, seq := range outbox.order.seqs {
+		entry, ok := outbox.entries[seq]
+		if !ok || outbox.inFlight[seq] || skip[seq] || outbox.isBlockedLocked(entry) {
+			continue
+		}
+		if !ignoreBackoff && entry.NextAttempt.After(now) {
+			if untilRetry := entry.NextAttempt.Sub(now); wait == 0 || untilRetry < wait {
+				wait = untilRetry
+			}
+			continue
+		}
+		outbox.inFlight[seq] = true
+		if outbox.uploads[entry.Path] == seq {
+			// Uploads enqueued from now on are applied after this one
+			delete(outbox.uploads, entry.Path)
+		}
+		return entry, 0, nil
+	}
+	return nil, wait, outbox.changed
+}
+
+// Returns flag indicating if the given change overlaps an older change, i.e., an older change of the same path, of a
+// directory the path is under or of a path under the path. Must be called with the lock held.
+func (outbox *uploadOutbox) isBlockedLocked(entry *outboxEntry) bool {
+	for _, path := range entry.paths() {
+		if outbox.hasOlderLocked(outbox.byPath[path], entry.Seq) || outbox.hasOlderLocked(outbox.underDir[path], entry.Seq) {
+			return true
+		}
+		for _, dir := range parentDirPaths(path) {
+			if outbox.hasOlderLocked(outbox.byPath[dir], entry.Seq) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns flag indicating if the given list has a change older than the given Seq, must be called with the lock held
+func (outbox *uploadOutbox) hasOlderLocked(list *outboxSeqList, seq int64) bool {
+	if list == nil {
+		return false
+	}
+	outbox.dropRemovedLocked(list)
+	return len(list.seqs) > 0 && list.seqs[0] < seq
+}
+
+// Drops the Seq of the changes removed from the outbox from the front of the given list, must be called with the lock
+// held
+func (outbox *uploadOutbox) dropRemovedLocked(list *outboxSeqList) {
+	for len(list.seqs) > 0 {
+		if _, ok := outbox.entries[list.seqs[0]]; ok {
+			return
+		}
+		list.seqs = list.seqs[1:]
+	}
+}
+
+// Adds the given change to the outbox and its indexes, must be called with the lock held. The changes must be added in
+// the order of their Seq.
+func (outbox *uploadOutbox) addLocked(entry *outboxEntry) {
+	outbox.entries[entry.Seq] = entry
+	addToOutboxSeqList(outbox.order, entry.Seq)
+	for _, path := range entry.paths() {
+		outbox.addToIndexLocked(outbox.byPath, path, entry.Seq)
+		for _, dir := range parentDirPaths(path) {
+			outbox.addToIndexLocked(outbox.underDir, dir, entry.Seq)
+		}
+	}
+	if entry.Op == outboxUpload && entry.Attempts == 0 {
+		outbox.uploads[entry.Path] = entry.Seq
+	}
+}
+
+// Removes the given change from the outbox and its indexes, must be called with the lock held
+func (outbox *uploadOutbox) removeLocked(entry *outboxEntry) {
+	delete(outbox.entries, entry.Seq)
+	delete(outbox.inFlight, entry.Seq)
+	if outbox.uploads[entry.Path] == entry.Seq {
+		delete(outbox.uploads, entry.Path)
+	}
+	outbox.removeFromListLocked(outbox.order)
+	for _, path := range entry.paths() {
+		outbox.removeFromIndexLocked(outbox.byPath, path)
+		for _, dir := range parentDirPaths(path) {
+			outbox.removeFromIndexLocked(outbox.underDir, dir)
+		}
+	}
+}
+
+func addToOutboxSeqList(list *outboxSeqList, seq int64) {
+	list.seqs = append(list.seqs, seq)
+	list.live++
+}
+
+// Must be called with the lock held
+func (outbox *uploadOutbox) addToIndexLocked(index map[string]*outboxSeqList, path string, seq int64) {
+	list, ok := index[path]
+	if !ok {
+		list = &outboxSeqList{}
+		index[path] = list
+	}
+	addToOutboxSeqList(list, seq)
+}
+
+// Accounts for a change removed from the outbox in the list of the given path of the given index, must be called with
+// the lock held
+func (outbox *uploadOutbox) removeFromIndexLocked(index map[string]*outboxSeqList, path string) {
+	list, ok := index[path]
+	if !ok {
+		return
+	}
+	if outbox.removeFromListLocked(list) {
+		delete(index, path)
+	}
+}
+
+// Accounts for a change removed from the outbox in the given list, compacting the list once it is mostly the Seq of
+// removed changes. Returns flag indicating if the list has no changes left. Must be called with the lock held.
+func (outbox *uploadOutbox) removeFromListLocked(list *outboxSeqList) bool {
+	list.live--
+	if list.live <= 0 {
+		list.seqs = nil
+		list.live = 0
+		return true
+	}
+	if len(list.seqs) > 2*list.live {
+		seqs := make([]int64, 0, list.live)
+		for _, seq := range list.seqs {
+			if _, ok := outbox.entries[seq]; ok {
+				seqs = append(seqs, seq)
+			}
+		}
+		list.seqs = seqs
+	}
+	return false
+}
+
+// Records the outcome of applying the given change. The change is removed if it was applied, otherwise it is
+// retried after the backoff.
+func (outbox *uploadOutbox) done(entry *outboxEntry, err error) {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+
+	if err != nil {
+		delete(outbox.inFlight, entry.Seq)
+		entry.Attempts++
+		backoff := outboxInitialBackoff
+		for i := 1; i < entry.Attempts && backoff < outboxMaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > outboxMaxBackoff {
+			backoff = outboxMaxBackoff
+		}
+		entry.NextAttempt = time.Now().Add(backoff)
+		entry.LastError = err.Error()
+		outbox.saveLocked(entry)
+		outbox.logger.withOp(string(entry.Op)).withPath(entry.Path).withError(err).warnf("Unable to apply the change (attempt %v), retrying in %v", entry.Attempts, backoff)
+	} else {
+		outbox.removeLocked(entry)
+		outbox.deleteLocked(entry)
+	}
+	outbox.changedLocked()
+}
+
+// Applies all the changes of the outbox without waiting for their backoff (e.g., the watcher is stopping). Each change
+// is attempted once, the changes that still fail are kept for the next start.
+func (outbox *uploadOutbox) flush() {
+	attempted := make(map[int64]bool)
+	for {
+		entry, _, changed := outbox.next(true, attempted)
+		if entry != nil {
+			attempted[entry.Seq] = true
+			outbox.done(entry, outbox.apply(entry))
+			continue
+		}
+		outbox.lock.Lock()
+		inFlight := len(outbox.inFlight)
+		outbox.lock.Unlock()
+		if inFlight == 0 {
+			return
+		}
+		// Wait for the workers, the changes they are applying may be blocking others
+		select {
+		case <-changed:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Stops the workers, the changes not applied yet are kept for the next start
+func (outbox *uploadOutbox) stop() {
+	outbox.stopOnce.Do(func() {
+		close(outbox.stopCh)
+	})
+	outbox.workers.Wait()
+}
+
+// Stops the workers and drops all the changes (e.g., the mount was removed)
+func (outbox *uploadOutbox) discard() {
+	outbox.stop()
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	for _, entry := range outbox.entries {
+		outbox.deleteLocked(entry)
+	}
+	outbox.entries = make(map[int64]*outboxEntry)
+	outbox.inFlight = make(map[int64]bool)
+	outbox.order = &outboxSeqList{}
+	outbox.byPath = make(map[string]*outboxSeqList)
+	outbox.underDir = make(map[string]*outboxSeqList)
+	outbox.uploads = make(map[string]int64)
+	outbox.sizeChanged()
+}
+
+// Returns the key of the record of the change with the given Seq. The keys of the changes sort in the order of their Seq.
+func (outbox *uploadOutbox) recordKey(seq int64) string {
+	return outbox.keyPrefix + fmt.Sprintf("%016x", seq)
+}
+
+// Saves the given change, must be called with the lock held
+func (outbox *uploadOutbox) saveLocked(entry *outboxEntry) {
+	if err := outbox.records.Put(outboxTable, outbox.recordKey(entry.Seq), entry); err != nil {
+		outbox.logger.withOp(string(entry.Op)).withPath(entry.Path).withError(err).errorf("Unable to save the pending change to upload")
+	}
+}
+
+// Removes the saved change, must be called with the lock held
+func (outbox *uploadOutbox) deleteLocked(entry *outboxEntry) {
+	if err := outbox.records.Delete(outboxTable, outbox.recordKey(entry.Seq)); err != nil {
+		outbox.logger.withOp(string(entry.Op)).withPath(entry.Path).withError(err).errorf("Unable to remove the pending change to upload")
+	}
+}
+
+// Wakes up the workers, must be called with the lock held
+func (outbox *uploadOutbox) changedLocked() {
+	close(outbox.changed)
+	outbox.changed = make(chan struct{})
+	outbox.sizeChanged()
+}
+
+func (outbox *uploadOutbox) sizeChanged() {
+	if outbox.onSizeChange != nil {
+		outbox.onSizeChange(len(outbox.entries))
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delays the uploads of the files of a writeable mount until they are quiet, i.e., until no file watcher event was
+// received for the file for the quiet period. A file that keeps changing is still uploaded once the maximum delay since
+// its first event elapsed. All the events received for a file in the meantime result in a single upload, and a file
+// being written (e.g., by a training job) is not uploaded half-written on every write.
+type uploadScheduler struct {
+	quietPeriod time.Duration
+	// Zero or negative means the uploads are delayed for as long as the files keep changing
+	maxDelay time.Duration
+	upload   func(path string)
+	// Called with the number of pending uploads every time it changes, never with the lock held
+	onPendingChange func(pending int)
+	// Serializes the calls of onPendingChange so that the last call has the current number
+	notifyLock sync.Mutex
+
+	// Receives the paths of the files whose uploads are due, the file watcher loop uploads them
+	due chan string
+
+	lock sync.Mutex
+	// Map of file path vs *scheduledUpload
+	pending map[string]*scheduledUpload
+}
+
+type scheduledUpload struct {
+	firstEvent time.Time
+	timer      *time.Timer
+	// Incremented every time the upload is rescheduled so that a timer that fired in the meantime is ignored
+	generation int
+	// Set once the upload is due and sent to the file watcher loop
+	isDue bool
+}
+
+// Returns a scheduler calling the given upload function for each file once it is quiet. With a quiet period of zero,
+// the files are uploaded on every event.
+func newUploadScheduler(quietPeriod time.Duration, maxDelay time.Duration, upload func(path string), onPendingChange func(pending int)) *uploadScheduler {
+	return &uploadScheduler{
+		quietPeriod:     quietPeriod,
+		maxDelay:        maxDelay,
+		upload:          upload,
+		onPendingChange: onPendingChange,
+		due:             make(chan string, 1000),
+		pending:         make(map[string]*scheduledUpload),
+	}
+}
+
+// Schedules the upload of the given file, or postpones it if it is already scheduled
+func (scheduler *uploadScheduler) schedule(path string) {
+	scheduler.scheduleAfter(path, scheduler.quietPeriod)
+}
+
+// Makes the upload of the given file due right away (e.g., the writer closed the file), without waiting for the file
+// to be quiet
+func (scheduler *uploadScheduler) scheduleNow(path string) {
+	scheduler.scheduleAfter(path, 0)
+}
+
+func (scheduler *uploadScheduler) scheduleAfter(path string, quietPeriod time.Duration) {
+	path = filepath.Clean(path)
+	if scheduler.quietPeriod <= 0 {
+		scheduler.upload(path)
+		return
+	}
+
+	scheduler.lock.Lock()
+	now := time.Now()
+	upload, ok := scheduler.pending[path]
+	if ok {
+		upload.timer.Stop()
+	} else {
+		upload = &scheduledUpload{firstEvent: now}
+		scheduler.pending[path] = upload
+	}
+	upload.generation++
+	upload.isDue = false
+
+	delay := quietPeriod
+	if scheduler.maxDelay > 0 {
+		if untilMaxDelay := upload.firstEvent.Add(scheduler.maxDelay).Sub(now); untilMaxDelay < delay {
+			delay = untilMaxDelay
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	generation := upload.generation
+	upload.timer = time.AfterFunc(delay, func() {
+		scheduler.markDue(path, upload, generation)
+	})
+	scheduler.lock.Unlock()
+
+	if !ok {
+		scheduler.pendingChanged()
+	}
+}
+
+func (scheduler *uploadScheduler) markDue(path string, upload *scheduledUpload, generation int) {
+	scheduler.lock.Lock()
+	if scheduler.pending[path] != upload || upload.generation != generation {
+		// Rescheduled or cancelled in the meantime
+		scheduler.lock.Unlock()
+		return
+	}
+	upload.isDue = true
+	scheduler.lock.Unlock()
+
+	scheduler.due <- path
+}
+
+// Uploads the given file if its upload is (still) due
+func (scheduler *uploadScheduler) uploadIfDue(path string) {
+	scheduler.lock.Lock()
+	upload, ok := scheduler.pending[path]
+	if !ok || !upload.isDue {
+		scheduler.lock.Unlock()
+		return
+	}
+	delete(scheduler.pending, path)
+	scheduler.lock.Unlock()
+	scheduler.pendingChanged()
+
+	scheduler.upload(path)
+}
+
+// Cancels the scheduled upload of the given path (e.g., the file was deleted or renamed) and of all the files under it
+// if it is a directory
+func (scheduler *uploadScheduler) cancel(path string) {
+	path = filepath.Clean(path)
+	scheduler.lock.Lock()
+	dirPrefix := path + string(os.PathSeparator)
+	cancelled := false
+	for pendingPath, upload := range scheduler.pending {
+		if pendingPath == path || strings.HasPrefix(pendingPath, dirPrefix) {
+			upload.timer.Stop()
+			delete(scheduler.pending, pendingPath)
+			cancelled = true
+		}
+	}
+	scheduler.lock.Unlock()
+
+	if cancelled {
+		scheduler.pendingChanged()
+	}
+}
+
+// Cancels all the scheduled uploads (e.g., the mount was removed)
+func (scheduler *uploadScheduler) cancelAll() {
+	scheduler.lock.Lock()
+	if len(scheduler.pending) == 0 {
+		scheduler.lock.Unlock()
+		return
+	}
+	for path, upload := range scheduler.pending {
+		upload.timer.Stop()
+		delete(scheduler.pending, path)
+	}
+	scheduler.lock.Unlock()
+
+	scheduler.pendingChanged()
+}
+
+// Uploads all the files with scheduled uploads without waiting for them to be quiet (e.g., the watcher is stopping)
+func (scheduler *uploadScheduler) flush() {
+	scheduler.lock.Lock()
+	paths := make([]string, 0, len(scheduler.pending))
+	for path, upload := range scheduler.pending {
+		upload.timer.Stop()
+		delete(scheduler.pending, path)
+		paths = append(paths, path)
+	}
+	scheduler.lock.Unlock()
+	if len(paths) > 0 {
+		scheduler.pendingChanged()
+	}
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			scheduler.upload(path)
+		}
+	}
+}
+
+// Returns flag indicating if the upload of the given file is scheduled
+func (scheduler *uploadScheduler) isPending(path string) bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	_, ok := scheduler.pending[filepath.Clean(path)]
+	return ok
+}
+
+// Returns the number of files waiting to be uploaded
+func (scheduler *uploadScheduler) pendingCount() int {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	return len(scheduler.pending)
+}
+
+// Must be called without the lock held. The number is read once the previous call completed so that the calls made
+// concurrently never leave an outdated number behind.
+func (scheduler *uploadScheduler) pendingChanged() {
+	if scheduler.onPendingChange == nil {
+		return
+	}
+	scheduler.notifyLock.Lock()
+	defer scheduler.notifyLock.Unlock()
+	scheduler.onPendingChange(scheduler.pendingCount())
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// SynchronizerState keeping the state of the mounts attached with AttachMountState in the synchronizer directory of
+// each mount, and the state of the other mounts in the shared state. The state of an attached mount is carried with
+// the data of the mount, e.g., when the volume of the mount is detached and reattached to another instance.
+type mountSynchronizerStates struct {
+	shared *persistentSynchronizerState
+
+	lock sync.RWMutex
+	// Map of namespace vs the state of the attached mount
+	mounts map[stateNamespace]*attachedMountState
+}
+
+type attachedMountState struct {
+	state *persistentSynchronizerState
+	// The state is closed when it is detached as many times as it was attached, e.g., when a mount is restarted the
+	// new configuration of the mount may attach the state before the previous one detaches it
+	refs int
+}
+
+func newMountSynchronizerStates(shared *persistentSynchronizerState) *mountSynchronizerStates {
+	return &mountSynchronizerStates{shared: shared, mounts: make(map[stateNamespace]*attachedMountState)}
+}
+
+// Keeps the state of the mount of the given namespace in the given directory from now on. The entries of the mount in
+// the shared state are moved to the state of the mount.
+func (states *mountSynchronizerStates) AttachMountState(ns stateNamespace, dirPath string) error {
+	states.lock.Lock()
+	defer states.lock.Unlock()
+	if attached, ok := states.mounts[ns]; ok {
+		attached.refs++
+		return nil
+	}
+	state, err := openStateDatabase(mountStateFileName, dirPath)
+	if err != nil {
+		return err
+	}
+	if moved := states.shared.moveNamespaceTo(ns, state); moved > 0 {
+		logger.withMount(ns.MountId, ns.Bucket).infof("Moved %v entries of the synchronizer state to %v", moved, dirPath)
+	}
+	states.mounts[ns] = &attachedMountState{state: state, refs: 1}
+	return nil
+}
+
+// Closes the state of the mount of the given namespace attached with AttachMountState
+func (states *mountSynchronizerStates) DetachMountState(ns stateNamespace) {
+	states.lock.Lock()
+	defer states.lock.Unlock()
+	attached, ok := states.mounts[ns]
+	if !ok {
+		return
+	}
+	attached.refs--
+	if attached.refs > 0 {
+		return
+	}
+	delete(states.mounts, ns)
+	if err := attached.state.records.Close(); err != nil {
+		logger.withMount(ns.MountId, ns.Bucket).withError(err).errorf("Error closing the synchronizer state")
+	}
+}
+
+// Returns the state keeping the entries of the given namespace
+func (states *mountSynchronizerStates) stateFor(ns stateNamespace) *persistentSynchronizerState {
+	states.lock.RLock()
+	defer states.lock.RUnlock()
+	if attached, ok := states.mounts[ns]; ok {
+		return attached.state
+	}
+	return states.shared
+}
+
+// Returns the shared state and the states of the attached mounts
+func (states *mountSynchronizerStates) all() []*persistentSynchronizerState {
+	states.lock.RLock()
+	defer states.lock.RUnlock()
+	all := []*persistentSynchronizerState{states.shared}
+	for _, attached := range states.mounts {
+		all = append(all, attached.state)
+	}
+	return all
+}
+
+func (states *mountSynchronizerStates) RecordFileDownloadToLocal(ns stateNamespace, item *s3.Object, fingerprint *fileFingerprint) {
+	states.stateFor(ns).RecordFileDownloadToLocal(ns, item, fingerprint)
+}
+
+func (states *mountSynchronizerStates) RecordFileUploadToS3(ns stateNamespace, key string, etag string, fingerprint *fileFingerprint) {
+	states.stateFor(ns).RecordFileUploadToS3(ns, key, etag, fingerprint)
+}
+
+func (states *mountSynchronizerStates) GetLocalFingerprint(ns stateNamespace, key string) *fileFingerprint {
+	return states.stateFor(ns).GetLocalFingerprint(ns, key)
+}
+
+func (states *mountSynchronizerStates) RecordLocalFingerprint(ns stateNamespace, key string, fingerprint *fileFingerprint) {
+	states.stateFor(ns).RecordLocalFingerprint(ns, key, fingerprint)
+}
+
+func (states *mountSynchronizerStates) RecordFileDeletionFromLocal(filePath string, config *mountConfiguration) {
+	states.stateFor(config.stateNamespace()).RecordFileDeletionFromLocal(filePath, config)
+}
+
+func (states *mountSynchronizerStates) RecordDirDeletionFromLocal(dirPath string, config *mountConfiguration) {
+	states.stateFor(config.stateNamespace()).RecordDirDeletionFromLocal(dirPath, config)
+}
+
+func (states *mountSynchronizerStates) RecordObjectMove(ns stateNamespace, oldKey string, newKey string, etag string) {
+	states.stateFor(ns).RecordObjectMove(ns, oldKey, newKey, etag)
+}
+
+func (states *mountSynchronizerStates) GetSyncBases(ns stateNamespace, keyPrefix string) []*syncBase {
+	return states.stateFor(ns).GetSyncBases(ns, keyPrefix)
+}
+
+func (states *mountSynchronizerStates) HasFileChangedInS3(ns stateNamespace, item *s3.Object) bool {
+	return states.stateFor(ns).HasFileChangedInS3(ns, item)
+}
+
+func (states *mountSynchronizerStates) IsFileDownloadedFromS3(filePath string, config *mountConfiguration) bool {
+	return states.stateFor(config.stateNamespace()).IsFileDownloadedFromS3(filePath, config)
+}
+
+// The entries of older versions are in the shared state, they are moved to the state of the mount when it is attached
+func (states *mountSynchronizerStates) ClaimLegacyEntries(ns stateNamespace, keyPrefix string) int {
+	return states.shared.ClaimLegacyEntries(ns, keyPrefix)
+}
+
+func (states *mountSynchronizerStates) ForgetMountState(ns stateNamespace) int {
+	return states.stateFor(ns).ForgetMountState(ns)
+}
+
+func (states *mountSynchronizerStates) OutboxRecords(ns stateNamespace) RecordPersistence {
+	return states.stateFor(ns).OutboxRecords(ns)
+}
+
+func (states *mountSynchronizerStates) GetPartialDownload(ns stateNamespace, key string) *partialDownload {
+	return states.stateFor(ns).GetPartialDownload(ns, key)
+}
+
+func (states *mountSynchronizerStates) GetPartialDownloads() []*partialDownload {
+	downloads := make([]*partialDownload, 0)
+	for _, state := range states.all() {
+		downloads = append(downloads, state.GetPartialDownloads()...)
+	}
+	return downloads
+}
+
+func (states *mountSynchronizerStates) RecordPartialDownload(download *partialDownload) {
+	states.stateFor(download.namespace()).RecordPartialDownload(download)
+}
+
+func (states *mountSynchronizerStates) RemovePartialDownload(ns stateNamespace, key string) {
+	states.stateFor(ns).RemovePartialDownload(ns, key)
+}
+
+func (states *mountSynchronizerStates) IsPartialDownloadFile(filePath string) bool {
+	for _, state := range states.all() {
+		if state.IsPartialDownloadFile(filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// The local writes are not saved, they are kept in the shared state for all mounts
+func (states *mountSynchronizerStates) RecordLocalWrite(filePath string, fingerprint *fileFingerprint) {
+	states.shared.RecordLocalWrite(filePath, fingerprint)
+}
+
+func (states *mountSynchronizerStates) GetLocalWrite(filePath string) *fileFingerprint {
+	return states.shared.GetLocalWrite(filePath)
+}
+
+func (states *mountSynchronizerStates) RemoveLocalWrite(filePath string) {
+	states.shared.RemoveLocalWrite(filePath)
+}
+
+func (states *mountSynchronizerStates) IsOwnLocalWrite(filePath string, fi os.FileInfo) bool {
+	return states.shared.IsOwnLocalWrite(filePath, fi)
+}
+
+func (states *mountSynchronizerStates) Flush() error {
+	var firstErr error
+	for _, state := range states.all() {
+		if err := state.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (states *mountSynchronizerStates) Clean() error {
+	var firstErr error
+	for _, state := range states.all() {
+		if err := state.Clean(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -1,114 +1,858 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/fsnotify/fsnotify"
 	"github.com/orcaman/concurrent-map"
+	bolt "go.etcd.io/bbolt"
 )
 
 type SynchronizerState interface {
-	RecordFileDownloadToLocal(item *s3.Object)
+	RecordFileDownloadToLocal(ns stateNamespace, item *s3.Object, fingerprint *fileFingerprint)
+	RecordFileUploadToS3(ns stateNamespace, key string, etag string, fingerprint *fileFingerprint)
+	GetLocalFingerprint(ns stateNamespace, key string) *fileFingerprint
+	RecordLocalFingerprint(ns stateNamespace, key string, fingerprint *fileFingerprint)
 	RecordFileDeletionFromLocal(filePath string, config *mountConfiguration)
-	HasFileChangedInS3(item *s3.Object) bool
+	RecordDirDeletionFromLocal(dirPath string, config *mountConfiguration)
+	RecordObjectMove(ns stateNamespace, oldKey string, newKey string, etag string)
+	GetSyncBases(ns stateNamespace, keyPrefix string) []*syncBase
+	ForgetMountState(ns stateNamespace) int
+	OutboxRecords(ns stateNamespace) RecordPersistence
+	HasFileChangedInS3(ns stateNamespace, item *s3.Object) bool
 	IsFileDownloadedFromS3(filePath string, config *mountConfiguration) bool
+	ClaimLegacyEntries(ns stateNamespace, keyPrefix string) int
+	GetPartialDownload(ns stateNamespace, key string) *partialDownload
+	GetPartialDownloads() []*partialDownload
+	RecordPartialDownload(download *partialDownload)
+	RemovePartialDownload(ns stateNamespace, key string)
+	IsPartialDownloadFile(filePath string) bool
+	RecordLocalWrite(filePath string, fingerprint *fileFingerprint)
+	GetLocalWrite(filePath string) *fileFingerprint
+	RemoveLocalWrite(filePath string)
+	IsOwnLocalWrite(filePath string, fi os.FileInfo) bool
+	AttachMountState(ns stateNamespace, dirPath string) error
+	DetachMountState(ns stateNamespace)
+	Flush() error
 	Clean() error
 }
 
+// The version of the format the synchronizer state is saved in. Version 1 (and the unversioned map of S3 object key
+// vs ETag before it) kept the entries of all mounts in flat maps keyed by object key only.
+const synchronizerStateVersion = 2
+
+// Name of the file the synchronizer state is saved in, in the state directory (the user's home directory by default).
+// The state is saved in a bolt database in this file with the ".db" extension, the JSON file is the format of older
+// versions and is imported once.
+const synchronizerStateFileName = "s3-synchronizer-state"
+
+// Name of the directory the outboxes of the mounts are saved in, in the state directory, when the state can not be saved
+// in a database (see OutboxRecords)
+const outboxDirName = "s3-synchronizer-outbox"
+
+// Name of the file the state of a mount is saved in, in the synchronizer directory of the mount, when the mounts keep
+// their own state
+const mountStateFileName = "state.db"
+
+// Names of the tables of the entries of the state when it is saved entry by entry, keyed by entry key
+const (
+	fileETagsTable         = "fileETags"
+	localFingerprintsTable = "localFingerprints"
+	partialDownloadsTable  = "partialDownloads"
+)
+
+// Scopes the entries of the synchronizer state to the objects of one mount, so that mounts of different buckets with
+// the same key layout (or different mounts of the same objects) do not share the state of their objects
+type stateNamespace struct {
+	MountId string
+	Bucket  string
+}
+
+// Returns the namespace of the entries of the objects of the mount
+func (config *mountConfiguration) stateNamespace() stateNamespace {
+	return stateNamespace{MountId: config.id, Bucket: config.bucket}
+}
+
+// Returns flag indicating if this is the namespace of entries loaded from a flat state file of an older version that
+// no mount has claimed yet. The bucket of these entries is unknown, except for partial downloads.
+func (ns stateNamespace) isLegacy() bool {
+	return ns.MountId == ""
+}
+
+// Returns the key of the entry of the given object key in the maps of the state
+func (ns stateNamespace) entryKey(key string) string {
+	return ns.MountId + "\x00" + ns.Bucket + "\x00" + key
+}
+
+// Returns the namespace and the object key of the given entry key
+func splitEntryKey(entryKey string) (stateNamespace, string) {
+	parts := strings.SplitN(entryKey, "\x00", 3)
+	if len(parts) != 3 {
+		return stateNamespace{}, entryKey
+	}
+	return stateNamespace{MountId: parts[0], Bucket: parts[1]}, parts[2]
+}
+
+// The object and the local file of a key as they were when they were last synchronized, i.e., the common base of the
+// changes made locally and in S3 since then
+type syncBase struct {
+	Key  string
+	ETag string
+	// Nil if the file was synchronized by a version that did not record the local file
+	Local *fileFingerprint
+}
+
+// Size and modification time of a local file, used to tell if the file changed locally since it was last downloaded
+// or uploaded. The MD5 of the content is cached when it is known so that the content does not have to be read again
+// to compare it with S3 until the file changes.
+type fileFingerprint struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	MD5     string    `json:"md5,omitempty"`
+}
+
+func newFileFingerprint(fi os.FileInfo) *fileFingerprint {
+	return &fileFingerprint{Size: fi.Size(), ModTime: fi.ModTime()}
+}
+
+// Returns flag indicating if the file described by the given file info still has this fingerprint
+func (fingerprint *fileFingerprint) matches(fi os.FileInfo) bool {
+	return fingerprint.Size == fi.Size() && fingerprint.ModTime.Equal(fi.ModTime())
+}
+
+// Returns flag indicating if the content with this fingerprint is known to be the content of the given object, i.e.,
+// the cached MD5 is the ETag of the (single part, not SSE-KMS encrypted) object
+func (fingerprint *fileFingerprint) contentMatches(item *s3.Object) bool {
+	return fingerprint.MD5 != "" && fingerprint.Size == aws.Int64Value(item.Size) &&
+		fingerprint.MD5 == strings.Trim(aws.StringValue(item.ETag), `"`)
+}
+
+// The maps of the state are keyed by the entry key of the object, i.e., the mount id, the bucket and the object key
 type persistentSynchronizerState struct {
+	// Map of entry key vs the ETag of the object when it was last downloaded or uploaded
 	s3FileETagsMap cmap.ConcurrentMap
+	// Map of entry key vs *fileFingerprint of the local file when the object was last downloaded or uploaded
+	localFingerprintsMap cmap.ConcurrentMap
+	// Map of entry key vs *partialDownload for the downloads that can be resumed
+	partialDownloadsMap cmap.ConcurrentMap
+	// Map of absolute local file path vs *fileFingerprint of the file being moved into place by a download. These are
+	// kept in memory only, until the download is recorded.
+	localWritesMap cmap.ConcurrentMap
 	persistence    Persistence
+	// Set if the persistence saves each entry under its own key, the entries are then saved as they change instead of
+	// saving the whole state after each change
+	records RecordPersistence
+	// The records the outboxes are saved in when the state is not saved entry by entry
+	outboxRecords RecordPersistence
 }
 
-func NewPersistentSynchronizerState() SynchronizerState {
-	persistence := NewFileBasedPersistenceWithJsonFormat("s3-synchronizer-state", "")
-	synchronizerState := &persistentSynchronizerState{s3FileETagsMap: cmap.New(), persistence: persistence}
+// The format the synchronizer state is saved in
+type persistedSynchronizerState struct {
+	Version int                    `json:"version,omitempty"`
+	Mounts  []*persistedMountState `json:"mounts,omitempty"`
+	// The entries of older versions not claimed by a mount yet, keyed by S3 object key
+	FileETags         map[string]string           `json:"fileETags,omitempty"`
+	LocalFingerprints map[string]*fileFingerprint `json:"localFingerprints,omitempty"`
+	PartialDownloads  map[string]*partialDownload `json:"partialDownloads,omitempty"`
+}
+
+// The entries of the objects of one mount, keyed by S3 object key
+type persistedMountState struct {
+	MountId string `json:"mountId"`
+	Bucket  string `json:"bucket"`
+	// Map of S3 object key vs the ETag of the object when it was last downloaded or uploaded
+	FileETags         map[string]string           `json:"fileETags,omitempty"`
+	LocalFingerprints map[string]*fileFingerprint `json:"localFingerprints,omitempty"`
+	PartialDownloads  map[string]*partialDownload `json:"partialDownloads,omitempty"`
+}
+
+// Returns the synchronizer state saved in the given directory (the user's home directory if empty). The mounts may keep
+// their state in their own directory instead, see AttachMountState.
+func NewPersistentSynchronizerState(stateDirPath string) SynchronizerState {
+	return newMountSynchronizerStates(newPersistentSynchronizerStateIn(stateDirPath))
+}
 
-	err := synchronizerState.Load()
+// Returns the state saved in the given directory (the user's home directory if empty). Exits if the state is in use by
+// another synchronizer process.
+func newPersistentSynchronizerStateIn(baseDirPath string) *persistentSynchronizerState {
+	legacy := NewFileBasedPersistenceWithJsonFormat(synchronizerStateFileName, baseDirPath)
+	synchronizerState, err := openStateDatabase(synchronizerStateFileName+".db", baseDirPath)
 	if err != nil {
-		// The initial load may fail if this is clean state and there is no state from any of the previous runs.
-		// Just log and move on in this case
-		fmt.Printf("Error loading synchronizerState from disk: %v", err)
+		if errors.Is(err, errPersistenceLocked) {
+			reportStateLoadError(err)
+		}
+		logger.withError(err).errorf("Unable to open the synchronizer state database, saving the state as JSON instead")
+		synchronizerState := newPersistentSynchronizerState(legacy, nil)
+		synchronizerState.outboxRecords = NewDirBasedPersistence(persistenceFilePath(outboxDirName, baseDirPath))
+		if err := synchronizerState.Load(); err != nil && !os.IsNotExist(err) {
+			reportStateLoadError(err)
+		}
+		return synchronizerState
+	}
+	if err := synchronizerState.importLegacyState(legacy, persistenceFilePath(synchronizerStateFileName, baseDirPath)); err != nil {
+		reportStateLoadError(err)
 	}
 	return synchronizerState
 }
 
-func (state persistentSynchronizerState) Load() error {
-	return state.persistence.Load(&state.s3FileETagsMap)
+// Opens the state saved in the database at the given filePath relative to the given baseDirPath. A corrupt database is
+// moved aside and replaced with an empty one.
+func openStateDatabase(filePath string, baseDirPath string) (*persistentSynchronizerState, error) {
+	records, err := NewBoltPersistence(filePath, baseDirPath)
+	switch err {
+	case bolt.ErrTimeout:
+		return nil, &os.PathError{Op: "open", Path: persistenceFilePath(filePath, baseDirPath), Err: errPersistenceLocked}
+	case bolt.ErrInvalid, bolt.ErrChecksum, bolt.ErrVersionMismatch:
+		expandedFilePath := persistenceFilePath(filePath, baseDirPath)
+		if renameErr := os.Rename(expandedFilePath, expandedFilePath+".corrupt"); renameErr != nil {
+			return nil, err
+		}
+		reportStateLoadError(&CorruptFileError{Path: expandedFilePath, MovedTo: expandedFilePath + ".corrupt", Err: err})
+		records, err = NewBoltPersistence(filePath, baseDirPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	synchronizerState := newPersistentSynchronizerState(records, records)
+	if err := synchronizerState.Load(); err != nil {
+		reportStateLoadError(err)
+	}
+	return synchronizerState, nil
 }
 
-func (state persistentSynchronizerState) Save() error {
-	return state.persistence.Save(&state.s3FileETagsMap)
+// Reports an error loading the state. Exits if the state is in use by another synchronizer process as both would
+// overwrite the state of the other.
+func reportStateLoadError(err error) {
+	if errors.Is(err, errPersistenceLocked) {
+		logger.withError(err).fatalf("Error loading synchronizerState from disk")
+	}
+	var corruptErr *CorruptFileError
+	if errors.As(err, &corruptErr) {
+		logger.withError(err).errorf("The synchronizer state is corrupt, the files are compared with S3 as if they were never synchronized")
+		return
+	}
+	logger.withError(err).errorf("Error loading synchronizerState from disk")
+}
+
+func newPersistentSynchronizerState(persistence Persistence, records RecordPersistence) *persistentSynchronizerState {
+	return &persistentSynchronizerState{s3FileETagsMap: cmap.New(), localFingerprintsMap: cmap.New(), partialDownloadsMap: cmap.New(), localWritesMap: cmap.New(), persistence: persistence, records: records}
 }
 
-func (state persistentSynchronizerState) Clean() error {
+// Imports the state saved as a whole in a JSON file by older versions into the database, then renames the file so that
+// it is imported once. The entries already in the database are kept.
+func (state *persistentSynchronizerState) importLegacyState(legacy Persistence, legacyFilePath string) error {
+	imported := newPersistentSynchronizerState(legacy, nil)
+	if err := imported.Load(); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := 0
+	for _, table := range []string{fileETagsTable, localFingerprintsTable, partialDownloadsTable} {
+		for entryKey, value := range imported.tableMap(table).Items() {
+			if state.tableMap(table).SetIfAbsent(entryKey, value) {
+				entries++
+			}
+		}
+	}
+	if err := state.Save(); err != nil {
+		return err
+	}
+	logger.infof("Imported %v entries of the synchronizer state from %v", entries, legacyFilePath)
+	return os.Rename(legacyFilePath, legacyFilePath+".imported")
+}
+
+// Returns the map of the entries of the given table
+func (state *persistentSynchronizerState) tableMap(table string) cmap.ConcurrentMap {
+	switch table {
+	case fileETagsTable:
+		return state.s3FileETagsMap
+	case localFingerprintsTable:
+		return state.localFingerprintsMap
+	default:
+		return state.partialDownloadsMap
+	}
+}
+
+// Saves the entries of the given entry keys in the given tables after they changed, or the whole state if the state
+// is not saved entry by entry
+func (state *persistentSynchronizerState) saveChanges(entryKeys []string, tables ...string) {
+	if state.records == nil {
+		state.Save()
+		return
+	}
+	for _, table := range tables {
+		m := state.tableMap(table)
+		for _, entryKey := range entryKeys {
+			var err error
+			if value, ok := m.Get(entryKey); ok {
+				err = state.records.Put(table, entryKey, value)
+			} else {
+				err = state.records.Delete(table, entryKey)
+			}
+			if err != nil {
+				logger.withError(err).errorf("Error saving synchronizerState entry %q", entryKey)
+			}
+		}
+	}
+}
+
+// Writes the changes of the state not saved yet
+func (state *persistentSynchronizerState) Flush() error {
+	if state.records == nil {
+		return nil
+	}
+	return state.records.Flush()
+}
+
+// Loads the saved state. The entries of the flat state files of older versions are loaded into the legacy namespace,
+// each mount claims the entries of its objects when it starts (see ClaimLegacyEntries).
+func (state *persistentSynchronizerState) Load() error {
+	if state.records != nil {
+		return state.loadRecords()
+	}
+	var raw json.RawMessage
+	if err := state.persistence.Load(&raw); err != nil {
+		return err
+	}
+	var persisted persistedSynchronizerState
+	if err := json.Unmarshal(raw, &persisted); err != nil || (persisted.Version == 0 && persisted.FileETags == nil) {
+		// Older versions saved the map of S3 object key vs ETag only
+		persisted = persistedSynchronizerState{}
+		if err := json.Unmarshal(raw, &persisted.FileETags); err != nil {
+			return err
+		}
+	}
+	if persisted.Version > synchronizerStateVersion {
+		return fmt.Errorf("unsupported synchronizer state version %v", persisted.Version)
+	}
+
+	load := func(ns stateNamespace, fileETags map[string]string, fingerprints map[string]*fileFingerprint, downloads map[string]*partialDownload) {
+		for key, etag := range fileETags {
+			state.s3FileETagsMap.Set(ns.entryKey(key), etag)
+		}
+		for key, fingerprint := range fingerprints {
+			state.localFingerprintsMap.Set(ns.entryKey(key), fingerprint)
+		}
+		for key, download := range downloads {
+			download.MountId = ns.MountId
+			state.partialDownloadsMap.Set(download.namespace().entryKey(key), download)
+		}
+	}
+	for _, mount := range persisted.Mounts {
+		if mount.MountId == "" {
+			continue
+		}
+		load(stateNamespace{MountId: mount.MountId, Bucket: mount.Bucket}, mount.FileETags, mount.LocalFingerprints, mount.PartialDownloads)
+	}
+	load(stateNamespace{}, persisted.FileETags, persisted.LocalFingerprints, persisted.PartialDownloads)
+	return nil
+}
+
+// Loads the entries saved entry by entry
+func (state *persistentSynchronizerState) loadRecords() error {
+	err := state.records.ForEach(fileETagsTable, func(entryKey string, data []byte) error {
+		var etag string
+		if err := json.Unmarshal(data, &etag); err != nil {
+			return err
+		}
+		state.s3FileETagsMap.Set(entryKey, etag)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = state.records.ForEach(localFingerprintsTable, func(entryKey string, data []byte) error {
+		var fingerprint fileFingerprint
+		if err := json.Unmarshal(data, &fingerprint); err != nil {
+			return err
+		}
+		state.localFingerprintsMap.Set(entryKey, &fingerprint)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return state.records.ForEach(partialDownloadsTable, func(entryKey string, data []byte) error {
+		var download partialDownload
+		if err := json.Unmarshal(data, &download); err != nil {
+			return err
+		}
+		state.partialDownloadsMap.Set(entryKey, &download)
+		return nil
+	})
+}
+
+// Saves the whole state. When the state is saved entry by entry, all the entries are written (e.g., after importing
+// the state of an older version).
+func (state *persistentSynchronizerState) Save() error {
+	if state.records != nil {
+		for _, table := range []string{fileETagsTable, localFingerprintsTable, partialDownloadsTable} {
+			for entryKey, value := range state.tableMap(table).Items() {
+				if err := state.records.Put(table, entryKey, value); err != nil {
+					return err
+				}
+			}
+		}
+		return state.records.Flush()
+	}
+
+	persisted := persistedSynchronizerState{Version: synchronizerStateVersion}
+	mounts := make(map[stateNamespace]*persistedMountState)
+	mountOf := func(entryKey string) (*persistedMountState, string) {
+		ns, key := splitEntryKey(entryKey)
+		if ns.isLegacy() {
+			// Saved flat, as they were loaded, until they are claimed
+			if persisted.FileETags == nil {
+				persisted.FileETags = make(map[string]string)
+				persisted.LocalFingerprints = make(map[string]*fileFingerprint)
+				persisted.PartialDownloads = make(map[string]*partialDownload)
+			}
+			return &persistedMountState{FileETags: persisted.FileETags, LocalFingerprints: persisted.LocalFingerprints, PartialDownloads: persisted.PartialDownloads}, key
+		}
+		mount, ok := mounts[ns]
+		if !ok {
+			mount = &persistedMountState{
+				MountId:           ns.MountId,
+				Bucket:            ns.Bucket,
+				FileETags:         make(map[string]string),
+				LocalFingerprints: make(map[string]*fileFingerprint),
+				PartialDownloads:  make(map[string]*partialDownload),
+			}
+			mounts[ns] = mount
+		}
+		return mount, key
+	}
+	for entryKey, etag := range state.s3FileETagsMap.Items() {
+		mount, key := mountOf(entryKey)
+		mount.FileETags[key] = etag.(string)
+	}
+	for entryKey, fingerprint := range state.localFingerprintsMap.Items() {
+		mount, key := mountOf(entryKey)
+		mount.LocalFingerprints[key] = fingerprint.(*fileFingerprint)
+	}
+	for entryKey, download := range state.partialDownloadsMap.Items() {
+		mount, key := mountOf(entryKey)
+		mount.PartialDownloads[key] = download.(*partialDownload)
+	}
+
+	persisted.Mounts = make([]*persistedMountState, 0, len(mounts))
+	for _, mount := range mounts {
+		persisted.Mounts = append(persisted.Mounts, mount)
+	}
+	sort.Slice(persisted.Mounts, func(i, j int) bool {
+		if persisted.Mounts[i].MountId != persisted.Mounts[j].MountId {
+			return persisted.Mounts[i].MountId < persisted.Mounts[j].MountId
+		}
+		return persisted.Mounts[i].Bucket < persisted.Mounts[j].Bucket
+	})
+	return state.persistence.Save(&persisted)
+}
+
+func (state *persistentSynchronizerState) Clean() error {
+	for _, key := range state.s3FileETagsMap.Keys() {
+		state.s3FileETagsMap.Remove(key)
+	}
+	for _, key := range state.localFingerprintsMap.Keys() {
+		state.localFingerprintsMap.Remove(key)
+	}
+	for _, key := range state.partialDownloadsMap.Keys() {
+		state.partialDownloadsMap.Remove(key)
+	}
+	if state.outboxRecords != nil {
+		if err := state.outboxRecords.Clean(); err != nil {
+			return err
+		}
+	}
 	return state.persistence.Clean()
 }
 
-func (state persistentSynchronizerState) RecordFileDownloadToLocal(item *s3.Object) {
-	state.s3FileETagsMap.Set(*item.Key, *item.ETag)
+// Moves the entries of the legacy namespace (loaded from a flat state file of an older version) with the given key
+// prefix into the given namespace of a mount, and returns the number of entries moved. The entries are moved to the
+// first mount that claims them, the objects of other mounts with the same key prefix are compared with the local
+// files again as if they were never synchronized. Partial downloads are only claimed by mounts of their bucket.
+func (state *persistentSynchronizerState) ClaimLegacyEntries(ns stateNamespace, keyPrefix string) int {
+	claimed := 0
+	changed := make([]string, 0)
+	claim := func(m cmap.ConcurrentMap, update func(value interface{}) interface{}) {
+		for _, entryKey := range m.Keys() {
+			entryNs, key := splitEntryKey(entryKey)
+			if !entryNs.isLegacy() || (entryNs.Bucket != "" && entryNs.Bucket != ns.Bucket) || !strings.HasPrefix(key, keyPrefix) {
+				continue
+			}
+			if value, ok := m.Pop(entryKey); ok {
+				m.Set(ns.entryKey(key), update(value))
+				changed = append(changed, entryKey, ns.entryKey(key))
+				claimed++
+			}
+		}
+	}
+	same := func(value interface{}) interface{} { return value }
+	claim(state.s3FileETagsMap, same)
+	claim(state.localFingerprintsMap, same)
+	claim(state.partialDownloadsMap, func(value interface{}) interface{} {
+		download := *value.(*partialDownload)
+		download.MountId = ns.MountId
+		return &download
+	})
+	if claimed > 0 {
+		state.saveChanges(changed, fileETagsTable, localFingerprintsTable, partialDownloadsTable)
+	}
+	return claimed
+}
+
+// Moves the entries of the given namespace to the given state, and returns the number of entries moved. The entries
+// the given state already has are kept.
+func (state *persistentSynchronizerState) moveNamespaceTo(ns stateNamespace, target *persistentSynchronizerState) int {
+	moved := 0
+	for _, table := range []string{fileETagsTable, localFingerprintsTable, partialDownloadsTable} {
+		changed := make([]string, 0)
+		for _, entryKey := range state.tableMap(table).Keys() {
+			if entryNs, _ := splitEntryKey(entryKey); entryNs != ns {
+				continue
+			}
+			if value, ok := state.tableMap(table).Pop(entryKey); ok {
+				target.tableMap(table).SetIfAbsent(entryKey, value)
+				changed = append(changed, entryKey)
+				moved++
+			}
+		}
+		if len(changed) > 0 {
+			target.saveChanges(changed, table)
+			state.saveChanges(changed, table)
+		}
+	}
+	if records, targetRecords := state.OutboxRecords(ns), target.OutboxRecords(ns); records != nil && targetRecords != nil {
+		moved += moveRecords(records, targetRecords, outboxTable, ns.entryKey(""))
+	}
+	return moved
+}
+
+// Moves the records of the given table with the given key prefix to the given target, and returns the number of
+// records moved
+func moveRecords(source RecordPersistence, target RecordPersistence, table string, keyPrefix string) int {
+	keys := make([]string, 0)
+	err := source.ForEach(table, func(key string, data []byte) error {
+		if !strings.HasPrefix(key, keyPrefix) {
+			return nil
+		}
+		keys = append(keys, key)
+		return target.Put(table, key, json.RawMessage(data))
+	})
+	if err != nil {
+		logger.withError(err).errorf("Error moving the %v records of the synchronizer state", table)
+		return 0
+	}
+	for _, key := range keys {
+		if err := source.Delete(table, key); err != nil {
+			logger.withError(err).errorf("Error saving synchronizerState entry %q", key)
+		}
+	}
+	return len(keys)
+}
+
+func (state *persistentSynchronizerState) RecordFileDownloadToLocal(ns stateNamespace, item *s3.Object, fingerprint *fileFingerprint) {
+	state.s3FileETagsMap.Set(ns.entryKey(*item.Key), *item.ETag)
+	if fingerprint != nil {
+		state.localFingerprintsMap.Set(ns.entryKey(*item.Key), fingerprint)
+	}
 
 	// Keep saving after each change
-	state.Save()
+	state.saveChanges([]string{ns.entryKey(*item.Key)}, fileETagsTable, localFingerprintsTable)
 }
 
-// Returns flag indicating if the given file was downloaded from S3 (as opposed to created locally)
-func (state persistentSynchronizerState) IsFileDownloadedFromS3(filePath string, config *mountConfiguration) bool {
-	s3Key := ToS3Key(filePath, config)
+// Records the object uploaded from the local file with the given fingerprint so that the object is not downloaded back
+// and the file is not uploaded again until either of them changes
+func (state *persistentSynchronizerState) RecordFileUploadToS3(ns stateNamespace, key string, etag string, fingerprint *fileFingerprint) {
+	state.s3FileETagsMap.Set(ns.entryKey(key), etag)
+	state.localFingerprintsMap.Set(ns.entryKey(key), fingerprint)
 
-	_, exists := state.s3FileETagsMap.Get(s3Key)
+	// Keep saving after each change
+	state.saveChanges([]string{ns.entryKey(key)}, fileETagsTable, localFingerprintsTable)
+}
+
+// Returns flag indicating if the given file was downloaded from S3 (as opposed to created locally)
+func (state *persistentSynchronizerState) IsFileDownloadedFromS3(filePath string, config *mountConfiguration) bool {
+	s3Key, err := config.keys.keyForLocalPath(filePath)
+	if err != nil {
+		return false
+	}
 
 	// If the entry for the given file exists in the state.s3FileETagsMap then it means this file was downloaded from S3
-	return exists
+	return state.s3FileETagsMap.Has(config.stateNamespace().entryKey(s3Key))
 }
 
-func (state persistentSynchronizerState) RecordFileDeletionFromLocal(filePath string, config *mountConfiguration) {
-	s3Key := ToS3Key(filePath, config)
+// Forgets the object of the given file deleted locally, so that a file created at the same path later on is not
+// mistaken for the downloaded one. Nothing is forgotten if the file exists again (e.g., a download put it back).
+func (state *persistentSynchronizerState) RecordFileDeletionFromLocal(filePath string, config *mountConfiguration) {
+	s3Key, err := config.keys.keyForLocalPath(filePath)
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		return
+	}
 
 	// Delete ETag from cache map when file is deleted from local machine
-	state.s3FileETagsMap.Remove(s3Key)
+	entryKey := config.stateNamespace().entryKey(s3Key)
+	state.s3FileETagsMap.Remove(entryKey)
+	state.localFingerprintsMap.Remove(entryKey)
+
+	// Keep saving after each change
+	state.saveChanges([]string{entryKey}, fileETagsTable, localFingerprintsTable)
+}
+
+// Forgets the objects of the files under the given directory deleted (or moved away) locally, except for the files
+// that exist again
+func (state *persistentSynchronizerState) RecordDirDeletionFromLocal(dirPath string, config *mountConfiguration) {
+	dirKey, err := config.keys.keyForLocalPath(dirPath)
+	if err != nil {
+		return
+	}
+	// Add trailing slash for the dir key, e.g., "data/" and not "data2/" for the dir "data"
+	prefix := config.stateNamespace().entryKey(dirKey + "/")
+	removed := make([]string, 0)
+	for _, m := range []cmap.ConcurrentMap{state.s3FileETagsMap, state.localFingerprintsMap} {
+		for _, entryKey := range m.Keys() {
+			if !strings.HasPrefix(entryKey, prefix) {
+				continue
+			}
+			_, key := splitEntryKey(entryKey)
+			if filePath, err := config.keys.localPath(key); err == nil {
+				if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+					continue
+				}
+			}
+			m.Remove(entryKey)
+			removed = append(removed, entryKey)
+		}
+	}
+	if len(removed) > 0 {
+		state.saveChanges(removed, fileETagsTable, localFingerprintsTable)
+	}
+}
+
+// Records that the object with the old key was copied to the new key with the given ETag for a local rename, the local
+// file is now synchronized with the new key
+func (state *persistentSynchronizerState) RecordObjectMove(ns stateNamespace, oldKey string, newKey string, etag string) {
+	state.s3FileETagsMap.Remove(ns.entryKey(oldKey))
+	state.s3FileETagsMap.Set(ns.entryKey(newKey), etag)
+	if fingerprint, ok := state.localFingerprintsMap.Pop(ns.entryKey(oldKey)); ok {
+		state.localFingerprintsMap.Set(ns.entryKey(newKey), fingerprint)
+	}
 
 	// Keep saving after each change
-	state.Save()
+	state.saveChanges([]string{ns.entryKey(oldKey), ns.entryKey(newKey)}, fileETagsTable, localFingerprintsTable)
 }
 
-func (state persistentSynchronizerState) HasFileChangedInS3(item *s3.Object) bool {
+func (state *persistentSynchronizerState) HasFileChangedInS3(ns stateNamespace, item *s3.Object) bool {
 	// Return true is the file was never downloaded from S3 (could happen when the file originated from local machine)
 	// and was uploaded to S3 but was never downloaded from S3 OR
 	// Return true if the S3 object's ETag is different than the one we have in our map since the last download
-	existing, ok := state.s3FileETagsMap.Get(*item.Key)
+	existing, ok := state.s3FileETagsMap.Get(ns.entryKey(*item.Key))
 
 	return !ok || existing.(string) != *item.ETag
 }
 
+// Returns the base records of the keys with the given prefix that were downloaded or uploaded
+func (state *persistentSynchronizerState) GetSyncBases(ns stateNamespace, keyPrefix string) []*syncBase {
+	bases := make([]*syncBase, 0)
+	prefix := ns.entryKey(keyPrefix)
+	for entryKey, etag := range state.s3FileETagsMap.Items() {
+		if strings.HasPrefix(entryKey, prefix) {
+			_, key := splitEntryKey(entryKey)
+			bases = append(bases, &syncBase{Key: key, ETag: etag.(string), Local: state.GetLocalFingerprint(ns, key)})
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool {
+		return bases[i].Key < bases[j].Key
+	})
+	return bases
+}
+
+// Removes all the entries of the given namespace (e.g., the local data of the mount was deleted), and returns the number
+// of entries removed. The files found at the paths of the mount later on are then new files, and the objects of the
+// files that are missing are not deleted.
+func (state *persistentSynchronizerState) ForgetMountState(ns stateNamespace) int {
+	forgotten := 0
+	for _, table := range []string{fileETagsTable, localFingerprintsTable, partialDownloadsTable} {
+		removed := make([]string, 0)
+		m := state.tableMap(table)
+		for _, entryKey := range m.Keys() {
+			if entryNs, _ := splitEntryKey(entryKey); entryNs == ns {
+				m.Remove(entryKey)
+				removed = append(removed, entryKey)
+			}
+		}
+		if len(removed) > 0 {
+			state.saveChanges(removed, table)
+			forgotten += len(removed)
+		}
+	}
+	return forgotten
+}
+
+// Returns the records the outbox of the local changes of the mount of the given namespace is saved in, under the entry
+// key prefix of the namespace. The outbox is saved with the entries of the state when they are saved entry by entry,
+// otherwise in its own directory next to the state file.
+func (state *persistentSynchronizerState) OutboxRecords(ns stateNamespace) RecordPersistence {
+	if state.records != nil {
+		return state.records
+	}
+	return state.outboxRecords
+}
+
+// Returns the fingerprint of the local file when the given object was last downloaded or uploaded, nil if unknown
+func (state *persistentSynchronizerState) GetLocalFingerprint(ns stateNamespace, key string) *fileFingerprint {
+	fingerprint, ok := state.localFingerprintsMap.Get(ns.entryKey(key))
+	if !ok {
+		return nil
+	}
+	return fingerprint.(*fileFingerprint)
+}
+
+// Records the fingerprint of the local file that has the same content as the given object in S3 (e.g., after
+// uploading the file)
+func (state *persistentSynchronizerState) RecordLocalFingerprint(ns stateNamespace, key string, fingerprint *fileFingerprint) {
+	state.localFingerprintsMap.Set(ns.entryKey(key), fingerprint)
+
+	// Keep saving after each change
+	state.saveChanges([]string{ns.entryKey(key)}, localFingerprintsTable)
+}
+
+// Returns the progress of the download of the given object that can be resumed, nil if there is none
+func (state *persistentSynchronizerState) GetPartialDownload(ns stateNamespace, key string) *partialDownload {
+	download, ok := state.partialDownloadsMap.Get(ns.entryKey(key))
+	if !ok {
+		return nil
+	}
+	return download.(*partialDownload)
+}
+
+// Returns the partial downloads of all mounts, including the ones not claimed by a mount yet
+func (state *persistentSynchronizerState) GetPartialDownloads() []*partialDownload {
+	downloads := make([]*partialDownload, 0)
+	for _, download := range state.partialDownloadsMap.Items() {
+		downloads = append(downloads, download.(*partialDownload))
+	}
+	return downloads
+}
+
+// Records the progress of a download so that it can be resumed after an interruption. The given download must not be
+// modified afterwards, record a copy with the new progress instead.
+func (state *persistentSynchronizerState) RecordPartialDownload(download *partialDownload) {
+	state.partialDownloadsMap.Set(download.namespace().entryKey(download.Key), download)
+
+	// Keep saving after each change
+	state.saveChanges([]string{download.namespace().entryKey(download.Key)}, partialDownloadsTable)
+}
+
+func (state *persistentSynchronizerState) RemovePartialDownload(ns stateNamespace, key string) {
+	if _, ok := state.partialDownloadsMap.Pop(ns.entryKey(key)); ok {
+		state.saveChanges([]string{ns.entryKey(key)}, partialDownloadsTable)
+	}
+}
+
+// Returns flag indicating if the given file is the temp file of a download that can be resumed
+func (state *persistentSynchronizerState) IsPartialDownloadFile(filePath string) bool {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return false
+	}
+	for _, download := range state.partialDownloadsMap.Items() {
+		if download.(*partialDownload).TempFile == absPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Records the fingerprint of the file a download is about to move into place at the given path so that the file
+// watcher events caused by the download are ignored until the download is recorded
+func (state *persistentSynchronizerState) RecordLocalWrite(filePath string, fingerprint *fileFingerprint) {
+	if absPath, err := filepath.Abs(filePath); err == nil {
+		state.localWritesMap.Set(absPath, fingerprint)
+	}
+}
+
+// Returns the fingerprint of the file the download moved into place at the given path, nil if there is none
+func (state *persistentSynchronizerState) GetLocalWrite(filePath string) *fileFingerprint {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil
+	}
+	fingerprint, ok := state.localWritesMap.Get(absPath)
+	if !ok {
+		return nil
+	}
+	return fingerprint.(*fileFingerprint)
+}
+
+func (state *persistentSynchronizerState) RemoveLocalWrite(filePath string) {
+	if absPath, err := filepath.Abs(filePath); err == nil {
+		state.localWritesMap.Remove(absPath)
+	}
+}
+
+// Returns flag indicating if the file described by the given file info at the given path was written by a download
+// that is not recorded yet (as opposed to changed locally)
+func (state *persistentSynchronizerState) IsOwnLocalWrite(filePath string, fi os.FileInfo) bool {
+	fingerprint := state.GetLocalWrite(filePath)
+	return fingerprint != nil && fingerprint.matches(fi)
+}
+
 // State hold map of directory path vs flag indicating if it is being watched by file watchers
 type dirWatcher struct {
 	dirWatchersMap cmap.ConcurrentMap
-	fsWatcher      *fsnotify.Watcher
+	backend        fileWatcherBackend
 	initError      error
-	debug          bool
 }
 
 func (dw dirWatcher) WatchDir(dirPath string) error {
 	if !dw.IsBeingWatched(dirPath) {
 		dw.dirWatchersMap.Set(dirPath, true)
-		return dw.fsWatcher.Add(dirPath)
+		return dw.backend.Add(dirPath)
 	}
 	return nil
 }
 
-func (dw dirWatcher) FsEvents() chan fsnotify.Event {
-	return dw.fsWatcher.Events
+func (dw dirWatcher) Events() <-chan fileWatcherEvent {
+	return dw.backend.Events()
 }
-func (dw dirWatcher) FsErrors() chan error {
-	return dw.fsWatcher.Errors
+func (dw dirWatcher) Errors() <-chan error {
+	return dw.backend.Errors()
 }
+
+// Stops watching the given directory and all its subdirectories
 func (dw dirWatcher) UnwatchDir(dirPath string) error {
-	if dw.IsBeingWatched(dirPath) {
-		dw.dirWatchersMap.Remove(dirPath)
-		return dw.fsWatcher.Remove(dirPath)
+	var firstErr error
+	for _, watched := range dw.watchedDirsUnder(dirPath) {
+		dw.dirWatchersMap.Remove(watched)
+		if err := dw.backend.Remove(watched); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	return firstErr
+}
+
+// Returns the watched directories that are the given directory or under it
+func (dw dirWatcher) watchedDirsUnder(dirPath string) []string {
+	dirs := make([]string, 0)
+	for _, watched := range dw.dirWatchersMap.Keys() {
+		if watched == dirPath || strings.HasPrefix(watched, dirPath+string(os.PathSeparator)) {
+			dirs = append(dirs, watched)
+		}
+	}
+	return dirs
 }
 
 func (dw dirWatcher) IsBeingWatched(dirPath string) bool {
@@ -116,7 +860,7 @@ func (dw dirWatcher) IsBeingWatched(dirPath string) bool {
 }
 
 func (dw dirWatcher) Stop() error {
-	return dw.fsWatcher.Close()
+	return dw.backend.Close()
 }
 
 func (dw dirWatcher) InitializedSuccessfully() bool {
@@ -127,10 +871,10 @@ func (dw dirWatcher) InitError() error {
 	return dw.initError
 }
 
-func NewDirWatcher(debug bool) *dirWatcher {
-	watcher, err := fsnotify.NewWatcher()
+func NewDirWatcher() *dirWatcher {
+	backend, err := newFileWatcherBackend()
 	if err != nil {
 		return &dirWatcher{initError: err}
 	}
-	return &dirWatcher{dirWatchersMap: cmap.New(), fsWatcher: watcher, initError: nil, debug: debug}
+	return &dirWatcher{dirWatchersMap: cmap.New(), backend: backend, initError: nil}
 }